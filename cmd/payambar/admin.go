@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/4xmen/payambar/internal/auth"
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/pkg/config"
+)
+
+// runAdmin grants or revokes the admin role, which is how the first
+// administrator is created.
+func runAdmin(cfg *config.Config, out io.Writer, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: payambar admin grant|revoke <username>")
+	}
+
+	var role string
+	switch args[0] {
+	case "grant":
+		role = auth.RoleAdmin
+	case "revoke":
+		role = auth.RoleUser
+	default:
+		return fmt.Errorf("unknown admin action: %s", args[0])
+	}
+
+	database, err := db.New(databaseURL(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer database.Close()
+
+	authSvc := auth.New(database, cfg.JWTSecret)
+	userID, err := authSvc.GetUserByUsername(args[1])
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[1], err)
+	}
+	if err := authSvc.SetRole(userID, role); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%s is now %s\n", args[1], role)
+	return nil
+}
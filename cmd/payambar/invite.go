@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/4xmen/payambar/internal/auth"
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/pkg/config"
+)
+
+type inviteOptions struct {
+	Uses    int
+	Expires time.Duration
+}
+
+func parseInviteArgs(args []string) (inviteOptions, error) {
+	opts := inviteOptions{Uses: 1, Expires: auth.DefaultInviteTTL}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if i+1 >= len(args) {
+			return opts, fmt.Errorf("missing value for invite flag: %s", arg)
+		}
+		value := args[i+1]
+		i++
+
+		switch arg {
+		case "--uses", "-n":
+			uses, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid --uses value: %s", value)
+			}
+			opts.Uses = uses
+		case "--expires", "-e":
+			expires, err := time.ParseDuration(value)
+			if err != nil || expires <= 0 {
+				return opts, fmt.Errorf("invalid --expires value: %s", value)
+			}
+			opts.Expires = expires
+		default:
+			return opts, fmt.Errorf("unknown invite flag: %s", arg)
+		}
+	}
+	return opts, nil
+}
+
+// runInvite mints an operator invite, which is how the first account is
+// created on an invite-only instance.
+func runInvite(cfg *config.Config, out io.Writer, args []string) error {
+	opts, err := parseInviteArgs(args)
+	if err != nil {
+		return err
+	}
+
+	database, err := db.New(databaseURL(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer database.Close()
+
+	invite, err := auth.New(database, cfg.JWTSecret).CreateInvite(nil, opts.Uses, opts.Expires)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Invite code : %s\n", invite.Code)
+	fmt.Fprintf(out, "Uses        : %d\n", invite.MaxUses)
+	fmt.Fprintf(out, "Expires at  : %s\n", invite.ExpiresAt.Format(time.RFC3339))
+	if cfg.RegistrationMode != auth.RegistrationInvite {
+		fmt.Fprintf(out, "Note: REGISTRATION_MODE is %q; set it to %q to require invites.\n", cfg.RegistrationMode, auth.RegistrationInvite)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseInviteArgs(t *testing.T) {
+	opts, err := parseInviteArgs(nil)
+	if err != nil {
+		t.Fatalf("parseInviteArgs returned error: %v", err)
+	}
+	if opts.Uses != 1 {
+		t.Fatalf("default Uses = %d, want 1", opts.Uses)
+	}
+
+	opts, err = parseInviteArgs([]string{"--uses", "5", "--expires", "72h"})
+	if err != nil {
+		t.Fatalf("parseInviteArgs returned error: %v", err)
+	}
+	if opts.Uses != 5 || opts.Expires != 72*time.Hour {
+		t.Fatalf("parseInviteArgs = %+v", opts)
+	}
+
+	for _, args := range [][]string{{"--uses"}, {"--uses", "x"}, {"--expires", "-1h"}, {"--bad", "1"}} {
+		if _, err := parseInviteArgs(args); err == nil {
+			t.Fatalf("parseInviteArgs(%v) expected error", args)
+		}
+	}
+}
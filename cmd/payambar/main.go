@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -16,9 +17,11 @@ import (
 	"time"
 
 	"github.com/4xmen/payambar/internal/auth"
+	"github.com/4xmen/payambar/internal/conversation"
 	"github.com/4xmen/payambar/internal/db"
 	"github.com/4xmen/payambar/internal/handlers"
 	"github.com/4xmen/payambar/internal/push"
+	"github.com/4xmen/payambar/internal/turn"
 	"github.com/4xmen/payambar/internal/ws"
 	"github.com/4xmen/payambar/pkg/config"
 	"github.com/gin-gonic/gin"
@@ -93,6 +96,44 @@ func serverErrorLogger() gin.HandlerFunc {
 	}
 }
 
+// sensitiveQueryParams never reach the request log.
+var sensitiveQueryParams = []string{"token", "ticket"}
+
+// requestLogger is gin's default request log with credentials in the query
+// string redacted.
+func requestLogger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+			param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+			param.StatusCode,
+			param.Latency,
+			param.ClientIP,
+			param.Method,
+			redactQuery(param.Path),
+			param.ErrorMessage,
+		)
+	})
+}
+
+// redactQuery masks the values of sensitive query parameters in a request
+// path.
+func redactQuery(requestPath string) string {
+	base, rawQuery, found := strings.Cut(requestPath, "?")
+	if !found {
+		return requestPath
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		for _, sensitive := range sensitiveQueryParams {
+			if strings.EqualFold(name, sensitive) {
+				params[i] = name + "=REDACTED"
+			}
+		}
+	}
+	return base + "?" + strings.Join(params, "&")
+}
+
 func panicRecovery() gin.HandlerFunc {
 	return gin.CustomRecovery(func(c *gin.Context, recovered interface{}) {
 		log.Printf(
@@ -130,6 +171,16 @@ func shouldServeSPA(c *gin.Context) bool {
 	return true
 }
 
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func main() {
 	cfg := config.Load()
 
@@ -151,6 +202,12 @@ func runCommand(cfg *config.Config, args []string) error {
 	switch command {
 	case "status":
 		return runStatus(cfg, os.Stdout, args[1:])
+	case "invite":
+		return runInvite(cfg, os.Stdout, args[1:])
+	case "admin":
+		return runAdmin(cfg, os.Stdout, args[1:])
+	case "migrate":
+		return runMigrate(cfg, os.Stdout, args[1:])
 	case "-h", "--help", "help":
 		printUsage(os.Stdout)
 		return nil
@@ -165,6 +222,56 @@ func printUsage(out *os.File) {
 	fmt.Fprintln(out, "  payambar           Start the web server")
 	fmt.Fprintln(out, "  payambar status    Show application statistics")
 	fmt.Fprintln(out, "  payambar status --json")
+	fmt.Fprintln(out, "  payambar invite    Create a registration invite code")
+	fmt.Fprintln(out, "  payambar invite --uses 5 --expires 72h")
+	fmt.Fprintln(out, "  payambar admin grant <username>   Give a user the admin role")
+	fmt.Fprintln(out, "  payambar admin revoke <username>  Remove the admin role")
+	fmt.Fprintln(out, "  payambar migrate status           Show applied and pending schema migrations")
+	fmt.Fprintln(out, "  payambar migrate up [version]     Apply pending migrations (all by default)")
+	fmt.Fprintln(out, "  payambar migrate down [version]   Roll back to a version (one migration by default)")
+}
+
+// startEmbeddedTURN starts the built-in STUN/TURN server and returns the URL
+// clients reach it at.
+func startEmbeddedTURN(cfg *config.Config) (*turn.Server, string, error) {
+	if cfg.TurnSecret == "" {
+		return nil, "", fmt.Errorf("TURN_EMBEDDED requires TURN_SECRET")
+	}
+	relayIP := net.ParseIP(cfg.TurnExternalIP)
+	if relayIP == nil {
+		return nil, "", fmt.Errorf("TURN_EMBEDDED requires TURN_EXTERNAL_IP to be an IP address")
+	}
+	if cfg.TurnRelayPortMin < 1 || cfg.TurnRelayPortMax > 65535 {
+		return nil, "", fmt.Errorf("invalid TURN relay port range %d-%d", cfg.TurnRelayPortMin, cfg.TurnRelayPortMax)
+	}
+	_, port, err := net.SplitHostPort(cfg.TurnListen)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid TURN_LISTEN: %w", err)
+	}
+
+	server, err := turn.NewServer(turn.ServerConfig{
+		ListenAddr:  cfg.TurnListen,
+		RelayIP:     relayIP,
+		Realm:       cfg.TurnRealm,
+		Secret:      cfg.TurnSecret,
+		MinPort:     uint16(cfg.TurnRelayPortMin),
+		MaxPort:     uint16(cfg.TurnRelayPortMax),
+		MaxBPS:      cfg.TurnMaxBPS,
+		BPSCapacity: cfg.TurnBPSCapacity,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return server, "turn:" + net.JoinHostPort(cfg.TurnExternalIP, port), nil
+}
+
+// databaseURL is the PostgreSQL URL when one is configured, otherwise the
+// SQLite file.
+func databaseURL(cfg *config.Config) string {
+	if cfg.DatabaseURL != "" {
+		return cfg.DatabaseURL
+	}
+	return cfg.DatabasePath
 }
 
 func runServer(cfg *config.Config) error {
@@ -172,33 +279,123 @@ func runServer(cfg *config.Config) error {
 	os.MkdirAll(cfg.FileStoragePath, 0755)
 	os.MkdirAll("/data", 0755)
 	// Initialize database
-	database, err := db.New(cfg.DatabasePath)
+	database, err := db.New(databaseURL(cfg))
 	if err != nil {
 		return fmt.Errorf("failed to initialize database: %w", err)
 	}
 	defer database.Close()
 
 	// Initialize services
-	authSvc := auth.New(database.GetConn(), cfg.JWTSecret)
+	authSvc := auth.New(database, cfg.JWTSecret)
+	authSvc.ConfigureLockout(auth.LockoutPolicy{
+		Threshold: cfg.LoginLockoutThreshold,
+		BaseDelay: cfg.LoginLockoutBase,
+		MaxDelay:  cfg.LoginLockoutMax,
+	})
+	if err := authSvc.SetRegistrationMode(cfg.RegistrationMode); err != nil {
+		return err
+	}
+	if cfg.WebAuthnRPID != "" {
+		origins := splitList(cfg.WebAuthnOrigins)
+		if len(origins) == 0 {
+			origins = []string{"https://" + cfg.WebAuthnRPID}
+		}
+		if err := authSvc.ConfigurePasskeys(cfg.WebAuthnRPID, cfg.WebAuthnRPName, origins); err != nil {
+			return err
+		}
+		log.Printf("Passkey login enabled for %s", cfg.WebAuthnRPID)
+	}
+
+	access, err := conversation.NewAuthorizer(database, cfg.ConversationPolicy)
+	if err != nil {
+		return err
+	}
 
 	// Initialize WebSocket hub
-	hub := ws.NewHub(database.GetConn())
+	hub := ws.NewHub(database)
+	hub.SetAuthorizer(access)
+	hub.SetUpgradeOptions(ws.UpgradeOptions{
+		AllowedOrigins:  splitList(cfg.CORSOrigins),
+		Compression:     cfg.WSCompression,
+		ReadBufferSize:  cfg.WSReadBufferSize,
+		WriteBufferSize: cfg.WSWriteBufferSize,
+		MaxMessageSize:  cfg.WSMaxMessageSize,
+	})
 
-	// Initialize push notifier (only if VAPID keys are configured)
-	var pushNotifier *push.Notifier
+	var broker ws.Broker = ws.NewLocalBroker()
+	if cfg.BrokerURL != "" {
+		if broker, err = ws.NewRedisBroker(cfg.BrokerURL); err != nil {
+			return err
+		}
+		log.Println("WebSocket hub joined the shared broker")
+	}
+	if err := hub.SetBroker(broker); err != nil {
+		return err
+	}
+
+	// Initialize push notifier (only if a push provider is configured)
+	var pushProviders []push.Provider
 	if cfg.VAPIDPublicKey != "" && cfg.VAPIDPrivateKey != "" {
-		pushNotifier = push.NewNotifier(database.GetConn(), cfg.VAPIDPublicKey, cfg.VAPIDPrivateKey)
-		hub.SetPushNotifier(pushNotifier)
-		log.Println("Web Push notifications enabled")
+		pushProviders = append(pushProviders, push.NewWebPush(cfg.VAPIDPublicKey, cfg.VAPIDPrivateKey))
 	} else {
 		log.Println("Web Push notifications disabled (no VAPID keys configured)")
 	}
+	if cfg.PushFCMURL != "" {
+		pushProviders = append(pushProviders, push.NewFCM(cfg.PushFCMURL, cfg.PushFCMKey))
+	}
+	if cfg.PushWebhook {
+		pushProviders = append(pushProviders, push.NewWebhook())
+	}
+	var pushNotifier *push.Notifier
+	if len(pushProviders) > 0 {
+		pushNotifier = push.NewNotifier(database, pushProviders...)
+		pushNotifier.SetDeliveryOptions(push.DeliveryOptions{
+			Workers:     cfg.PushWorkers,
+			MaxAttempts: cfg.PushMaxAttempts,
+			MaxFailures: cfg.PushMaxFailures,
+		})
+		pushNotifier.Start()
+		defer pushNotifier.Stop()
+		hub.SetPushNotifier(pushNotifier)
+		names := make([]string, len(pushProviders))
+		for i, p := range pushProviders {
+			names[i] = p.Name()
+		}
+		log.Printf("Push notifications enabled (%s)", strings.Join(names, ", "))
+	}
 
 	go hub.Run()
+	// A lone node owns every call, so calls open at shutdown are over
+	if cfg.BrokerURL == "" {
+		hub.EndOpenCalls()
+	}
+
+	// Start the built-in STUN/TURN server; TURN_SERVER still wins as the
+	// advertised URL (e.g. a hostname instead of the IP)
+	turnServerURL := cfg.TurnServer
+	var turnServer *turn.Server
+	if cfg.TurnEmbedded {
+		var embeddedURL string
+		if turnServer, embeddedURL, err = startEmbeddedTURN(cfg); err != nil {
+			return err
+		}
+		defer turnServer.Close()
+		if turnServerURL == "" {
+			turnServerURL = embeddedURL
+		}
+		log.Printf("Embedded STUN/TURN server listening on %s (udp+tcp)", turnServer.Addr())
+	}
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(authSvc)
-	msgHandler := handlers.NewMessageHandler(database.GetConn(), hub, cfg.FileStoragePath, cfg.MaxUploadSize, cfg.StunServers, cfg.TurnServer, cfg.TurnUsername, cfg.TurnPassword, pushNotifier)
+	msgHandler := handlers.NewMessageHandler(database, hub, cfg.FileStoragePath, cfg.MaxUploadSize, cfg.StunServers, turnServerURL, cfg.TurnUsername, cfg.TurnPassword, pushNotifier)
+	if cfg.TurnSecret != "" {
+		msgHandler.SetTURNSecret(cfg.TurnSecret, cfg.TurnCredentialTTL)
+	}
+	msgHandler.SetAuthorizer(access)
+	adminHandler := handlers.NewAdminHandler(database, authSvc, msgHandler, hub, func() interface{} {
+		return statusPayload(collectStatus(cfg))
+	})
 
 	// Setup router
 	if cfg.Environment == "production" {
@@ -207,7 +404,7 @@ func runServer(cfg *config.Config) error {
 
 	router := gin.New()
 	router.Use(serverErrorLogger())
-	router.Use(gin.Logger())
+	router.Use(requestLogger())
 	router.Use(panicRecovery())
 	router.MaxMultipartMemory = cfg.MaxUploadSize
 
@@ -233,8 +430,11 @@ func runServer(cfg *config.Config) error {
 		registerLimiter := limiter.New(memory.NewStore(), limiter.Rate{Period: time.Minute, Limit: 2})
 
 		// Auth endpoints
+		api.GET("/auth/registration", authHandler.GetRegistrationMode)
 		api.POST("/auth/register", rateLimitMiddleware(registerLimiter), authHandler.Register)
 		api.POST("/auth/login", rateLimitMiddleware(loginLimiter), authHandler.Login)
+		api.POST("/auth/passkey/begin", rateLimitMiddleware(loginLimiter), authHandler.BeginPasskeyLogin)
+		api.POST("/auth/passkey/finish", rateLimitMiddleware(loginLimiter), authHandler.FinishPasskeyLogin)
 
 		// Public profile endpoint
 		api.GET("/users/:username", msgHandler.GetUserProfile)
@@ -259,32 +459,71 @@ func runServer(cfg *config.Config) error {
 		protected.GET("/keys/devices/self", msgHandler.GetMyDeviceKeys)
 		protected.GET("/keys/users/:id/devices", msgHandler.GetUserDeviceKeys)
 		protected.GET("/users", msgHandler.GetUsers)
+		protected.POST("/ws/ticket", authHandler.CreateWSTicket)
 		protected.POST("/conversations", msgHandler.CreateConversation)
 		protected.DELETE("/conversations/:id", msgHandler.DeleteConversation)
+		protected.GET("/conversations/:id/notifications", msgHandler.GetConversationNotifications)
+		protected.PUT("/conversations/:id/notifications", msgHandler.UpdateConversationNotifications)
+		protected.DELETE("/conversations/:id/notifications", msgHandler.ResetConversationNotifications)
 		protected.PUT("/messages/:id/delivered", msgHandler.MarkAsDelivered)
 		protected.PUT("/messages/:id/read", msgHandler.MarkAsRead)
 		protected.DELETE("/messages/:id", msgHandler.DeleteMessage)
 		protected.POST("/upload", msgHandler.UploadFile)
 
+		// Blocking
+		protected.GET("/blocks", msgHandler.GetBlockedUsers)
+		protected.POST("/users/:id/block", msgHandler.BlockUser)
+		protected.DELETE("/users/:id/block", msgHandler.UnblockUser)
+
 		// Profile
 		protected.GET("/profile", msgHandler.GetMyProfile)
 		protected.PUT("/profile", msgHandler.UpdateProfile)
 		protected.POST("/profile/avatar", msgHandler.UploadAvatar)
 		protected.DELETE("/profile", msgHandler.DeleteAccount)
 
+		// Passkeys
+		protected.GET("/passkeys", authHandler.GetPasskeys)
+		protected.POST("/passkeys/register/begin", authHandler.BeginPasskeyRegistration)
+		protected.POST("/passkeys/register/finish", authHandler.FinishPasskeyRegistration)
+		protected.PUT("/passkeys/second-factor", authHandler.SetPasskeySecondFactor)
+		protected.DELETE("/passkeys/:id", authHandler.DeletePasskey)
+
+		// Invites
+		protected.GET("/invites", authHandler.GetInvites)
+		protected.POST("/invites", authHandler.CreateInvite)
+		protected.DELETE("/invites/:id", authHandler.RevokeInvite)
+
 		// WebRTC
 		protected.GET("/webrtc/config", msgHandler.GetWebRTCConfig)
 
 		// Push notifications
 		protected.POST("/push/subscribe", msgHandler.SubscribePush)
 		protected.DELETE("/push/subscribe", msgHandler.UnsubscribePush)
+		protected.GET("/push/subscriptions", msgHandler.GetPushSubscriptions)
+		protected.DELETE("/push/subscriptions/:id", msgHandler.DeletePushSubscription)
+		protected.POST("/push/subscriptions/:id/test", msgHandler.TestPushSubscription)
+		protected.GET("/notifications/settings", msgHandler.GetNotificationSettings)
+		protected.PUT("/notifications/settings", msgHandler.UpdateNotificationSettings)
+	}
+
+	// Admin endpoints
+	admin := protected.Group("/admin")
+	admin.Use(authHandler.AdminMiddleware())
+	{
+		admin.GET("/stats", adminHandler.GetStats)
+		admin.GET("/users", adminHandler.ListUsers)
+		admin.PUT("/users/:id/role", adminHandler.SetUserRole)
+		admin.POST("/users/:id/suspend", adminHandler.SuspendUser)
+		admin.POST("/users/:id/unsuspend", adminHandler.UnsuspendUser)
+		admin.POST("/users/:id/logout", adminHandler.ForceLogout)
+		admin.DELETE("/users/:id", adminHandler.DeleteUser)
 	}
 
 	// Serve uploaded files from configured storage path
 	router.Static("/api/files", cfg.FileStoragePath)
 
 	// WebSocket endpoint
-	router.GET("/ws", authHandler.AuthMiddleware(), hub.HandleWebSocket)
+	router.GET("/ws", authHandler.WSAuthMiddleware(cfg.WSAllowQueryToken), hub.HandleWebSocket)
 
 	// Health check
 	router.GET("/health", func(c *gin.Context) {
@@ -418,6 +657,13 @@ func runServer(cfg *config.Config) error {
 	go func() {
 		<-sigint
 		log.Println("\nShutting down gracefully...")
+		hub.Close()
+		if pushNotifier != nil {
+			pushNotifier.Stop()
+		}
+		if turnServer != nil {
+			turnServer.Close()
+		}
 		os.Exit(0)
 	}()
 
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/4xmen/payambar/pkg/config"
+)
+
+func TestRedactQuery(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/api/conversations", "/api/conversations"},
+		{"/ws?token=eyJhbGci.secret&epoch=abc", "/ws?token=REDACTED&epoch=abc"},
+		{"/ws?epoch=abc&ticket=t0k3n&last_seq=4", "/ws?epoch=abc&ticket=REDACTED&last_seq=4"},
+		{"/ws?Token=x", "/ws?Token=REDACTED"},
+		{"/search?q=token", "/search?q=token"},
+	}
+	for _, tt := range tests {
+		if got := redactQuery(tt.path); got != tt.want {
+			t.Errorf("redactQuery(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestStartEmbeddedTURN(t *testing.T) {
+	cfg := &config.Config{
+		TurnSecret:       "north",
+		TurnListen:       "127.0.0.1:0",
+		TurnExternalIP:   "127.0.0.1",
+		TurnRealm:        "payambar",
+		TurnRelayPortMin: 50000,
+		TurnRelayPortMax: 50999,
+	}
+	server, url, err := startEmbeddedTURN(cfg)
+	if err != nil {
+		t.Fatalf("startEmbeddedTURN: %v", err)
+	}
+	server.Close()
+	if url != "turn:127.0.0.1:0" {
+		t.Errorf("url = %q", url)
+	}
+
+	for name, broken := range map[string]func(*config.Config){
+		"no secret": func(c *config.Config) { c.TurnSecret = "" },
+		"hostname":  func(c *config.Config) { c.TurnExternalIP = "turn.example.com" },
+		"bad ports": func(c *config.Config) { c.TurnRelayPortMax = 70000 },
+		"no port":   func(c *config.Config) { c.TurnListen = "127.0.0.1" },
+	} {
+		invalid := *cfg
+		broken(&invalid)
+		if server, _, err := startEmbeddedTURN(&invalid); err == nil {
+			server.Close()
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/pkg/config"
+)
+
+type migrateOptions struct {
+	Action string
+	// Target is the version to migrate to; -1 means the default (latest for
+	// up, one migration back for down)
+	Target int
+}
+
+func parseMigrateArgs(args []string) (migrateOptions, error) {
+	opts := migrateOptions{Target: -1}
+	if len(args) == 0 || len(args) > 2 {
+		return opts, fmt.Errorf("usage: payambar migrate status|up|down [version]")
+	}
+
+	opts.Action = args[0]
+	switch opts.Action {
+	case "status":
+		if len(args) > 1 {
+			return opts, fmt.Errorf("migrate status takes no version")
+		}
+	case "up", "down":
+		if len(args) > 1 {
+			target, err := strconv.Atoi(args[1])
+			if err != nil || target < 0 {
+				return opts, fmt.Errorf("invalid migration version: %s", args[1])
+			}
+			opts.Target = target
+		}
+	default:
+		return opts, fmt.Errorf("unknown migrate action: %s", opts.Action)
+	}
+	return opts, nil
+}
+
+// runMigrate shows or changes the schema version. Unlike the server it opens
+// the database without migrating it first.
+func runMigrate(cfg *config.Config, out io.Writer, args []string) error {
+	opts, err := parseMigrateArgs(args)
+	if err != nil {
+		return err
+	}
+
+	database, err := db.Open(databaseURL(cfg))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	defer database.Close()
+
+	switch opts.Action {
+	case "status":
+		return printMigrationStatus(database, out)
+
+	case "up":
+		target := opts.Target
+		if target == -1 {
+			target = 0
+		} else if target == 0 || target > db.LatestVersion() {
+			return fmt.Errorf("invalid migration version %d: this binary knows 1 to %d", target, db.LatestVersion())
+		}
+		applied, err := database.MigrateUp(target)
+		for _, m := range applied {
+			fmt.Fprintf(out, "Applied     %3d  %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(out, "Nothing to apply.")
+		}
+
+	case "down":
+		target := opts.Target
+		if target == -1 {
+			current, err := database.Version()
+			if err != nil {
+				return err
+			}
+			target = current - 1
+		}
+		if target < 0 {
+			target = 0
+		}
+		rolledBack, err := database.MigrateDown(target)
+		for _, m := range rolledBack {
+			fmt.Fprintf(out, "Rolled back %3d  %s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(rolledBack) == 0 {
+			fmt.Fprintln(out, "Nothing to roll back.")
+		}
+	}
+	return nil
+}
+
+func printMigrationStatus(database *db.DB, out io.Writer) error {
+	status, err := database.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	version, err := database.Version()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Schema version : %d (this binary: %d)\n\n", version, db.LatestVersion())
+	for _, m := range status {
+		state := "pending"
+		switch {
+		case m.Unknown:
+			state = "unknown, applied by a newer binary"
+		case m.AppliedAt != nil:
+			state = "applied " + m.AppliedAt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(out, "%3d  %-36s %s\n", m.Version, m.Name, state)
+	}
+	if version > db.LatestVersion() {
+		fmt.Fprintln(out, "\nThe database is newer than this binary; the server will not start.")
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestParseMigrateArgs(t *testing.T) {
+	opts, err := parseMigrateArgs([]string{"down"})
+	if err != nil {
+		t.Fatalf("parseMigrateArgs returned error: %v", err)
+	}
+	if opts.Action != "down" || opts.Target != -1 {
+		t.Fatalf("parseMigrateArgs = %+v", opts)
+	}
+
+	opts, err = parseMigrateArgs([]string{"up", "7"})
+	if err != nil {
+		t.Fatalf("parseMigrateArgs returned error: %v", err)
+	}
+	if opts.Action != "up" || opts.Target != 7 {
+		t.Fatalf("parseMigrateArgs = %+v", opts)
+	}
+
+	for _, args := range [][]string{nil, {"sideways"}, {"up", "x"}, {"down", "-1"}, {"status", "3"}, {"up", "1", "2"}} {
+		if _, err := parseMigrateArgs(args); err == nil {
+			t.Fatalf("parseMigrateArgs(%v) expected error", args)
+		}
+	}
+}
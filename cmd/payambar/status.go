@@ -1,16 +1,17 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/push"
+	"github.com/4xmen/payambar/internal/store"
 	"github.com/4xmen/payambar/pkg/config"
 )
 
@@ -28,9 +29,13 @@ type appStatus struct {
 	UploadedBytes   int64
 	MessagesLast24h int64
 	LatestMessageAt string
+	FailedLogins24h int64
+	LockedUsernames int64
+	Push            push.Stats
 	DBSize          int64
 	DBWALSize       int64
 	DBSHMSize       int64
+	DBRemote        bool
 	UploadDirSize   int64
 	UploadFileCount int64
 	DBMetricsReady  bool
@@ -78,18 +83,25 @@ func collectStatus(cfg *config.Config) appStatus {
 		FileStoragePath: cfg.FileStoragePath,
 	}
 
-	if size, err := fileSize(cfg.DatabasePath); err == nil {
-		status.DBSize = size
+	// A PostgreSQL database has no local files to measure
+	postgres := cfg.DatabaseURL != ""
+	if postgres {
+		status.DatabasePath = redactURL(cfg.DatabaseURL)
+		status.DBRemote = true
 	} else {
-		status.StorageWarnings = append(status.StorageWarnings, fmt.Sprintf("database file: %v", err))
-	}
+		if size, err := fileSize(cfg.DatabasePath); err == nil {
+			status.DBSize = size
+		} else {
+			status.StorageWarnings = append(status.StorageWarnings, fmt.Sprintf("database file: %v", err))
+		}
 
-	if size, err := fileSize(cfg.DatabasePath + "-wal"); err == nil {
-		status.DBWALSize = size
-	}
+		if size, err := fileSize(cfg.DatabasePath + "-wal"); err == nil {
+			status.DBWALSize = size
+		}
 
-	if size, err := fileSize(cfg.DatabasePath + "-shm"); err == nil {
-		status.DBSHMSize = size
+		if size, err := fileSize(cfg.DatabasePath + "-shm"); err == nil {
+			status.DBSHMSize = size
+		}
 	}
 
 	if bytes, files, err := dirUsage(cfg.FileStoragePath); err == nil {
@@ -99,59 +111,40 @@ func collectStatus(cfg *config.Config) appStatus {
 		status.StorageWarnings = append(status.StorageWarnings, fmt.Sprintf("upload dir: %v", err))
 	}
 
-	if _, err := os.Stat(cfg.DatabasePath); err != nil {
-		status.DBWarning = fmt.Sprintf("database unavailable: %v", err)
-		return status
+	if !postgres {
+		if _, err := os.Stat(cfg.DatabasePath); err != nil {
+			status.DBWarning = fmt.Sprintf("database unavailable: %v", err)
+			return status
+		}
 	}
 
-	dbConn, err := sql.Open("sqlite3", cfg.DatabasePath)
+	database, err := db.Open(databaseURL(cfg))
 	if err != nil {
 		status.DBWarning = fmt.Sprintf("database unavailable: %v", err)
 		return status
 	}
-	defer dbConn.Close()
-
-	if err := dbConn.Ping(); err != nil {
-		status.DBWarning = fmt.Sprintf("database unavailable: %v", err)
-		return status
-	}
-
-	if status.Users, err = queryInt64(dbConn, "SELECT COUNT(*) FROM users"); err != nil {
-		status.DBWarning = fmt.Sprintf("could not read database stats: %v", err)
-		return status
-	}
-
-	if status.Conversations, err = queryInt64(dbConn, "SELECT COUNT(*) FROM conversations"); err != nil {
-		status.DBWarning = fmt.Sprintf("could not read database stats: %v", err)
-		return status
-	}
-
-	if status.Messages, err = queryInt64(dbConn, "SELECT COUNT(*) FROM messages"); err != nil {
-		status.DBWarning = fmt.Sprintf("could not read database stats: %v", err)
-		return status
-	}
-
-	if status.UnreadMessages, err = queryInt64(dbConn, "SELECT COUNT(*) FROM messages WHERE read_at IS NULL"); err != nil {
-		status.DBWarning = fmt.Sprintf("could not read database stats: %v", err)
-		return status
-	}
+	defer database.Close()
 
-	if status.Files, err = queryInt64(dbConn, "SELECT COUNT(*) FROM files"); err != nil {
-		status.DBWarning = fmt.Sprintf("could not read database stats: %v", err)
-		return status
-	}
-
-	if status.UploadedBytes, err = queryInt64(dbConn, "SELECT COALESCE(SUM(file_size), 0) FROM files"); err != nil {
+	s := store.New(database)
+	stats, err := s.Stats.Read()
+	if err != nil {
 		status.DBWarning = fmt.Sprintf("could not read database stats: %v", err)
 		return status
 	}
-
-	if status.MessagesLast24h, err = queryInt64(dbConn, "SELECT COUNT(*) FROM messages WHERE datetime(created_at) >= datetime('now', '-1 day')"); err != nil {
-		status.DBWarning = fmt.Sprintf("could not read database stats: %v", err)
-		return status
+	status.Users = stats.Users
+	status.Conversations = stats.Conversations
+	status.Messages = stats.Messages
+	status.UnreadMessages = stats.UnreadMessages
+	status.Files = stats.Files
+	status.UploadedBytes = stats.UploadedBytes
+	status.MessagesLast24h = stats.MessagesLast24h
+	if stats.LatestMessageAt != nil {
+		status.LatestMessageAt = stats.LatestMessageAt.UTC().Format(time.DateTime)
 	}
+	status.FailedLogins24h = stats.FailedLogins24h
+	status.LockedUsernames = stats.LockedUsernames
 
-	if status.LatestMessageAt, err = queryString(dbConn, "SELECT COALESCE(MAX(created_at), '') FROM messages"); err != nil {
+	if status.Push, err = push.ReadStats(s); err != nil {
 		status.DBWarning = fmt.Sprintf("could not read database stats: %v", err)
 		return status
 	}
@@ -160,20 +153,13 @@ func collectStatus(cfg *config.Config) appStatus {
 	return status
 }
 
-func queryInt64(db *sql.DB, query string) (int64, error) {
-	var value int64
-	if err := db.QueryRow(query).Scan(&value); err != nil {
-		return 0, err
-	}
-	return value, nil
-}
-
-func queryString(db *sql.DB, query string) (string, error) {
-	var value string
-	if err := db.QueryRow(query).Scan(&value); err != nil {
-		return "", err
+// redactURL hides the password in a database URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid URL)"
 	}
-	return value, nil
+	return u.Redacted()
 }
 
 func fileSize(path string) (int64, error) {
@@ -256,16 +242,31 @@ func printStatus(out io.Writer, status appStatus) {
 		fmt.Fprintf(out, "  Uploaded bytes DB : %s\n", formatBytes(status.UploadedBytes))
 		fmt.Fprintf(out, "  Messages last 24h : %d\n", status.MessagesLast24h)
 		fmt.Fprintf(out, "  Latest message at : %s\n", formatTimestamp(status.LatestMessageAt))
+		fmt.Fprintf(out, "  Failed logins 24h : %d\n", status.FailedLogins24h)
+		fmt.Fprintf(out, "  Locked usernames  : %d\n", status.LockedUsernames)
 	} else {
 		fmt.Fprintln(out, "  Database metrics  : n/a")
 	}
 	fmt.Fprintln(out)
 
+	if status.DBMetricsReady {
+		fmt.Fprintln(out, "Push")
+		fmt.Fprintf(out, "  Queued            : %d\n", status.Push.Queued)
+		fmt.Fprintf(out, "  Pending           : %d\n", status.Push.Pending)
+		fmt.Fprintf(out, "  Sent              : %d\n", status.Push.Sent)
+		fmt.Fprintf(out, "  Retried           : %d\n", status.Push.Retried)
+		fmt.Fprintf(out, "  Failed            : %d\n", status.Push.Failed)
+		fmt.Fprintf(out, "  Revoked           : %d\n", status.Push.Revoked)
+		fmt.Fprintln(out)
+	}
+
 	fmt.Fprintln(out, "Storage")
-	fmt.Fprintf(out, "  DB file       : %s\n", formatBytes(status.DBSize))
-	fmt.Fprintf(out, "  DB WAL file   : %s\n", formatBytes(status.DBWALSize))
-	fmt.Fprintf(out, "  DB SHM file   : %s\n", formatBytes(status.DBSHMSize))
-	fmt.Fprintf(out, "  DB footprint  : %s\n", formatBytes(totalDB))
+	if !status.DBRemote {
+		fmt.Fprintf(out, "  DB file       : %s\n", formatBytes(status.DBSize))
+		fmt.Fprintf(out, "  DB WAL file   : %s\n", formatBytes(status.DBWALSize))
+		fmt.Fprintf(out, "  DB SHM file   : %s\n", formatBytes(status.DBSHMSize))
+		fmt.Fprintf(out, "  DB footprint  : %s\n", formatBytes(totalDB))
+	}
 	fmt.Fprintf(out, "  Upload files  : %d\n", status.UploadFileCount)
 	fmt.Fprintf(out, "  Upload size   : %s\n", formatBytes(status.UploadDirSize))
 
@@ -283,7 +284,14 @@ func printStatus(out io.Writer, status appStatus) {
 }
 
 func printStatusJSON(out io.Writer, status appStatus) error {
-	payload := map[string]any{
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(statusPayload(status))
+}
+
+// statusPayload is the JSON shape shared by `status --json` and the admin API.
+func statusPayload(status appStatus) map[string]any {
+	return map[string]any{
 		"generated_at":      status.GeneratedAt.Format(time.RFC3339),
 		"environment":       status.Environment,
 		"port":              status.Port,
@@ -300,7 +308,10 @@ func printStatusJSON(out io.Writer, status appStatus) error {
 			"messages_last_24h":  status.MessagesLast24h,
 			"latest_message_at":  formatTimestamp(status.LatestMessageAt),
 			"uploaded_bytes_hum": formatBytes(status.UploadedBytes),
+			"failed_logins_24h":  status.FailedLogins24h,
+			"locked_usernames":   status.LockedUsernames,
 		},
+		"push": status.Push,
 		"storage": map[string]any{
 			"db_file_bytes":      status.DBSize,
 			"db_wal_bytes":       status.DBWALSize,
@@ -319,8 +330,4 @@ func printStatusJSON(out io.Writer, status appStatus) error {
 			"storage":  status.StorageWarnings,
 		},
 	}
-
-	encoder := json.NewEncoder(out)
-	encoder.SetIndent("", "  ")
-	return encoder.Encode(payload)
 }
@@ -7,6 +7,10 @@ import (
 	"path/filepath"
 	"testing"
 	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/push"
+	"github.com/4xmen/payambar/pkg/config"
 )
 
 func TestFormatBytes(t *testing.T) {
@@ -93,6 +97,7 @@ func TestPrintStatusJSON(t *testing.T) {
 		DatabasePath:    "/tmp/payambar.db",
 		FileStoragePath: "/tmp/uploads",
 		Users:           3,
+		Push:            push.Stats{Sent: 5, Pending: 1},
 	}
 
 	var out bytes.Buffer
@@ -108,4 +113,40 @@ func TestPrintStatusJSON(t *testing.T) {
 	if payload["environment"] != "development" {
 		t.Fatalf("unexpected environment: %#v", payload["environment"])
 	}
+	if pushStats, _ := payload["push"].(map[string]any); pushStats["sent"] != float64(5) || pushStats["pending"] != float64(1) {
+		t.Fatalf("unexpected push stats: %#v", payload["push"])
+	}
+}
+
+func TestCollectStatus(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{DatabasePath: filepath.Join(dir, "payambar.db"), FileStoragePath: dir}
+	database, err := db.New(cfg.DatabasePath)
+	if err != nil {
+		t.Fatalf("db.New: %v", err)
+	}
+	database.Exec("INSERT INTO users (username, password_hash) VALUES ('alice', 'hash'), ('bob', 'hash')")
+	database.Exec("INSERT INTO messages (sender_id, receiver_id, content) VALUES (1, 2, 'hi')")
+	database.Exec("INSERT INTO messages (sender_id, receiver_id, content, created_at) VALUES (2, 1, 'old', '2020-01-02 03:04:05')")
+	database.Close()
+
+	status := collectStatus(cfg)
+	if !status.DBMetricsReady {
+		t.Fatalf("metrics not ready: %s", status.DBWarning)
+	}
+	if status.Users != 2 || status.Messages != 2 || status.MessagesLast24h != 1 {
+		t.Fatalf("users = %d, messages = %d, last 24h = %d", status.Users, status.Messages, status.MessagesLast24h)
+	}
+	if latest, err := time.Parse(time.DateTime, status.LatestMessageAt); err != nil || time.Since(latest) > time.Hour {
+		t.Fatalf("LatestMessageAt = %q", status.LatestMessageAt)
+	}
+	if status.DBSize == 0 || status.DBRemote {
+		t.Fatalf("DBSize = %d, DBRemote = %v", status.DBSize, status.DBRemote)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	if got := redactURL("postgres://payambar:secret@db:5432/payambar"); got != "postgres://payambar:xxxxx@db:5432/payambar" {
+		t.Fatalf("redactURL = %q", got)
+	}
 }
@@ -1,7 +1,8 @@
 #!/bin/bash
 set -e
 
-if [ "$TURN_ENABLED" = "true" ]; then
+# The built-in server (TURN_EMBEDDED) takes the same ports as coturn
+if [ "$TURN_ENABLED" = "true" ] && [ "$TURN_EMBEDDED" != "true" ]; then
     echo "Starting Coturn..."
     mkdir -p /etc/coturn
 
@@ -30,7 +31,11 @@ EOF
         echo "relay-ip=$TURN_EXTERNAL_IP" >> /etc/coturn/turnserver.conf
     fi
 
-    if [ -n "$TURN_USERNAME" ] && [ -n "$TURN_PASSWORD" ]; then
+    # A shared secret lets Payambar hand out short-lived per-user logins
+    if [ -n "$TURN_SECRET" ]; then
+        echo "use-auth-secret" >> /etc/coturn/turnserver.conf
+        echo "static-auth-secret=$TURN_SECRET" >> /etc/coturn/turnserver.conf
+    elif [ -n "$TURN_USERNAME" ] && [ -n "$TURN_PASSWORD" ]; then
         echo "user=$TURN_USERNAME:$TURN_PASSWORD" >> /etc/coturn/turnserver.conf
     fi
 
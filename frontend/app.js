@@ -80,10 +80,14 @@ const app = createApp({
             wsReconnectMaxDelay: 30000,
             wsReconnectTimer: null,
             wsIntentionalClose: false,
+            wsTicketPending: false,
+            wsEpoch: '',
+            wsLastSeq: 0,
             wsConnected: false,
             authTab: 'login',
             login: { username: '', password: '' },
-            register: { username: '', password: '', confirm: '' },
+            register: { username: '', password: '', confirm: '', invite: '' },
+            registrationMode: 'open',
             authPassword: '',
             suppressBackupWarningOnce: false,
             showRulesModal: false,
@@ -132,6 +136,11 @@ const app = createApp({
             serverOffline: false,
             // Push notification state
             pushNotificationsEnabled: false,
+            pushPreview: false,
+            pushSubscriptionId: null,
+            pushDevices: [],
+            // Conversation to open once loaded (notification deep link)
+            pendingConversationId: null,
             // Pull to refresh state
             pullToRefresh: {
                 startY: 0,
@@ -143,6 +152,7 @@ const app = createApp({
             },
             // WebRTC Call state
             iceServers: [],
+            iceServersExpireAt: null,
             localStream: null,
             remoteStream: null,
             peerConnection: null,
@@ -202,7 +212,9 @@ const app = createApp({
     mounted() {
         console.log('Vue app mounted');
         this.fetchAppVersion();
+        this.fetchRegistrationMode();
         this.initAuth();
+        this.pendingConversationId = parseInt(new URLSearchParams(window.location.search).get('conversation'), 10) || null;
         console.log('Auth state:', { token: !!this.token, userId: this.userId, isAuthed: this.isAuthed });
         if (this.isAuthed) {
             this.loadConversations();
@@ -229,6 +241,16 @@ const app = createApp({
         });
         window.addEventListener('offline', () => { this.isOffline = true; });
 
+        // A notification was clicked while this window was open
+        if ('serviceWorker' in navigator) {
+            navigator.serviceWorker.addEventListener('message', (event) => {
+                if (event.data?.type === 'open-conversation' && this.isAuthed) {
+                    this.pendingConversationId = event.data.conversation_id;
+                    this.loadConversations();
+                }
+            });
+        }
+
         // Reconnect WebSocket when tab becomes visible again
         document.addEventListener('visibilitychange', () => {
             if (document.visibilityState === 'visible' && this.isAuthed) {
@@ -255,6 +277,22 @@ const app = createApp({
                 console.warn('Failed to fetch app version:', e);
             }
         },
+        async fetchRegistrationMode() {
+            try {
+                const res = await fetch(`${API_URL}/auth/registration`);
+                if (res.ok) {
+                    const data = await res.json();
+                    this.registrationMode = data.mode || 'open';
+                }
+            } catch (e) {
+                console.warn('Failed to fetch registration mode:', e);
+            }
+            const invite = new URLSearchParams(window.location.search).get('invite');
+            if (invite) {
+                this.register.invite = invite;
+                this.authTab = 'register';
+            }
+        },
         initAuth() {
             const storedToken = localStorage.getItem('token');
             const storedUserId = localStorage.getItem('userId');
@@ -665,8 +703,22 @@ const app = createApp({
         formatStatus(msg) {
             if (msg.status === 'read') return '✓✓';
             if (msg.status === 'delivered') return '✓';
+            if (msg.status === 'failed') return '⚠';
             return '';
         },
+        formatCallEntry(msg) {
+            const call = msg.call;
+            const incoming = Number(msg.receiver_id) === Number(this.userId);
+            const kind = call.kind === 'video' ? 'تماس تصویری' : 'تماس صوتی';
+            if (call.outcome === 'completed') {
+                const minutes = Math.floor((call.duration || 0) / 60).toString().padStart(2, '0');
+                const seconds = ((call.duration || 0) % 60).toString().padStart(2, '0');
+                return `📞 ${kind} (${minutes}:${seconds})`.replace(/[0-9]/g, d => '۰۱۲۳۴۵۶۷۸۹'[d]);
+            }
+            if (call.outcome === 'busy') return `📞 ${kind} - مشغول`;
+            if (call.outcome === 'declined') return `📞 ${kind} - رد شد`;
+            return incoming ? `📞 ${kind} بی‌پاسخ` : `📞 ${kind} - پاسخی دریافت نشد`;
+        },
         shouldShowMessageStatus(msg, index) {
             if (!msg) return false;
             if (Number(msg.sender_id) !== Number(this.userId)) return false;
@@ -817,7 +869,11 @@ const app = createApp({
                 const res = await fetch(`${API_URL}/auth/register`, {
                     method: 'POST',
                     headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify({ username: this.register.username, password: this.register.password }),
+                    body: JSON.stringify({
+                        username: this.register.username,
+                        password: this.register.password,
+                        invite_code: this.register.invite.trim(),
+                    }),
                 });
                 if (!res.ok) throw new Error((await res.json()).error || 'Registration failed');
                 const data = await res.json();
@@ -885,6 +941,8 @@ const app = createApp({
             this.conversationMenu = { show: false, x: 0, y: 0, conversation: null };
             this.serverOffline = false;
             this.wsReconnectAttempts = 0;
+            this.wsEpoch = '';
+            this.wsLastSeq = 0;
             if (this.newChatSearchTimeout) {
                 clearTimeout(this.newChatSearchTimeout);
                 this.newChatSearchTimeout = null;
@@ -911,6 +969,8 @@ const app = createApp({
                 if (res.ok) {
                     const data = await res.json();
                     this.iceServers = data.iceServers || [];
+                    // Ephemeral TURN credentials must be renewed before they expire
+                    this.iceServersExpireAt = data.expires_at ? Date.parse(data.expires_at) : null;
                 }
             } catch (err) {
                 console.error('Error fetching WebRTC config:', err);
@@ -918,6 +978,11 @@ const app = createApp({
                 this.iceServers = [{ urls: 'stun:stun.l.google.com:19302' }];
             }
         },
+        async ensureFreshIceServers() {
+            if (this.iceServersExpireAt && Date.now() > this.iceServersExpireAt - 60000) {
+                await this.fetchWebRTCConfig();
+            }
+        },
         async loadMyProfile() {
             try {
                 const res = await fetch(`${API_URL}/profile`, {
@@ -927,6 +992,7 @@ const app = createApp({
                     const data = await res.json();
                     this.profileDisplayName = data.display_name || '';
                     this.myAvatarUrl = data.avatar_url || null;
+                    this.pushPreview = !!data.push_preview;
                 }
             } catch (err) {
                 console.error('Error loading profile:', err);
@@ -950,6 +1016,23 @@ const app = createApp({
                 alert('خطا در ذخیره پروفایل');
             }
         },
+        async savePushPreview() {
+            try {
+                const res = await fetch(`${API_URL}/profile`, {
+                    method: 'PUT',
+                    headers: {
+                        'Content-Type': 'application/json',
+                        Authorization: `Bearer ${this.token}`
+                    },
+                    body: JSON.stringify({ display_name: this.profileDisplayName, push_preview: this.pushPreview }),
+                });
+                if (!res.ok) throw new Error('Failed to save push preview');
+            } catch (err) {
+                console.error('Error saving push preview:', err);
+                this.pushPreview = !this.pushPreview;
+                alert('خطا در ذخیره تنظیمات اعلان');
+            }
+        },
         // ── Push Notifications ─────────────────────────────────────────────
         async restorePushSubscription() {
             const stored = localStorage.getItem('pushNotificationsEnabled');
@@ -1027,9 +1110,64 @@ const app = createApp({
                         p256dh: subJSON.keys.p256dh,
                         auth: subJSON.keys.auth,
                     },
+                    label: this.pushDeviceLabel(),
                 }),
             });
             if (!res.ok) throw new Error('Server rejected subscription');
+            const data = await res.json();
+            this.pushSubscriptionId = data.id || null;
+        },
+        // pushDeviceLabel names this device in the subscription list, e.g. "Firefox · Android"
+        pushDeviceLabel() {
+            const ua = navigator.userAgent;
+            const browsers = [['Edg/', 'Edge'], ['OPR/', 'Opera'], ['Firefox/', 'Firefox'], ['Chrome/', 'Chrome'], ['Safari/', 'Safari']];
+            const systems = [['Android', 'Android'], ['iPhone', 'iPhone'], ['iPad', 'iPad'], ['Windows', 'Windows'], ['Mac OS', 'macOS'], ['Linux', 'Linux']];
+            const browser = browsers.find(([token]) => ua.includes(token));
+            const system = systems.find(([token]) => ua.includes(token));
+            return [browser && browser[1], system && system[1]].filter(Boolean).join(' · ');
+        },
+        async loadPushDevices() {
+            try {
+                const res = await fetch(`${API_URL}/push/subscriptions`, {
+                    headers: { Authorization: `Bearer ${this.token}` },
+                });
+                if (!res.ok) throw new Error('Failed to load push devices');
+                const data = await res.json();
+                this.pushDevices = data.subscriptions || [];
+            } catch (err) {
+                console.error('Error loading push devices:', err);
+            }
+        },
+        async testPushDevice(device) {
+            try {
+                const res = await fetch(`${API_URL}/push/subscriptions/${device.id}/test`, {
+                    method: 'POST',
+                    headers: { Authorization: `Bearer ${this.token}` },
+                });
+                if (!res.ok) throw new Error('Failed to send test notification');
+            } catch (err) {
+                console.error('Error sending test notification:', err);
+                alert('ارسال اعلان آزمایشی ناموفق بود');
+            }
+        },
+        async removePushDevice(device) {
+            if (!confirm('دریافت اعلان روی این دستگاه متوقف شود؟')) return;
+            try {
+                const res = await fetch(`${API_URL}/push/subscriptions/${device.id}`, {
+                    method: 'DELETE',
+                    headers: { Authorization: `Bearer ${this.token}` },
+                });
+                if (!res.ok) throw new Error('Failed to remove push device');
+                this.pushDevices = this.pushDevices.filter((d) => d.id !== device.id);
+                if (device.id === this.pushSubscriptionId) {
+                    this.pushSubscriptionId = null;
+                    this.pushNotificationsEnabled = false;
+                    localStorage.removeItem('pushNotificationsEnabled');
+                }
+            } catch (err) {
+                console.error('Error removing push device:', err);
+                alert('حذف دستگاه ناموفق بود');
+            }
         },
         async unsubscribePush() {
             try {
@@ -1133,6 +1271,7 @@ const app = createApp({
                 const data = await res.json();
                 this.conversations = data.conversations || [];
                 this.sortConversationsInPlace();
+                this.openPendingConversation();
             } catch (err) {
                 console.error(err);
                 this.serverOffline = true;
@@ -1140,6 +1279,17 @@ const app = createApp({
                 this.loadingConversations = false;
             }
         },
+        openPendingConversation() {
+            if (!this.pendingConversationId) return;
+            const conv = this.conversations.find((c) => c.id === this.pendingConversationId);
+            this.pendingConversationId = null;
+            if (window.location.search.includes('conversation=')) {
+                window.history.replaceState(null, '', '/');
+            }
+            if (conv) {
+                this.selectConversation(conv);
+            }
+        },
         async selectConversation(conv) {
             this.closeConversationMenu();
             this.currentConversationId = conv.user_id;
@@ -1209,7 +1359,7 @@ const app = createApp({
             const content = (this.messageText || '').trim();
             if (!content || !this.currentConversationId || !this.ws || this.ws.readyState !== WebSocket.OPEN) return;
 
-            const clientMessageId = `client-${Date.now()}`;
+            const clientMessageId = `client-${Date.now()}-${Math.random().toString(36).slice(2, 10)}`;
             const msg = {
                 id: null,
                 client_message_id: clientMessageId,
@@ -1568,7 +1718,7 @@ const app = createApp({
                 this.serverOffline = false;
             }
         },
-        connectWebSocket() {
+        async connectWebSocket() {
             const token = this.token;
             const isTokenValid = typeof token === 'string' && token && token !== 'undefined' && token !== 'null';
             if (!this.isAuthed || !isTokenValid) {
@@ -1577,14 +1727,47 @@ const app = createApp({
             if (this.ws && (this.ws.readyState === WebSocket.OPEN || this.ws.readyState === WebSocket.CONNECTING)) {
                 return;
             }
+            if (this.wsTicketPending) {
+                return;
+            }
             if (this.wsReconnectTimer) {
                 clearTimeout(this.wsReconnectTimer);
                 this.wsReconnectTimer = null;
             }
             this.wsIntentionalClose = false;
             this.wsConnected = false;
-            const wsUrlWithToken = `${WS_URL}?token=${encodeURIComponent(token)}`;
-            this.ws = new WebSocket(wsUrlWithToken);
+
+            // A single-use ticket keeps the login token out of the URL
+            let ticket;
+            this.wsTicketPending = true;
+            try {
+                const res = await fetch(`${API_URL}/ws/ticket`, {
+                    method: 'POST',
+                    headers: { Authorization: `Bearer ${token}` },
+                });
+                if (res.status === 401) {
+                    this.clearAuth();
+                    return;
+                }
+                if (!res.ok) {
+                    throw new Error(`ticket request failed: ${res.status}`);
+                }
+                ticket = (await res.json()).ticket;
+            } catch (err) {
+                console.warn('WebSocket ticket error:', err);
+                this.serverOffline = true;
+                this.scheduleWebSocketReconnect();
+                return;
+            } finally {
+                this.wsTicketPending = false;
+            }
+            if (!this.isAuthed) {
+                return;
+            }
+
+            // Epoch and last seq let the server replay only what we missed
+            const wsUrlWithTicket = `${WS_URL}?ticket=${encodeURIComponent(ticket)}&epoch=${encodeURIComponent(this.wsEpoch)}&last_seq=${this.wsLastSeq}`;
+            this.ws = new WebSocket(wsUrlWithTicket);
 
             this.ws.onopen = () => {
                 this.wsReconnectAttempts = 0;
@@ -1595,6 +1778,18 @@ const app = createApp({
             this.ws.onmessage = (event) => {
                 try {
                     const data = JSON.parse(event.data);
+                    if (data.type === 'hello') {
+                        if (data.epoch !== this.wsEpoch) {
+                            this.wsEpoch = data.epoch;
+                            this.wsLastSeq = 0;
+                        }
+                        return;
+                    }
+                    if (data.seq) {
+                        this.ws.send(JSON.stringify({ type: 'ack', seq: data.seq }));
+                        if (data.seq <= this.wsLastSeq) return;
+                        this.wsLastSeq = data.seq;
+                    }
                     this.handleWebSocketMessage(data);
                 } catch (err) {
                     console.error('WebSocket parse error:', err);
@@ -1619,28 +1814,32 @@ const app = createApp({
                     return;
                 }
                 this.serverOffline = true;
-                if (this.wsReconnectAttempts < this.wsMaxReconnectAttempts && this.isAuthed) {
-                    this.wsReconnectAttempts++;
-                    const delay = Math.min(
-                        this.wsReconnectBaseDelay * Math.pow(2, this.wsReconnectAttempts - 1),
-                        this.wsReconnectMaxDelay
-                    );
-                    this.wsReconnectTimer = setTimeout(() => {
-                        this.wsReconnectTimer = null;
-                        this.connectWebSocket();
-                    }, delay);
-                }
+                this.scheduleWebSocketReconnect();
             };
         },
+        scheduleWebSocketReconnect() {
+            if (this.wsReconnectAttempts < this.wsMaxReconnectAttempts && this.isAuthed) {
+                this.wsReconnectAttempts++;
+                const delay = Math.min(
+                    this.wsReconnectBaseDelay * Math.pow(2, this.wsReconnectAttempts - 1),
+                    this.wsReconnectMaxDelay
+                );
+                this.wsReconnectTimer = setTimeout(() => {
+                    this.wsReconnectTimer = null;
+                    this.connectWebSocket();
+                }, delay);
+            }
+        },
         async handleWebSocketMessage(data) {
             if (data.type === 'call_offer') {
                 if (this.activeCall || this.incomingCall || this.outgoingCall) {
-                    this.ws.send(JSON.stringify({ type: 'call_reject', receiver_id: data.sender_id, payload: { reason: 'busy' } }));
+                    this.ws.send(JSON.stringify({ type: 'call_reject', call_id: data.call_id, receiver_id: data.sender_id, payload: { reason: 'busy' } }));
                     return;
                 }
                 // Fetch sender info if not in conversations
                 const sender = this.conversations.find(c => c.user_id === data.sender_id) || { username: 'کاربر', user_id: data.sender_id };
                 this.incomingCall = {
+                    call_id: data.call_id,
                     sender_id: data.sender_id,
                     username: sender.username,
                     displayName: sender.display_name,
@@ -1663,6 +1862,21 @@ const app = createApp({
                     alert('تماس رد شد');
                     this.endCall(false);
                 }
+            } else if (data.type === 'call_state') {
+                // The server owns the call: learn our call id and close the
+                // call when it ends, e.g. when nobody answers in time
+                const session = data.session || {};
+                if (this.outgoingCall && session.caller_id === this.userId && !this.outgoingCall.call_id) {
+                    this.outgoingCall.call_id = data.call_id;
+                }
+                const current = this.activeCall || this.outgoingCall || this.incomingCall;
+                if (session.state === 'ended' && current && current.call_id === data.call_id) {
+                    const reasons = { missed: 'پاسخی دریافت نشد', busy: 'مخاطب در حال تماس دیگری است', declined: 'تماس رد شد' };
+                    if (this.outgoingCall && reasons[session.end_reason]) {
+                        alert(reasons[session.end_reason]);
+                    }
+                    this.endCall(false);
+                }
             } else if (data.type === 'call_hangup') {
                 if ((this.activeCall && this.activeCall.user_id === data.sender_id) ||
                     (this.incomingCall && this.incomingCall.sender_id === data.sender_id)) {
@@ -1716,6 +1930,7 @@ const app = createApp({
                             iv: data.iv,
                             ciphertext: data.ciphertext,
                             aad: data.aad,
+                            call: data.call,
                         });
                     }
                 } else {
@@ -1746,6 +1961,7 @@ const app = createApp({
                             iv: data.iv,
                             ciphertext: data.ciphertext,
                             aad: data.aad,
+                            call: data.call,
                         });
                     }
                 }
@@ -1776,6 +1992,13 @@ const app = createApp({
                 if (msg) {
                     msg.status = data.status;
                 }
+            } else if (data.type === 'error') {
+                const allMsgs = Object.values(this.messages).flat();
+                const msg = data.client_message_id && allMsgs.find((m) => m.client_message_id === data.client_message_id);
+                if (msg) {
+                    msg.status = 'failed';
+                }
+                if (data.error) alert(data.error);
             }
         },
         openNewChat() {
@@ -1949,6 +2172,36 @@ const app = createApp({
             this.conversationMenu.show = false;
             this.conversationMenu.conversation = null;
         },
+        async toggleConversationMute(conversation) {
+            if (!conversation || !conversation.id) {
+                this.closeConversationMenu();
+                return;
+            }
+
+            const url = `${API_URL}/conversations/${conversation.id}/notifications`;
+            try {
+                const res = await fetch(url, { headers: { Authorization: `Bearer ${this.token}` } });
+                if (!res.ok) throw new Error('Failed to load notification settings');
+                const { settings } = await res.json();
+                const muted = !settings.muted;
+
+                const saveRes = await fetch(url, {
+                    method: 'PUT',
+                    headers: {
+                        'Content-Type': 'application/json',
+                        Authorization: `Bearer ${this.token}`
+                    },
+                    body: JSON.stringify({ level: settings.level, muted }),
+                });
+                if (!saveRes.ok) throw new Error('Failed to save notification settings');
+                alert(muted ? 'اعلان‌های این مکالمه بی‌صدا شد' : 'اعلان‌های این مکالمه فعال شد');
+            } catch (err) {
+                console.error('Error toggling conversation mute:', err);
+                alert('خطا در ذخیره تنظیمات اعلان');
+            } finally {
+                this.closeConversationMenu();
+            }
+        },
         async deleteConversation(conversation) {
             if (!conversation || !conversation.id) {
                 this.closeConversationMenu();
@@ -2042,6 +2295,7 @@ const app = createApp({
             this.outgoingCall = { receiver_id: receiverId, username, displayName, avatarUrl, status: 'calling' };
 
             try {
+                await this.ensureFreshIceServers();
                 console.log('[WebRTC] startCall: Getting user media...');
                 this.localStream = await navigator.mediaDevices.getUserMedia({ audio: true, video: false });
                 console.log('[WebRTC] startCall: Got local stream with tracks:', this.localStream.getTracks().map(t => t.kind + ':' + t.enabled));
@@ -2070,6 +2324,7 @@ const app = createApp({
             const senderId = this.incomingCall.sender_id;
 
             try {
+                await this.ensureFreshIceServers();
                 console.log('[WebRTC] acceptCall: Getting user media...');
                 this.localStream = await navigator.mediaDevices.getUserMedia({ audio: true, video: false });
                 console.log('[WebRTC] acceptCall: Got local stream with tracks:', this.localStream.getTracks().map(t => t.kind + ':' + t.enabled));
@@ -2085,11 +2340,13 @@ const app = createApp({
 
                 this.ws.send(JSON.stringify({
                     type: 'call_answer',
+                    call_id: this.incomingCall.call_id,
                     receiver_id: senderId,
                     payload: { answer }
                 }));
 
                 this.activeCall = {
+                    call_id: this.incomingCall.call_id,
                     user_id: senderId,
                     username: this.incomingCall.username,
                     displayName: this.incomingCall.displayName,
@@ -2107,9 +2364,9 @@ const app = createApp({
             if (!this.incomingCall) return;
             this.ws.send(JSON.stringify({
                 type: 'call_reject',
+                call_id: this.incomingCall.call_id,
                 receiver_id: this.incomingCall.sender_id
             }));
-            this.saveCallLogMessage(this.incomingCall.sender_id, 'تماس ناموفق');
             this.incomingCall = null;
         },
         endCall(isInitiator = true) {
@@ -2117,18 +2374,17 @@ const app = createApp({
                 if (isInitiator) {
                     this.ws.send(JSON.stringify({
                         type: 'call_hangup',
+                        call_id: this.activeCall.call_id,
                         receiver_id: this.activeCall.user_id
                     }));
-                    const duration = this.callDuration ? ` (${this.callDuration})` : '';
-                    this.saveCallLogMessage(this.activeCall.user_id, `تماس صوتی${duration}`);
                 }
             } else if (this.outgoingCall) {
                 if (isInitiator) {
                     this.ws.send(JSON.stringify({
                         type: 'call_hangup',
+                        call_id: this.outgoingCall.call_id,
                         receiver_id: this.outgoingCall.receiver_id
                     }));
-                    this.saveCallLogMessage(this.outgoingCall.receiver_id, 'تماس ناموفق');
                 }
             }
 
@@ -2156,8 +2412,10 @@ const app = createApp({
             this.peerConnection.onicecandidate = (event) => {
                 if (event.candidate) {
                     console.log('[WebRTC] Sending ICE candidate:', event.candidate.type, event.candidate.address);
+                    const call = this.activeCall || this.outgoingCall || this.incomingCall;
                     this.ws.send(JSON.stringify({
                         type: 'ice_candidate',
+                        call_id: call ? call.call_id : undefined,
                         receiver_id: otherUserId,
                         payload: { candidate: event.candidate }
                     }));
@@ -2205,16 +2463,6 @@ const app = createApp({
             this.callDuration = '';
             this.callStartTime = null;
         },
-        saveCallLogMessage(otherUserId, content) {
-            // Send a regular message for call history
-            if (this.ws && this.ws.readyState === WebSocket.OPEN) {
-                this.ws.send(JSON.stringify({
-                    type: 'message',
-                    receiver_id: otherUserId,
-                    content: content
-                }));
-            }
-        },
     },
 });
 
@@ -110,12 +110,18 @@ self.addEventListener('push', (event) => {
   const title = payload.title || 'پیام جدید';
   const options = {
     body: payload.body || 'پیام جدید دارید',
-    icon: '/favicon-192.png',
+    icon: payload.icon || '/favicon-192.png',
     badge: '/favicon-96.png',
-    data: { url: payload.url || '/' },
-    tag: 'new-message',
+    data: { url: payload.url || '/', conversation_id: payload.conversation_id },
+    // One notification per conversation; newer messages replace it
+    tag: payload.tag || 'new-message',
     renotify: true,
   };
+  if (payload.type === 'call') {
+    // Ring until dismissed; the missed-call push reuses the tag and replaces it
+    options.requireInteraction = true;
+    options.vibrate = [500, 250, 500, 250, 500];
+  }
 
   event.waitUntil(self.registration.showNotification(title, options));
 });
@@ -125,12 +131,16 @@ self.addEventListener('notificationclick', (event) => {
   event.notification.close();
 
   const url = event.notification.data?.url || '/';
+  const conversationId = event.notification.data?.conversation_id;
 
   event.waitUntil(
     clients.matchAll({ type: 'window', includeUncontrolled: true }).then((windowClients) => {
-      // Focus an existing window if available
+      // Focus an existing window if available and open the conversation there
       for (const client of windowClients) {
         if (client.url.includes(self.location.origin) && 'focus' in client) {
+          if (conversationId) {
+            client.postMessage({ type: 'open-conversation', conversation_id: conversationId });
+          }
           return client.focus();
         }
       }
@@ -257,6 +257,9 @@ STUN_SERVERS=stun:stun.l.google.com:19302
 TURN_SERVER=
 TURN_USERNAME=
 TURN_PASSWORD=
+TURN_SECRET=
+TURN_EMBEDDED=false
+TURN_EXTERNAL_IP=
 VAPID_PUBLIC_KEY=${VAPID_PUBLIC_KEY}
 VAPID_PRIVATE_KEY=${VAPID_PRIVATE_KEY}
 EOF
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/4xmen/payambar/internal/store"
+)
+
+// User roles
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrAccountSuspended = errors.New("account suspended")
+	ErrSessionRevoked   = errors.New("session revoked")
+)
+
+// Authorize checks that the token's user still exists, is not suspended and
+// has not been force-logged-out since the token was issued. It returns the
+// user's role.
+func (s *Service) Authorize(claims *Claims) (string, error) {
+	user, err := s.store.Users.Get(claims.UserID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return "", ErrUserNotFound
+		}
+		return "", fmt.Errorf("failed to query user: %w", err)
+	}
+	if user.SuspendedAt != nil {
+		return "", ErrAccountSuspended
+	}
+	if claims.TokenVersion != user.TokenVersion {
+		return "", ErrSessionRevoked
+	}
+	return user.Role, nil
+}
+
+// SetRole changes a user's role.
+func (s *Service) SetRole(userID int, role string) error {
+	if role != RoleUser && role != RoleAdmin {
+		return fmt.Errorf("invalid role")
+	}
+	return updateUser(s.store.Users.SetRole(userID, role))
+}
+
+// SetSuspended suspends or reinstates a user. Suspending also revokes all of
+// the user's sessions, so reinstated users have to log in again.
+func (s *Service) SetSuspended(userID int, suspended bool) error {
+	if suspended {
+		return updateUser(s.store.Users.Suspend(userID, time.Now().UTC()))
+	}
+	return updateUser(s.store.Users.Unsuspend(userID))
+}
+
+// RevokeSessions invalidates every token issued to a user so far.
+func (s *Service) RevokeSessions(userID int) error {
+	return updateUser(s.store.Users.RevokeSessions(userID))
+}
+
+func updateUser(err error) error {
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthorizeSuspensionAndRevocation(t *testing.T) {
+	svc := setupPasskeyService(t)
+	userID, err := svc.Register("peggy", "password123")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	token, err := svc.Login("peggy", "password123", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	claims, _ := svc.ValidateToken(token)
+	if role, err := svc.Authorize(claims); err != nil || role != RoleUser {
+		t.Fatalf("Authorize = %q, %v; want %q", role, err, RoleUser)
+	}
+
+	if err := svc.SetRole(userID, "superuser"); err == nil {
+		t.Fatal("expected invalid role to fail")
+	}
+	if err := svc.SetRole(userID, RoleAdmin); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	if role, _ := svc.Authorize(claims); role != RoleAdmin {
+		t.Fatalf("role = %q, want %q", role, RoleAdmin)
+	}
+
+	if err := svc.SetSuspended(userID, true); err != nil {
+		t.Fatalf("SetSuspended: %v", err)
+	}
+	if _, err := svc.Authorize(claims); !errors.Is(err, ErrAccountSuspended) {
+		t.Fatalf("Authorize error = %v, want ErrAccountSuspended", err)
+	}
+	if _, err := svc.Login("peggy", "password123", "127.0.0.1"); !errors.Is(err, ErrAccountSuspended) {
+		t.Fatalf("Login error = %v, want ErrAccountSuspended", err)
+	}
+	if _, err := svc.Login("peggy", "wrong-password", "127.0.0.1"); errors.Is(err, ErrAccountSuspended) {
+		t.Fatal("suspension must not be revealed without the right password")
+	}
+
+	// Reinstated users must log in again
+	if err := svc.SetSuspended(userID, false); err != nil {
+		t.Fatalf("SetSuspended: %v", err)
+	}
+	if _, err := svc.Authorize(claims); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("Authorize error = %v, want ErrSessionRevoked", err)
+	}
+
+	token, err = svc.Login("peggy", "password123", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Login after reinstatement: %v", err)
+	}
+	claims, _ = svc.ValidateToken(token)
+	if err := svc.RevokeSessions(userID); err != nil {
+		t.Fatalf("RevokeSessions: %v", err)
+	}
+	if _, err := svc.Authorize(claims); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("Authorize error = %v, want ErrSessionRevoked", err)
+	}
+
+	if err := svc.RevokeSessions(9999); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("RevokeSessions(unknown) = %v, want ErrUserNotFound", err)
+	}
+}
@@ -1,35 +1,59 @@
 package auth
 
 import (
-	"database/sql"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/store"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Service struct {
-	db        *sql.DB
+	store     *store.Store
 	jwtSecret string
+	webauthn  *webauthn.WebAuthn
+	lockout   LockoutPolicy
+
+	registrationMode string
+
+	// Unix nanoseconds of the last pruneLoginRecords run
+	lastLoginPrune atomic.Int64
 }
 
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
+	UserID       int    `json:"user_id"`
+	Username     string `json:"username"`
+	TokenVersion int    `json:"token_version"`
 	jwt.RegisteredClaims
 }
 
-func New(db *sql.DB, jwtSecret string) *Service {
+func New(database *db.DB, jwtSecret string) *Service {
 	return &Service{
-		db:        db,
+		store:     store.New(database),
 		jwtSecret: jwtSecret,
+		lockout:   DefaultLockoutPolicy,
 	}
 }
 
 func (s *Service) Register(username, password string) (int, error) {
+	return s.RegisterWithInvite(username, password, "")
+}
+
+// RegisterWithInvite creates a user, enforcing the registration mode. In
+// invite mode one use of inviteCode is consumed together with the insert.
+func (s *Service) RegisterWithInvite(username, password, inviteCode string) (int, error) {
+	mode := s.RegistrationMode()
+	if mode == RegistrationClosed {
+		return 0, ErrRegistrationClosed
+	}
+
 	// Validate inputs
 	username = strings.TrimSpace(username)
 	if len(username) < 3 || len(username) > 32 {
@@ -45,59 +69,81 @@ func (s *Service) Register(username, password string) (int, error) {
 		return 0, fmt.Errorf("password must be at least 6 characters")
 	}
 
+	var code string
+	if mode == RegistrationInvite {
+		if code = strings.TrimSpace(inviteCode); code == "" {
+			return 0, ErrInviteRequired
+		}
+	}
+
 	// Hash password
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return 0, fmt.Errorf("failed to hash password: %w", err)
 	}
 
-	// Insert user
-	result, err := s.db.Exec(
-		"INSERT INTO users (username, password_hash) VALUES (?, ?)",
-		username,
-		string(hash),
-	)
-	if err != nil {
-		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
-			return 0, fmt.Errorf("username already exists")
-		}
+	id, err := s.store.Users.Create(store.NewUser{Username: username, PasswordHash: string(hash), InviteCode: code})
+	switch {
+	case errors.Is(err, store.ErrInvalidInvite):
+		return 0, ErrInvalidInvite
+	case errors.Is(err, store.ErrDuplicate):
+		return 0, fmt.Errorf("username already exists")
+	case err != nil:
 		return 0, fmt.Errorf("failed to register user: %w", err)
 	}
 
-	id, err := result.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get user id: %w", err)
-	}
-
-	return int(id), nil
+	return id, nil
 }
 
-func (s *Service) Login(username, password string) (string, error) {
+// Login verifies a username and password. Repeated failures lock the
+// username according to the lockout policy and are recorded with clientIP.
+func (s *Service) Login(username, password, clientIP string) (string, error) {
 	username = strings.TrimSpace(username)
 
-	// Get user by username
-	var userID int
-	var passwordHash string
-
-	err := s.db.QueryRow(
-		"SELECT id, password_hash FROM users WHERE username = ?",
-		username,
-	).Scan(&userID, &passwordHash)
+	retryAfter, err := s.lockedFor(username)
+	if err != nil {
+		return "", err
+	}
+	if retryAfter > 0 {
+		s.auditLoginFailure(username, clientIP, loginFailureLocked)
+		return "", &LockoutError{RetryAfter: retryAfter}
+	}
 
+	user, err := s.store.Users.GetByUsername(username)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, store.ErrNotFound) {
+			compareDummyHash(password)
+			if err := s.registerLoginFailure(username, clientIP, loginFailureUnknownUser); err != nil {
+				return "", err
+			}
 			return "", fmt.Errorf("invalid username or password")
 		}
 		return "", fmt.Errorf("failed to query user: %w", err)
 	}
 
 	// Verify password
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		if err := s.registerLoginFailure(username, clientIP, loginFailureBadPassword); err != nil {
+			return "", err
+		}
 		return "", fmt.Errorf("invalid username or password")
 	}
+	if user.SuspendedAt != nil {
+		return "", ErrAccountSuspended
+	}
+
+	// Accounts with a passkey second factor finish login via FinishPasskeyLogin,
+	// which clears the failure counter once both factors passed
+	if user.PasskeyRequired {
+		if s.webauthn == nil {
+			return "", ErrSecondFactorUnavailable
+		}
+		return "", s.beginSecondFactor(user.ID)
+	}
+	s.clearLoginFailures(username)
 
 	// Generate JWT token
-	token, err := s.GenerateToken(userID, username)
+	token, err := s.GenerateToken(user.ID, username)
 	if err != nil {
 		return "", fmt.Errorf("failed to generate token: %w", err)
 	}
@@ -105,10 +151,24 @@ func (s *Service) Login(username, password string) (string, error) {
 	return token, nil
 }
 
+// GenerateToken issues a JWT bound to the user's current token version, so
+// RevokeSessions invalidates it. Suspended users get ErrAccountSuspended.
 func (s *Service) GenerateToken(userID int, username string) (string, error) {
+	user, err := s.store.Users.Get(userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return "", ErrUserNotFound
+		}
+		return "", fmt.Errorf("failed to query user: %w", err)
+	}
+	if user.SuspendedAt != nil {
+		return "", ErrAccountSuspended
+	}
+
 	claims := Claims{
-		UserID:   userID,
-		Username: username,
+		UserID:       userID,
+		Username:     username,
+		TokenVersion: user.TokenVersion,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(30 * 24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -145,21 +205,19 @@ func (s *Service) ValidateToken(tokenString string) (*Claims, error) {
 }
 
 func (s *Service) GetUserByUsername(username string) (int, error) {
-	var userID int
-	err := s.db.QueryRow("SELECT id FROM users WHERE username = ?", username).Scan(&userID)
+	user, err := s.store.Users.GetByUsername(username)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("user not found")
+		if errors.Is(err, store.ErrNotFound) {
+			return 0, ErrUserNotFound
 		}
 		return 0, fmt.Errorf("failed to query user: %w", err)
 	}
-	return userID, nil
+	return user.ID, nil
 }
 
 // UserExists checks if a user with the given ID exists
 func (s *Service) UserExists(userID int) (bool, error) {
-	var exists bool
-	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists)
+	exists, err := s.store.Users.Exists(userID)
 	if err != nil {
 		return false, fmt.Errorf("failed to query user: %w", err)
 	}
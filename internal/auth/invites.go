@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/4xmen/payambar/internal/store"
+)
+
+// Registration modes
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+const (
+	// DefaultInviteTTL applies when an invite is minted without an expiry
+	DefaultInviteTTL = 7 * 24 * time.Hour
+	MaxInviteTTL     = 30 * 24 * time.Hour
+	MaxInviteUses    = 100
+)
+
+var (
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrInviteRequired     = errors.New("invite code required")
+	ErrInvalidInvite      = errors.New("invalid or expired invite code")
+)
+
+type Invite = store.Invite
+
+// SetRegistrationMode sets whether Register is open, needs an invite, or is closed.
+func (s *Service) SetRegistrationMode(mode string) error {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		mode = RegistrationOpen
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+	default:
+		return fmt.Errorf("unknown registration mode: %s", mode)
+	}
+	s.registrationMode = mode
+	return nil
+}
+
+// RegistrationMode returns the configured registration mode.
+func (s *Service) RegistrationMode() string {
+	if s.registrationMode == "" {
+		return RegistrationOpen
+	}
+	return s.registrationMode
+}
+
+// CreateInvite mints an invite code. createdBy is nil for invites created
+// by the operator from the CLI.
+func (s *Service) CreateInvite(createdBy *int, maxUses int, ttl time.Duration) (*Invite, error) {
+	if maxUses < 1 || maxUses > MaxInviteUses {
+		return nil, fmt.Errorf("max uses must be between 1 and %d", MaxInviteUses)
+	}
+	if ttl <= 0 {
+		ttl = DefaultInviteTTL
+	}
+	if ttl > MaxInviteTTL {
+		return nil, fmt.Errorf("invite expiry cannot exceed 30 days")
+	}
+
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, fmt.Errorf("failed to generate invite code: %w", err)
+	}
+
+	invite := &Invite{
+		Code:      base64.RawURLEncoding.EncodeToString(raw),
+		CreatedBy: createdBy,
+		MaxUses:   maxUses,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	if err := s.store.Invites.Create(invite); err != nil {
+		return nil, fmt.Errorf("failed to create invite: %w", err)
+	}
+
+	return invite, nil
+}
+
+// ListInvites returns the invites minted by a user, newest first.
+func (s *Service) ListInvites(createdBy int) ([]Invite, error) {
+	invites, err := s.store.Invites.ListBy(createdBy)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch invites: %w", err)
+	}
+	return invites, nil
+}
+
+// RevokeInvite disables one of the user's invites.
+func (s *Service) RevokeInvite(createdBy, inviteID int) error {
+	err := s.store.Invites.Revoke(inviteID, createdBy, time.Now().UTC())
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("invite not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to revoke invite: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRegistrationModes(t *testing.T) {
+	svc := setupPasskeyService(t)
+
+	if err := svc.SetRegistrationMode("bogus"); err == nil {
+		t.Fatal("expected unknown registration mode to fail")
+	}
+
+	if err := svc.SetRegistrationMode(RegistrationClosed); err != nil {
+		t.Fatalf("SetRegistrationMode: %v", err)
+	}
+	if _, err := svc.Register("frank", "password123"); !errors.Is(err, ErrRegistrationClosed) {
+		t.Fatalf("closed Register error = %v, want ErrRegistrationClosed", err)
+	}
+
+	if err := svc.SetRegistrationMode(RegistrationInvite); err != nil {
+		t.Fatalf("SetRegistrationMode: %v", err)
+	}
+	if _, err := svc.Register("frank", "password123"); !errors.Is(err, ErrInviteRequired) {
+		t.Fatalf("invite Register error = %v, want ErrInviteRequired", err)
+	}
+	if _, err := svc.RegisterWithInvite("frank", "password123", "not-a-code"); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("bad code error = %v, want ErrInvalidInvite", err)
+	}
+}
+
+func TestInviteRedemption(t *testing.T) {
+	svc, database := setupPasskeyServiceDB(t)
+	ownerID, err := svc.Register("grace", "password123")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	svc.SetRegistrationMode(RegistrationInvite)
+
+	single, err := svc.CreateInvite(&ownerID, 1, 0)
+	if err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+	userID, err := svc.RegisterWithInvite("heidi", "password123", single.Code)
+	if err != nil {
+		t.Fatalf("RegisterWithInvite: %v", err)
+	}
+	var inviteID int
+	database.QueryRow("SELECT invite_id FROM users WHERE id = $1", userID).Scan(&inviteID)
+	if inviteID != single.ID {
+		t.Fatalf("invite_id = %d, want %d", inviteID, single.ID)
+	}
+	if _, err := svc.RegisterWithInvite("ivan", "password123", single.Code); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("reused single-use invite error = %v, want ErrInvalidInvite", err)
+	}
+
+	// A failed registration must not burn a use
+	multi, _ := svc.CreateInvite(&ownerID, 2, 0)
+	if _, err := svc.RegisterWithInvite("heidi", "password123", multi.Code); err == nil {
+		t.Fatal("expected duplicate username to fail")
+	}
+	for _, username := range []string{"judy", "mallory"} {
+		if _, err := svc.RegisterWithInvite(username, "password123", multi.Code); err != nil {
+			t.Fatalf("RegisterWithInvite(%s): %v", username, err)
+		}
+	}
+	if _, err := svc.RegisterWithInvite("niaj", "password123", multi.Code); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("exhausted invite error = %v, want ErrInvalidInvite", err)
+	}
+
+	expired, _ := svc.CreateInvite(&ownerID, 1, time.Hour)
+	database.Exec("UPDATE invites SET expires_at = $1 WHERE id = $2", time.Now().UTC().Add(-time.Minute), expired.ID)
+	if _, err := svc.RegisterWithInvite("olivia", "password123", expired.Code); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("expired invite error = %v, want ErrInvalidInvite", err)
+	}
+
+	revoked, _ := svc.CreateInvite(&ownerID, 1, 0)
+	if err := svc.RevokeInvite(ownerID, revoked.ID); err != nil {
+		t.Fatalf("RevokeInvite: %v", err)
+	}
+	if _, err := svc.RegisterWithInvite("olivia", "password123", revoked.Code); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("revoked invite error = %v, want ErrInvalidInvite", err)
+	}
+
+	invites, err := svc.ListInvites(ownerID)
+	if err != nil {
+		t.Fatalf("ListInvites: %v", err)
+	}
+	if len(invites) != 4 {
+		t.Fatalf("ListInvites returned %d invites, want 4", len(invites))
+	}
+}
+
+func TestCreateInviteLimits(t *testing.T) {
+	svc := setupPasskeyService(t)
+
+	if _, err := svc.CreateInvite(nil, 0, 0); err == nil {
+		t.Fatal("expected zero max uses to fail")
+	}
+	if _, err := svc.CreateInvite(nil, MaxInviteUses+1, 0); err == nil {
+		t.Fatal("expected too many uses to fail")
+	}
+	if _, err := svc.CreateInvite(nil, 1, MaxInviteTTL+time.Hour); err == nil {
+		t.Fatal("expected too long expiry to fail")
+	}
+	invite, err := svc.CreateInvite(nil, 1, 0)
+	if err != nil {
+		t.Fatalf("CreateInvite: %v", err)
+	}
+	if invite.CreatedBy != nil {
+		t.Fatalf("operator invite CreatedBy = %v, want nil", *invite.CreatedBy)
+	}
+	if time.Until(invite.ExpiresAt) > DefaultInviteTTL {
+		t.Fatalf("default expiry too far: %v", invite.ExpiresAt)
+	}
+}
@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrAccountLocked is matched by LockoutError via errors.Is.
+var ErrAccountLocked = errors.New("too many failed login attempts, try again later")
+
+const (
+	// Failure counters start over once a username has been quiet this long
+	lockoutResetWindow = 24 * time.Hour
+	// Failed login audit rows are kept for this long
+	loginAuditRetention = 30 * 24 * time.Hour
+	// Stale counters and audit rows are pruned at most this often
+	loginPruneInterval = 10 * time.Minute
+)
+
+// Reasons recorded in the failed login audit trail
+const (
+	loginFailureUnknownUser = "unknown_user"
+	loginFailureBadPassword = "bad_password"
+	loginFailureLocked      = "locked"
+)
+
+// LockoutPolicy controls per-username lockouts after repeated failed logins.
+// Once Threshold consecutive failures are reached the username is locked for
+// BaseDelay, doubling with every further failure up to MaxDelay.
+type LockoutPolicy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// DefaultLockoutPolicy is used unless ConfigureLockout is called.
+var DefaultLockoutPolicy = LockoutPolicy{
+	Threshold: 5,
+	BaseDelay: time.Minute,
+	MaxDelay:  time.Hour,
+}
+
+// LockoutError is returned by Login while a username is locked.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return ErrAccountLocked.Error()
+}
+
+func (e *LockoutError) Is(target error) bool {
+	return target == ErrAccountLocked
+}
+
+// ConfigureLockout replaces the lockout policy. A threshold of zero or less
+// disables lockouts; failed logins are still audited.
+func (s *Service) ConfigureLockout(policy LockoutPolicy) {
+	if policy.BaseDelay <= 0 {
+		policy.BaseDelay = DefaultLockoutPolicy.BaseDelay
+	}
+	if policy.MaxDelay < policy.BaseDelay {
+		policy.MaxDelay = policy.BaseDelay
+	}
+	s.lockout = policy
+}
+
+// delay returns how long a username stays locked after failures consecutive failures.
+func (p LockoutPolicy) delay(failures int) time.Duration {
+	if p.Threshold <= 0 || failures < p.Threshold {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.Threshold; i < failures; i++ {
+		delay *= 2
+		if delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	return delay
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// compareDummyHash spends the same bcrypt work as a real password check so
+// unknown usernames can't be told apart by response time.
+func compareDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("payambar-unknown-user"), bcrypt.DefaultCost)
+	})
+	bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// lockedFor returns the remaining lockout for username, or zero.
+func (s *Service) lockedFor(username string) (time.Duration, error) {
+	lockedUntil, err := s.store.Lockouts.LockedUntil(username)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query lockout: %w", err)
+	}
+	if lockedUntil == nil {
+		return 0, nil
+	}
+	remaining := time.Until(*lockedUntil)
+	if remaining <= 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
+// registerLoginFailure audits a failed attempt and advances the username's
+// failure counter, locking it once the policy threshold is reached.
+func (s *Service) registerLoginFailure(username, clientIP, reason string) error {
+	s.auditLoginFailure(username, clientIP, reason)
+	now := time.Now().UTC()
+	s.pruneLoginRecords(now)
+
+	if err := s.store.Lockouts.RecordFailure(username, now, lockoutResetWindow, s.lockout.delay); err != nil {
+		return fmt.Errorf("failed to record login failure: %w", err)
+	}
+	return nil
+}
+
+// clearLoginFailures resets the failure counter after a successful login.
+func (s *Service) clearLoginFailures(username string) {
+	s.store.Lockouts.Clear(username)
+}
+
+// pruneLoginRecords drops counters that have reset and are no longer locked,
+// so guessed usernames don't accumulate rows forever, along with expired audit
+// rows. It runs at most once per loginPruneInterval so a flood of failed
+// logins doesn't turn into a flood of deletes.
+func (s *Service) pruneLoginRecords(now time.Time) {
+	last := s.lastLoginPrune.Load()
+	if now.UnixNano()-last < int64(loginPruneInterval) || !s.lastLoginPrune.CompareAndSwap(last, now.UnixNano()) {
+		return
+	}
+	s.store.Lockouts.Prune(now, lockoutResetWindow, loginAuditRetention)
+}
+
+func (s *Service) auditLoginFailure(username, clientIP, reason string) {
+	s.store.Lockouts.Audit(username, clientIP, reason, time.Now().UTC())
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: 0},
+		{failures: 2, want: 0},
+		{failures: 3, want: time.Minute},
+		{failures: 4, want: 2 * time.Minute},
+		{failures: 5, want: 4 * time.Minute},
+		{failures: 6, want: 8 * time.Minute},
+		{failures: 7, want: 10 * time.Minute},
+		{failures: 50, want: 10 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := policy.delay(tt.failures); got != tt.want {
+			t.Fatalf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	if got := (LockoutPolicy{}).delay(100); got != 0 {
+		t.Fatalf("disabled policy delay = %v, want 0", got)
+	}
+}
+
+func TestLoginLockoutAndReset(t *testing.T) {
+	svc, database := setupPasskeyServiceDB(t)
+	svc.ConfigureLockout(LockoutPolicy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour})
+	if _, err := svc.Register("erin", "password123"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	// A success clears earlier failures
+	svc.Login("erin", "wrong-password", "10.0.0.1")
+	if _, err := svc.Login("erin", "password123", "10.0.0.1"); err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	svc.Login("erin", "wrong-password", "10.0.0.1")
+	if _, err := svc.Login("erin", "password123", "10.0.0.1"); err != nil {
+		t.Fatalf("Login after reset: %v", err)
+	}
+
+	svc.Login("erin", "wrong-password", "10.0.0.1")
+	svc.Login("erin", "wrong-password", "10.0.0.2")
+
+	_, err := svc.Login("erin", "password123", "10.0.0.3")
+	var lockoutErr *LockoutError
+	if !errors.As(err, &lockoutErr) || !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("Login error = %v, want LockoutError", err)
+	}
+	if lockoutErr.RetryAfter <= 0 || lockoutErr.RetryAfter > time.Minute {
+		t.Fatalf("RetryAfter = %v, want within (0, 1m]", lockoutErr.RetryAfter)
+	}
+
+	// Lockout expires, but the next failure doubles the delay
+	database.Exec("UPDATE login_lockouts SET locked_until = $1 WHERE username = $2", time.Now().UTC().Add(-time.Second), "erin")
+	svc.Login("erin", "wrong-password", "10.0.0.1")
+	_, err = svc.Login("erin", "password123", "10.0.0.1")
+	if !errors.As(err, &lockoutErr) || lockoutErr.RetryAfter <= time.Minute {
+		t.Fatalf("Login error = %v, want doubled lockout", err)
+	}
+
+	var locked int
+	database.QueryRow("SELECT COUNT(*) FROM login_failures WHERE username = $1 AND reason = 'locked'", "erin").Scan(&locked)
+	if locked != 2 {
+		t.Fatalf("locked audit rows = %d, want 2", locked)
+	}
+}
+
+func TestLoginLockoutPrunesStaleRecords(t *testing.T) {
+	svc, database := setupPasskeyServiceDB(t)
+
+	// The first failure prunes; with nothing stale it removes nothing
+	svc.Login("ghost", "wrong-password", "10.0.0.1")
+	stale := time.Now().UTC().Add(-lockoutResetWindow - time.Minute)
+	database.Exec("UPDATE login_lockouts SET last_failed_at = $1 WHERE username = $2", stale, "ghost")
+	database.Exec("UPDATE login_failures SET created_at = $1 WHERE username = $2", time.Now().UTC().Add(-loginAuditRetention-time.Minute), "ghost")
+
+	countRows := func() (ghosts, phantoms, audits int) {
+		database.QueryRow("SELECT COUNT(*) FROM login_lockouts WHERE username = $1", "ghost").Scan(&ghosts)
+		database.QueryRow("SELECT COUNT(*) FROM login_lockouts WHERE username = $1", "phantom").Scan(&phantoms)
+		database.QueryRow("SELECT COUNT(*) FROM login_failures WHERE username = $1", "ghost").Scan(&audits)
+		return
+	}
+
+	// Within the prune interval further failures leave stale rows alone
+	svc.Login("phantom", "wrong-password", "10.0.0.1")
+	if ghosts, phantoms, audits := countRows(); ghosts != 1 || phantoms != 1 || audits != 1 {
+		t.Fatalf("rows before the interval: ghost = %d, phantom = %d, audit = %d, want 1, 1 and 1", ghosts, phantoms, audits)
+	}
+
+	svc.lastLoginPrune.Store(time.Now().Add(-loginPruneInterval).UnixNano())
+	svc.Login("phantom", "wrong-password", "10.0.0.1")
+	if ghosts, phantoms, audits := countRows(); ghosts != 0 || phantoms != 1 || audits != 0 {
+		t.Fatalf("rows after the interval: ghost = %d, phantom = %d, audit = %d, want 0, 1 and 0", ghosts, phantoms, audits)
+	}
+}
+
+func TestLoginLockoutCountsConcurrentFailures(t *testing.T) {
+	svc, database := setupPasskeyServiceDB(t)
+	svc.ConfigureLockout(LockoutPolicy{Threshold: 100, BaseDelay: time.Minute, MaxDelay: time.Hour})
+
+	const attempts = 20
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := svc.registerLoginFailure("ghost", "10.0.0.1", loginFailureUnknownUser); err != nil {
+				t.Errorf("registerLoginFailure: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failures int
+	database.QueryRow("SELECT failed_count FROM login_lockouts WHERE username = $1", "ghost").Scan(&failures)
+	if failures != attempts {
+		t.Fatalf("failed_count = %d, want %d", failures, attempts)
+	}
+}
@@ -0,0 +1,534 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4xmen/payambar/internal/store"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	ceremonyRegister     = "register"
+	ceremonyLogin        = "login"
+	ceremonySecondFactor = "second_factor"
+
+	// passkeySessionTTL bounds how long a begun ceremony can be finished.
+	passkeySessionTTL = 5 * time.Minute
+
+	loginFailureBadPasskey = "bad_passkey"
+)
+
+var (
+	// ErrPasskeysDisabled is returned when no relying party is configured.
+	ErrPasskeysDisabled = errors.New("passkeys not configured")
+	// ErrPasskeyRequired is returned by Login when the password was correct
+	// but the account requires a passkey assertion as a second factor.
+	ErrPasskeyRequired = errors.New("passkey verification required")
+	// ErrPasswordRequired is returned for a passwordless login by an account
+	// whose passkey is a second factor rather than a replacement.
+	ErrPasswordRequired = errors.New("password required for this account")
+	// ErrSecondFactorUnavailable is returned by Login for an account that
+	// requires a passkey while no relying party is configured, rather than
+	// letting the password alone through.
+	ErrSecondFactorUnavailable = errors.New("passkey required but passkeys are not configured")
+	ErrInvalidPreAuth          = errors.New("invalid or expired pre-auth token")
+)
+
+// PasskeyRequiredError is returned by Login once the password was verified
+// for an account with the passkey second factor. The assertion must be
+// finished with FinishPasskeyLogin together with PreAuthToken, which ties
+// the ceremony to this password step.
+type PasskeyRequiredError struct {
+	Assertion    *protocol.CredentialAssertion
+	SessionID    string
+	PreAuthToken string
+}
+
+func (e *PasskeyRequiredError) Error() string {
+	return ErrPasskeyRequired.Error()
+}
+
+func (e *PasskeyRequiredError) Is(target error) bool {
+	return target == ErrPasskeyRequired
+}
+
+// preAuthClaims are signed with a key derived from the JWT secret so a
+// pre-auth token can never pass ValidateToken as a session.
+type preAuthClaims struct {
+	UserID    int    `json:"uid"`
+	SessionID string `json:"sid"`
+	jwt.RegisteredClaims
+}
+
+// Passkey is a registered WebAuthn credential as shown to its owner.
+type Passkey = store.Passkey
+
+// passkeyUser adapts a users row to webauthn.User.
+type passkeyUser struct {
+	id          int
+	username    string
+	displayName string
+	credentials []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return userHandle(u.id) }
+func (u *passkeyUser) WebAuthnName() string                       { return u.username }
+func (u *passkeyUser) WebAuthnDisplayName() string                { return u.displayName }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+func userHandle(userID int) []byte {
+	return []byte(strconv.Itoa(userID))
+}
+
+// ConfigurePasskeys enables WebAuthn ceremonies for the given relying party.
+func (s *Service) ConfigurePasskeys(rpID, rpName string, rpOrigins []string) error {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     rpOrigins,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to configure webauthn: %w", err)
+	}
+	s.webauthn = w
+	return nil
+}
+
+// PasskeysEnabled reports whether ConfigurePasskeys succeeded.
+func (s *Service) PasskeysEnabled() bool {
+	return s.webauthn != nil
+}
+
+// BeginPasskeyRegistration starts a registration ceremony for userID and
+// returns the creation options for navigator.credentials.create together
+// with the id of the stored challenge.
+func (s *Service) BeginPasskeyRegistration(userID int) (*protocol.CredentialCreation, string, error) {
+	if s.webauthn == nil {
+		return nil, "", ErrPasskeysDisabled
+	}
+
+	user, err := s.loadPasskeyUser(userID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	exclusions := webauthn.Credentials(user.credentials).CredentialDescriptors()
+	creation, session, err := s.webauthn.BeginRegistration(user,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+	)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to begin registration: %w", err)
+	}
+
+	sessionID, err := s.saveCeremony(userID, ceremonyRegister, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return creation, sessionID, nil
+}
+
+// FinishPasskeyRegistration verifies the attestation response for a
+// registration ceremony begun by the same user and stores the credential.
+func (s *Service) FinishPasskeyRegistration(userID int, sessionID, name string, response []byte) (*Passkey, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysDisabled
+	}
+
+	sessionUserID, session, err := s.consumeCeremony(sessionID, ceremonyRegister)
+	if err != nil {
+		return nil, err
+	}
+	if sessionUserID != userID {
+		return nil, fmt.Errorf("invalid passkey session")
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(response)
+	if err != nil {
+		return nil, fmt.Errorf("invalid passkey response")
+	}
+
+	user, err := s.loadPasskeyUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.webauthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("passkey verification failed")
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+
+	id, err := s.store.Passkeys.Add(userID, name, store.Credential{
+		CredentialID:    encodeCredentialID(credential.ID),
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+		Transports:      strings.Join(transports, ","),
+	})
+	if err != nil {
+		if errors.Is(err, store.ErrDuplicate) {
+			return nil, fmt.Errorf("passkey already registered")
+		}
+		return nil, fmt.Errorf("failed to save passkey: %w", err)
+	}
+
+	return &Passkey{ID: id, Name: name, CreatedAt: time.Now()}, nil
+}
+
+// BeginPasskeyLogin starts an assertion ceremony. With an empty username the
+// ceremony is discoverable and the authenticator chooses the account;
+// otherwise only that user's credentials are allowed.
+func (s *Service) BeginPasskeyLogin(username string) (*protocol.CredentialAssertion, string, error) {
+	if s.webauthn == nil {
+		return nil, "", ErrPasskeysDisabled
+	}
+
+	username = strings.TrimSpace(username)
+	if username == "" {
+		assertion, session, err := s.webauthn.BeginDiscoverableLogin()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to begin login: %w", err)
+		}
+		sessionID, err := s.saveCeremony(0, ceremonyLogin, session)
+		if err != nil {
+			return nil, "", err
+		}
+		return assertion, sessionID, nil
+	}
+
+	userID, err := s.GetUserByUsername(username)
+	if err != nil {
+		return nil, "", fmt.Errorf("no passkeys registered")
+	}
+	user, err := s.loadPasskeyUser(userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(user.credentials) == 0 {
+		return nil, "", fmt.Errorf("no passkeys registered")
+	}
+
+	assertion, session, err := s.webauthn.BeginLogin(user)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to begin login: %w", err)
+	}
+	sessionID, err := s.saveCeremony(userID, ceremonyLogin, session)
+	if err != nil {
+		return nil, "", err
+	}
+	return assertion, sessionID, nil
+}
+
+// beginSecondFactor starts the assertion ceremony that completes a password
+// login and signs a pre-auth token bound to it.
+func (s *Service) beginSecondFactor(userID int) error {
+	user, err := s.loadPasskeyUser(userID)
+	if err != nil {
+		return err
+	}
+	assertion, session, err := s.webauthn.BeginLogin(user)
+	if err != nil {
+		return fmt.Errorf("failed to begin login: %w", err)
+	}
+	sessionID, err := s.saveCeremony(userID, ceremonySecondFactor, session)
+	if err != nil {
+		return err
+	}
+
+	claims := preAuthClaims{
+		UserID:    userID,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(passkeySessionTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.preAuthKey())
+	if err != nil {
+		return fmt.Errorf("failed to sign token: %w", err)
+	}
+
+	return &PasskeyRequiredError{Assertion: assertion, SessionID: sessionID, PreAuthToken: token}
+}
+
+func (s *Service) preAuthKey() []byte {
+	return []byte(s.jwtSecret + ":passkey-preauth")
+}
+
+func (s *Service) parsePreAuthToken(tokenString string) (*preAuthClaims, error) {
+	claims := &preAuthClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return s.preAuthKey(), nil
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidPreAuth
+	}
+	return claims, nil
+}
+
+// FinishPasskeyLogin verifies an assertion response and, on success, returns
+// a JWT for the credential's owner. A non-empty preAuthToken finishes the
+// second factor begun by Login; without one the login is passwordless, which
+// accounts with the second factor on are refused. Failed assertions count
+// towards the username's lockout like failed passwords. Sign counters that
+// fail to advance are treated as a cloned authenticator and rejected.
+func (s *Service) FinishPasskeyLogin(sessionID string, response []byte, preAuthToken, clientIP string) (string, int, string, error) {
+	if s.webauthn == nil {
+		return "", 0, "", ErrPasskeysDisabled
+	}
+
+	ceremony := ceremonyLogin
+	preAuthUserID := 0
+	if preAuthToken != "" {
+		claims, err := s.parsePreAuthToken(preAuthToken)
+		if err != nil {
+			return "", 0, "", err
+		}
+		if claims.SessionID != sessionID {
+			return "", 0, "", ErrInvalidPreAuth
+		}
+		ceremony = ceremonySecondFactor
+		preAuthUserID = claims.UserID
+	}
+
+	sessionUserID, session, err := s.consumeCeremony(sessionID, ceremony)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if ceremony == ceremonySecondFactor && sessionUserID != preAuthUserID {
+		return "", 0, "", ErrInvalidPreAuth
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(response)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("invalid passkey response")
+	}
+
+	var (
+		user       *passkeyUser
+		credential *webauthn.Credential
+	)
+	if sessionUserID > 0 {
+		user, err = s.loadPasskeyUser(sessionUserID)
+		if err != nil {
+			return "", 0, "", err
+		}
+		credential, err = s.webauthn.ValidateLogin(user, *session, parsed)
+	} else {
+		credential, err = s.webauthn.ValidateDiscoverableLogin(func(rawID, handle []byte) (webauthn.User, error) {
+			id, convErr := strconv.Atoi(string(handle))
+			if convErr != nil {
+				return nil, fmt.Errorf("unknown user handle")
+			}
+			user, convErr = s.loadPasskeyUser(id)
+			return user, convErr
+		}, *session, parsed)
+	}
+
+	if user != nil {
+		retryAfter, lockErr := s.lockedFor(user.username)
+		if lockErr != nil {
+			return "", 0, "", lockErr
+		}
+		if retryAfter > 0 {
+			s.auditLoginFailure(user.username, clientIP, loginFailureLocked)
+			return "", 0, "", &LockoutError{RetryAfter: retryAfter}
+		}
+	}
+	if err == nil && credential.Authenticator.CloneWarning {
+		err = fmt.Errorf("clone warning")
+	}
+	if err != nil {
+		if user != nil {
+			if err := s.registerLoginFailure(user.username, clientIP, loginFailureBadPasskey); err != nil {
+				return "", 0, "", err
+			}
+		}
+		return "", 0, "", fmt.Errorf("passkey verification failed")
+	}
+
+	if err := s.store.Passkeys.Touch(user.id, encodeCredentialID(credential.ID), credential.Authenticator.SignCount, credential.Flags.BackupState); err != nil {
+		return "", 0, "", fmt.Errorf("failed to update passkey: %w", err)
+	}
+
+	if ceremony == ceremonyLogin {
+		required, err := s.PasskeyRequired(user.id)
+		if err != nil {
+			return "", 0, "", err
+		}
+		if required {
+			return "", 0, "", ErrPasswordRequired
+		}
+	}
+
+	token, err := s.GenerateToken(user.id, user.username)
+	if errors.Is(err, ErrAccountSuspended) {
+		return "", 0, "", err
+	}
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	s.clearLoginFailures(user.username)
+	return token, user.id, user.username, nil
+}
+
+// ListPasskeys returns the passkeys registered by userID.
+func (s *Service) ListPasskeys(userID int) ([]Passkey, error) {
+	passkeys, err := s.store.Passkeys.List(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch passkeys: %w", err)
+	}
+	return passkeys, nil
+}
+
+// DeletePasskey removes one of userID's passkeys. Removing the last passkey
+// also turns off the passkey second factor so the account stays reachable.
+func (s *Service) DeletePasskey(userID, passkeyID int) error {
+	err := s.store.Passkeys.Delete(userID, passkeyID)
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("passkey not found")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete passkey: %w", err)
+	}
+	return nil
+}
+
+// SetPasskeyRequired toggles whether password logins must be completed with
+// a passkey assertion.
+func (s *Service) SetPasskeyRequired(userID int, required bool) error {
+	if required {
+		count, err := s.store.Passkeys.Count(userID)
+		if err != nil {
+			return fmt.Errorf("failed to fetch passkeys: %w", err)
+		}
+		if count == 0 {
+			return fmt.Errorf("no passkeys registered")
+		}
+	}
+
+	if err := s.store.Users.SetPasskeyRequired(userID, required); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	return nil
+}
+
+// PasskeyRequired reports whether userID has the passkey second factor on.
+func (s *Service) PasskeyRequired(userID int) (bool, error) {
+	user, err := s.store.Users.Get(userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to query user: %w", err)
+	}
+	return user.PasskeyRequired, nil
+}
+
+func (s *Service) loadPasskeyUser(userID int) (*passkeyUser, error) {
+	u, err := s.store.Users.Get(userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, fmt.Errorf("failed to query user: %w", err)
+	}
+	user := &passkeyUser{id: userID, username: u.Username, displayName: u.Name()}
+
+	credentials, err := s.store.Passkeys.Credentials(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch passkeys: %w", err)
+	}
+	for _, c := range credentials {
+		id, err := base64.RawURLEncoding.DecodeString(c.CredentialID)
+		if err != nil {
+			continue
+		}
+		cred := webauthn.Credential{
+			ID:              id,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+		}
+		cred.Authenticator.AAGUID = c.AAGUID
+		cred.Authenticator.SignCount = c.SignCount
+		cred.Flags.BackupEligible = c.BackupEligible
+		cred.Flags.BackupState = c.BackupState
+		for _, t := range strings.Split(c.Transports, ",") {
+			if t != "" {
+				cred.Transport = append(cred.Transport, protocol.AuthenticatorTransport(t))
+			}
+		}
+		user.credentials = append(user.credentials, cred)
+	}
+	return user, nil
+}
+
+// saveCeremony stores the challenge state of a begun ceremony and returns an
+// opaque id the client echoes back when finishing it.
+func (s *Service) saveCeremony(userID int, ceremony string, session *webauthn.SessionData) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", fmt.Errorf("failed to store passkey session: %w", err)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to store passkey session: %w", err)
+	}
+	sessionID := base64.RawURLEncoding.EncodeToString(buf)
+
+	if err := s.store.Passkeys.SaveSession(sessionID, userID, ceremony, string(data), time.Now().UTC().Add(passkeySessionTTL)); err != nil {
+		return "", fmt.Errorf("failed to store passkey session: %w", err)
+	}
+	return sessionID, nil
+}
+
+// consumeCeremony loads and deletes a stored ceremony so every challenge can
+// be answered at most once.
+func (s *Service) consumeCeremony(sessionID, ceremony string) (int, *webauthn.SessionData, error) {
+	stored, err := s.store.Passkeys.ConsumeSession(sessionID, ceremony)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil, fmt.Errorf("invalid passkey session")
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to load passkey session: %w", err)
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return 0, nil, fmt.Errorf("passkey session expired")
+	}
+
+	var session webauthn.SessionData
+	if err := json.Unmarshal([]byte(stored.Data), &session); err != nil {
+		return 0, nil, fmt.Errorf("failed to load passkey session: %w", err)
+	}
+	return stored.UserID, &session, nil
+}
+
+func encodeCredentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
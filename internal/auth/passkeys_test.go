@@ -0,0 +1,389 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/db/dbtest"
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	testRPID   = "chat.example.com"
+	testOrigin = "https://chat.example.com"
+)
+
+// softAuthenticator is a minimal ES256 platform authenticator producing
+// "none" attestations, enough to drive both WebAuthn ceremonies in tests.
+type softAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	signCount  uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softAuthenticator{key: key, credID: credID}
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony, challenge string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatalf("marshal client data: %v", err)
+	}
+	return data
+}
+
+func (a *softAuthenticator) create(t *testing.T, challenge string, userHandle []byte) []byte {
+	t.Helper()
+	a.userHandle = userHandle
+
+	ecdhKey, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		t.Fatalf("public key: %v", err)
+	}
+	point := ecdhKey.Bytes() // 0x04 || X || Y
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: point[1:33],
+		-3: point[33:],
+	})
+	if err != nil {
+		t.Fatalf("marshal cose key: %v", err)
+	}
+
+	rpHash := sha256.Sum256([]byte(testRPID))
+	authData := append([]byte{}, rpHash[:]...)
+	authData = append(authData, 0x45) // UP | UV | AT
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credID)))
+	authData = append(authData, a.credID...)
+	authData = append(authData, coseKey...)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatalf("marshal attestation: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(a.clientData(t, "webauthn.create", challenge)),
+			"attestationObject": b64(attestation),
+		},
+	})
+	return body
+}
+
+func (a *softAuthenticator) assert(t *testing.T, challenge string) []byte {
+	t.Helper()
+	a.signCount++
+
+	rpHash := sha256.Sum256([]byte(testRPID))
+	authData := append([]byte{}, rpHash[:]...)
+	authData = append(authData, 0x05) // UP | UV
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+
+	clientData := a.clientData(t, "webauthn.get", challenge)
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("sign assertion: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credID),
+		"rawId": b64(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(a.userHandle),
+		},
+	})
+	return body
+}
+
+func setupPasskeyService(t *testing.T) *Service {
+	t.Helper()
+	svc, _ := setupPasskeyServiceDB(t)
+	return svc
+}
+
+// setupPasskeyServiceDB also returns the database, for tests that inspect or
+// age rows directly.
+func setupPasskeyServiceDB(t *testing.T) (*Service, *db.DB) {
+	t.Helper()
+	database := dbtest.New(t)
+
+	svc := New(database, "test-jwt-secret")
+	if err := svc.ConfigurePasskeys(testRPID, "Payambar", []string{testOrigin}); err != nil {
+		t.Fatalf("ConfigurePasskeys: %v", err)
+	}
+	return svc, database
+}
+
+// registerPasskey runs a full registration ceremony for userID.
+func registerPasskey(t *testing.T, svc *Service, userID int) *softAuthenticator {
+	t.Helper()
+	creation, sessionID, err := svc.BeginPasskeyRegistration(userID)
+	if err != nil {
+		t.Fatalf("BeginPasskeyRegistration: %v", err)
+	}
+	authenticator := newSoftAuthenticator(t)
+	response := authenticator.create(t, creation.Response.Challenge.String(), []byte(strconv.Itoa(userID)))
+	if _, err := svc.FinishPasskeyRegistration(userID, sessionID, "laptop", response); err != nil {
+		t.Fatalf("FinishPasskeyRegistration: %v", err)
+	}
+	return authenticator
+}
+
+func loginWithPasskey(t *testing.T, svc *Service, authenticator *softAuthenticator, username string) (string, int, error) {
+	t.Helper()
+	assertion, sessionID, err := svc.BeginPasskeyLogin(username)
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %v", err)
+	}
+	token, userID, _, err := svc.FinishPasskeyLogin(sessionID, authenticator.assert(t, assertion.Response.Challenge.String()), "", "127.0.0.1")
+	return token, userID, err
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	svc, database := setupPasskeyServiceDB(t)
+	userID, err := svc.Register("alice", "password123")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	authenticator := registerPasskey(t, svc, userID)
+
+	passkeys, err := svc.ListPasskeys(userID)
+	if err != nil {
+		t.Fatalf("ListPasskeys: %v", err)
+	}
+	if len(passkeys) != 1 || passkeys[0].Name != "laptop" {
+		t.Fatalf("unexpected passkeys: %+v", passkeys)
+	}
+
+	t.Run("username-first login", func(t *testing.T) {
+		token, gotID, err := loginWithPasskey(t, svc, authenticator, "alice")
+		if err != nil {
+			t.Fatalf("FinishPasskeyLogin: %v", err)
+		}
+		if gotID != userID {
+			t.Fatalf("user id = %d, want %d", gotID, userID)
+		}
+		claims, err := svc.ValidateToken(token)
+		if err != nil || claims.UserID != userID {
+			t.Fatalf("token not valid for user: %v", err)
+		}
+	})
+
+	t.Run("discoverable login", func(t *testing.T) {
+		_, gotID, err := loginWithPasskey(t, svc, authenticator, "")
+		if err != nil {
+			t.Fatalf("FinishPasskeyLogin: %v", err)
+		}
+		if gotID != userID {
+			t.Fatalf("user id = %d, want %d", gotID, userID)
+		}
+	})
+
+	var signCount uint32
+	database.QueryRow("SELECT sign_count FROM webauthn_credentials WHERE user_id = $1", userID).Scan(&signCount)
+	if signCount != authenticator.signCount {
+		t.Fatalf("stored sign_count = %d, want %d", signCount, authenticator.signCount)
+	}
+}
+
+func TestPasskeyRejectsSignCountRegression(t *testing.T) {
+	svc := setupPasskeyService(t)
+	userID, _ := svc.Register("bob", "password123")
+	authenticator := registerPasskey(t, svc, userID)
+
+	if _, _, err := loginWithPasskey(t, svc, authenticator, "bob"); err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+
+	// A cloned authenticator replays an older counter value
+	authenticator.signCount = 0
+	if _, _, err := loginWithPasskey(t, svc, authenticator, "bob"); err == nil {
+		t.Fatal("expected login with regressed sign count to fail")
+	}
+}
+
+func TestPasskeySessionIsSingleUse(t *testing.T) {
+	svc := setupPasskeyService(t)
+	userID, _ := svc.Register("carol", "password123")
+	authenticator := registerPasskey(t, svc, userID)
+
+	assertion, sessionID, err := svc.BeginPasskeyLogin("carol")
+	if err != nil {
+		t.Fatalf("BeginPasskeyLogin: %v", err)
+	}
+	challenge := assertion.Response.Challenge.String()
+	if _, _, _, err := svc.FinishPasskeyLogin(sessionID, authenticator.assert(t, challenge), "", "127.0.0.1"); err != nil {
+		t.Fatalf("FinishPasskeyLogin: %v", err)
+	}
+	if _, _, _, err := svc.FinishPasskeyLogin(sessionID, authenticator.assert(t, challenge), "", "127.0.0.1"); err == nil {
+		t.Fatal("expected replayed session to be rejected")
+	}
+}
+
+func TestPasskeySecondFactor(t *testing.T) {
+	svc := setupPasskeyService(t)
+	userID, _ := svc.Register("dave", "password123")
+
+	if err := svc.SetPasskeyRequired(userID, true); err == nil {
+		t.Fatal("expected enabling second factor without passkeys to fail")
+	}
+
+	authenticator := registerPasskey(t, svc, userID)
+	if err := svc.SetPasskeyRequired(userID, true); err != nil {
+		t.Fatalf("SetPasskeyRequired: %v", err)
+	}
+
+	login := func() *PasskeyRequiredError {
+		t.Helper()
+		_, err := svc.Login("dave", "password123", "127.0.0.1")
+		var passkeyErr *PasskeyRequiredError
+		if !errors.As(err, &passkeyErr) || !errors.Is(err, ErrPasskeyRequired) {
+			t.Fatalf("Login error = %v, want PasskeyRequiredError", err)
+		}
+		return passkeyErr
+	}
+	finish := func(step *PasskeyRequiredError, sessionID, preAuthToken string) error {
+		response := authenticator.assert(t, step.Assertion.Response.Challenge.String())
+		_, _, _, err := svc.FinishPasskeyLogin(sessionID, response, preAuthToken, "127.0.0.1")
+		return err
+	}
+
+	if _, err := svc.Login("dave", "wrong-password", "127.0.0.1"); errors.Is(err, ErrPasskeyRequired) {
+		t.Fatal("wrong password must not reach the second factor")
+	}
+
+	// The passkey alone is not enough
+	if _, _, err := loginWithPasskey(t, svc, authenticator, "dave"); !errors.Is(err, ErrPasswordRequired) {
+		t.Fatalf("passwordless login error = %v, want ErrPasswordRequired", err)
+	}
+	if _, _, err := loginWithPasskey(t, svc, authenticator, ""); !errors.Is(err, ErrPasswordRequired) {
+		t.Fatalf("discoverable login error = %v, want ErrPasswordRequired", err)
+	}
+
+	// The second factor session needs the pre-auth token from its own password step
+	first, second := login(), login()
+	if err := finish(first, first.SessionID, ""); err == nil {
+		t.Fatal("second factor session finished without a pre-auth token")
+	}
+	if err := finish(second, second.SessionID, first.PreAuthToken); !errors.Is(err, ErrInvalidPreAuth) {
+		t.Fatalf("mismatched pre-auth token error = %v, want ErrInvalidPreAuth", err)
+	}
+	if _, err := svc.ValidateToken(second.PreAuthToken); err == nil {
+		t.Fatal("pre-auth token accepted as a session token")
+	}
+
+	step := login()
+	if err := finish(step, step.SessionID, step.PreAuthToken); err != nil {
+		t.Fatalf("second factor login: %v", err)
+	}
+
+	passkeys, _ := svc.ListPasskeys(userID)
+	if err := svc.DeletePasskey(userID, passkeys[0].ID); err != nil {
+		t.Fatalf("DeletePasskey: %v", err)
+	}
+	if required, _ := svc.PasskeyRequired(userID); required {
+		t.Fatal("removing the last passkey should disable the second factor")
+	}
+	if _, err := svc.Login("dave", "password123", "127.0.0.1"); err != nil {
+		t.Fatalf("password login after removing passkeys: %v", err)
+	}
+}
+
+func TestPasskeySecondFactorWithoutPasskeysConfigured(t *testing.T) {
+	svc, database := setupPasskeyServiceDB(t)
+	userID, _ := svc.Register("erin", "password123")
+	registerPasskey(t, svc, userID)
+	if err := svc.SetPasskeyRequired(userID, true); err != nil {
+		t.Fatalf("SetPasskeyRequired: %v", err)
+	}
+
+	// A restart without the WebAuthn settings must not fall back to the
+	// password alone
+	unconfigured := New(database, "test-jwt-secret")
+	token, err := unconfigured.Login("erin", "password123", "127.0.0.1")
+	if !errors.Is(err, ErrSecondFactorUnavailable) {
+		t.Fatalf("Login error = %v, want ErrSecondFactorUnavailable", err)
+	}
+	if token != "" {
+		t.Fatal("Login issued a token without the second factor")
+	}
+}
+
+func TestPasskeyLoginLockout(t *testing.T) {
+	svc, database := setupPasskeyServiceDB(t)
+	svc.ConfigureLockout(LockoutPolicy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour})
+	userID, _ := svc.Register("frank", "password123")
+	authenticator := registerPasskey(t, svc, userID)
+
+	for i := 0; i < 2; i++ {
+		_, sessionID, err := svc.BeginPasskeyLogin("frank")
+		if err != nil {
+			t.Fatalf("BeginPasskeyLogin: %v", err)
+		}
+		// Answering a different challenge fails verification
+		if _, _, _, err := svc.FinishPasskeyLogin(sessionID, authenticator.assert(t, "c3RhbGUtY2hhbGxlbmdl"), "", "10.0.0.1"); err == nil {
+			t.Fatal("expected assertion for the wrong challenge to fail")
+		}
+	}
+
+	_, _, err := loginWithPasskey(t, svc, authenticator, "frank")
+	if !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("passkey login error = %v, want ErrAccountLocked", err)
+	}
+	if _, err := svc.Login("frank", "password123", "10.0.0.1"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("password login error = %v, want ErrAccountLocked", err)
+	}
+
+	var failures int
+	database.QueryRow("SELECT COUNT(*) FROM login_failures WHERE username = $1 AND reason = $2", "frank", loginFailureBadPasskey).Scan(&failures)
+	if failures != 2 {
+		t.Fatalf("bad passkey audit rows = %d, want 2", failures)
+	}
+}
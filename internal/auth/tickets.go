@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/4xmen/payambar/internal/store"
+)
+
+// WSTicketTTL is how long a WebSocket ticket can be redeemed.
+const WSTicketTTL = 30 * time.Second
+
+var ErrInvalidTicket = errors.New("invalid or expired ticket")
+
+// CreateWSTicket mints a single-use ticket that authenticates one WebSocket
+// connection, so the long-lived JWT never appears in a URL. The ticket is
+// bound to the session in claims and dies with it.
+func (s *Service) CreateWSTicket(claims *Claims) (string, time.Time, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create ticket: %w", err)
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(buf)
+	expiresAt := time.Now().UTC().Add(WSTicketTTL)
+
+	if err := s.store.Tickets.Create(ticket, claims.UserID, claims.TokenVersion, expiresAt); err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to create ticket: %w", err)
+	}
+	return ticket, expiresAt, nil
+}
+
+// RedeemWSTicket consumes a ticket and returns the claims of the session that
+// minted it. Callers still run Authorize on them.
+func (s *Service) RedeemWSTicket(ticket string) (*Claims, error) {
+	redeemed, err := s.store.Tickets.Redeem(ticket)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, ErrInvalidTicket
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ticket: %w", err)
+	}
+	if time.Now().After(redeemed.ExpiresAt) {
+		return nil, ErrInvalidTicket
+	}
+	return &Claims{UserID: redeemed.UserID, Username: redeemed.Username, TokenVersion: redeemed.TokenVersion}, nil
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWSTicketSingleUse(t *testing.T) {
+	svc := setupPasskeyService(t)
+	userID, err := svc.Register("heidi", "password123")
+	if err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	token, _ := svc.GenerateToken(userID, "heidi")
+	claims, _ := svc.ValidateToken(token)
+
+	ticket, expiresAt, err := svc.CreateWSTicket(claims)
+	if err != nil {
+		t.Fatalf("CreateWSTicket: %v", err)
+	}
+	if time.Until(expiresAt) > WSTicketTTL {
+		t.Fatalf("ticket expires at %v, beyond the TTL", expiresAt)
+	}
+
+	redeemed, err := svc.RedeemWSTicket(ticket)
+	if err != nil {
+		t.Fatalf("RedeemWSTicket: %v", err)
+	}
+	if redeemed.UserID != userID || redeemed.Username != "heidi" || redeemed.TokenVersion != claims.TokenVersion {
+		t.Fatalf("redeemed claims = %+v", redeemed)
+	}
+
+	if _, err := svc.RedeemWSTicket(ticket); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("second redeem error = %v, want ErrInvalidTicket", err)
+	}
+	if _, err := svc.RedeemWSTicket("made-up"); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("unknown ticket error = %v, want ErrInvalidTicket", err)
+	}
+}
+
+func TestWSTicketExpiresAndFollowsSession(t *testing.T) {
+	svc, database := setupPasskeyServiceDB(t)
+	userID, _ := svc.Register("ivan", "password123")
+	token, _ := svc.GenerateToken(userID, "ivan")
+	claims, _ := svc.ValidateToken(token)
+
+	expired, _, _ := svc.CreateWSTicket(claims)
+	database.Exec("UPDATE ws_tickets SET expires_at = $1 WHERE id = $2", time.Now().UTC().Add(-time.Second), expired)
+	if _, err := svc.RedeemWSTicket(expired); !errors.Is(err, ErrInvalidTicket) {
+		t.Fatalf("expired ticket error = %v, want ErrInvalidTicket", err)
+	}
+
+	// A ticket minted before a forced logout is no better than the old token
+	ticket, _, _ := svc.CreateWSTicket(claims)
+	if err := svc.RevokeSessions(userID); err != nil {
+		t.Fatalf("RevokeSessions: %v", err)
+	}
+	redeemed, err := svc.RedeemWSTicket(ticket)
+	if err != nil {
+		t.Fatalf("RedeemWSTicket: %v", err)
+	}
+	if _, err := svc.Authorize(redeemed); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("Authorize error = %v, want ErrSessionRevoked", err)
+	}
+}
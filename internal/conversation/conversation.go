@@ -0,0 +1,129 @@
+// Package conversation decides whether one user may send messages and files
+// to another, shared by the WebSocket and HTTP transports.
+package conversation
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/store"
+)
+
+// Policies for sending to a user without an existing direct conversation
+const (
+	// PolicyAutoCreate opens the conversation on the first message
+	PolicyAutoCreate = "auto"
+	// PolicyExisting requires the conversation to be created first
+	PolicyExisting = "existing"
+)
+
+var (
+	ErrSelf            = errors.New("cannot message yourself")
+	ErrUnknownReceiver = errors.New("receiver not found")
+	ErrNoConversation  = errors.New("conversation not found")
+	ErrBlocked         = errors.New("you have blocked this user")
+)
+
+// Grant is the result of a successful Authorize.
+type Grant struct {
+	ConversationID int
+	// Hidden is set when the receiver blocked the sender: the message is
+	// stored and echoed to the sender but never shown to the receiver.
+	Hidden bool
+}
+
+type Authorizer struct {
+	store  *store.Store
+	policy string
+}
+
+func NewAuthorizer(database *db.DB, policy string) (*Authorizer, error) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	switch policy {
+	case "":
+		policy = PolicyAutoCreate
+	case PolicyAutoCreate, PolicyExisting:
+	default:
+		return nil, fmt.Errorf("unknown conversation policy: %s", policy)
+	}
+	return &Authorizer{store: store.New(database), policy: policy}, nil
+}
+
+// Policy returns the configured policy.
+func (a *Authorizer) Policy() string {
+	return a.policy
+}
+
+// Authorize checks that senderID may message receiverID and returns the
+// direct conversation between them, creating it if the policy allows.
+func (a *Authorizer) Authorize(senderID, receiverID int) (*Grant, error) {
+	if senderID == receiverID {
+		return nil, ErrSelf
+	}
+
+	exists, err := a.store.Users.Exists(receiverID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check receiver: %w", err)
+	}
+	if !exists {
+		return nil, ErrUnknownReceiver
+	}
+
+	blocked, err := IsBlocked(a.store, senderID, receiverID)
+	if err != nil {
+		return nil, err
+	}
+	if blocked {
+		return nil, ErrBlocked
+	}
+	hidden, err := IsBlocked(a.store, receiverID, senderID)
+	if err != nil {
+		return nil, err
+	}
+
+	convID, err := FindDirect(a.store, senderID, receiverID)
+	if errors.Is(err, ErrNoConversation) && a.policy == PolicyAutoCreate {
+		convID, err = CreateDirect(a.store, senderID, receiverID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Grant{ConversationID: convID, Hidden: hidden}, nil
+}
+
+// IsBlocked reports whether blockerID has blocked blockedID.
+func IsBlocked(s *store.Store, blockerID, blockedID int) (bool, error) {
+	blocked, err := s.Blocks.IsBlocked(blockerID, blockedID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check block: %w", err)
+	}
+	return blocked, nil
+}
+
+// FindDirect returns the id of the two-person conversation between userA and
+// userB, or ErrNoConversation.
+func FindDirect(s *store.Store, userA, userB int) (int, error) {
+	convID, err := s.Conversations.FindDirect(userA, userB)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, ErrNoConversation
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to check conversation: %w", err)
+	}
+	return convID, nil
+}
+
+// CreateDirect creates a two-person conversation between userA and userB.
+// The unique (direct_low, direct_high) pair makes it safe to race: when a
+// concurrent call, on this or another node, created the conversation first,
+// its id is returned instead.
+func CreateDirect(s *store.Store, userA, userB int) (int, error) {
+	id, err := s.Conversations.CreateDirect(userA, userB)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create conversation: %w", err)
+	}
+	return id, nil
+}
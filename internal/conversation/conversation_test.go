@@ -0,0 +1,149 @@
+package conversation
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/db/dbtest"
+	"github.com/4xmen/payambar/internal/store"
+)
+
+func setupTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	database := dbtest.New(t)
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := database.Exec("INSERT INTO users (username, password_hash) VALUES ($1, 'hash')", name); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	return database
+}
+
+func TestNewAuthorizerPolicy(t *testing.T) {
+	conn := setupTestDB(t)
+
+	a, err := NewAuthorizer(conn, "")
+	if err != nil || a.Policy() != PolicyAutoCreate {
+		t.Fatalf("default policy = %v, %v", a, err)
+	}
+	if _, err := NewAuthorizer(conn, "sometimes"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
+
+func TestAuthorizeAutoCreate(t *testing.T) {
+	conn := setupTestDB(t)
+	a, _ := NewAuthorizer(conn, PolicyAutoCreate)
+
+	if _, err := a.Authorize(1, 1); !errors.Is(err, ErrSelf) {
+		t.Fatalf("self: err = %v, want ErrSelf", err)
+	}
+	if _, err := a.Authorize(1, 99); !errors.Is(err, ErrUnknownReceiver) {
+		t.Fatalf("unknown receiver: err = %v, want ErrUnknownReceiver", err)
+	}
+
+	grant, err := a.Authorize(1, 2)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	again, err := a.Authorize(2, 1)
+	if err != nil {
+		t.Fatalf("Authorize reverse: %v", err)
+	}
+	if grant.ConversationID != again.ConversationID {
+		t.Fatalf("conversation ids differ: %d vs %d", grant.ConversationID, again.ConversationID)
+	}
+	if grant.Hidden {
+		t.Fatal("grant should not be hidden without a block")
+	}
+
+	var count int
+	conn.QueryRow("SELECT COUNT(*) FROM conversations").Scan(&count)
+	if count != 1 {
+		t.Fatalf("conversations = %d, want 1", count)
+	}
+}
+
+func TestAuthorizeAutoCreateRace(t *testing.T) {
+	conn := setupTestDB(t)
+
+	// Separate authorizers stand in for separate nodes
+	const senders = 8
+	ids := make(chan int, senders)
+	errs := make(chan error, senders)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, _ := NewAuthorizer(conn, PolicyAutoCreate)
+			grant, err := a.Authorize(1+i%2, 2-i%2)
+			if err != nil {
+				errs <- err
+				return
+			}
+			ids <- grant.ConversationID
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("Authorize: %v", err)
+	}
+	first := <-ids
+	for id := range ids {
+		if id != first {
+			t.Fatalf("conversation ids differ: %d vs %d", first, id)
+		}
+	}
+	var count int
+	conn.QueryRow("SELECT COUNT(*) FROM conversations").Scan(&count)
+	if count != 1 {
+		t.Fatalf("conversations = %d, want 1", count)
+	}
+}
+
+func TestAuthorizeExisting(t *testing.T) {
+	conn := setupTestDB(t)
+	a, _ := NewAuthorizer(conn, PolicyExisting)
+
+	if _, err := a.Authorize(1, 2); !errors.Is(err, ErrNoConversation) {
+		t.Fatalf("err = %v, want ErrNoConversation", err)
+	}
+
+	convID, err := CreateDirect(store.New(conn), 1, 2)
+	if err != nil {
+		t.Fatalf("CreateDirect: %v", err)
+	}
+	grant, err := a.Authorize(2, 1)
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if grant.ConversationID != convID {
+		t.Fatalf("conversation id = %d, want %d", grant.ConversationID, convID)
+	}
+}
+
+func TestAuthorizeBlocked(t *testing.T) {
+	conn := setupTestDB(t)
+	a, _ := NewAuthorizer(conn, PolicyAutoCreate)
+
+	// bob blocked alice
+	conn.Exec("INSERT INTO user_blocks (blocker_id, blocked_id) VALUES (2, 1)")
+
+	if _, err := a.Authorize(2, 1); !errors.Is(err, ErrBlocked) {
+		t.Fatalf("blocker: err = %v, want ErrBlocked", err)
+	}
+	grant, err := a.Authorize(1, 2)
+	if err != nil {
+		t.Fatalf("blocked sender: %v", err)
+	}
+	if !grant.Hidden {
+		t.Fatal("message from a blocked sender should be hidden")
+	}
+}
@@ -3,207 +3,139 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
+)
 
-	_ "github.com/mattn/go-sqlite3"
+// Supported databases, as returned by DB.Dialect.
+const (
+	SQLite   = "sqlite"
+	Postgres = "postgres"
 )
 
+// DB is the application's storage, a SQLite file or a PostgreSQL database.
+// Queries are written once, with PostgreSQL's $N placeholders, and the
+// dialect adapts them and the schema. The few clauses that can't be written
+// for both come from ForUpdate and Later.
 type DB struct {
-	conn *sql.DB
+	conn    *sql.DB
+	dialect dialect
 }
 
-func New(path string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", path)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
-	}
+// dialect is what differs between the supported databases.
+type dialect interface {
+	name() string
+	// ddl rewrites a schema statement written for SQLite
+	ddl(stmt string) string
+	// query rewrites a statement written with $N placeholders
+	query(stmt string) string
+	forUpdate() string
+	later(column string, ago time.Duration) string
+	hasColumn(tx *Tx, table, column string) (bool, error)
+	// lock keeps other processes from migrating until unlock is called
+	lock(conn *sql.DB) (unlock func(), err error)
+}
 
-	// Test connection
-	if err := conn.Ping(); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+// Open opens the database without migrating it; see New. url is a
+// postgres:// or postgresql:// URL, or the path of a SQLite file.
+func Open(url string) (*DB, error) {
+	if strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://") {
+		return openPostgres(url)
 	}
+	return openSQLite(url)
+}
 
-	// Enable WAL mode for concurrent writes and reads
-	// WAL mode allows readers to work while a writer is writing
-	if _, err := conn.Exec("PRAGMA journal_mode=WAL"); err != nil {
-		return nil, fmt.Errorf("failed to enable WAL mode: %w", err)
+// New opens the database and applies pending migrations. It refuses a
+// database migrated by a newer binary.
+func New(url string) (*DB, error) {
+	db, err := Open(url)
+	if err != nil {
+		return nil, err
 	}
 
-	// Set busy timeout to 5 seconds (waits instead of immediate SQLITE_BUSY error)
-	// This helps with concurrent write attempts
-	if _, err := conn.Exec("PRAGMA busy_timeout=5000"); err != nil {
-		return nil, fmt.Errorf("failed to set busy timeout: %w", err)
+	// Run migrations
+	if _, err := db.MigrateUp(0); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migration failed: %w", err)
 	}
 
-	// Use NORMAL synchronous mode (faster than FULL, still safe with WAL)
-	// FULL=safest but slower, NORMAL=good balance, OFF=fastest but risky
-	if _, err := conn.Exec("PRAGMA synchronous=NORMAL"); err != nil {
-		return nil, fmt.Errorf("failed to set synchronous mode: %w", err)
-	}
+	return db, nil
+}
 
-	// Optional: Set cache size for better performance (negative = KB, positive = pages)
-	// -64000 = 64MB cache
-	if _, err := conn.Exec("PRAGMA cache_size=-64000"); err != nil {
-		return nil, fmt.Errorf("failed to set cache size: %w", err)
-	}
+func (db *DB) Close() error {
+	return db.conn.Close()
+}
 
-	// Configure connection pool
-	// With WAL mode, you can have more concurrent connections
-	conn.SetMaxOpenConns(25)
-	conn.SetMaxIdleConns(5)
-	conn.SetConnMaxLifetime(5 * time.Minute)
+// Dialect is SQLite or Postgres.
+func (db *DB) Dialect() string {
+	return db.dialect.name()
+}
 
-	db := &DB{conn: conn}
+// ForUpdate is appended to a SELECT inside a transaction to lock the rows
+// it reads until the transaction ends. SQLite locks the whole database on
+// the first write instead, so there it is empty.
+func (db *DB) ForUpdate() string {
+	return db.dialect.forUpdate()
+}
 
-	// Run migrations
-	if err := db.migrate(); err != nil {
-		return nil, fmt.Errorf("migration failed: %w", err)
-	}
+// Later is a condition that holds while column is later than ago before the
+// database's clock.
+func (db *DB) Later(column string, ago time.Duration) string {
+	return db.dialect.later(column, ago)
+}
 
-	return db, nil
+// Ping checks that the database is reachable.
+func (db *DB) Ping() error {
+	return db.conn.Ping()
+}
+
+func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.conn.Exec(db.dialect.query(query), args...)
+}
+
+func (db *DB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.conn.Query(db.dialect.query(query), args...)
+}
+
+func (db *DB) QueryRow(query string, args ...interface{}) *sql.Row {
+	return db.conn.QueryRow(db.dialect.query(query), args...)
 }
 
-func (db *DB) migrate() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS users (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT UNIQUE NOT NULL,
-		password_hash TEXT NOT NULL,
-		display_name TEXT,
-		avatar_url TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS conversations (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS conversation_participants (
-		conversation_id INTEGER NOT NULL,
-		user_id INTEGER NOT NULL,
-		joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		PRIMARY KEY (conversation_id, user_id),
-		FOREIGN KEY (conversation_id) REFERENCES conversations(id),
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	);
-
-	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		sender_id INTEGER NOT NULL,
-		receiver_id INTEGER NOT NULL,
-		content TEXT NOT NULL,
-		encrypted INTEGER NOT NULL DEFAULT 0,
-		e2ee_v INTEGER,
-		alg TEXT,
-		sender_device_id TEXT,
-		key_id TEXT,
-		iv TEXT,
-		ciphertext TEXT,
-		aad TEXT,
-		status TEXT DEFAULT 'sent',
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		delivered_at TIMESTAMP,
-		read_at TIMESTAMP,
-		FOREIGN KEY (sender_id) REFERENCES users(id),
-		FOREIGN KEY (receiver_id) REFERENCES users(id)
-	);
-
-	CREATE TABLE IF NOT EXISTS files (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		message_id INTEGER NOT NULL,
-		file_name TEXT NOT NULL,
-		file_path TEXT NOT NULL,
-		file_size INTEGER NOT NULL,
-		content_type TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY (message_id) REFERENCES messages(id)
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_messages_sender_receiver ON messages(sender_id, receiver_id);
-	CREATE INDEX IF NOT EXISTS idx_messages_receiver ON messages(receiver_id);
-	CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at DESC);
-	CREATE INDEX IF NOT EXISTS idx_messages_unread ON messages(receiver_id, sender_id, read_at);
-	CREATE INDEX IF NOT EXISTS idx_files_message_id ON files(message_id);
-	CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
-	CREATE INDEX IF NOT EXISTS idx_conversation_participants_user_id ON conversation_participants(user_id);
-	CREATE INDEX IF NOT EXISTS idx_conversation_participants_conversation_id ON conversation_participants(conversation_id);
-
-	CREATE TABLE IF NOT EXISTS user_device_keys (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		device_id TEXT NOT NULL,
-		algorithm TEXT NOT NULL,
-		public_key TEXT NOT NULL,
-		key_id TEXT NOT NULL,
-		enc_private_key TEXT,
-		enc_private_key_iv TEXT,
-		kdf_salt TEXT,
-		kdf_iterations INTEGER,
-		kdf_alg TEXT,
-		key_wrap_version INTEGER,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		revoked_at TIMESTAMP,
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	);
-	CREATE UNIQUE INDEX IF NOT EXISTS idx_user_device_keys_unique ON user_device_keys(user_id, device_id, key_id);
-	`
-
-	_, err := db.conn.Exec(schema)
+func (db *DB) Begin() (*Tx, error) {
+	tx, err := db.conn.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &Tx{tx: tx, dialect: db.dialect}, nil
+}
 
-	// Add display_name and avatar_url columns if they don't exist (migration for existing databases)
-	db.conn.Exec("ALTER TABLE users ADD COLUMN display_name TEXT")
-	db.conn.Exec("ALTER TABLE users ADD COLUMN avatar_url TEXT")
-
-	// E2EE-compatible message columns (safe on existing DBs; duplicate-column errors ignored)
-	db.conn.Exec("ALTER TABLE messages ADD COLUMN encrypted INTEGER NOT NULL DEFAULT 0")
-	db.conn.Exec("ALTER TABLE messages ADD COLUMN e2ee_v INTEGER")
-	db.conn.Exec("ALTER TABLE messages ADD COLUMN alg TEXT")
-	db.conn.Exec("ALTER TABLE messages ADD COLUMN sender_device_id TEXT")
-	db.conn.Exec("ALTER TABLE messages ADD COLUMN key_id TEXT")
-	db.conn.Exec("ALTER TABLE messages ADD COLUMN iv TEXT")
-	db.conn.Exec("ALTER TABLE messages ADD COLUMN ciphertext TEXT")
-	db.conn.Exec("ALTER TABLE messages ADD COLUMN aad TEXT")
-
-	// Encrypted private key backup columns
-	db.conn.Exec("ALTER TABLE user_device_keys ADD COLUMN enc_private_key TEXT")
-	db.conn.Exec("ALTER TABLE user_device_keys ADD COLUMN enc_private_key_iv TEXT")
-	db.conn.Exec("ALTER TABLE user_device_keys ADD COLUMN kdf_salt TEXT")
-	db.conn.Exec("ALTER TABLE user_device_keys ADD COLUMN kdf_iterations INTEGER")
-	db.conn.Exec("ALTER TABLE user_device_keys ADD COLUMN kdf_alg TEXT")
-	db.conn.Exec("ALTER TABLE user_device_keys ADD COLUMN key_wrap_version INTEGER")
-	db.conn.Exec("ALTER TABLE user_device_keys ADD COLUMN updated_at TIMESTAMP")
-
-	// Web Push subscriptions table
-	db.conn.Exec(`CREATE TABLE IF NOT EXISTS push_subscriptions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER NOT NULL,
-		endpoint TEXT NOT NULL,
-		p256dh TEXT NOT NULL,
-		auth TEXT NOT NULL,
-		user_agent TEXT,
-		device_label TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		revoked_at TIMESTAMP,
-		FOREIGN KEY (user_id) REFERENCES users(id)
-	)`)
-	db.conn.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_push_subscriptions_endpoint_unique ON push_subscriptions(endpoint)")
-	db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_push_subscriptions_user_id ON push_subscriptions(user_id)")
-	db.conn.Exec("CREATE INDEX IF NOT EXISTS idx_push_subscriptions_active ON push_subscriptions(user_id, revoked_at)")
-
-	return nil
+// Tx is a transaction on DB.
+type Tx struct {
+	tx      *sql.Tx
+	dialect dialect
 }
 
-func (db *DB) Close() error {
-	return db.conn.Close()
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.Exec(tx.dialect.query(query), args...)
+}
+
+func (tx *Tx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.Query(tx.dialect.query(query), args...)
+}
+
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.tx.QueryRow(tx.dialect.query(query), args...)
+}
+
+func (tx *Tx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *Tx) Rollback() error {
+	return tx.tx.Rollback()
 }
 
-func (db *DB) GetConn() *sql.DB {
-	return db.conn
+// IsUniqueViolation reports whether err is a unique constraint failure.
+func IsUniqueViolation(err error) bool {
+	return isSQLiteUniqueViolation(err) || isPostgresUniqueViolation(err)
 }
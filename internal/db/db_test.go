@@ -1,6 +1,7 @@
 package db
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -127,3 +128,199 @@ func TestConversationParticipantsSchema(t *testing.T) {
 		t.Fatalf("Expected idx_conversation_participants_conversation_id index to exist")
 	}
 }
+
+func TestMigrateUpAndDown(t *testing.T) {
+	db, err := New(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	version, err := db.Version()
+	if err != nil || version != LatestVersion() {
+		t.Fatalf("Version() = %d, %v; want %d", version, err, LatestVersion())
+	}
+
+	// Roll back the direct conversation pairs and re-apply them over
+	// duplicate conversations, as older releases could create
+	rolledBack, err := db.MigrateDown(LatestVersion() - 1)
+	if err != nil || len(rolledBack) != 1 {
+		t.Fatalf("MigrateDown() = %v, %v", rolledBack, err)
+	}
+	var n int
+	db.conn.QueryRow("SELECT COUNT(*) FROM pragma_table_info('conversations') WHERE name = 'direct_low'").Scan(&n)
+	if n != 0 {
+		t.Fatalf("direct_low column still exists after rollback")
+	}
+	db.conn.Exec("INSERT INTO users (id, username, password_hash) VALUES (1, 'a', 'x'), (2, 'b', 'x')")
+	db.conn.Exec("INSERT INTO conversations (id) VALUES (1), (2)")
+	db.conn.Exec("INSERT INTO conversation_participants (conversation_id, user_id) VALUES (1, 2), (1, 1), (2, 1), (2, 2)")
+	if _, err := db.MigrateUp(0); err != nil {
+		t.Fatalf("MigrateUp() failed over duplicate conversations: %v", err)
+	}
+	var paired int
+	db.conn.QueryRow("SELECT id FROM conversations WHERE direct_low = 1 AND direct_high = 2").Scan(&paired)
+	db.conn.QueryRow("SELECT COUNT(*) FROM conversations WHERE direct_low IS NOT NULL").Scan(&n)
+	if paired != 1 || n != 1 {
+		t.Fatalf("paired conversation = %d of %d, want only the oldest", paired, n)
+	}
+	db.conn.Exec("DELETE FROM conversation_participants")
+	db.conn.Exec("DELETE FROM conversations")
+	db.conn.Exec("DELETE FROM users")
+
+	// Everything down to an empty database and back up again
+	if _, err := db.MigrateDown(0); err != nil {
+		t.Fatalf("MigrateDown(0) failed: %v", err)
+	}
+	db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')").Scan(&n)
+	if n != 0 {
+		t.Fatalf("%d tables left after rolling back every migration", n)
+	}
+	applied, err := db.MigrateUp(0)
+	if err != nil || len(applied) != len(migrations) {
+		t.Fatalf("MigrateUp(0) applied %d of %d: %v", len(applied), len(migrations), err)
+	}
+
+	status, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus() failed: %v", err)
+	}
+	for _, m := range status {
+		if m.AppliedAt == nil || m.Unknown {
+			t.Fatalf("migration %d not applied: %+v", m.Version, m)
+		}
+	}
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	path := t.TempDir() + "/test.db"
+	legacy, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	// A database from before migrations were versioned, already carrying
+	// columns added by later migrations
+	if _, err := legacy.conn.Exec(`CREATE TABLE users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT UNIQUE NOT NULL,
+		password_hash TEXT NOT NULL,
+		display_name TEXT,
+		avatar_url TEXT,
+		role TEXT NOT NULL DEFAULT 'user',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		t.Fatalf("Failed to create legacy schema: %v", err)
+	}
+	legacy.conn.Exec("INSERT INTO users (username, password_hash) VALUES ('ali', 'x')")
+	legacy.Close()
+
+	db, err := New(path)
+	if err != nil {
+		t.Fatalf("Failed to migrate legacy database: %v", err)
+	}
+	defer db.Close()
+
+	var username string
+	if err := db.conn.QueryRow("SELECT username FROM users").Scan(&username); err != nil || username != "ali" {
+		t.Fatalf("legacy user lost: %q, %v", username, err)
+	}
+	if version, _ := db.Version(); version != LatestVersion() {
+		t.Fatalf("Version() = %d, want %d", version, LatestVersion())
+	}
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	path := t.TempDir() + "/test.db"
+	db, err := New(path)
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	db.conn.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, 'from the future')", LatestVersion()+1)
+	db.Close()
+
+	if _, err := New(path); !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("New() error = %v, want ErrSchemaTooNew", err)
+	}
+
+	db, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	status, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatalf("MigrationStatus() failed: %v", err)
+	}
+	if last := status[len(status)-1]; !last.Unknown || last.Version != LatestVersion()+1 {
+		t.Fatalf("unknown migration not listed: %+v", last)
+	}
+}
+
+func TestFailedMigrationRollsBack(t *testing.T) {
+	db, err := New(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	defer db.Close()
+
+	saved := migrations
+	defer func() { migrations = saved }()
+	migrations = append(migrations[:len(migrations):len(migrations)], migration{
+		version: LatestVersion() + 1,
+		name:    "broken",
+		up: []step{exec(
+			"CREATE TABLE half_done (id INTEGER)",
+			"ALTER TABLE no_such_table ADD COLUMN x TEXT",
+		)},
+	})
+
+	if _, err := db.MigrateUp(0); err == nil {
+		t.Fatalf("MigrateUp() succeeded with a broken migration")
+	}
+	var n int
+	db.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half_done'").Scan(&n)
+	if n != 0 {
+		t.Fatalf("failed migration was partly applied")
+	}
+	if version, _ := db.Version(); version != LatestVersion()-1 {
+		t.Fatalf("Version() = %d, want %d", version, LatestVersion()-1)
+	}
+}
+
+func TestPostgresDDL(t *testing.T) {
+	got := postgresDialect{}.ddl(`CREATE TABLE files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		message_id INTEGER NOT NULL,
+		data BLOB,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (message_id) REFERENCES messages(id)
+	)`)
+	want := `CREATE TABLE files (
+		id BIGSERIAL PRIMARY KEY,
+		message_id BIGINT NOT NULL,
+		data BYTEA,
+		created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (message_id) REFERENCES messages(id)
+	)`
+	if got != want {
+		t.Fatalf("ddl =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSQLiteNumberedParams(t *testing.T) {
+	db, err := New(t.TempDir() + "/test.db")
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	defer db.Close()
+
+	// SQLite alone would bind $2 to the first argument
+	var second, first string
+	if err := db.QueryRow("SELECT $2, $1, $2", "one", "two").Scan(&second, &first, new(string)); err != nil {
+		t.Fatalf("QueryRow: %v", err)
+	}
+	if first != "one" || second != "two" {
+		t.Fatalf("$1 = %q, $2 = %q, want one and two", first, second)
+	}
+}
@@ -0,0 +1,96 @@
+// Package dbtest opens throwaway databases for tests.
+package dbtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// Open returns a migrated, empty database and a function that removes it.
+// The database is a SQLite file in a new temporary directory, or, when
+// TEST_DATABASE_URL is set, a new schema in that PostgreSQL database, so
+// test runs never touch tables they did not create. A TEST_DATABASE_URL
+// whose database name does not contain "test" is refused.
+func Open() (*db.DB, func(), error) {
+	if url := os.Getenv("TEST_DATABASE_URL"); url != "" {
+		return openSchema(url)
+	}
+
+	dir, err := os.MkdirTemp("", "payambar-test-db")
+	if err != nil {
+		return nil, nil, err
+	}
+	// Enforce foreign keys like PostgreSQL does, so both backends reject the
+	// same orphaned rows
+	database, err := db.New("file:" + filepath.Join(dir, "test.db") + "?_foreign_keys=on")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	return database, func() {
+		database.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+// New is Open for one test, removed when the test ends.
+func New(t testing.TB) *db.DB {
+	t.Helper()
+	database, cleanup, err := Open()
+	if err != nil {
+		t.Fatalf("Failed to create test database: %v", err)
+	}
+	t.Cleanup(cleanup)
+	return database
+}
+
+func openSchema(rawURL string) (*db.DB, func(), error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid TEST_DATABASE_URL: %w", err)
+	}
+	if name := strings.TrimPrefix(u.Path, "/"); !strings.Contains(strings.ToLower(name), "test") {
+		return nil, nil, fmt.Errorf("refusing to run tests in database %q: TEST_DATABASE_URL must name a test database", name)
+	}
+
+	suffix := make([]byte, 6)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, nil, err
+	}
+	schema := "test_" + hex.EncodeToString(suffix)
+
+	admin, err := db.Open(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := admin.Exec("CREATE SCHEMA " + schema); err != nil {
+		admin.Close()
+		return nil, nil, fmt.Errorf("failed to create test schema: %w", err)
+	}
+	drop := func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		admin.Close()
+	}
+
+	// Every connection of the test database works in the new schema
+	query := u.Query()
+	query.Set("search_path", schema)
+	u.RawQuery = query.Encode()
+	database, err := db.New(u.String())
+	if err != nil {
+		drop()
+		return nil, nil, err
+	}
+	return database, func() {
+		database.Close()
+		drop()
+	}, nil
+}
@@ -0,0 +1,675 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// ErrSchemaTooNew means the database was migrated by a newer payambar.
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// Migration is the state of one schema migration.
+type Migration struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	// Unknown migrations were applied by a newer binary
+	Unknown bool `json:"unknown,omitempty"`
+}
+
+// step is one statement of a migration, run inside its transaction.
+type step func(tx *Tx) error
+
+// migration is a numbered schema change, written for SQLite; see
+// dialect.ddl. Up must also work on databases created before migrations
+// were versioned, which may already have part of it, so tables and indexes
+// use IF NOT EXISTS and columns use addColumn.
+type migration struct {
+	version int
+	name    string
+	up      []step
+	down    []step
+}
+
+// exec runs schema statements.
+func exec(stmts ...string) step {
+	return func(tx *Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(tx.dialect.ddl(stmt)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column unless the table already has it.
+func addColumn(table, column, definition string) step {
+	return func(tx *Tx) error {
+		exists, err := tx.dialect.hasColumn(tx, table, column)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec(tx.dialect.ddl(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)))
+		return err
+	}
+}
+
+// dropColumn drops a column if the table has it. Indexes on the column must
+// be dropped first.
+func dropColumn(table, column string) step {
+	return func(tx *Tx) error {
+		exists, err := tx.dialect.hasColumn(tx, table, column)
+		if err != nil || !exists {
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", table, column))
+		return err
+	}
+}
+
+// migrations are applied in order; append new ones at the end and never
+// change one that was released.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		up: []step{
+			exec(`CREATE TABLE IF NOT EXISTS users (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT UNIQUE NOT NULL,
+				password_hash TEXT NOT NULL,
+				display_name TEXT,
+				avatar_url TEXT,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`, `CREATE TABLE IF NOT EXISTS conversations (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`, `CREATE TABLE IF NOT EXISTS conversation_participants (
+				conversation_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (conversation_id, user_id),
+				FOREIGN KEY (conversation_id) REFERENCES conversations(id),
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`, `CREATE TABLE IF NOT EXISTS messages (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				sender_id INTEGER NOT NULL,
+				receiver_id INTEGER NOT NULL,
+				content TEXT NOT NULL,
+				encrypted INTEGER NOT NULL DEFAULT 0,
+				e2ee_v INTEGER,
+				alg TEXT,
+				sender_device_id TEXT,
+				key_id TEXT,
+				iv TEXT,
+				ciphertext TEXT,
+				aad TEXT,
+				status TEXT DEFAULT 'sent',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				delivered_at TIMESTAMP,
+				read_at TIMESTAMP,
+				FOREIGN KEY (sender_id) REFERENCES users(id),
+				FOREIGN KEY (receiver_id) REFERENCES users(id)
+			)`, `CREATE TABLE IF NOT EXISTS files (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				message_id INTEGER NOT NULL,
+				file_name TEXT NOT NULL,
+				file_path TEXT NOT NULL,
+				file_size INTEGER NOT NULL,
+				content_type TEXT,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (message_id) REFERENCES messages(id)
+			)`, `CREATE TABLE IF NOT EXISTS user_device_keys (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				device_id TEXT NOT NULL,
+				algorithm TEXT NOT NULL,
+				public_key TEXT NOT NULL,
+				key_id TEXT NOT NULL,
+				enc_private_key TEXT,
+				enc_private_key_iv TEXT,
+				kdf_salt TEXT,
+				kdf_iterations INTEGER,
+				kdf_alg TEXT,
+				key_wrap_version INTEGER,
+				updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				revoked_at TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`),
+			// Columns added to these tables before migrations were versioned
+			addColumn("users", "display_name", "TEXT"),
+			addColumn("users", "avatar_url", "TEXT"),
+			addColumn("messages", "encrypted", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("messages", "e2ee_v", "INTEGER"),
+			addColumn("messages", "alg", "TEXT"),
+			addColumn("messages", "sender_device_id", "TEXT"),
+			addColumn("messages", "key_id", "TEXT"),
+			addColumn("messages", "iv", "TEXT"),
+			addColumn("messages", "ciphertext", "TEXT"),
+			addColumn("messages", "aad", "TEXT"),
+			addColumn("user_device_keys", "enc_private_key", "TEXT"),
+			addColumn("user_device_keys", "enc_private_key_iv", "TEXT"),
+			addColumn("user_device_keys", "kdf_salt", "TEXT"),
+			addColumn("user_device_keys", "kdf_iterations", "INTEGER"),
+			addColumn("user_device_keys", "kdf_alg", "TEXT"),
+			addColumn("user_device_keys", "key_wrap_version", "INTEGER"),
+			addColumn("user_device_keys", "updated_at", "TIMESTAMP"),
+			exec(
+				"CREATE INDEX IF NOT EXISTS idx_messages_sender_receiver ON messages(sender_id, receiver_id)",
+				"CREATE INDEX IF NOT EXISTS idx_messages_receiver ON messages(receiver_id)",
+				"CREATE INDEX IF NOT EXISTS idx_messages_created_at ON messages(created_at DESC)",
+				"CREATE INDEX IF NOT EXISTS idx_messages_unread ON messages(receiver_id, sender_id, read_at)",
+				"CREATE INDEX IF NOT EXISTS idx_files_message_id ON files(message_id)",
+				"CREATE INDEX IF NOT EXISTS idx_users_username ON users(username)",
+				"CREATE INDEX IF NOT EXISTS idx_conversation_participants_user_id ON conversation_participants(user_id)",
+				"CREATE INDEX IF NOT EXISTS idx_conversation_participants_conversation_id ON conversation_participants(conversation_id)",
+				"CREATE UNIQUE INDEX IF NOT EXISTS idx_user_device_keys_unique ON user_device_keys(user_id, device_id, key_id)",
+			),
+		},
+		down: []step{exec(
+			"DROP TABLE IF EXISTS user_device_keys",
+			"DROP TABLE IF EXISTS files",
+			"DROP TABLE IF EXISTS messages",
+			"DROP TABLE IF EXISTS conversation_participants",
+			"DROP TABLE IF EXISTS conversations",
+			"DROP TABLE IF EXISTS users",
+		)},
+	},
+	{
+		version: 2,
+		name:    "web push subscriptions",
+		up: []step{exec(`CREATE TABLE IF NOT EXISTS push_subscriptions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL,
+			endpoint TEXT NOT NULL,
+			p256dh TEXT NOT NULL,
+			auth TEXT NOT NULL,
+			user_agent TEXT,
+			device_label TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			revoked_at TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`,
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_push_subscriptions_endpoint_unique ON push_subscriptions(endpoint)",
+			"CREATE INDEX IF NOT EXISTS idx_push_subscriptions_user_id ON push_subscriptions(user_id)",
+			"CREATE INDEX IF NOT EXISTS idx_push_subscriptions_active ON push_subscriptions(user_id, revoked_at)",
+		)},
+		down: []step{exec("DROP TABLE IF EXISTS push_subscriptions")},
+	},
+	{
+		// Primary login or second factor
+		version: 3,
+		name:    "webauthn passkeys",
+		up: []step{
+			addColumn("users", "passkey_required", "INTEGER NOT NULL DEFAULT 0"),
+			exec(`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				credential_id TEXT NOT NULL,
+				name TEXT NOT NULL,
+				public_key BLOB NOT NULL,
+				attestation_type TEXT NOT NULL DEFAULT '',
+				aaguid BLOB,
+				sign_count INTEGER NOT NULL DEFAULT 0,
+				backup_eligible INTEGER NOT NULL DEFAULT 0,
+				backup_state INTEGER NOT NULL DEFAULT 0,
+				transports TEXT NOT NULL DEFAULT '',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				last_used_at TIMESTAMP,
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+				"CREATE UNIQUE INDEX IF NOT EXISTS idx_webauthn_credentials_credential_id ON webauthn_credentials(credential_id)",
+				"CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id)",
+				`CREATE TABLE IF NOT EXISTS webauthn_sessions (
+				id TEXT PRIMARY KEY,
+				user_id INTEGER,
+				ceremony TEXT NOT NULL,
+				session_data TEXT NOT NULL,
+				expires_at TIMESTAMP NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`),
+		},
+		down: []step{
+			exec("DROP TABLE IF EXISTS webauthn_sessions", "DROP TABLE IF EXISTS webauthn_credentials"),
+			dropColumn("users", "passkey_required"),
+		},
+	},
+	{
+		version: 4,
+		name:    "single-use websocket tickets",
+		up: []step{exec(`CREATE TABLE IF NOT EXISTS ws_tickets (
+			id TEXT PRIMARY KEY,
+			user_id INTEGER NOT NULL,
+			token_version INTEGER NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		)`)},
+		down: []step{exec("DROP TABLE IF EXISTS ws_tickets")},
+	},
+	{
+		// Per-username login lockouts and failed login audit trail
+		version: 5,
+		name:    "login lockouts",
+		up: []step{exec(`CREATE TABLE IF NOT EXISTS login_lockouts (
+			username TEXT PRIMARY KEY,
+			failed_count INTEGER NOT NULL DEFAULT 0,
+			last_failed_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP
+		)`, `CREATE TABLE IF NOT EXISTS login_failures (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL,
+			client_ip TEXT,
+			reason TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+			"CREATE INDEX IF NOT EXISTS idx_login_failures_username ON login_failures(username, created_at)",
+			"CREATE INDEX IF NOT EXISTS idx_login_failures_created_at ON login_failures(created_at)",
+		)},
+		down: []step{exec("DROP TABLE IF EXISTS login_failures", "DROP TABLE IF EXISTS login_lockouts")},
+	},
+	{
+		version: 6,
+		name:    "registration invites",
+		up: []step{
+			addColumn("users", "invite_id", "INTEGER"),
+			exec(`CREATE TABLE IF NOT EXISTS invites (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				code TEXT NOT NULL,
+				created_by INTEGER,
+				max_uses INTEGER NOT NULL DEFAULT 1,
+				use_count INTEGER NOT NULL DEFAULT 0,
+				expires_at TIMESTAMP NOT NULL,
+				revoked_at TIMESTAMP,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				FOREIGN KEY (created_by) REFERENCES users(id)
+			)`,
+				"CREATE UNIQUE INDEX IF NOT EXISTS idx_invites_code ON invites(code)",
+				"CREATE INDEX IF NOT EXISTS idx_invites_created_by ON invites(created_by)",
+			),
+		},
+		down: []step{
+			exec("DROP TABLE IF EXISTS invites"),
+			dropColumn("users", "invite_id"),
+		},
+	},
+	{
+		version: 7,
+		name:    "roles, suspension and forced logout",
+		up: []step{
+			addColumn("users", "role", "TEXT NOT NULL DEFAULT 'user'"),
+			addColumn("users", "suspended_at", "TIMESTAMP"),
+			addColumn("users", "token_version", "INTEGER NOT NULL DEFAULT 0"),
+		},
+		down: []step{
+			dropColumn("users", "token_version"),
+			dropColumn("users", "suspended_at"),
+			dropColumn("users", "role"),
+		},
+	},
+	{
+		// Messages sent to a user who blocked the sender are kept for the
+		// sender but hidden from the receiver
+		version: 8,
+		name:    "user blocks",
+		up: []step{
+			addColumn("messages", "hidden", "INTEGER NOT NULL DEFAULT 0"),
+			exec(`CREATE TABLE IF NOT EXISTS user_blocks (
+				blocker_id INTEGER NOT NULL,
+				blocked_id INTEGER NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				PRIMARY KEY (blocker_id, blocked_id),
+				FOREIGN KEY (blocker_id) REFERENCES users(id),
+				FOREIGN KEY (blocked_id) REFERENCES users(id)
+			)`,
+				"CREATE INDEX IF NOT EXISTS idx_user_blocks_blocked_id ON user_blocks(blocked_id)",
+			),
+		},
+		down: []step{
+			exec("DROP TABLE IF EXISTS user_blocks"),
+			dropColumn("messages", "hidden"),
+		},
+	},
+	{
+		// Client-generated message ids make retried sends idempotent per sender
+		version: 9,
+		name:    "client message ids",
+		up: []step{
+			addColumn("messages", "client_message_id", "TEXT"),
+			exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_sender_client_message_id
+				ON messages(sender_id, client_message_id) WHERE client_message_id IS NOT NULL`),
+		},
+		down: []step{
+			exec("DROP INDEX IF EXISTS idx_messages_sender_client_message_id"),
+			dropColumn("messages", "client_message_id"),
+		},
+	},
+	{
+		// Each invitee gets a history entry in the conversation once the
+		// call ends
+		version: 10,
+		name:    "call sessions",
+		up: []step{
+			addColumn("messages", "call_id", "INTEGER"),
+			exec(`CREATE TABLE IF NOT EXISTS calls (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				caller_id INTEGER NOT NULL,
+				kind TEXT NOT NULL DEFAULT 'audio',
+				state TEXT NOT NULL DEFAULT 'ringing',
+				end_reason TEXT,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				answered_at TIMESTAMP,
+				ended_at TIMESTAMP,
+				FOREIGN KEY (caller_id) REFERENCES users(id)
+			)`, `CREATE TABLE IF NOT EXISTS call_participants (
+				call_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				state TEXT NOT NULL DEFAULT 'invited',
+				hidden INTEGER NOT NULL DEFAULT 0,
+				outcome TEXT,
+				joined_at TIMESTAMP,
+				left_at TIMESTAMP,
+				PRIMARY KEY (call_id, user_id),
+				FOREIGN KEY (call_id) REFERENCES calls(id),
+				FOREIGN KEY (user_id) REFERENCES users(id)
+			)`,
+				"CREATE INDEX IF NOT EXISTS idx_call_participants_user ON call_participants(user_id, state)",
+				"CREATE INDEX IF NOT EXISTS idx_calls_state ON calls(state)",
+			),
+		},
+		down: []step{
+			exec("DROP TABLE IF EXISTS call_participants", "DROP TABLE IF EXISTS calls"),
+			dropColumn("messages", "call_id"),
+		},
+	},
+	{
+		version: 11,
+		name:    "push message previews",
+		up:      []step{addColumn("users", "push_preview", "INTEGER NOT NULL DEFAULT 0")},
+		down:    []step{dropColumn("users", "push_preview")},
+	},
+	{
+		// conversation_id 0 holds the account-wide settings
+		version: 12,
+		name:    "notification settings",
+		up: []step{exec(`CREATE TABLE IF NOT EXISTS notification_settings (
+			user_id INTEGER NOT NULL,
+			conversation_id INTEGER NOT NULL DEFAULT 0,
+			level TEXT NOT NULL DEFAULT 'all',
+			muted INTEGER NOT NULL DEFAULT 0,
+			muted_until TIMESTAMP,
+			quiet_start TEXT,
+			quiet_end TEXT,
+			timezone TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user_id, conversation_id),
+			FOREIGN KEY (user_id) REFERENCES users(id)
+		)`)},
+		down: []step{exec("DROP TABLE IF EXISTS notification_settings")},
+	},
+	{
+		// A persistent retry queue, per-subscription health and delivery
+		// counters for `payambar status`
+		version: 13,
+		name:    "push delivery queue",
+		up: []step{
+			addColumn("push_subscriptions", "failure_count", "INTEGER NOT NULL DEFAULT 0"),
+			addColumn("push_subscriptions", "last_success_at", "TIMESTAMP"),
+			addColumn("push_subscriptions", "last_failure_at", "TIMESTAMP"),
+			exec(`CREATE TABLE IF NOT EXISTS push_queue (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				subscription_id INTEGER NOT NULL,
+				payload BLOB NOT NULL,
+				topic TEXT NOT NULL DEFAULT '',
+				urgency TEXT NOT NULL DEFAULT 'normal',
+				ttl INTEGER NOT NULL,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				next_attempt_at TIMESTAMP NOT NULL,
+				locked_until TIMESTAMP,
+				created_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (subscription_id) REFERENCES push_subscriptions(id)
+			)`,
+				"CREATE INDEX IF NOT EXISTS idx_push_queue_next_attempt ON push_queue(next_attempt_at)",
+				"CREATE INDEX IF NOT EXISTS idx_push_queue_subscription ON push_queue(subscription_id, topic)",
+				`CREATE TABLE IF NOT EXISTS push_counters (
+				name TEXT PRIMARY KEY,
+				value INTEGER NOT NULL DEFAULT 0
+			)`),
+		},
+		down: []step{
+			exec("DROP TABLE IF EXISTS push_counters", "DROP TABLE IF EXISTS push_queue"),
+			dropColumn("push_subscriptions", "last_failure_at"),
+			dropColumn("push_subscriptions", "last_success_at"),
+			dropColumn("push_subscriptions", "failure_count"),
+		},
+	},
+	{
+		// How each subscription is reached: webpush, fcm or webhook
+		version: 14,
+		name:    "push providers",
+		up:      []step{addColumn("push_subscriptions", "provider", "TEXT NOT NULL DEFAULT 'webpush'")},
+		down:    []step{dropColumn("push_subscriptions", "provider")},
+	},
+	{
+		// Invite order, which the rowid kept until PostgreSQL was supported
+		version: 15,
+		name:    "call participant order",
+		up:      []step{addColumn("call_participants", "seq", "INTEGER NOT NULL DEFAULT 0")},
+		down:    []step{dropColumn("call_participants", "seq")},
+	},
+	{
+		// A direct conversation's users as (lower id, higher id), unique so
+		// concurrent first messages on any node open a single conversation.
+		// Only the oldest of any existing duplicates keeps the pair.
+		version: 16,
+		name:    "direct conversation pairs",
+		up: []step{
+			addColumn("conversations", "direct_low", "INTEGER"),
+			addColumn("conversations", "direct_high", "INTEGER"),
+			exec(`UPDATE conversations SET
+				direct_low = (SELECT MIN(user_id) FROM conversation_participants cp WHERE cp.conversation_id = conversations.id),
+				direct_high = (SELECT MAX(user_id) FROM conversation_participants cp WHERE cp.conversation_id = conversations.id)
+			WHERE (SELECT COUNT(*) FROM conversation_participants cp WHERE cp.conversation_id = conversations.id) = 2`,
+				`UPDATE conversations SET direct_low = NULL, direct_high = NULL
+			WHERE EXISTS (
+				SELECT 1 FROM conversations older
+				WHERE older.direct_low = conversations.direct_low
+					AND older.direct_high = conversations.direct_high
+					AND older.id < conversations.id
+			)`,
+				"CREATE UNIQUE INDEX IF NOT EXISTS idx_conversations_direct ON conversations(direct_low, direct_high)"),
+		},
+		down: []step{
+			exec("DROP INDEX IF EXISTS idx_conversations_direct"),
+			dropColumn("conversations", "direct_high"),
+			dropColumn("conversations", "direct_low"),
+		},
+	},
+}
+
+// LatestVersion is the schema version this binary migrates to.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// applied reads the applied migrations by version, creating the tracking
+// table on first use.
+func (db *DB) applied() (map[int]Migration, error) {
+	if _, err := db.conn.Exec(db.dialect.ddl(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	rows, err := db.conn.Query("SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]Migration)
+	for rows.Next() {
+		var m Migration
+		var at time.Time
+		if err := rows.Scan(&m.Version, &m.Name, &at); err != nil {
+			return nil, fmt.Errorf("failed to read schema_migrations: %w", err)
+		}
+		m.AppliedAt = &at
+		applied[m.Version] = m
+	}
+	return applied, rows.Err()
+}
+
+// Version is the newest migration applied to the database, 0 if none.
+func (db *DB) Version() (int, error) {
+	applied, err := db.applied()
+	if err != nil {
+		return 0, err
+	}
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// checkVersion refuses a database migrated past what this binary knows.
+func (db *DB) checkVersion(applied map[int]Migration) error {
+	for v := range applied {
+		if v > LatestVersion() {
+			return fmt.Errorf("%w: it has migration %d, this binary knows up to %d", ErrSchemaTooNew, v, LatestVersion())
+		}
+	}
+	return nil
+}
+
+// MigrationStatus lists every known migration, applied or not, and any
+// unknown ones a newer binary applied.
+func (db *DB) MigrationStatus() ([]Migration, error) {
+	applied, err := db.applied()
+	if err != nil {
+		return nil, err
+	}
+	status := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		state := Migration{Version: m.version, Name: m.name}
+		if a, ok := applied[m.version]; ok {
+			state.AppliedAt = a.AppliedAt
+			delete(applied, m.version)
+		}
+		status = append(status, state)
+	}
+	unknown := make([]Migration, 0, len(applied))
+	for _, a := range applied {
+		a.Unknown = true
+		unknown = append(unknown, a)
+	}
+	sort.Slice(unknown, func(i, j int) bool { return unknown[i].Version < unknown[j].Version })
+	return append(status, unknown...), nil
+}
+
+// MigrateUp applies pending migrations up to and including target, or all
+// of them if target is 0. Each runs in its own transaction. It returns the
+// migrations applied.
+func (db *DB) MigrateUp(target int) ([]Migration, error) {
+	unlock, err := db.dialect.lock(db.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := db.applied()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.checkVersion(applied); err != nil {
+		return nil, err
+	}
+	if target == 0 {
+		target = LatestVersion()
+	}
+
+	var done []Migration
+	for _, m := range migrations {
+		if m.version > target {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if err := db.run(m, m.up, true); err != nil {
+			return done, err
+		}
+		done = append(done, Migration{Version: m.version, Name: m.name})
+	}
+	return done, nil
+}
+
+// MigrateDown rolls back applied migrations newer than target, newest
+// first. It returns the migrations rolled back.
+func (db *DB) MigrateDown(target int) ([]Migration, error) {
+	unlock, err := db.dialect.lock(db.conn)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	applied, err := db.applied()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.checkVersion(applied); err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= target {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if err := db.run(m, m.down, false); err != nil {
+			return done, err
+		}
+		done = append(done, Migration{Version: m.version, Name: m.name})
+	}
+	return done, nil
+}
+
+// run applies steps and records the migration as applied (up) or not (down)
+// in one transaction.
+func (db *DB) run(m migration, steps []step, up bool) error {
+	direction := "up"
+	if !up {
+		direction = "down"
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("migration %d (%s) %s: %w", m.version, m.name, direction, err)
+	}
+	defer tx.Rollback()
+
+	for _, s := range steps {
+		if err := s(tx); err != nil {
+			return fmt.Errorf("migration %d (%s) %s: %w", m.version, m.name, direction, err)
+		}
+	}
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name)
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = $1", m.version)
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d (%s) %s: %w", m.version, m.name, direction, err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type postgresDialect struct{}
+
+// migrationLock is the advisory lock id held while migrating, so nodes
+// starting together against one database take turns.
+const migrationLock = 0x7061_7961_6d62 // "payamb"
+
+func openPostgres(url string) (*DB, error) {
+	conn, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	conn.SetMaxOpenConns(25)
+	conn.SetMaxIdleConns(5)
+	conn.SetConnMaxLifetime(5 * time.Minute)
+
+	return &DB{conn: conn, dialect: postgresDialect{}}, nil
+}
+
+func (postgresDialect) name() string { return Postgres }
+
+var (
+	autoincrement = regexp.MustCompile(`\bINTEGER PRIMARY KEY AUTOINCREMENT\b`)
+	integerType   = regexp.MustCompile(`\bINTEGER\b`)
+	blobType      = regexp.MustCompile(`\bBLOB\b`)
+	timestampType = regexp.MustCompile(`\bTIMESTAMP\b`)
+)
+
+// ddl maps SQLite column types to PostgreSQL ones. Times are stored with
+// their zone; ids are 64-bit like SQLite's.
+func (postgresDialect) ddl(stmt string) string {
+	stmt = autoincrement.ReplaceAllString(stmt, "BIGSERIAL PRIMARY KEY")
+	stmt = integerType.ReplaceAllString(stmt, "BIGINT")
+	stmt = blobType.ReplaceAllString(stmt, "BYTEA")
+	return timestampType.ReplaceAllString(stmt, "TIMESTAMPTZ")
+}
+
+func (postgresDialect) query(stmt string) string { return stmt }
+
+func (postgresDialect) forUpdate() string { return " FOR UPDATE" }
+
+func (postgresDialect) later(column string, ago time.Duration) string {
+	return fmt.Sprintf("%s > now() - interval '%d seconds'", column, int64(ago/time.Second))
+}
+
+func (postgresDialect) hasColumn(tx *Tx, table, column string) (bool, error) {
+	var n int
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2
+	`, table, column).Scan(&n)
+	return n > 0, err
+}
+
+func (postgresDialect) lock(conn *sql.DB) (func(), error) {
+	ctx := context.Background()
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	if _, err := c.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	return func() {
+		c.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLock)
+		c.Close()
+	}, nil
+}
+
+func isPostgresUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
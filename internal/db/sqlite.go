@@ -0,0 +1,100 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+type sqliteDialect struct{}
+
+func openSQLite(path string) (*DB, error) {
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// Test connection
+	if err := conn.Ping(); err != nil {
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	// Enable WAL mode for concurrent writes and reads
+	// WAL mode allows readers to work while a writer is writing
+	if _, err := conn.Exec("PRAGMA journal_mode=WAL"); err != nil {
+		return nil, fmt.Errorf("failed to enable WAL mode: %w", err)
+	}
+
+	// Set busy timeout to 5 seconds (waits instead of immediate SQLITE_BUSY error)
+	// This helps with concurrent write attempts
+	if _, err := conn.Exec("PRAGMA busy_timeout=5000"); err != nil {
+		return nil, fmt.Errorf("failed to set busy timeout: %w", err)
+	}
+
+	// Use NORMAL synchronous mode (faster than FULL, still safe with WAL)
+	// FULL=safest but slower, NORMAL=good balance, OFF=fastest but risky
+	if _, err := conn.Exec("PRAGMA synchronous=NORMAL"); err != nil {
+		return nil, fmt.Errorf("failed to set synchronous mode: %w", err)
+	}
+
+	// Optional: Set cache size for better performance (negative = KB, positive = pages)
+	// -64000 = 64MB cache
+	if _, err := conn.Exec("PRAGMA cache_size=-64000"); err != nil {
+		return nil, fmt.Errorf("failed to set cache size: %w", err)
+	}
+
+	// Configure connection pool
+	// With WAL mode, you can have more concurrent connections
+	conn.SetMaxOpenConns(25)
+	conn.SetMaxIdleConns(5)
+	conn.SetConnMaxLifetime(5 * time.Minute)
+
+	return &DB{conn: conn, dialect: sqliteDialect{}}, nil
+}
+
+func (sqliteDialect) name() string { return SQLite }
+
+// The schema is written for SQLite, so it passes through.
+func (sqliteDialect) ddl(stmt string) string { return stmt }
+
+var numberedParam = regexp.MustCompile(`\$(\d+)`)
+
+// query turns $N into ?N. SQLite reads $N as a named parameter and numbers
+// those in order of first appearance, so "$2 ... $1" would bind the wrong
+// arguments; ?N binds argument N.
+func (sqliteDialect) query(stmt string) string {
+	if !strings.Contains(stmt, "$") {
+		return stmt
+	}
+	return numberedParam.ReplaceAllString(stmt, "?$1")
+}
+
+func (sqliteDialect) forUpdate() string { return "" }
+
+// Times written by CURRENT_TIMESTAMP and by the driver are formatted
+// differently, so both sides go through datetime before comparing.
+func (sqliteDialect) later(column string, ago time.Duration) string {
+	return fmt.Sprintf("datetime(%s) > datetime('now', '-%d seconds')", column, int64(ago/time.Second))
+}
+
+func (sqliteDialect) hasColumn(tx *Tx, table, column string) (bool, error) {
+	var n int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, column).Scan(&n)
+	return n > 0, err
+}
+
+// A SQLite file is served by a single process, so migrations need no lock.
+func (sqliteDialect) lock(conn *sql.DB) (func(), error) {
+	return func() {}, nil
+}
+
+func isSQLiteUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) &&
+		(sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey)
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4xmen/payambar/internal/auth"
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+// SessionTerminator closes a user's live WebSocket connection
+type SessionTerminator interface {
+	DisconnectUser(userID int)
+}
+
+// StatsProvider returns instance statistics for the admin dashboard
+type StatsProvider func() interface{}
+
+type AdminHandler struct {
+	store      *store.Store
+	authSvc    *auth.Service
+	msgHandler *MessageHandler
+	sessions   SessionTerminator
+	stats      StatsProvider
+}
+
+func NewAdminHandler(db *db.DB, authSvc *auth.Service, msgHandler *MessageHandler, sessions SessionTerminator, stats StatsProvider) *AdminHandler {
+	return &AdminHandler{
+		store:      store.New(db),
+		authSvc:    authSvc,
+		msgHandler: msgHandler,
+		sessions:   sessions,
+		stats:      stats,
+	}
+}
+
+type AdminUser struct {
+	ID          int        `json:"id"`
+	Username    string     `json:"username"`
+	DisplayName *string    `json:"display_name,omitempty"`
+	Role        string     `json:"role"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	IsOnline    bool       `json:"is_online"`
+}
+
+// ListUsers lists or searches all accounts
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 200 {
+		limit = 50
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	found, total, err := h.store.Users.Search(strings.TrimSpace(c.Query("q")), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch users")})
+		return
+	}
+
+	users := make([]AdminUser, 0, len(found))
+	for _, u := range found {
+		users = append(users, AdminUser{
+			ID:          u.ID,
+			Username:    u.Username,
+			DisplayName: u.DisplayName,
+			Role:        u.Role,
+			SuspendedAt: u.SuspendedAt,
+			CreatedAt:   u.CreatedAt,
+			IsOnline:    h.msgHandler.onlineChecker != nil && h.msgHandler.onlineChecker.IsUserOnline(u.ID),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users, "total": total, "limit": limit, "offset": offset})
+}
+
+// GetStats returns instance statistics
+func (h *AdminHandler) GetStats(c *gin.Context) {
+	if h.stats == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": __("stats unavailable")})
+		return
+	}
+	c.JSON(http.StatusOK, h.stats())
+}
+
+// SetUserRole promotes or demotes a user
+func (h *AdminHandler) SetUserRole(c *gin.Context) {
+	targetID, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
+
+	if err := h.authSvc.SetRole(targetID, req.Role); err != nil {
+		h.userError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": targetID, "role": req.Role})
+}
+
+// SuspendUser blocks a user from logging in and drops their sessions
+func (h *AdminHandler) SuspendUser(c *gin.Context) {
+	targetID, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.authSvc.SetSuspended(targetID, true); err != nil {
+		h.userError(c, err)
+		return
+	}
+	h.disconnect(targetID)
+
+	c.JSON(http.StatusOK, gin.H{"status": "suspended"})
+}
+
+// UnsuspendUser lets a suspended user log in again
+func (h *AdminHandler) UnsuspendUser(c *gin.Context) {
+	targetID, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.authSvc.SetSuspended(targetID, false); err != nil {
+		h.userError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "active"})
+}
+
+// ForceLogout revokes all of a user's tokens and closes their connection
+func (h *AdminHandler) ForceLogout(c *gin.Context) {
+	targetID, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	if err := h.authSvc.RevokeSessions(targetID); err != nil {
+		h.userError(c, err)
+		return
+	}
+	h.disconnect(targetID)
+
+	c.JSON(http.StatusOK, gin.H{"status": "logged_out"})
+}
+
+// DeleteUser deletes an account with the same cleanup as DeleteAccount
+func (h *AdminHandler) DeleteUser(c *gin.Context) {
+	targetID, ok := h.targetUser(c)
+	if !ok {
+		return
+	}
+
+	if status, err := h.msgHandler.deleteUserAccount(targetID); err != nil {
+		c.JSON(status, gin.H{"error": __(err.Error())})
+		return
+	}
+	h.disconnect(targetID)
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// targetUser parses the :id parameter; admins cannot act on their own account
+func (h *AdminHandler) targetUser(c *gin.Context) (int, bool) {
+	targetID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid user id")})
+		return 0, false
+	}
+	if userID, _ := c.Get("user_id"); userID == targetID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("cannot modify your own account")})
+		return 0, false
+	}
+	return targetID, true
+}
+
+func (h *AdminHandler) userError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, auth.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": __(err.Error())})
+	case err.Error() == "invalid role":
+		c.JSON(http.StatusBadRequest, gin.H{"error": __(err.Error())})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to update user")})
+	}
+}
+
+func (h *AdminHandler) disconnect(userID int) {
+	if h.sessions != nil {
+		h.sessions.DisconnectUser(userID)
+	}
+}
@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/4xmen/payambar/internal/auth"
 	"github.com/gin-gonic/gin"
@@ -16,8 +19,9 @@ func NewAuthHandler(authSvc *auth.Service) *AuthHandler {
 }
 
 type RegisterRequest struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Username   string `json:"username" binding:"required"`
+	Password   string `json:"password" binding:"required"`
+	InviteCode string `json:"invite_code"`
 }
 
 type LoginRequest struct {
@@ -39,7 +43,11 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	userID, err := h.authSvc.Register(req.Username, req.Password)
+	userID, err := h.authSvc.RegisterWithInvite(req.Username, req.Password, req.InviteCode)
+	if errors.Is(err, auth.ErrRegistrationClosed) {
+		c.JSON(http.StatusForbidden, gin.H{"error": __(err.Error())})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": __(err.Error())})
 		return
@@ -67,7 +75,35 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	token, err := h.authSvc.Login(req.Username, req.Password)
+	token, err := h.authSvc.Login(req.Username, req.Password, c.ClientIP())
+	var lockoutErr *auth.LockoutError
+	if errors.As(err, &lockoutErr) {
+		retryAfter := int(math.Ceil(lockoutErr.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": __(err.Error()), "retry_after": retryAfter})
+		return
+	}
+	var passkeyErr *auth.PasskeyRequiredError
+	if errors.As(err, &passkeyErr) {
+		// Password accepted; the client must finish with FinishPasskeyLogin,
+		// passing back the pre-auth token
+		c.JSON(http.StatusUnauthorized, gin.H{
+			"error":            __(err.Error()),
+			"passkey_required": true,
+			"session_id":       passkeyErr.SessionID,
+			"preauth_token":    passkeyErr.PreAuthToken,
+			"publicKey":        passkeyErr.Assertion.Response,
+		})
+		return
+	}
+	if errors.Is(err, auth.ErrAccountSuspended) {
+		c.JSON(http.StatusForbidden, gin.H{"error": __(err.Error())})
+		return
+	}
+	if errors.Is(err, auth.ErrSecondFactorUnavailable) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": __(err.Error())})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": __(err.Error())})
 		return
@@ -90,24 +126,51 @@ func (h *AuthHandler) Login(c *gin.Context) {
 // AuthMiddleware validates JWT token
 func (h *AuthHandler) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Try to get token from Authorization header first
-		authHeader := c.GetHeader("Authorization")
-		token := ""
-
-		if authHeader != "" {
-			// Extract token from "Bearer <token>"
-			if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-				token = authHeader[7:]
+		token := bearerToken(c)
+		if token == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": __("missing authorization token")})
+			c.Abort()
+			return
+		}
+
+		claims, err := h.authSvc.ValidateToken(token)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": __("invalid token")})
+			c.Abort()
+			return
+		}
+
+		h.authorize(c, claims)
+	}
+}
+
+// WSAuthMiddleware authenticates WebSocket upgrades with a ticket from
+// CreateWSTicket, or a bearer header for clients that can send one. With
+// allowQueryToken it also accepts the JWT as ?token=, the legacy behavior
+// that exposes the token to access logs and proxies.
+func (h *AuthHandler) WSAuthMiddleware(allowQueryToken bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ticket := c.Query("ticket"); ticket != "" {
+			claims, err := h.authSvc.RedeemWSTicket(ticket)
+			if err != nil {
+				if errors.Is(err, auth.ErrInvalidTicket) {
+					c.JSON(http.StatusUnauthorized, gin.H{"error": __(err.Error())})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to validate user")})
+				}
+				c.Abort()
+				return
 			}
+			h.authorize(c, claims)
+			return
 		}
 
-		// If not in header, try query parameter (for WebSocket)
-		if token == "" {
+		token := bearerToken(c)
+		if token == "" && allowQueryToken {
 			token = c.Query("token")
 		}
-
 		if token == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": __("missing authorization token")})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": __("missing websocket ticket")})
 			c.Abort()
 			return
 		}
@@ -118,21 +181,63 @@ func (h *AuthHandler) AuthMiddleware() gin.HandlerFunc {
 			c.Abort()
 			return
 		}
+		h.authorize(c, claims)
+	}
+}
 
-		exists, err := h.authSvc.UserExists(claims.UserID)
-		if err != nil {
+// CreateWSTicket mints a short-lived, single-use ticket for opening the
+// WebSocket as /ws?ticket=...
+func (h *AuthHandler) CreateWSTicket(c *gin.Context) {
+	claims := c.MustGet("claims").(*auth.Claims)
+	ticket, expiresAt, err := h.authSvc.CreateWSTicket(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to create ticket")})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"ticket": ticket, "expires_at": expiresAt})
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header.
+func bearerToken(c *gin.Context) string {
+	authHeader := c.GetHeader("Authorization")
+	if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+		return authHeader[7:]
+	}
+	return ""
+}
+
+// authorize checks that the session behind claims is still valid and stores
+// the user in the context.
+func (h *AuthHandler) authorize(c *gin.Context, claims *auth.Claims) {
+	role, err := h.authSvc.Authorize(claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, auth.ErrAccountSuspended):
+			c.JSON(http.StatusForbidden, gin.H{"error": __(err.Error())})
+		case errors.Is(err, auth.ErrUserNotFound), errors.Is(err, auth.ErrSessionRevoked):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": __(err.Error())})
+		default:
 			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to validate user")})
-			c.Abort()
-			return
 		}
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": __("user not found")})
+		c.Abort()
+		return
+	}
+
+	c.Set("user_id", claims.UserID)
+	c.Set("username", claims.Username)
+	c.Set("role", role)
+	c.Set("claims", claims)
+	c.Next()
+}
+
+// AdminMiddleware rejects non-admin users; it must run after AuthMiddleware
+func (h *AuthHandler) AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if role, _ := c.Get("role"); role != auth.RoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": __("admin access required")})
 			c.Abort()
 			return
 		}
-
-		c.Set("user_id", claims.UserID)
-		c.Set("username", claims.Username)
 		c.Next()
 	}
 }
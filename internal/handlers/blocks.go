@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type BlockedUser struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	DisplayName *string   `json:"display_name,omitempty"`
+	AvatarURL   *string   `json:"avatar_url,omitempty"`
+	BlockedAt   time.Time `json:"blocked_at"`
+}
+
+// BlockUser blocks another user. The blocked user is not told: their
+// messages are still accepted but never shown to the blocker.
+func (h *MessageHandler) BlockUser(c *gin.Context) {
+	currentUserID, targetID, ok := h.blockTarget(c)
+	if !ok {
+		return
+	}
+
+	if exists, err := h.store.Users.Exists(targetID); err != nil || !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": __("user not found")})
+		return
+	}
+
+	if err := h.store.Blocks.Block(currentUserID, targetID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to block user")})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "blocked"})
+}
+
+// UnblockUser removes a block. Messages sent while blocked stay hidden.
+func (h *MessageHandler) UnblockUser(c *gin.Context) {
+	currentUserID, targetID, ok := h.blockTarget(c)
+	if !ok {
+		return
+	}
+
+	if err := h.store.Blocks.Unblock(currentUserID, targetID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to unblock user")})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "unblocked"})
+}
+
+// GetBlockedUsers lists the users the current user has blocked
+func (h *MessageHandler) GetBlockedUsers(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	blocked, err := h.store.Blocks.List(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch blocked users")})
+		return
+	}
+
+	users := make([]BlockedUser, 0, len(blocked))
+	for _, u := range blocked {
+		users = append(users, BlockedUser(u))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+func (h *MessageHandler) blockTarget(c *gin.Context) (int, int, bool) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return 0, 0, false
+	}
+
+	targetID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid user id")})
+		return 0, 0, false
+	}
+	if targetID == userID.(int) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("cannot block yourself")})
+		return 0, 0, false
+	}
+
+	return userID.(int), targetID, true
+}
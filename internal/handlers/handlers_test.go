@@ -2,22 +2,29 @@ package handlers
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/json"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/4xmen/payambar/internal/auth"
+	"github.com/4xmen/payambar/internal/conversation"
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/db/dbtest"
+	"github.com/4xmen/payambar/internal/models"
+	"github.com/4xmen/payambar/internal/push"
+	"github.com/4xmen/payambar/internal/store"
 	"github.com/gin-gonic/gin"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
-	testDB        *sql.DB
+	testDB        *db.DB
 	testAuthSvc   *auth.Service
 	testRouter    *gin.Engine
 	testUploadDir string
@@ -26,110 +33,15 @@ var (
 func TestMain(m *testing.M) {
 	gin.SetMode(gin.TestMode)
 
-	// Create in-memory SQLite database with shared cache mode
-	// This ensures all connections in the pool share the same database
+	// Tests run against a SQLite file, or a schema of their own in the
+	// PostgreSQL database in TEST_DATABASE_URL
 	var err error
-	testDB, err = sql.Open("sqlite3", "file::memory:?cache=shared")
+	var closeDB func()
+	testDB, closeDB, err = dbtest.Open()
 	if err != nil {
 		panic(err)
 	}
 
-	// Run migrations
-	_, err = testDB.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			display_name TEXT,
-			avatar_url TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-
-		CREATE TABLE IF NOT EXISTS conversations (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-
-		CREATE TABLE IF NOT EXISTS conversation_participants (
-			conversation_id INTEGER NOT NULL,
-			user_id INTEGER NOT NULL,
-			joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			PRIMARY KEY (conversation_id, user_id)
-		);
-
-		CREATE TABLE IF NOT EXISTS messages (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			sender_id INTEGER NOT NULL,
-			receiver_id INTEGER NOT NULL,
-			content TEXT NOT NULL,
-			encrypted INTEGER NOT NULL DEFAULT 0,
-			e2ee_v INTEGER,
-			alg TEXT,
-			sender_device_id TEXT,
-			key_id TEXT,
-			iv TEXT,
-			ciphertext TEXT,
-			aad TEXT,
-			status TEXT DEFAULT 'sent',
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			delivered_at TIMESTAMP,
-			read_at TIMESTAMP,
-			FOREIGN KEY (sender_id) REFERENCES users(id),
-			FOREIGN KEY (receiver_id) REFERENCES users(id)
-		);
-
-		CREATE TABLE IF NOT EXISTS files (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			message_id INTEGER NOT NULL,
-			file_name TEXT NOT NULL,
-			file_path TEXT NOT NULL,
-			file_size INTEGER NOT NULL,
-			content_type TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			FOREIGN KEY (message_id) REFERENCES messages(id)
-		);
-
-		CREATE TABLE IF NOT EXISTS user_device_keys (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			device_id TEXT NOT NULL,
-			algorithm TEXT NOT NULL,
-			public_key TEXT NOT NULL,
-			key_id TEXT NOT NULL,
-			enc_private_key TEXT,
-			enc_private_key_iv TEXT,
-			kdf_salt TEXT,
-			kdf_iterations INTEGER,
-			kdf_alg TEXT,
-			key_wrap_version INTEGER,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			revoked_at TIMESTAMP,
-			UNIQUE (user_id, device_id, key_id)
-		);
-
-		CREATE TABLE IF NOT EXISTS push_subscriptions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			endpoint TEXT NOT NULL,
-			p256dh TEXT NOT NULL,
-			auth TEXT NOT NULL,
-			user_agent TEXT,
-			device_label TEXT,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			revoked_at TIMESTAMP,
-			FOREIGN KEY (user_id) REFERENCES users(id)
-		);
-	`)
-	if err != nil {
-		panic(err)
-	}
-
-	// Create unique index required for ON CONFLICT(endpoint)
-	testDB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_push_subscriptions_endpoint_unique ON push_subscriptions(endpoint)")
-
 	testUploadDir, err = os.MkdirTemp("", "payambar-test-uploads")
 	if err != nil {
 		panic(err)
@@ -141,7 +53,7 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 
 	os.RemoveAll(testUploadDir)
-	testDB.Close()
+	closeDB()
 	os.Exit(code)
 }
 
@@ -153,6 +65,7 @@ func setupTestRouter() *gin.Engine {
 
 	api := router.Group("/api")
 	{
+		api.GET("/auth/registration", authHandler.GetRegistrationMode)
 		api.POST("/auth/register", authHandler.Register)
 		api.POST("/auth/login", authHandler.Login)
 	}
@@ -168,11 +81,48 @@ func setupTestRouter() *gin.Engine {
 		protected.GET("/users", msgHandler.GetUsers)
 		protected.POST("/conversations", msgHandler.CreateConversation)
 		protected.DELETE("/conversations/:id", msgHandler.DeleteConversation)
+		protected.GET("/conversations/:id/notifications", msgHandler.GetConversationNotifications)
+		protected.PUT("/conversations/:id/notifications", msgHandler.UpdateConversationNotifications)
+		protected.DELETE("/conversations/:id/notifications", msgHandler.ResetConversationNotifications)
+		protected.GET("/notifications/settings", msgHandler.GetNotificationSettings)
+		protected.PUT("/notifications/settings", msgHandler.UpdateNotificationSettings)
 		protected.PUT("/messages/:id/delivered", msgHandler.MarkAsDelivered)
 		protected.PUT("/messages/:id/read", msgHandler.MarkAsRead)
+		protected.GET("/profile", msgHandler.GetMyProfile)
+		protected.PUT("/profile", msgHandler.UpdateProfile)
 		protected.DELETE("/profile", msgHandler.DeleteAccount)
 		protected.POST("/push/subscribe", msgHandler.SubscribePush)
 		protected.DELETE("/push/subscribe", msgHandler.UnsubscribePush)
+		protected.GET("/push/subscriptions", msgHandler.GetPushSubscriptions)
+		protected.DELETE("/push/subscriptions/:id", msgHandler.DeletePushSubscription)
+		protected.POST("/push/subscriptions/:id/test", msgHandler.TestPushSubscription)
+		protected.GET("/invites", authHandler.GetInvites)
+		protected.POST("/invites", authHandler.CreateInvite)
+		protected.DELETE("/invites/:id", authHandler.RevokeInvite)
+		protected.POST("/upload", msgHandler.UploadFile)
+		protected.GET("/blocks", msgHandler.GetBlockedUsers)
+		protected.POST("/users/:id/block", msgHandler.BlockUser)
+		protected.DELETE("/users/:id/block", msgHandler.UnblockUser)
+		protected.POST("/ws/ticket", authHandler.CreateWSTicket)
+	}
+
+	router.GET("/ws", authHandler.WSAuthMiddleware(false), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetInt("user_id")})
+	})
+
+	adminHandler := NewAdminHandler(testDB, testAuthSvc, msgHandler, nil, func() interface{} {
+		return gin.H{"metrics": gin.H{"users": 0}}
+	})
+	admin := protected.Group("/admin")
+	admin.Use(authHandler.AdminMiddleware())
+	{
+		admin.GET("/stats", adminHandler.GetStats)
+		admin.GET("/users", adminHandler.ListUsers)
+		admin.PUT("/users/:id/role", adminHandler.SetUserRole)
+		admin.POST("/users/:id/suspend", adminHandler.SuspendUser)
+		admin.POST("/users/:id/unsuspend", adminHandler.UnsuspendUser)
+		admin.POST("/users/:id/logout", adminHandler.ForceLogout)
+		admin.DELETE("/users/:id", adminHandler.DeleteUser)
 	}
 
 	api.GET("/push/vapid-key", msgHandler.GetVAPIDKey)
@@ -181,27 +131,36 @@ func setupTestRouter() *gin.Engine {
 }
 
 func clearTestData() {
+	testDB.Exec("DELETE FROM notification_settings")
+	testDB.Exec("DELETE FROM call_participants")
+	testDB.Exec("DELETE FROM calls")
+	testDB.Exec("DELETE FROM ws_tickets")
+	testDB.Exec("DELETE FROM user_blocks")
+	testDB.Exec("DELETE FROM invites")
+	testDB.Exec("DELETE FROM login_failures")
+	testDB.Exec("DELETE FROM login_lockouts")
+	testDB.Exec("DELETE FROM push_queue")
 	testDB.Exec("DELETE FROM push_subscriptions")
 	testDB.Exec("DELETE FROM files")
 	testDB.Exec("DELETE FROM messages")
 	testDB.Exec("DELETE FROM conversation_participants")
 	testDB.Exec("DELETE FROM conversations")
+	testDB.Exec("DELETE FROM webauthn_sessions")
+	testDB.Exec("DELETE FROM webauthn_credentials")
+	testDB.Exec("DELETE FROM user_device_keys")
 	testDB.Exec("DELETE FROM users")
 }
 
 func insertDirectConversation(t *testing.T, user1ID, user2ID int) int64 {
 	t.Helper()
 
-	result, err := testDB.Exec("INSERT INTO conversations DEFAULT VALUES")
+	var convID int64
+	err := testDB.QueryRow("INSERT INTO conversations DEFAULT VALUES RETURNING id").Scan(&convID)
 	if err != nil {
 		t.Fatalf("Failed to create conversation: %v", err)
 	}
-	convID, err := result.LastInsertId()
-	if err != nil {
-		t.Fatalf("Failed to get conversation id: %v", err)
-	}
 	_, err = testDB.Exec(
-		`INSERT INTO conversation_participants (conversation_id, user_id) VALUES (?, ?), (?, ?)`,
+		`INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2), ($3, $4)`,
 		convID, user1ID, convID, user2ID,
 	)
 	if err != nil {
@@ -283,6 +242,84 @@ func TestRegister(t *testing.T) {
 	}
 }
 
+func TestInviteOnlyRegistration(t *testing.T) {
+	clearTestData()
+	t.Cleanup(func() { testAuthSvc.SetRegistrationMode(auth.RegistrationOpen) })
+
+	inviterID, _ := testAuthSvc.Register("inviter", "password123")
+	token, _ := testAuthSvc.GenerateToken(inviterID, "inviter")
+	adminID, _ := testAuthSvc.Register("inviteadmin", "password123")
+	testAuthSvc.SetRole(adminID, auth.RoleAdmin)
+	adminToken, _ := testAuthSvc.GenerateToken(adminID, "inviteadmin")
+	testAuthSvc.SetRegistrationMode(auth.RegistrationInvite)
+
+	register := func(username, code string) int {
+		body, _ := json.Marshal(map[string]string{"username": username, "password": "password123", "invite_code": code})
+		req := httptest.NewRequest("POST", "/api/auth/register", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	req := httptest.NewRequest("GET", "/api/auth/registration", nil)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"mode":"invite"`) {
+		t.Fatalf("registration mode response = %s", w.Body.String())
+	}
+
+	if code := register("invitee", ""); code != http.StatusBadRequest {
+		t.Fatalf("register without invite: status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	body, _ := json.Marshal(map[string]int{"max_uses": 1, "expires_in_hours": 24})
+	req = httptest.NewRequest("POST", "/api/invites", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create invite: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var invite auth.Invite
+	json.Unmarshal(w.Body.Bytes(), &invite)
+
+	createInvite := func(token string, maxUses int) int {
+		body, _ := json.Marshal(map[string]int{"max_uses": maxUses})
+		req := httptest.NewRequest("POST", "/api/invites", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := createInvite(token, 5); code != http.StatusForbidden {
+		t.Fatalf("member multi-use invite: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := createInvite(adminToken, 5); code != http.StatusCreated {
+		t.Fatalf("admin multi-use invite: status = %d, want %d", code, http.StatusCreated)
+	}
+
+	if code := register("invitee", invite.Code); code != http.StatusCreated {
+		t.Fatalf("register with invite: status = %d, want %d", code, http.StatusCreated)
+	}
+	if code := register("invitee2", invite.Code); code != http.StatusBadRequest {
+		t.Fatalf("register with used invite: status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	testAuthSvc.SetRegistrationMode(auth.RegistrationClosed)
+	if code := register("invitee3", invite.Code); code != http.StatusForbidden {
+		t.Fatalf("register while closed: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := createInvite(token, 1); code != http.StatusForbidden {
+		t.Fatalf("member invite while closed: status = %d, want %d", code, http.StatusForbidden)
+	}
+	if code := createInvite(adminToken, 1); code != http.StatusCreated {
+		t.Fatalf("admin invite while closed: status = %d, want %d", code, http.StatusCreated)
+	}
+}
+
 func TestLogin(t *testing.T) {
 	clearTestData()
 
@@ -334,6 +371,50 @@ func TestLogin(t *testing.T) {
 	}
 }
 
+func TestLoginLockout(t *testing.T) {
+	clearTestData()
+
+	if _, err := testAuthSvc.Register("lockeduser", "password123"); err != nil {
+		t.Fatalf("Failed to create test user: %v", err)
+	}
+
+	login := func(username, password string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+		req := httptest.NewRequest("POST", "/api/auth/login", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, username := range []string{"lockeduser", "ghostuser"} {
+		for i := 0; i < auth.DefaultLockoutPolicy.Threshold; i++ {
+			if w := login(username, "wrongpassword"); w.Code != http.StatusUnauthorized {
+				t.Fatalf("%s attempt %d: status = %d, want %d", username, i+1, w.Code, http.StatusUnauthorized)
+			}
+		}
+
+		// Locked even with the right password, and unknown users behave the same
+		w := login(username, "password123")
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("%s locked login: status = %d, want %d", username, w.Code, http.StatusTooManyRequests)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Fatalf("%s locked login: missing Retry-After header", username)
+		}
+	}
+
+	var failures int
+	testDB.QueryRow("SELECT COUNT(*) FROM login_failures WHERE username = $1 AND reason = 'bad_password'", "lockeduser").Scan(&failures)
+	if failures != auth.DefaultLockoutPolicy.Threshold {
+		t.Fatalf("bad_password audit rows = %d, want %d", failures, auth.DefaultLockoutPolicy.Threshold)
+	}
+	testDB.QueryRow("SELECT COUNT(*) FROM login_failures WHERE username = $1 AND reason = 'unknown_user'", "ghostuser").Scan(&failures)
+	if failures != auth.DefaultLockoutPolicy.Threshold {
+		t.Fatalf("unknown_user audit rows = %d, want %d", failures, auth.DefaultLockoutPolicy.Threshold)
+	}
+}
+
 func TestConversations(t *testing.T) {
 	clearTestData()
 
@@ -466,14 +547,15 @@ func TestMessages(t *testing.T) {
 	insertDirectConversation(t, user1ID, user2ID)
 
 	// Insert a test message
-	result, err := testDB.Exec(`
+	var msgID int64
+	err := testDB.QueryRow(`
 		INSERT INTO messages (sender_id, receiver_id, content, status) 
-		VALUES (?, ?, ?, 'sent')
-	`, user1ID, user2ID, "Hello!")
+		VALUES ($1, $2, $3, 'sent')
+		RETURNING id
+	`, user1ID, user2ID, "Hello!").Scan(&msgID)
 	if err != nil {
 		t.Fatalf("Failed to insert message: %v", err)
 	}
-	msgID, _ := result.LastInsertId()
 
 	t.Run("get messages", func(t *testing.T) {
 		req := httptest.NewRequest("GET", "/api/messages?user_id="+strconv.Itoa(user2ID), nil)
@@ -524,11 +606,12 @@ func TestMessages(t *testing.T) {
 
 	t.Run("cannot mark other's message as delivered", func(t *testing.T) {
 		// Insert another message from user2 to user1
-		result2, _ := testDB.Exec(`
+		var msgID2 int64
+		testDB.QueryRow(`
 			INSERT INTO messages (sender_id, receiver_id, content, status) 
-			VALUES (?, ?, ?, 'sent')
-		`, user2ID, user1ID, "Reply!")
-		msgID2, _ := result2.LastInsertId()
+			VALUES ($1, $2, $3, 'sent')
+			RETURNING id
+		`, user2ID, user1ID, "Reply!").Scan(&msgID2)
 
 		// Try to mark it as delivered by user2 (who is the sender, not receiver)
 		req := httptest.NewRequest("PUT", "/api/messages/"+strconv.FormatInt(msgID2, 10)+"/delivered", nil)
@@ -653,14 +736,15 @@ func TestDeleteConversationCleansUpData(t *testing.T) {
 
 	convID := insertDirectConversation(t, user1ID, user2ID)
 
-	messageResult, err := testDB.Exec(`
+	var messageID int64
+	err := testDB.QueryRow(`
 		INSERT INTO messages (sender_id, receiver_id, content, status)
-		VALUES (?, ?, ?, 'sent')
-	`, user1ID, user2ID, "conversation delete test")
+		VALUES ($1, $2, $3, 'sent')
+		RETURNING id
+	`, user1ID, user2ID, "conversation delete test").Scan(&messageID)
 	if err != nil {
 		t.Fatalf("Failed to insert message: %v", err)
 	}
-	messageID, _ := messageResult.LastInsertId()
 
 	filePath := filepath.Join(testUploadDir, "delete-conversation.txt")
 	if err := os.WriteFile(filePath, []byte("test"), 0o644); err != nil {
@@ -668,7 +752,7 @@ func TestDeleteConversationCleansUpData(t *testing.T) {
 	}
 	_, err = testDB.Exec(`
 		INSERT INTO files (message_id, file_name, file_path, file_size, content_type)
-		VALUES (?, ?, ?, ?, ?)
+		VALUES ($1, $2, $3, $4, $5)
 	`, messageID, "delete-conversation.txt", filePath, 4, "text/plain")
 	if err != nil {
 		t.Fatalf("Failed to insert file record: %v", err)
@@ -685,21 +769,21 @@ func TestDeleteConversationCleansUpData(t *testing.T) {
 	}
 
 	var count int
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversations WHERE id = ?", convID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversations WHERE id = $1", convID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check conversations: %v", err)
 	}
 	if count != 0 {
 		t.Fatalf("Expected conversation to be deleted, got count=%d", count)
 	}
 
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = ?", convID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = $1", convID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check conversation_participants: %v", err)
 	}
 	if count != 0 {
 		t.Fatalf("Expected conversation participants to be deleted, got count=%d", count)
 	}
 
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM messages WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)", user1ID, user2ID, user2ID, user1ID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM messages WHERE (sender_id = $1 AND receiver_id = $2) OR (sender_id = $3 AND receiver_id = $4)", user1ID, user2ID, user2ID, user1ID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check messages: %v", err)
 	}
 	if count != 0 {
@@ -727,13 +811,12 @@ func TestDeleteAccountConversationMembershipCleanup(t *testing.T) {
 
 	convID := insertDirectConversation(t, user1ID, user2ID)
 
-	orphanResult, err := testDB.Exec("INSERT INTO conversations DEFAULT VALUES")
-	if err != nil {
+	var orphanConvID int64
+	if err := testDB.QueryRow("INSERT INTO conversations DEFAULT VALUES RETURNING id").Scan(&orphanConvID); err != nil {
 		t.Fatalf("Failed to create orphan candidate conversation: %v", err)
 	}
-	orphanConvID, _ := orphanResult.LastInsertId()
 	if _, err := testDB.Exec(
-		"INSERT INTO conversation_participants (conversation_id, user_id) VALUES (?, ?)",
+		"INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2)",
 		orphanConvID, user1ID,
 	); err != nil {
 		t.Fatalf("Failed to attach orphan candidate participant: %v", err)
@@ -743,18 +826,19 @@ func TestDeleteAccountConversationMembershipCleanup(t *testing.T) {
 	if err := os.WriteFile(avatarFile, []byte("avatar"), 0o644); err != nil {
 		t.Fatalf("Failed to create avatar fixture: %v", err)
 	}
-	if _, err := testDB.Exec("UPDATE users SET avatar_url = ? WHERE id = ?", "/api/files/delacct-avatar.png", user1ID); err != nil {
+	if _, err := testDB.Exec("UPDATE users SET avatar_url = $1 WHERE id = $2", "/api/files/delacct-avatar.png", user1ID); err != nil {
 		t.Fatalf("Failed to set avatar url: %v", err)
 	}
 
-	messageResult, err := testDB.Exec(`
+	var messageID int64
+	err := testDB.QueryRow(`
 		INSERT INTO messages (sender_id, receiver_id, content, status)
-		VALUES (?, ?, ?, 'sent')
-	`, user1ID, user2ID, "delete account test")
+		VALUES ($1, $2, $3, 'sent')
+		RETURNING id
+	`, user1ID, user2ID, "delete account test").Scan(&messageID)
 	if err != nil {
 		t.Fatalf("Failed to insert message: %v", err)
 	}
-	messageID, _ := messageResult.LastInsertId()
 
 	filePath := filepath.Join(testUploadDir, "delete-account.txt")
 	if err := os.WriteFile(filePath, []byte("test"), 0o644); err != nil {
@@ -762,7 +846,7 @@ func TestDeleteAccountConversationMembershipCleanup(t *testing.T) {
 	}
 	if _, err := testDB.Exec(`
 		INSERT INTO files (message_id, file_name, file_path, file_size, content_type)
-		VALUES (?, ?, ?, ?, ?)
+		VALUES ($1, $2, $3, $4, $5)
 	`, messageID, "delete-account.txt", filePath, 4, "text/plain"); err != nil {
 		t.Fatalf("Failed to insert file record: %v", err)
 	}
@@ -778,42 +862,42 @@ func TestDeleteAccountConversationMembershipCleanup(t *testing.T) {
 	}
 
 	var count int
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM users WHERE id = ?", user1ID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM users WHERE id = $1", user1ID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check user delete: %v", err)
 	}
 	if count != 0 {
 		t.Fatalf("Expected user to be deleted, got count=%d", count)
 	}
 
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversation_participants WHERE user_id = ?", user1ID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversation_participants WHERE user_id = $1", user1ID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check membership cleanup: %v", err)
 	}
 	if count != 0 {
 		t.Fatalf("Expected user memberships to be deleted, got count=%d", count)
 	}
 
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversations WHERE id = ?", orphanConvID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversations WHERE id = $1", orphanConvID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check orphan conversation cleanup: %v", err)
 	}
 	if count != 0 {
 		t.Fatalf("Expected orphan conversation to be deleted, got count=%d", count)
 	}
 
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversations WHERE id = ?", convID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversations WHERE id = $1", convID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check retained conversation: %v", err)
 	}
 	if count != 1 {
 		t.Fatalf("Expected non-orphan conversation to remain, got count=%d", count)
 	}
 
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = ? AND user_id = ?", convID, user2ID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2", convID, user2ID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check remaining participant: %v", err)
 	}
 	if count != 1 {
 		t.Fatalf("Expected participant user2 to remain, got count=%d", count)
 	}
 
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM messages WHERE sender_id = ? OR receiver_id = ?", user1ID, user1ID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM messages WHERE sender_id = $1 OR receiver_id = $2", user1ID, user1ID).Scan(&count); err != nil {
 		t.Fatalf("Failed to check messages cleanup: %v", err)
 	}
 	if count != 0 {
@@ -838,13 +922,14 @@ func TestDeleteAccountConversationMembershipCleanup(t *testing.T) {
 func TestDeviceKeysAPI(t *testing.T) {
 	clearTestData()
 
-	result, err := testDB.Exec(`INSERT INTO users (username, password_hash) VALUES (?, ?), (?, ?)`, "keysuser1", "hash", "keysuser2", "hash")
+	var user1ID, user2ID int
+	err := testDB.QueryRow(`INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id`, "keysuser1", "hash").Scan(&user1ID)
+	if err == nil {
+		err = testDB.QueryRow(`INSERT INTO users (username, password_hash) VALUES ($1, $2) RETURNING id`, "keysuser2", "hash").Scan(&user2ID)
+	}
 	if err != nil {
 		t.Fatalf("failed to insert users: %v", err)
 	}
-	lastID, _ := result.LastInsertId()
-	user2ID := int(lastID)
-	user1ID := user2ID - 1
 	token1, _ := testAuthSvc.GenerateToken(user1ID, "keysuser1")
 
 	body := map[string]interface{}{
@@ -870,7 +955,7 @@ func TestDeviceKeysAPI(t *testing.T) {
 	}
 
 	var count int
-	if err := testDB.QueryRow("SELECT COUNT(*) FROM user_device_keys WHERE user_id = ?", user1ID).Scan(&count); err != nil {
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM user_device_keys WHERE user_id = $1", user1ID).Scan(&count); err != nil {
 		t.Fatalf("query device key count failed: %v", err)
 	}
 	if count != 1 {
@@ -957,7 +1042,7 @@ func TestPushSubscribe(t *testing.T) {
 
 		// Verify DB has the subscription
 		var count int
-		testDB.QueryRow("SELECT COUNT(*) FROM push_subscriptions WHERE user_id = ?", user1ID).Scan(&count)
+		testDB.QueryRow("SELECT COUNT(*) FROM push_subscriptions WHERE user_id = $1", user1ID).Scan(&count)
 		if count != 1 {
 			t.Fatalf("Expected 1 push subscription, got %d", count)
 		}
@@ -984,14 +1069,14 @@ func TestPushSubscribe(t *testing.T) {
 
 		// Should still be 1 subscription (upsert)
 		var count int
-		testDB.QueryRow("SELECT COUNT(*) FROM push_subscriptions WHERE user_id = ?", user1ID).Scan(&count)
+		testDB.QueryRow("SELECT COUNT(*) FROM push_subscriptions WHERE user_id = $1", user1ID).Scan(&count)
 		if count != 1 {
 			t.Fatalf("Expected 1 push subscription after re-subscribe, got %d", count)
 		}
 
 		// Verify keys were updated
 		var p256dh string
-		testDB.QueryRow("SELECT p256dh FROM push_subscriptions WHERE user_id = ?", user1ID).Scan(&p256dh)
+		testDB.QueryRow("SELECT p256dh FROM push_subscriptions WHERE user_id = $1", user1ID).Scan(&p256dh)
 		if p256dh != "updated-p256dh-key" {
 			t.Fatalf("Expected updated p256dh key, got %s", p256dh)
 		}
@@ -1033,7 +1118,7 @@ func TestPushSubscribe(t *testing.T) {
 
 		// Verify subscription was removed
 		var count int
-		testDB.QueryRow("SELECT COUNT(*) FROM push_subscriptions WHERE user_id = ? AND revoked_at IS NULL", user1ID).Scan(&count)
+		testDB.QueryRow("SELECT COUNT(*) FROM push_subscriptions WHERE user_id = $1 AND revoked_at IS NULL", user1ID).Scan(&count)
 		if count != 0 {
 			t.Fatalf("Expected 0 active push subscriptions after unsubscribe, got %d", count)
 		}
@@ -1053,3 +1138,707 @@ func TestGetVAPIDKey(t *testing.T) {
 		}
 	})
 }
+
+// fakePushNotifier records test notifications instead of queueing them.
+type fakePushNotifier struct {
+	tested []int64
+}
+
+func (f *fakePushNotifier) SendNewMessageNotification(push.Message) {}
+
+func (f *fakePushNotifier) SendTestNotification(subscriptionID int64) error {
+	f.tested = append(f.tested, subscriptionID)
+	return nil
+}
+
+func (f *fakePushNotifier) HasProvider(name string) bool {
+	return name == push.ProviderWebPush || name == push.ProviderWebhook
+}
+
+func (f *fakePushNotifier) VAPIDPublicKey() string {
+	return "test-vapid-key"
+}
+
+func TestPushSubscriptionDevices(t *testing.T) {
+	clearTestData()
+
+	aliceID, _ := testAuthSvc.Register("alice", "password123")
+	aliceToken, _ := testAuthSvc.GenerateToken(aliceID, "alice")
+	bobID, _ := testAuthSvc.Register("bob", "password123")
+	bobToken, _ := testAuthSvc.GenerateToken(bobID, "bob")
+
+	notifier := &fakePushNotifier{}
+	h := NewMessageHandler(testDB, nil, testUploadDir, 10_485_760, "", "", "", "", notifier)
+	router := gin.New()
+	protected := router.Group("/api", NewAuthHandler(testAuthSvc).AuthMiddleware())
+	protected.POST("/push/subscribe", h.SubscribePush)
+	protected.GET("/push/subscriptions", h.GetPushSubscriptions)
+	protected.DELETE("/push/subscriptions/:id", h.DeletePushSubscription)
+	protected.POST("/push/subscriptions/:id/test", h.TestPushSubscription)
+
+	request := func(method, path, token, body string) (int, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "Mozilla/5.0 (Android 14) Firefox/130.0")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	subscribe := func(endpoint, label string) int {
+		t.Helper()
+		code, resp := request("POST", "/api/push/subscribe", aliceToken,
+			`{"endpoint": "`+endpoint+`", "keys": {"p256dh": "k", "auth": "a"}, "label": "`+label+`"}`)
+		if code != http.StatusOK {
+			t.Fatalf("subscribe status = %d, body = %v", code, resp)
+		}
+		return int(resp["id"].(float64))
+	}
+
+	phone := subscribe("https://push.example.com/sub/phone", "  Phone  ")
+	laptop := subscribe("https://push.example.com/sub/laptop", "")
+	// Re-subscribing without a label keeps the old one
+	if again := subscribe("https://push.example.com/sub/phone", ""); again != phone {
+		t.Fatalf("re-subscribe id = %d, want %d", again, phone)
+	}
+
+	// Other providers need no keys, but must be enabled
+	if code, resp := request("POST", "/api/push/subscribe", aliceToken,
+		`{"provider": "webhook", "endpoint": "https://up.example.com/UP?token=abc"}`); code != http.StatusOK {
+		t.Fatalf("webhook subscribe status = %d, body = %v", code, resp)
+	}
+	if code, _ := request("POST", "/api/push/subscribe", aliceToken,
+		`{"provider": "webhook", "endpoint": "not a url"}`); code != http.StatusBadRequest {
+		t.Errorf("webhook subscribe without a URL status = %d, want 400", code)
+	}
+	if code, _ := request("POST", "/api/push/subscribe", aliceToken,
+		`{"provider": "fcm", "endpoint": "device-token"}`); code != http.StatusBadRequest {
+		t.Errorf("subscribe with a disabled provider status = %d, want 400", code)
+	}
+	if code, _ := request("POST", "/api/push/subscribe", aliceToken,
+		`{"endpoint": "https://push.example.com/sub/nokeys"}`); code != http.StatusBadRequest {
+		t.Errorf("web push subscribe without keys status = %d, want 400", code)
+	}
+
+	code, resp := request("GET", "/api/push/subscriptions", aliceToken, "")
+	subs, _ := resp["subscriptions"].([]interface{})
+	if code != http.StatusOK || len(subs) != 3 {
+		t.Fatalf("list status = %d, body = %v", code, resp)
+	}
+	labels := map[int]interface{}{}
+	providers := map[interface{}]int{}
+	for _, s := range subs {
+		sub := s.(map[string]interface{})
+		labels[int(sub["id"].(float64))] = sub["label"]
+		providers[sub["provider"]]++
+		if sub["user_agent"] != "Mozilla/5.0 (Android 14) Firefox/130.0" || sub["endpoint"] != nil {
+			t.Errorf("unexpected subscription: %v", sub)
+		}
+	}
+	if labels[phone] != "Phone" || labels[laptop] != nil {
+		t.Errorf("labels = %v", labels)
+	}
+	if providers["webpush"] != 2 || providers["webhook"] != 1 {
+		t.Errorf("providers = %v", providers)
+	}
+
+	// Bob can neither test nor remove alice's devices
+	if code, _ := request("POST", "/api/push/subscriptions/"+strconv.Itoa(phone)+"/test", bobToken, ""); code != http.StatusNotFound {
+		t.Errorf("test by another user status = %d, want 404", code)
+	}
+	if code, _ := request("DELETE", "/api/push/subscriptions/"+strconv.Itoa(phone), bobToken, ""); code != http.StatusNotFound {
+		t.Errorf("delete by another user status = %d, want 404", code)
+	}
+
+	if code, _ := request("POST", "/api/push/subscriptions/"+strconv.Itoa(phone)+"/test", aliceToken, ""); code != http.StatusAccepted {
+		t.Errorf("test status = %d, want 202", code)
+	}
+	if len(notifier.tested) != 1 || notifier.tested[0] != int64(phone) {
+		t.Errorf("tested subscriptions = %v", notifier.tested)
+	}
+
+	testDB.Exec(`INSERT INTO push_queue (subscription_id, payload, ttl, next_attempt_at, created_at)
+		VALUES ($1, '{}', 60, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)`, laptop)
+	if code, _ := request("DELETE", "/api/push/subscriptions/"+strconv.Itoa(laptop), aliceToken, ""); code != http.StatusOK {
+		t.Fatalf("delete status = %d, want 200", code)
+	}
+	var queued int
+	testDB.QueryRow("SELECT COUNT(*) FROM push_queue WHERE subscription_id = $1", laptop).Scan(&queued)
+	if queued != 0 {
+		t.Errorf("%d notifications still queued for a removed device", queued)
+	}
+	if _, resp := request("GET", "/api/push/subscriptions", aliceToken, ""); len(resp["subscriptions"].([]interface{})) != 2 {
+		t.Errorf("removed device still listed: %v", resp)
+	}
+	if code, _ := request("POST", "/api/push/subscriptions/"+strconv.Itoa(laptop)+"/test", aliceToken, ""); code != http.StatusNotFound {
+		t.Errorf("test of a removed device status = %d, want 404", code)
+	}
+	if code, _ := request("DELETE", "/api/push/subscriptions/abc", aliceToken, ""); code != http.StatusBadRequest {
+		t.Errorf("invalid id status = %d, want 400", code)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	clearTestData()
+
+	adminID, _ := testAuthSvc.Register("rootadmin", "password123")
+	userID, _ := testAuthSvc.Register("regular", "password123")
+	if err := testAuthSvc.SetRole(adminID, auth.RoleAdmin); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	adminToken, _ := testAuthSvc.GenerateToken(adminID, "rootadmin")
+	userToken, _ := testAuthSvc.GenerateToken(userID, "regular")
+
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var reader *bytes.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		return w
+	}
+	userPath := "/api/admin/users/" + strconv.Itoa(userID)
+
+	if w := do("GET", "/api/admin/users", userToken, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("non-admin list users: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w := do("GET", "/api/admin/users?q=regu", adminToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("list users: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	var list struct {
+		Users []AdminUser `json:"users"`
+		Total int         `json:"total"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if list.Total != 1 || len(list.Users) != 1 || list.Users[0].Username != "regular" {
+		t.Fatalf("unexpected user list: %s", w.Body.String())
+	}
+
+	// LIKE wildcards in the search term match literally
+	w = do("GET", "/api/admin/users?q=%25", adminToken, nil)
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != http.StatusOK || list.Total != 0 {
+		t.Fatalf("wildcard search: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	if w := do("GET", "/api/admin/stats", adminToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("stats: status = %d", w.Code)
+	}
+
+	if w := do("POST", "/api/admin/users/"+strconv.Itoa(adminID)+"/suspend", adminToken, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("self suspend: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// Suspension locks out existing tokens and new logins
+	if w := do("POST", userPath+"/suspend", adminToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("suspend: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := do("GET", "/api/conversations", userToken, nil); w.Code != http.StatusForbidden {
+		t.Fatalf("suspended request: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	loginBody, _ := json.Marshal(map[string]string{"username": "regular", "password": "password123"})
+	req := httptest.NewRequest("POST", "/api/auth/login", bytes.NewReader(loginBody))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("suspended login: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	if w := do("POST", userPath+"/unsuspend", adminToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("unsuspend: status = %d", w.Code)
+	}
+	if w := do("GET", "/api/conversations", userToken, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("pre-suspension token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	userToken, _ = testAuthSvc.GenerateToken(userID, "regular")
+	if w := do("POST", userPath+"/logout", adminToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("force logout: status = %d", w.Code)
+	}
+	if w := do("GET", "/api/conversations", userToken, nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("logged out token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	if w := do("PUT", userPath+"/role", adminToken, map[string]string{"role": "owner"}); w.Code != http.StatusBadRequest {
+		t.Fatalf("invalid role: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do("PUT", userPath+"/role", adminToken, map[string]string{"role": auth.RoleAdmin}); w.Code != http.StatusOK {
+		t.Fatalf("set role: status = %d", w.Code)
+	}
+
+	if w := do("DELETE", userPath, adminToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("delete user: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if w := do("DELETE", userPath, adminToken, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("delete missing user: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestUserBlocking(t *testing.T) {
+	clearTestData()
+
+	aliceID, _ := testAuthSvc.Register("alice", "password123")
+	bobID, _ := testAuthSvc.Register("bob", "password123")
+	aliceToken, _ := testAuthSvc.GenerateToken(aliceID, "alice")
+	bobToken, _ := testAuthSvc.GenerateToken(bobID, "bob")
+	insertDirectConversation(t, aliceID, bobID)
+
+	do := func(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+		var reader *bytes.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		} else {
+			reader = bytes.NewReader(nil)
+		}
+		req := httptest.NewRequest(method, path, reader)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		return w
+	}
+	blockPath := "/api/users/" + strconv.Itoa(bobID) + "/block"
+
+	if w := do("POST", "/api/users/"+strconv.Itoa(aliceID)+"/block", aliceToken, nil); w.Code != http.StatusBadRequest {
+		t.Fatalf("self block: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := do("POST", blockPath, aliceToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("block: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// Bob keeps messaging; the message is stored hidden
+	testDB.Exec("INSERT INTO messages (sender_id, receiver_id, content, hidden) VALUES ($1, $2, 'visible before', 0)", bobID, aliceID)
+	testDB.Exec("INSERT INTO messages (sender_id, receiver_id, content, hidden) VALUES ($1, $2, 'while blocked', 1)", bobID, aliceID)
+
+	w := do("GET", "/api/blocks", aliceToken, nil)
+	var blocks struct {
+		Users []BlockedUser `json:"users"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &blocks)
+	if len(blocks.Users) != 1 || blocks.Users[0].ID != bobID {
+		t.Fatalf("unexpected blocked users: %s", w.Body.String())
+	}
+
+	// Neither side finds the other in search
+	for _, tc := range []struct{ token, query string }{{aliceToken, "bob"}, {bobToken, "alice"}} {
+		w := do("GET", "/api/users?q="+tc.query, tc.token, nil)
+		var users []map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &users)
+		if len(users) != 0 {
+			t.Fatalf("search %q returned blocked user: %s", tc.query, w.Body.String())
+		}
+	}
+
+	// The blocker is told; the blocked user is not
+	if w := do("POST", "/api/conversations", aliceToken, map[string]int{"participant_id": bobID}); w.Code != http.StatusForbidden {
+		t.Fatalf("blocker create conversation: status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if w := do("POST", "/api/conversations", bobToken, map[string]int{"participant_id": aliceID}); w.Code != http.StatusOK {
+		t.Fatalf("blocked create conversation: status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	var convs struct {
+		Conversations []ConversationPreview `json:"conversations"`
+	}
+	json.Unmarshal(do("GET", "/api/conversations", aliceToken, nil).Body.Bytes(), &convs)
+	if len(convs.Conversations) != 0 {
+		t.Fatalf("blocker still sees %d conversations", len(convs.Conversations))
+	}
+	json.Unmarshal(do("GET", "/api/conversations", bobToken, nil).Body.Bytes(), &convs)
+	if len(convs.Conversations) != 1 {
+		t.Fatalf("blocked user sees %d conversations, want 1", len(convs.Conversations))
+	}
+
+	messagesOf := func(token string, otherID int) []string {
+		w := do("GET", "/api/messages?user_id="+strconv.Itoa(otherID), token, nil)
+		var resp struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		var contents []string
+		for _, m := range resp.Messages {
+			contents = append(contents, m.Content)
+		}
+		return contents
+	}
+
+	if w := do("DELETE", blockPath, aliceToken, nil); w.Code != http.StatusOK {
+		t.Fatalf("unblock: status = %d", w.Code)
+	}
+
+	// Messages sent while blocked stay hidden from the receiver only
+	if got := messagesOf(aliceToken, bobID); len(got) != 1 || got[0] != "visible before" {
+		t.Fatalf("blocker messages = %v", got)
+	}
+	if got := messagesOf(bobToken, aliceID); len(got) != 2 {
+		t.Fatalf("sender messages = %v, want both", got)
+	}
+}
+
+func uploadRequest(t *testing.T, token string, receiverID int) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("receiver_id", strconv.Itoa(receiverID))
+	part, _ := writer.CreateFormFile("file", "note.txt")
+	part.Write([]byte("hello"))
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestUploadFileAuthorization(t *testing.T) {
+	clearTestData()
+
+	aliceID, _ := testAuthSvc.Register("alice", "password123")
+	bobID, _ := testAuthSvc.Register("bob", "password123")
+	aliceToken, _ := testAuthSvc.GenerateToken(aliceID, "alice")
+
+	upload := func(router *gin.Engine, receiverID int) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, uploadRequest(t, aliceToken, receiverID))
+		return w
+	}
+
+	if w := upload(testRouter, 999999); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown receiver: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if w := upload(testRouter, aliceID); w.Code != http.StatusBadRequest {
+		t.Fatalf("self upload: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count)
+	if count != 0 {
+		t.Fatalf("rejected uploads created %d messages", count)
+	}
+
+	// With the existing-conversation policy the conversation must come first
+	access, err := conversation.NewAuthorizer(testDB, conversation.PolicyExisting)
+	if err != nil {
+		t.Fatalf("NewAuthorizer: %v", err)
+	}
+	strictHandler := NewMessageHandler(testDB, nil, testUploadDir, 10_485_760, "", "", "", "", nil)
+	strictHandler.SetAuthorizer(access)
+	strictRouter := gin.New()
+	strictRouter.POST("/api/upload", NewAuthHandler(testAuthSvc).AuthMiddleware(), strictHandler.UploadFile)
+
+	if w := upload(strictRouter, bobID); w.Code != http.StatusNotFound {
+		t.Fatalf("no conversation: status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// The default policy opens the conversation on first upload
+	if w := upload(testRouter, bobID); w.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if _, err := conversation.FindDirect(store.New(testDB), aliceID, bobID); err != nil {
+		t.Fatalf("conversation not created: %v", err)
+	}
+	if w := upload(strictRouter, bobID); w.Code != http.StatusOK {
+		t.Fatalf("upload with conversation: status = %d, body = %s", w.Code, w.Body.String())
+	}
+}
+
+func TestConversationIncludesClientMessageID(t *testing.T) {
+	clearTestData()
+
+	aliceID, _ := testAuthSvc.Register("alice", "password123")
+	bobID, _ := testAuthSvc.Register("bob", "password123")
+	aliceToken, _ := testAuthSvc.GenerateToken(aliceID, "alice")
+	insertDirectConversation(t, aliceID, bobID)
+
+	testDB.Exec("INSERT INTO messages (sender_id, receiver_id, content, client_message_id) VALUES ($1, $2, 'hi', 'client-7')", aliceID, bobID)
+	if _, err := testDB.Exec("INSERT INTO messages (sender_id, receiver_id, content, client_message_id) VALUES ($1, $2, 'dup', 'client-7')", aliceID, bobID); err == nil {
+		t.Fatal("duplicate client_message_id for the same sender was accepted")
+	}
+
+	req := httptest.NewRequest("GET", "/api/messages?user_id="+strconv.Itoa(bobID), nil)
+	req.Header.Set("Authorization", "Bearer "+aliceToken)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+
+	var resp struct {
+		Messages []struct {
+			ClientMsgID string `json:"client_message_id"`
+		} `json:"messages"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Messages) != 1 || resp.Messages[0].ClientMsgID != "client-7" {
+		t.Fatalf("unexpected messages: %s", w.Body.String())
+	}
+}
+
+func TestConversationIncludesCallHistory(t *testing.T) {
+	clearTestData()
+
+	aliceID, _ := testAuthSvc.Register("alice", "password123")
+	bobID, _ := testAuthSvc.Register("bob", "password123")
+	bobToken, _ := testAuthSvc.GenerateToken(bobID, "bob")
+	insertDirectConversation(t, aliceID, bobID)
+
+	answeredAt := time.Now().UTC().Add(-time.Minute)
+	var completed, missed int64
+	testDB.QueryRow("INSERT INTO calls (caller_id, kind, state, end_reason, answered_at, ended_at) VALUES ($1, 'video', 'ended', 'completed', $2, $3) RETURNING id",
+		aliceID, answeredAt, answeredAt.Add(42*time.Second)).Scan(&completed)
+	testDB.Exec("INSERT INTO call_participants (call_id, user_id, state, outcome) VALUES ($1, $2, 'left', 'completed')", completed, bobID)
+	testDB.Exec("INSERT INTO messages (sender_id, receiver_id, content, call_id) VALUES ($1, $2, '', $3)", aliceID, bobID, completed)
+
+	testDB.QueryRow("INSERT INTO calls (caller_id, state, end_reason, ended_at) VALUES ($1, 'ended', 'missed', $2) RETURNING id", aliceID, time.Now().UTC()).Scan(&missed)
+	testDB.Exec("INSERT INTO call_participants (call_id, user_id, state, outcome) VALUES ($1, $2, 'missed', 'missed')", missed, bobID)
+	testDB.Exec("INSERT INTO messages (sender_id, receiver_id, content, call_id, created_at) VALUES ($1, $2, '', $3, $4)", aliceID, bobID, missed, time.Now().UTC().Add(time.Second))
+
+	req := httptest.NewRequest("GET", "/api/messages?user_id="+strconv.Itoa(aliceID), nil)
+	req.Header.Set("Authorization", "Bearer "+bobToken)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+
+	var resp struct {
+		Messages []struct {
+			Call *models.CallSummary `json:"call"`
+		} `json:"messages"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Messages) != 2 || resp.Messages[0].Call == nil || resp.Messages[1].Call == nil {
+		t.Fatalf("unexpected messages: %s", w.Body.String())
+	}
+	if call := resp.Messages[0].Call; call.Kind != "video" || call.Outcome != "completed" || call.Duration != 42 {
+		t.Errorf("unexpected completed call: %+v", call)
+	}
+	if call := resp.Messages[1].Call; call.Kind != "audio" || call.Outcome != "missed" || call.Duration != 0 {
+		t.Errorf("unexpected missed call: %+v", call)
+	}
+}
+
+func TestWSTicketAuth(t *testing.T) {
+	clearTestData()
+
+	userID, _ := testAuthSvc.Register("ticket_user", "password123")
+	token, _ := testAuthSvc.GenerateToken(userID, "ticket_user")
+
+	connect := func(router *gin.Engine, query string) int {
+		req := httptest.NewRequest("GET", "/ws?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	mintTicket := func() string {
+		req := httptest.NewRequest("POST", "/api/ws/ticket", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("ticket status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body.String())
+		}
+		var resp struct {
+			Ticket    string    `json:"ticket"`
+			ExpiresAt time.Time `json:"expires_at"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Ticket == "" || resp.ExpiresAt.IsZero() {
+			t.Fatalf("unexpected ticket response: %s", w.Body.String())
+		}
+		return resp.Ticket
+	}
+
+	if code := connect(testRouter, "token="+token); code != http.StatusUnauthorized {
+		t.Errorf("JWT in query status = %d, want 401", code)
+	}
+
+	ticket := mintTicket()
+	if code := connect(testRouter, "ticket="+ticket); code != http.StatusOK {
+		t.Errorf("ticket status = %d, want 200", code)
+	}
+	if code := connect(testRouter, "ticket="+ticket); code != http.StatusUnauthorized {
+		t.Errorf("reused ticket status = %d, want 401", code)
+	}
+
+	// Native clients may still send the token as a header
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("bearer header status = %d, want 200", w.Code)
+	}
+
+	// The compatibility flag restores ?token=
+	legacy := gin.New()
+	legacy.GET("/ws", NewAuthHandler(testAuthSvc).WSAuthMiddleware(true), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	if code := connect(legacy, "token="+token); code != http.StatusOK {
+		t.Errorf("legacy query token status = %d, want 200", code)
+	}
+}
+
+func TestWebRTCConfigTURNCredentials(t *testing.T) {
+	clearTestData()
+
+	aliceID, _ := testAuthSvc.Register("alice", "password123")
+	aliceToken, _ := testAuthSvc.GenerateToken(aliceID, "alice")
+
+	getConfig := func(h *MessageHandler) map[string]interface{} {
+		t.Helper()
+		router := gin.New()
+		router.GET("/api/webrtc/config", NewAuthHandler(testAuthSvc).AuthMiddleware(), h.GetWebRTCConfig)
+		req := httptest.NewRequest("GET", "/api/webrtc/config", nil)
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+	turnServer := func(resp map[string]interface{}) map[string]interface{} {
+		servers := resp["iceServers"].([]interface{})
+		return servers[len(servers)-1].(map[string]interface{})
+	}
+
+	// Static credentials are handed out as configured
+	static := NewMessageHandler(testDB, nil, testUploadDir, 10_485_760, "stun:stun.example.com", "turn:turn.example.com:3478", "shared", "hunter2", nil)
+	resp := getConfig(static)
+	if server := turnServer(resp); server["username"] != "shared" || server["credential"] != "hunter2" {
+		t.Fatalf("unexpected static TURN server: %v", server)
+	}
+	if _, ok := resp["ttl"]; ok {
+		t.Fatal("static credentials must not advertise a ttl")
+	}
+
+	// A shared secret replaces them with per-user, expiring credentials
+	static.SetTURNSecret("north", time.Hour)
+	resp = getConfig(static)
+	server := turnServer(resp)
+	username, _ := server["username"].(string)
+	if !strings.HasSuffix(username, ":"+strconv.Itoa(aliceID)) || server["credential"] == "hunter2" || server["credential"] == "" {
+		t.Fatalf("unexpected ephemeral TURN server: %v", server)
+	}
+	if resp["ttl"] != float64(3600) || resp["expires_at"] == nil {
+		t.Fatalf("unexpected ttl: %v", resp)
+	}
+}
+
+func TestProfilePushPreview(t *testing.T) {
+	clearTestData()
+
+	aliceID, _ := testAuthSvc.Register("alice", "password123")
+	aliceToken, _ := testAuthSvc.GenerateToken(aliceID, "alice")
+
+	request := func(method, body string) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(method, "/api/profile", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+aliceToken)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s /api/profile status = %d, body = %s", method, w.Code, w.Body.String())
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	if profile := request("GET", ""); profile["push_preview"] != false {
+		t.Fatalf("Expected previews off by default, got %v", profile["push_preview"])
+	}
+
+	request("PUT", `{"display_name": "Alice", "push_preview": true}`)
+	if profile := request("GET", ""); profile["push_preview"] != true || profile["display_name"] != "Alice" {
+		t.Fatalf("Expected previews on, got %v", profile)
+	}
+
+	// Saving the display name alone keeps the preference
+	request("PUT", `{"display_name": "Alice B."}`)
+	if profile := request("GET", ""); profile["push_preview"] != true {
+		t.Fatalf("Expected previews to stay on, got %v", profile["push_preview"])
+	}
+}
+
+func TestNotificationSettings(t *testing.T) {
+	clearTestData()
+
+	aliceID, _ := testAuthSvc.Register("alice", "password123")
+	bobID, _ := testAuthSvc.Register("bob", "password123")
+	carolID, _ := testAuthSvc.Register("carol", "password123")
+	aliceToken, _ := testAuthSvc.GenerateToken(aliceID, "alice")
+	carolToken, _ := testAuthSvc.GenerateToken(carolID, "carol")
+	convID := insertDirectConversation(t, aliceID, bobID)
+	convPath := "/api/conversations/" + strconv.FormatInt(convID, 10) + "/notifications"
+
+	request := func(token, method, path, body string, wantStatus int) map[string]interface{} {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		testRouter.ServeHTTP(w, req)
+		if w.Code != wantStatus {
+			t.Fatalf("%s %s status = %d, want %d, body = %s", method, path, w.Code, wantStatus, w.Body.String())
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	resp := request(aliceToken, "GET", "/api/notifications/settings", "", http.StatusOK)
+	if settings := resp["settings"].(map[string]interface{}); settings["level"] != "all" || settings["muted"] != false {
+		t.Fatalf("Expected default settings, got %v", settings)
+	}
+
+	request(aliceToken, "PUT", "/api/notifications/settings", `{"level": "loud"}`, http.StatusBadRequest)
+	request(aliceToken, "PUT", "/api/notifications/settings", `{"quiet_start": "22:00"}`, http.StatusBadRequest)
+	request(aliceToken, "PUT", "/api/notifications/settings", `{"quiet_start": "22:00", "quiet_end": "07:00", "timezone": "Nowhere/City"}`, http.StatusBadRequest)
+	request(aliceToken, "PUT", "/api/notifications/settings",
+		`{"level": "mentions", "quiet_start": "22:00", "quiet_end": "07:00", "timezone": "Asia/Tehran"}`, http.StatusOK)
+
+	// Without its own settings a conversation shows the account level
+	resp = request(aliceToken, "GET", convPath, "", http.StatusOK)
+	if resp["custom"] != false || resp["settings"].(map[string]interface{})["level"] != "mentions" {
+		t.Fatalf("Expected account settings, got %v", resp)
+	}
+
+	request(aliceToken, "PUT", convPath, `{"quiet_start": "01:00", "quiet_end": "02:00"}`, http.StatusBadRequest)
+	request(aliceToken, "PUT", convPath, `{"muted": true, "muted_until": "2030-01-01T00:00:00Z"}`, http.StatusOK)
+	resp = request(aliceToken, "GET", convPath, "", http.StatusOK)
+	settings := resp["settings"].(map[string]interface{})
+	if resp["custom"] != true || settings["muted"] != true || settings["muted_until"] != "2030-01-01T00:00:00Z" {
+		t.Fatalf("Expected the conversation to be muted, got %v", resp)
+	}
+
+	resp = request(aliceToken, "GET", "/api/notifications/settings", "", http.StatusOK)
+	if conversations := resp["conversations"].([]interface{}); len(conversations) != 1 ||
+		conversations[0].(map[string]interface{})["conversation_id"] != float64(convID) {
+		t.Fatalf("Expected one conversation with settings, got %v", resp["conversations"])
+	}
+
+	// Other users cannot see or change the conversation
+	request(carolToken, "GET", convPath, "", http.StatusNotFound)
+	request(carolToken, "PUT", convPath, `{"muted": true}`, http.StatusNotFound)
+	request(aliceToken, "GET", "/api/conversations/abc/notifications", "", http.StatusBadRequest)
+
+	request(aliceToken, "DELETE", convPath, "", http.StatusOK)
+	if resp := request(aliceToken, "GET", convPath, "", http.StatusOK); resp["custom"] != false {
+		t.Fatalf("Expected conversation settings to be reset, got %v", resp)
+	}
+}
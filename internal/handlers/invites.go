@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/4xmen/payambar/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type CreateInviteRequest struct {
+	MaxUses        int `json:"max_uses"`
+	ExpiresInHours int `json:"expires_in_hours"`
+}
+
+// GetRegistrationMode tells clients whether registration needs an invite
+func (h *AuthHandler) GetRegistrationMode(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"mode": h.authSvc.RegistrationMode()})
+}
+
+// CreateInvite mints an invite code owned by the current user. Members may
+// only mint single-use invites while registration is not closed; multi-use
+// invites and invites in closed mode are reserved for admins.
+func (h *AuthHandler) CreateInvite(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	var req CreateInviteRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+			return
+		}
+	}
+	if req.MaxUses == 0 {
+		req.MaxUses = 1
+	}
+	if req.ExpiresInHours < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
+
+	if role, _ := c.Get("role"); role != auth.RoleAdmin {
+		if h.authSvc.RegistrationMode() == auth.RegistrationClosed {
+			c.JSON(http.StatusForbidden, gin.H{"error": __("registration is closed")})
+			return
+		}
+		if req.MaxUses > 1 {
+			c.JSON(http.StatusForbidden, gin.H{"error": __("only admins can create multi-use invites")})
+			return
+		}
+	}
+
+	creator := userID.(int)
+	invite, err := h.authSvc.CreateInvite(&creator, req.MaxUses, time.Duration(req.ExpiresInHours)*time.Hour)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __(err.Error())})
+		return
+	}
+
+	c.JSON(http.StatusCreated, invite)
+}
+
+// GetInvites lists invites minted by the current user
+func (h *AuthHandler) GetInvites(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	invites, err := h.authSvc.ListInvites(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch invites")})
+		return
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+// RevokeInvite disables one of the current user's invites
+func (h *AuthHandler) RevokeInvite(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	inviteID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid invite id")})
+		return
+	}
+
+	if err := h.authSvc.RevokeInvite(userID.(int), inviteID); err != nil {
+		if err.Error() == "invite not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": __(err.Error())})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to revoke invite")})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
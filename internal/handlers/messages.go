@@ -1,7 +1,7 @@
 package handlers
 
 import (
-	"database/sql"
+	"errors"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -9,28 +9,15 @@ import (
 	"strings"
 	"time"
 
+	"github.com/4xmen/payambar/internal/conversation"
+	"github.com/4xmen/payambar/internal/db"
 	"github.com/4xmen/payambar/internal/models"
+	"github.com/4xmen/payambar/internal/push"
+	"github.com/4xmen/payambar/internal/store"
+	"github.com/4xmen/payambar/internal/turn"
 	"github.com/gin-gonic/gin"
 )
 
-func parseSQLiteTimestamp(value string) (time.Time, bool) {
-	if strings.TrimSpace(value) == "" {
-		return time.Time{}, false
-	}
-	layouts := []string{
-		time.RFC3339Nano,
-		time.RFC3339,
-		"2006-01-02 15:04:05",
-		"2006-01-02 15:04:05.999999999",
-	}
-	for _, layout := range layouts {
-		if t, err := time.Parse(layout, value); err == nil {
-			return t, true
-		}
-	}
-	return time.Time{}, false
-}
-
 // OnlineChecker interface for checking user online status
 type OnlineChecker interface {
 	IsUserOnline(userID int) bool
@@ -43,12 +30,15 @@ type MessageBroadcaster interface {
 
 // PushNotifier sends push notifications to offline users
 type PushNotifier interface {
-	SendNewMessageNotification(receiverID int, senderUsername string)
+	SendNewMessageNotification(msg push.Message)
+	SendTestNotification(subscriptionID int64) error
+	HasProvider(name string) bool
 	VAPIDPublicKey() string
 }
 
 type MessageHandler struct {
-	db             *sql.DB
+	store          *store.Store
+	access         *conversation.Authorizer
 	onlineChecker  OnlineChecker
 	broadcaster    MessageBroadcaster
 	pushNotifier   PushNotifier
@@ -59,6 +49,10 @@ type MessageHandler struct {
 	turnUsername   string
 	turnPassword   string
 	vapidPublicKey string
+	// turnSecret, when set, replaces the static TURN login with
+	// per-user credentials
+	turnSecret        string
+	turnCredentialTTL time.Duration
 }
 
 func isLocalUploadPath(uploadDir, filePath string) bool {
@@ -92,7 +86,7 @@ func localPathFromAvatarURL(avatarURL, uploadDir string) (string, bool) {
 	return filepath.Join(uploadDir, fileName), true
 }
 
-func NewMessageHandler(db *sql.DB, onlineChecker OnlineChecker, uploadDir string, maxUploadSize int64, stunServers, turnServer, turnUsername, turnPassword string, pushNotifier PushNotifier) *MessageHandler {
+func NewMessageHandler(db *db.DB, onlineChecker OnlineChecker, uploadDir string, maxUploadSize int64, stunServers, turnServer, turnUsername, turnPassword string, pushNotifier PushNotifier) *MessageHandler {
 	var broadcaster MessageBroadcaster
 	if b, ok := onlineChecker.(MessageBroadcaster); ok {
 		broadcaster = b
@@ -101,8 +95,10 @@ func NewMessageHandler(db *sql.DB, onlineChecker OnlineChecker, uploadDir string
 	if pushNotifier != nil {
 		vapidKey = pushNotifier.VAPIDPublicKey()
 	}
+	access, _ := conversation.NewAuthorizer(db, conversation.PolicyAutoCreate)
 	return &MessageHandler{
-		db:             db,
+		store:          store.New(db),
+		access:         access,
 		onlineChecker:  onlineChecker,
 		broadcaster:    broadcaster,
 		pushNotifier:   pushNotifier,
@@ -116,6 +112,11 @@ func NewMessageHandler(db *sql.DB, onlineChecker OnlineChecker, uploadDir string
 	}
 }
 
+// SetAuthorizer replaces the default auto-create conversation authorizer
+func (h *MessageHandler) SetAuthorizer(access *conversation.Authorizer) {
+	h.access = access
+}
+
 // ConversationPreview represents a conversation in the list view
 
 type DeviceKeyPayload struct {
@@ -188,103 +189,20 @@ func (h *MessageHandler) GetConversation(c *gin.Context) {
 	currentUserID := userID.(int)
 
 	// Ensure conversation exists to prevent stale UI states
-	var convExists bool
-	if err := h.db.QueryRow(
-		`
-		SELECT EXISTS(
-			SELECT 1
-			FROM conversations c
-			INNER JOIN conversation_participants cp1
-				ON cp1.conversation_id = c.id AND cp1.user_id = ?
-			INNER JOIN conversation_participants cp2
-				ON cp2.conversation_id = c.id AND cp2.user_id = ?
-			WHERE (
-				SELECT COUNT(*)
-				FROM conversation_participants cp
-				WHERE cp.conversation_id = c.id
-			) = 2
-		)
-		`,
-		currentUserID, otherUserID,
-	).Scan(&convExists); err != nil {
+	if _, err := conversation.FindDirect(h.store, currentUserID, otherUserID); err != nil {
+		if errors.Is(err, conversation.ErrNoConversation) {
+			c.JSON(http.StatusNotFound, gin.H{"error": __("conversation not found")})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to check conversation")})
 		return
 	}
-	if !convExists {
-		c.JSON(http.StatusNotFound, gin.H{"error": __("conversation not found")})
-		return
-	}
-
-	// Get messages between the two users with file attachments in single query (fixes N+1)
-	rows, err := h.db.Query(`
-		SELECT m.id, m.sender_id, m.receiver_id, m.content, m.encrypted, m.e2ee_v, m.alg, m.sender_device_id, m.key_id, m.iv, m.ciphertext, m.aad,
-		       m.status, m.created_at, m.delivered_at, m.read_at, f.file_name, f.file_path, f.content_type
-		FROM messages m
-		LEFT JOIN files f ON f.message_id = m.id
-		WHERE (m.sender_id = ? AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = ?)
-		ORDER BY m.created_at DESC
-		LIMIT ? OFFSET ?
-	`, currentUserID, otherUserID, otherUserID, currentUserID, limit, offset)
 
+	messages, err := h.store.Messages.History(currentUserID, otherUserID, limit, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch messages")})
 		return
 	}
-	defer rows.Close()
-
-	var messages []*models.Message
-	for rows.Next() {
-		msg := &models.Message{}
-		var (
-			fileName, filePath, fileType                          sql.NullString
-			e2eeVersion                                           sql.NullInt64
-			encrypted                                             sql.NullInt64
-			algorithm, senderDeviceID, keyID, iv, ciphertext, aad sql.NullString
-		)
-		if err := rows.Scan(&msg.ID, &msg.SenderID, &msg.ReceiverID, &msg.Content, &encrypted, &e2eeVersion, &algorithm, &senderDeviceID, &keyID, &iv, &ciphertext, &aad, &msg.Status, &msg.CreatedAt, &msg.DeliveredAt, &msg.ReadAt, &fileName, &filePath, &fileType); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to scan message")})
-			return
-		}
-		msg.Encrypted = encrypted.Valid && encrypted.Int64 != 0
-		if e2eeVersion.Valid {
-			v := int(e2eeVersion.Int64)
-			msg.E2EEVersion = &v
-		}
-		if algorithm.Valid {
-			msg.Algorithm = &algorithm.String
-		}
-		if senderDeviceID.Valid {
-			msg.SenderDeviceID = &senderDeviceID.String
-		}
-		if keyID.Valid {
-			msg.KeyID = &keyID.String
-		}
-		if iv.Valid {
-			msg.IV = &iv.String
-		}
-		if ciphertext.Valid {
-			msg.Ciphertext = &ciphertext.String
-		}
-		if aad.Valid {
-			msg.AAD = &aad.String
-		}
-		// Set file attachment if present
-		if fileName.Valid {
-			msg.FileName = &fileName.String
-			fileURL := "/api/files/" + filepath.Base(filePath.String)
-			msg.FileURL = &fileURL
-			if fileType.Valid {
-				msg.FileType = &fileType.String
-			}
-		}
-		messages = append(messages, msg)
-	}
-
-	// Reverse to get oldest first
-	for i := len(messages)/2 - 1; i >= 0; i-- {
-		opp := len(messages) - 1 - i
-		messages[i], messages[opp] = messages[opp], messages[i]
-	}
 
 	c.JSON(http.StatusOK, gin.H{"messages": messages})
 }
@@ -299,141 +217,25 @@ func (h *MessageHandler) GetConversations(c *gin.Context) {
 
 	currentUserID := userID.(int)
 
-	var conversations []*ConversationPreview
-
-	// Optimized approach: Fetch conversations for this user, then batch-load related data
-	// Step 1: Get user's direct conversations in one query
-	rows, err := h.db.Query(`
-		SELECT c.id, other.user_id
-		FROM conversations c
-		INNER JOIN conversation_participants me
-			ON me.conversation_id = c.id AND me.user_id = ?
-		INNER JOIN conversation_participants other
-			ON other.conversation_id = c.id AND other.user_id != ?
-		WHERE (
-			SELECT COUNT(*)
-			FROM conversation_participants cp
-			WHERE cp.conversation_id = c.id
-		) = 2
-	`, currentUserID, currentUserID)
-
+	summaries, err := h.store.Conversations.List(currentUserID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch conversations")})
 		return
 	}
-	defer rows.Close()
-
-	type convData struct {
-		id           int
-		participants []int
-		otherUserID  int
-	}
-	var userConvs []convData
-	var otherUserIDs []int
-	seenOtherUsers := make(map[int]struct{})
-
-	for rows.Next() {
-		var cd convData
-		if err := rows.Scan(&cd.id, &cd.otherUserID); err != nil {
-			continue
-		}
-		if cd.otherUserID > 0 {
-			cd.participants = []int{currentUserID, cd.otherUserID}
-			userConvs = append(userConvs, cd)
-			if _, seen := seenOtherUsers[cd.otherUserID]; !seen {
-				seenOtherUsers[cd.otherUserID] = struct{}{}
-				otherUserIDs = append(otherUserIDs, cd.otherUserID)
-			}
-		}
-	}
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch conversations")})
-		return
-	}
-
-	if len(userConvs) == 0 {
-		c.JSON(http.StatusOK, gin.H{"conversations": []*ConversationPreview{}})
-		return
-	}
-
-	// Step 2: Batch fetch user info for all other users
-	userInfoMap := make(map[int]struct {
-		username    string
-		displayName sql.NullString
-		avatarURL   sql.NullString
-	})
-
-	// Build placeholders for IN clause
-	placeholders := strings.Repeat("?,", len(otherUserIDs))
-	placeholders = placeholders[:len(placeholders)-1]
 
-	args := make([]interface{}, len(otherUserIDs))
-	for i, id := range otherUserIDs {
-		args[i] = id
-	}
-
-	userRows, err := h.db.Query(
-		`SELECT id, username, display_name, avatar_url FROM users WHERE id IN (`+placeholders+`)`,
-		args...,
-	)
-	if err == nil {
-		for userRows.Next() {
-			var id int
-			var info struct {
-				username    string
-				displayName sql.NullString
-				avatarURL   sql.NullString
-			}
-			if err := userRows.Scan(&id, &info.username, &info.displayName, &info.avatarURL); err == nil {
-				userInfoMap[id] = info
-			}
-		}
-		userRows.Close()
-	}
-
-	// Step 3: Build conversations with the fetched data
-	// For last_message_at and unread_count, we still need individual queries but only for filtered convs
-	for _, cd := range userConvs {
-		userInfo, ok := userInfoMap[cd.otherUserID]
-		if !ok {
-			continue
-		}
-
-		var lastMessageAt sql.NullString
-		var unreadCount int
-
-		h.db.QueryRow(`
-			SELECT COALESCE(MAX(created_at), '') FROM messages
-			WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
-		`, currentUserID, cd.otherUserID, cd.otherUserID, currentUserID).Scan(&lastMessageAt)
-
-		h.db.QueryRow(`
-			SELECT COUNT(*) FROM messages
-			WHERE receiver_id = ? AND sender_id = ? AND read_at IS NULL
-		`, currentUserID, cd.otherUserID).Scan(&unreadCount)
-
-		conv := &ConversationPreview{
-			ID:           cd.id,
-			UserID:       cd.otherUserID,
-			Username:     userInfo.username,
-			IsOnline:     h.onlineChecker != nil && h.onlineChecker.IsUserOnline(cd.otherUserID),
-			UnreadCount:  unreadCount,
-			Participants: cd.participants,
-		}
-
-		if userInfo.displayName.Valid {
-			conv.DisplayName = &userInfo.displayName.String
-		}
-		if userInfo.avatarURL.Valid {
-			conv.AvatarURL = &userInfo.avatarURL.String
-		}
-		if lastMessageAt.Valid {
-			if parsed, ok := parseSQLiteTimestamp(lastMessageAt.String); ok {
-				conv.LastMessageAt = parsed
-			}
-		}
-
-		conversations = append(conversations, conv)
+	var conversations []*ConversationPreview
+	for _, summary := range summaries {
+		conversations = append(conversations, &ConversationPreview{
+			ID:            summary.ID,
+			UserID:        summary.UserID,
+			Username:      summary.Username,
+			DisplayName:   summary.DisplayName,
+			AvatarURL:     summary.AvatarURL,
+			IsOnline:      !summary.BlockedMe && h.onlineChecker != nil && h.onlineChecker.IsUserOnline(summary.UserID),
+			LastMessageAt: summary.LastMessageAt,
+			UnreadCount:   summary.UnreadCount,
+			Participants:  []int{currentUserID, summary.UserID},
+		})
 	}
 
 	if conversations == nil {
@@ -469,21 +271,12 @@ func (h *MessageHandler) MarkAsDelivered(c *gin.Context) {
 
 	currentUserID := userID.(int)
 
-	// Verify message belongs to current user as receiver
-	var receiverID int
-	err = h.db.QueryRow("SELECT receiver_id FROM messages WHERE id = ?", messageID).Scan(&receiverID)
-	if err != nil || receiverID != currentUserID {
-		c.JSON(http.StatusForbidden, gin.H{"error": __("cannot mark this message")})
-		return
-	}
-
-	_, err = h.db.Exec(`
-		UPDATE messages 
-		SET status = 'delivered', delivered_at = CURRENT_TIMESTAMP
-		WHERE id = ? AND status = 'sent'
-	`, messageID)
-
-	if err != nil {
+	// Only the receiver can mark a message
+	if _, err := h.store.Messages.MarkDelivered(messageID, currentUserID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusForbidden, gin.H{"error": __("cannot mark this message")})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to update message")})
 		return
 	}
@@ -508,21 +301,12 @@ func (h *MessageHandler) MarkAsRead(c *gin.Context) {
 
 	currentUserID := userID.(int)
 
-	// Verify message belongs to current user as receiver
-	var receiverID int
-	err = h.db.QueryRow("SELECT receiver_id FROM messages WHERE id = ?", messageID).Scan(&receiverID)
-	if err != nil || receiverID != currentUserID {
-		c.JSON(http.StatusForbidden, gin.H{"error": __("cannot mark this message")})
-		return
-	}
-
-	_, err = h.db.Exec(`
-		UPDATE messages 
-		SET status = 'read', read_at = CURRENT_TIMESTAMP
-		WHERE id = ? AND receiver_id = ?
-	`, messageID, currentUserID)
-
-	if err != nil {
+	// Only the receiver can mark a message
+	if _, err := h.store.Messages.MarkRead(messageID, currentUserID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			c.JSON(http.StatusForbidden, gin.H{"error": __("cannot mark this message")})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to update message")})
 		return
 	}
@@ -547,37 +331,22 @@ func (h *MessageHandler) DeleteMessage(c *gin.Context) {
 
 	currentUserID := userID.(int)
 
-	// Verify message belongs to current user as sender
-	var senderID int
-	err = h.db.QueryRow("SELECT sender_id FROM messages WHERE id = ?", messageID).Scan(&senderID)
+	filePath, err := h.store.Messages.Delete(messageID, currentUserID)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		switch {
+		case errors.Is(err, store.ErrNotFound):
 			c.JSON(http.StatusNotFound, gin.H{"error": __("message not found")})
-			return
+		case errors.Is(err, store.ErrForbidden):
+			c.JSON(http.StatusForbidden, gin.H{"error": __("can only delete own messages")})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete message")})
 		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch message")})
-		return
-	}
-
-	if senderID != currentUserID {
-		c.JSON(http.StatusForbidden, gin.H{"error": __("can only delete own messages")})
 		return
 	}
 
-	// Delete associated file if exists
-	var filePath sql.NullString
-	h.db.QueryRow("SELECT file_path FROM files WHERE message_id = ?", messageID).Scan(&filePath)
-	if filePath.Valid && filePath.String != "" {
-		// Try to delete the file (ignore errors)
-		os.Remove(filePath.String)
-		h.db.Exec("DELETE FROM files WHERE message_id = ?", messageID)
-	}
-
-	// Delete the message
-	_, err = h.db.Exec("DELETE FROM messages WHERE id = ? AND sender_id = ?", messageID, currentUserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete message")})
-		return
+	// Try to delete the file (ignore errors)
+	if filePath != "" {
+		os.Remove(filePath)
 	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
@@ -593,13 +362,9 @@ func (h *MessageHandler) GetUserProfile(c *gin.Context) {
 		return
 	}
 
-	var user models.User
-	err := h.db.QueryRow(`
-		SELECT id, username, display_name, avatar_url, created_at FROM users WHERE username = ?
-	`, username).Scan(&user.ID, &user.Username, &user.DisplayName, &user.AvatarURL, &user.CreatedAt)
-
+	user, err := h.store.Users.GetByUsername(username)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if errors.Is(err, store.ErrNotFound) {
 			c.JSON(http.StatusNotFound, gin.H{"error": __("user not found")})
 			return
 		}
@@ -629,27 +394,12 @@ func (h *MessageHandler) GetUsers(c *gin.Context) {
 
 	searchQuery := strings.TrimSpace(c.Query("q"))
 
-	var rows *sql.Rows
-	var err error
-
-	if searchQuery != "" {
-		// Search by username (case-insensitive)
-		rows, err = h.db.Query(`
-			SELECT id, username, display_name, avatar_url, created_at FROM users 
-			WHERE id != ? AND (username LIKE ? OR display_name LIKE ?)
-			ORDER BY username LIMIT 20
-		`, userID, "%"+searchQuery+"%", "%"+searchQuery+"%")
-	} else {
-		rows, err = h.db.Query(`
-			SELECT id, username, display_name, avatar_url, created_at FROM users WHERE id != ? ORDER BY username LIMIT 20
-		`, userID)
-	}
-
+	// Users on either side of a block never see each other
+	found, err := h.store.Users.Directory(userID.(int), searchQuery, 20)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch users")})
 		return
 	}
-	defer rows.Close()
 
 	type UserWithOnline struct {
 		ID          int     `json:"id"`
@@ -660,11 +410,7 @@ func (h *MessageHandler) GetUsers(c *gin.Context) {
 	}
 
 	var users []UserWithOnline
-	for rows.Next() {
-		var user models.User
-		if err := rows.Scan(&user.ID, &user.Username, &user.DisplayName, &user.AvatarURL, &user.CreatedAt); err != nil {
-			continue
-		}
+	for _, user := range found {
 		u := UserWithOnline{
 			ID:       user.ID,
 			Username: user.Username,
@@ -709,34 +455,28 @@ func (h *MessageHandler) CreateConversation(c *gin.Context) {
 	}
 
 	// Check if participant exists
-	var exists2 bool
-	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", req.ParticipantID).Scan(&exists2)
+	exists2, err := h.store.Users.Exists(req.ParticipantID)
 	if err != nil || !exists2 {
 		c.JSON(http.StatusNotFound, gin.H{"error": __("participant not found")})
 		return
 	}
 
-	// Check if direct conversation already exists between these two users
+	// Only the blocker is told about a block; the blocked side proceeds as
+	// usual and the conversation stays hidden from the blocker
 	currentUID := userID.(int)
-	var existingID int
-	err = h.db.QueryRow(`
-		SELECT cp1.conversation_id
-		FROM conversation_participants cp1
-		INNER JOIN conversation_participants cp2
-			ON cp2.conversation_id = cp1.conversation_id AND cp2.user_id = ?
-		WHERE cp1.user_id = ?
-			AND (
-				SELECT COUNT(*)
-				FROM conversation_participants cp
-				WHERE cp.conversation_id = cp1.conversation_id
-			) = 2
-		LIMIT 1
-	`, req.ParticipantID, currentUID).Scan(&existingID)
+	if blocked, err := conversation.IsBlocked(h.store, currentUID, req.ParticipantID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to check conversation")})
+		return
+	} else if blocked {
+		c.JSON(http.StatusForbidden, gin.H{"error": __("you have blocked this user")})
+		return
+	}
 
+	// Check if direct conversation already exists between these two users
+	existingID, err := conversation.FindDirect(h.store, currentUID, req.ParticipantID)
 	if err == nil {
 		// Conversation already exists - get username
-		var username string
-		h.db.QueryRow("SELECT username FROM users WHERE id = ?", req.ParticipantID).Scan(&username)
+		username := h.participantName(req.ParticipantID)
 
 		c.JSON(http.StatusOK, gin.H{
 			"id":              existingID,
@@ -748,53 +488,21 @@ func (h *MessageHandler) CreateConversation(c *gin.Context) {
 		})
 		return
 	}
-	if err != sql.ErrNoRows {
+	if !errors.Is(err, conversation.ErrNoConversation) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to check conversation")})
 		return
 	}
 
 	// Create new conversation
-	tx, err := h.db.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to start transaction")})
-		return
-	}
-	committed := false
-	defer func() {
-		if !committed {
-			_ = tx.Rollback()
-		}
-	}()
-
-	result, err := tx.Exec(`
-		INSERT INTO conversations DEFAULT VALUES
-	`)
-
+	id, err := conversation.CreateDirect(h.store, currentUID, req.ParticipantID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to create conversation")})
 		return
 	}
-
-	id, _ := result.LastInsertId()
 	participantIDs := []int{currentUID, req.ParticipantID}
 
-	if _, err = tx.Exec(`
-		INSERT INTO conversation_participants (conversation_id, user_id)
-		VALUES (?, ?), (?, ?)
-	`, id, currentUID, id, req.ParticipantID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to create conversation")})
-		return
-	}
-
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to create conversation")})
-		return
-	}
-	committed = true
-
 	// Get username for the response
-	var username string
-	h.db.QueryRow("SELECT username FROM users WHERE id = ?", req.ParticipantID).Scan(&username)
+	username := h.participantName(req.ParticipantID)
 
 	c.JSON(http.StatusCreated, gin.H{
 		"id":              id,
@@ -806,6 +514,15 @@ func (h *MessageHandler) CreateConversation(c *gin.Context) {
 	})
 }
 
+// participantName returns the username of userID, or "" when it can't be read
+func (h *MessageHandler) participantName(userID int) string {
+	user, err := h.store.Users.Get(userID)
+	if err != nil {
+		return ""
+	}
+	return user.Username
+}
+
 // DeleteConversation deletes a conversation and its messages/files (participant-only)
 func (h *MessageHandler) DeleteConversation(c *gin.Context) {
 	userID, exists := c.Get("user_id")
@@ -823,128 +540,21 @@ func (h *MessageHandler) DeleteConversation(c *gin.Context) {
 
 	currentUserID := userID.(int)
 
-	tx, err := h.db.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to start transaction")})
-		return
-	}
-	committed := false
-	defer func() {
-		if !committed {
-			_ = tx.Rollback()
-		}
-	}()
-
-	rows, err := tx.Query("SELECT user_id FROM conversation_participants WHERE conversation_id = ?", convID)
+	filePaths, err := h.store.Conversations.Delete(convID, currentUserID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch conversation")})
-		return
-	}
-	defer rows.Close()
-
-	participantIDs := make([]int, 0, 4)
-	hasCurrent := false
-	for rows.Next() {
-		var pid int
-		if err := rows.Scan(&pid); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch conversation")})
-			return
-		}
-		if pid <= 0 {
-			continue
-		}
-		participantIDs = append(participantIDs, pid)
-		if pid == currentUserID {
-			hasCurrent = true
-		}
-	}
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch conversation")})
-		return
-	}
-
-	if len(participantIDs) == 0 {
-		var convExists bool
-		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM conversations WHERE id = ?)", convID).Scan(&convExists); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch conversation")})
-			return
-		}
-		if !convExists {
+		switch {
+		case errors.Is(err, store.ErrNotFound):
 			c.JSON(http.StatusNotFound, gin.H{"error": __("conversation not found")})
-			return
+		case errors.Is(err, store.ErrForbidden):
+			c.JSON(http.StatusForbidden, gin.H{"error": __("not a participant")})
+		case errors.Is(err, store.ErrNotDirect):
+			c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid participants")})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete conversation")})
 		}
-		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid participants")})
 		return
 	}
 
-	if !hasCurrent {
-		c.JSON(http.StatusForbidden, gin.H{"error": __("not a participant")})
-		return
-	}
-	if len(participantIDs) != 2 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid participants")})
-		return
-	}
-
-	p1 := participantIDs[0]
-	p2 := participantIDs[1]
-
-	filePaths := []string{}
-	fileRows, err := tx.Query(`
-		SELECT f.file_path FROM files f
-		INNER JOIN messages m ON f.message_id = m.id
-		WHERE (m.sender_id = ? AND m.receiver_id = ?) OR (m.sender_id = ? AND m.receiver_id = ?)
-	`, p1, p2, p2, p1)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch files")})
-		return
-	}
-	for fileRows.Next() {
-		var fp string
-		if err := fileRows.Scan(&fp); err == nil && fp != "" {
-			filePaths = append(filePaths, fp)
-		}
-	}
-	fileRows.Close()
-
-	_, err = tx.Exec(`
-		DELETE FROM files WHERE message_id IN (
-			SELECT id FROM messages
-			WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
-		)
-	`, p1, p2, p2, p1)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete files")})
-		return
-	}
-
-	_, err = tx.Exec(`
-		DELETE FROM messages
-		WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
-	`, p1, p2, p2, p1)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete messages")})
-		return
-	}
-
-	_, err = tx.Exec("DELETE FROM conversation_participants WHERE conversation_id = ?", convID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete conversation")})
-		return
-	}
-
-	_, err = tx.Exec("DELETE FROM conversations WHERE id = ?", convID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete conversation")})
-		return
-	}
-
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to commit delete")})
-		return
-	}
-	committed = true
-
 	for _, fp := range filePaths {
 		if isLocalUploadPath(h.uploadDir, fp) {
 			_ = os.Remove(fp)
@@ -981,17 +591,24 @@ func (h *MessageHandler) UploadFile(c *gin.Context) {
 		return
 	}
 
-	// Create message for the file
-	result, err := h.db.Exec(`
-		INSERT INTO messages (sender_id, receiver_id, content, status, created_at)
-		VALUES (?, ?, ?, 'sent', CURRENT_TIMESTAMP)
-	`, userID.(int), receiverID, "[فایل]")
+	grant, err := h.access.Authorize(userID.(int), receiverID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to create message")})
+		accessError(c, err)
 		return
 	}
 
-	messageID, _ := result.LastInsertId()
+	// Create message for the file; files sent to someone who blocked the
+	// sender are stored but hidden
+	messageID, err := h.store.Messages.Create(store.NewMessage{
+		SenderID:   userID.(int),
+		ReceiverID: receiverID,
+		Content:    "[فایل]",
+		Hidden:     grant.Hidden,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to create message")})
+		return
+	}
 
 	// Generate unique filename with path traversal protection
 	// filepath.Base() strips any directory components from the filename
@@ -1006,10 +623,13 @@ func (h *MessageHandler) UploadFile(c *gin.Context) {
 	}
 
 	// Save file record
-	_, err = h.db.Exec(`
-		INSERT INTO files (message_id, file_name, file_path, file_size, content_type, created_at)
-		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
-	`, messageID, safeFilename, uploadPath, header.Size, header.Header.Get("Content-Type"))
+	err = h.store.Messages.AttachFile(&models.File{
+		MessageID:   messageID,
+		FileName:    safeFilename,
+		FilePath:    uploadPath,
+		FileSize:    header.Size,
+		ContentType: header.Header.Get("Content-Type"),
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to save file record")})
 		return
@@ -1020,7 +640,7 @@ func (h *MessageHandler) UploadFile(c *gin.Context) {
 	// Broadcast file message to receiver via WebSocket
 	if h.broadcaster != nil {
 		h.broadcaster.BroadcastMessage(
-			int(messageID),
+			messageID,
 			userID.(int),
 			receiverID,
 			"📎 "+header.Filename,
@@ -1040,6 +660,20 @@ func (h *MessageHandler) UploadFile(c *gin.Context) {
 	})
 }
 
+// accessError maps conversation authorization failures to responses
+func accessError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, conversation.ErrSelf):
+		c.JSON(http.StatusBadRequest, gin.H{"error": __(err.Error())})
+	case errors.Is(err, conversation.ErrUnknownReceiver), errors.Is(err, conversation.ErrNoConversation):
+		c.JSON(http.StatusNotFound, gin.H{"error": __(err.Error())})
+	case errors.Is(err, conversation.ErrBlocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": __(err.Error())})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to create message")})
+	}
+}
+
 // UpdateProfile updates the current user's profile
 func (h *MessageHandler) UpdateProfile(c *gin.Context) {
 	userID, exists := c.Get("user_id")
@@ -1050,6 +684,8 @@ func (h *MessageHandler) UpdateProfile(c *gin.Context) {
 
 	var req struct {
 		DisplayName string `json:"display_name"`
+		// PushPreview opts in to message text in push notifications
+		PushPreview *bool `json:"push_preview"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -1057,16 +693,16 @@ func (h *MessageHandler) UpdateProfile(c *gin.Context) {
 		return
 	}
 
-	_, err := h.db.Exec(`
-		UPDATE users SET display_name = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
-	`, req.DisplayName, userID.(int))
-
-	if err != nil {
+	if err := h.store.Users.UpdateProfile(userID.(int), req.DisplayName, req.PushPreview); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to update profile")})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "updated", "display_name": req.DisplayName})
+	response := gin.H{"status": "updated", "display_name": req.DisplayName}
+	if req.PushPreview != nil {
+		response["push_preview"] = *req.PushPreview
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 // UploadAvatar handles avatar image uploads
@@ -1115,11 +751,7 @@ func (h *MessageHandler) UploadAvatar(c *gin.Context) {
 
 	// Update user's avatar_url
 	avatarURL := "/api/files/" + filename
-	_, err = h.db.Exec(`
-		UPDATE users SET avatar_url = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
-	`, avatarURL, userID.(int))
-
-	if err != nil {
+	if err := h.store.Users.SetAvatar(userID.(int), avatarURL); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to update avatar")})
 		return
 	}
@@ -1137,110 +769,41 @@ func (h *MessageHandler) DeleteAccount(c *gin.Context) {
 		return
 	}
 
-	currentUserID := userID.(int)
-
-	tx, err := h.db.Begin()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to start transaction")})
+	if status, err := h.deleteUserAccount(userID.(int)); err != nil {
+		c.JSON(status, gin.H{"error": __(err.Error())})
 		return
 	}
-	committed := false
-	defer func() {
-		if !committed {
-			_ = tx.Rollback()
-		}
-	}()
 
-	var avatarURL sql.NullString
-	if err := tx.QueryRow("SELECT avatar_url FROM users WHERE id = ?", currentUserID).Scan(&avatarURL); err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": __("user not found")})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch user")})
-		return
-	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
 
-	filePaths := []string{}
-	fileRows, err := tx.Query(`
-		SELECT f.file_path FROM files f
-		INNER JOIN messages m ON f.message_id = m.id
-		WHERE m.sender_id = ? OR m.receiver_id = ?
-	`, currentUserID, currentUserID)
+// deleteUserAccount removes a user together with their messages, files and
+// conversation memberships. On failure it returns the HTTP status and the
+// untranslated error message to report.
+func (h *MessageHandler) deleteUserAccount(currentUserID int) (int, error) {
+	deleted, err := h.store.Users.Delete(currentUserID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch files")})
-		return
-	}
-	for fileRows.Next() {
-		var fp string
-		if err := fileRows.Scan(&fp); err == nil && fp != "" {
-			filePaths = append(filePaths, fp)
+		if errors.Is(err, store.ErrNotFound) {
+			return http.StatusNotFound, errors.New("user not found")
 		}
+		return http.StatusInternalServerError, errors.New("failed to delete user")
 	}
-	fileRows.Close()
 
-	_, err = tx.Exec(`
-		DELETE FROM files WHERE message_id IN (
-			SELECT id FROM messages WHERE sender_id = ? OR receiver_id = ?
-		)
-	`, currentUserID, currentUserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete files")})
-		return
-	}
-
-	_, err = tx.Exec("DELETE FROM messages WHERE sender_id = ? OR receiver_id = ?", currentUserID, currentUserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete messages")})
-		return
-	}
-
-	_, err = tx.Exec("DELETE FROM conversation_participants WHERE user_id = ?", currentUserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete conversations")})
-		return
-	}
-
-	_, err = tx.Exec(`
-		DELETE FROM conversations
-		WHERE NOT EXISTS (
-			SELECT 1
-			FROM conversation_participants cp
-			WHERE cp.conversation_id = conversations.id
-		)
-	`)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete conversations")})
-		return
-	}
-
-	_, err = tx.Exec("DELETE FROM users WHERE id = ?", currentUserID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete user")})
-		return
-	}
-
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to commit delete")})
-		return
-	}
-	committed = true
-
-	for _, fp := range filePaths {
+	for _, fp := range deleted.FilePaths {
 		if isLocalUploadPath(h.uploadDir, fp) {
 			_ = os.Remove(fp)
 		}
 	}
 
-	if avatarURL.Valid {
-		if avatarPath, ok := localPathFromAvatarURL(avatarURL.String, h.uploadDir); ok {
+	if deleted.AvatarURL != nil {
+		if avatarPath, ok := localPathFromAvatarURL(*deleted.AvatarURL, h.uploadDir); ok {
 			if isLocalUploadPath(h.uploadDir, avatarPath) {
 				_ = os.Remove(avatarPath)
 			}
 		}
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	return http.StatusOK, nil
 }
 
 // UpsertDeviceKey stores or rotates the current user's device public key.
@@ -1266,39 +829,7 @@ func (h *MessageHandler) UpsertDeviceKey(c *gin.Context) {
 		return
 	}
 
-	valOrNil := func(ptr *string) interface{} {
-		if ptr == nil {
-			return nil
-		}
-		return *ptr
-	}
-	intOrNil := func(ptr *int) interface{} {
-		if ptr == nil {
-			return nil
-		}
-		return *ptr
-	}
-
-	_, err := h.db.Exec(`
-		INSERT INTO user_device_keys (
-			user_id, device_id, algorithm, public_key, key_id,
-			enc_private_key, enc_private_key_iv, kdf_salt, kdf_iterations, kdf_alg, key_wrap_version, updated_at
-		)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
-		ON CONFLICT(user_id, device_id, key_id)
-		DO UPDATE SET
-			algorithm = excluded.algorithm,
-			public_key = excluded.public_key,
-			enc_private_key = COALESCE(excluded.enc_private_key, user_device_keys.enc_private_key),
-			enc_private_key_iv = COALESCE(excluded.enc_private_key_iv, user_device_keys.enc_private_key_iv),
-			kdf_salt = COALESCE(excluded.kdf_salt, user_device_keys.kdf_salt),
-			kdf_iterations = COALESCE(excluded.kdf_iterations, user_device_keys.kdf_iterations),
-			kdf_alg = COALESCE(excluded.kdf_alg, user_device_keys.kdf_alg),
-			key_wrap_version = COALESCE(excluded.key_wrap_version, user_device_keys.key_wrap_version),
-			updated_at = CURRENT_TIMESTAMP,
-			revoked_at = NULL
-	`, userID.(int), payload.DeviceID, payload.Algorithm, payload.PublicKey, payload.KeyID,
-		valOrNil(payload.EncPrivateKey), valOrNil(payload.EncPrivateKeyIV), valOrNil(payload.KDFSalt), intOrNil(payload.KDFIterations), valOrNil(payload.KDFAlg), intOrNil(payload.KeyWrapVersion))
+	err := h.store.DeviceKeys.Upsert(userID.(int), store.DeviceKey(payload))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to store device key")})
 		return
@@ -1316,31 +847,15 @@ func (h *MessageHandler) GetUserDeviceKeys(c *gin.Context) {
 		return
 	}
 
-	rows, err := h.db.Query(`
-		SELECT device_id, algorithm, public_key, key_id
-		FROM user_device_keys
-		WHERE user_id = ? AND revoked_at IS NULL
-		ORDER BY created_at DESC
-	`, userID)
+	keys, err := h.store.DeviceKeys.ListPublic(userID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch device keys")})
 		return
 	}
-	defer rows.Close()
-
-	devices := make([]DeviceKeyResponse, 0)
-	for rows.Next() {
-		var device DeviceKeyResponse
-		if err := rows.Scan(&device.DeviceID, &device.Algorithm, &device.PublicKey, &device.KeyID); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to scan device key")})
-			return
-		}
-		devices = append(devices, device)
-	}
 
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to read device keys")})
-		return
+	devices := make([]DeviceKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		devices = append(devices, DeviceKeyResponse(key))
 	}
 
 	c.JSON(http.StatusOK, gin.H{"devices": devices})
@@ -1354,44 +869,15 @@ func (h *MessageHandler) GetMyDeviceKeys(c *gin.Context) {
 		return
 	}
 
-	rows, err := h.db.Query(`
-		SELECT device_id, algorithm, public_key, key_id,
-		       enc_private_key, enc_private_key_iv, kdf_salt, kdf_iterations, kdf_alg, key_wrap_version, updated_at
-		FROM user_device_keys
-		WHERE user_id = ? AND revoked_at IS NULL
-		ORDER BY COALESCE(updated_at, created_at) DESC
-	`, userID)
+	keys, err := h.store.DeviceKeys.ListOwn(userID.(int))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch device keys")})
 		return
 	}
-	defer rows.Close()
-
-	devices := make([]DeviceKeyResponse, 0)
-	for rows.Next() {
-		var device DeviceKeyResponse
-		if err := rows.Scan(
-			&device.DeviceID,
-			&device.Algorithm,
-			&device.PublicKey,
-			&device.KeyID,
-			&device.EncPrivateKey,
-			&device.EncPrivateKeyIV,
-			&device.KDFSalt,
-			&device.KDFIterations,
-			&device.KDFAlg,
-			&device.KeyWrapVersion,
-			new(interface{}), // updated_at ignored in response
-		); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to scan device key")})
-			return
-		}
-		devices = append(devices, device)
-	}
 
-	if err := rows.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to read device keys")})
-		return
+	devices := make([]DeviceKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		devices = append(devices, DeviceKeyResponse(key))
 	}
 
 	c.JSON(http.StatusOK, gin.H{"devices": devices})
@@ -1405,22 +891,33 @@ func (h *MessageHandler) GetMyProfile(c *gin.Context) {
 		return
 	}
 
-	var user models.User
-	err := h.db.QueryRow(`
-		SELECT id, username, display_name, avatar_url, created_at FROM users WHERE id = ?
-	`, userID.(int)).Scan(&user.ID, &user.Username, &user.DisplayName, &user.AvatarURL, &user.CreatedAt)
-
+	user, err := h.store.Users.Get(userID.(int))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch profile")})
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	c.JSON(http.StatusOK, models.User{
+		ID:          user.ID,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		AvatarURL:   user.AvatarURL,
+		CreatedAt:   user.CreatedAt,
+		PushPreview: &user.PushPreview,
+	})
+}
+
+// SetTURNSecret switches TURN to time-limited per-user credentials derived
+// from secret, replacing the static username and password.
+func (h *MessageHandler) SetTURNSecret(secret string, ttl time.Duration) {
+	h.turnSecret = secret
+	h.turnCredentialTTL = ttl
 }
 
 // GetWebRTCConfig returns STUN/TURN server configuration
 func (h *MessageHandler) GetWebRTCConfig(c *gin.Context) {
 	iceServers := []gin.H{}
+	response := gin.H{}
 
 	// Add STUN servers
 	stunServers := strings.Split(h.stunServers, ",")
@@ -1444,16 +941,26 @@ func (h *MessageHandler) GetWebRTCConfig(c *gin.Context) {
 		turnConfig := gin.H{
 			"urls": turnUrls,
 		}
-		if h.turnUsername != "" {
-			turnConfig["username"] = h.turnUsername
-		}
-		if h.turnPassword != "" {
-			turnConfig["credential"] = h.turnPassword
+		if h.turnSecret != "" {
+			creds := turn.NewCredentials(h.turnSecret, c.GetInt("user_id"), h.turnCredentialTTL, time.Now())
+			turnConfig["username"] = creds.Username
+			turnConfig["credential"] = creds.Password
+			// Clients fetch new credentials before these expire
+			response["ttl"] = int(h.turnCredentialTTL.Seconds())
+			response["expires_at"] = creds.ExpiresAt.UTC()
+		} else {
+			if h.turnUsername != "" {
+				turnConfig["username"] = h.turnUsername
+			}
+			if h.turnPassword != "" {
+				turnConfig["credential"] = h.turnPassword
+			}
 		}
 		iceServers = append(iceServers, turnConfig)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"iceServers": iceServers})
+	response["iceServers"] = iceServers
+	c.JSON(http.StatusOK, response)
 }
 
 // GetVAPIDKey returns the public VAPID key for push subscription
@@ -1474,33 +981,64 @@ func (h *MessageHandler) SubscribePush(c *gin.Context) {
 	}
 
 	var req struct {
+		// Provider is webpush (the default), fcm or webhook; Endpoint is the
+		// push service URL, device token or webhook URL respectively
+		Provider string `json:"provider"`
 		Endpoint string `json:"endpoint" binding:"required"`
-		Keys     struct {
-			P256dh string `json:"p256dh" binding:"required"`
-			Auth   string `json:"auth" binding:"required"`
-		} `json:"keys" binding:"required"`
+		// Keys are only used by Web Push
+		Keys struct {
+			P256dh string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+		// Label names the device in the subscription list
+		Label string `json:"label"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
 		return
 	}
+	if req.Provider == "" {
+		req.Provider = push.ProviderWebPush
+	}
+	switch {
+	case req.Provider == push.ProviderWebPush:
+		if req.Keys.P256dh == "" || req.Keys.Auth == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+			return
+		}
+	case h.pushNotifier == nil || !h.pushNotifier.HasProvider(req.Provider):
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("unsupported push provider")})
+		return
+	case req.Provider == push.ProviderWebhook && !isHTTPURL(req.Endpoint):
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
 
 	currentUserID := userID.(int)
-
-	// Upsert — if endpoint already exists (maybe from a different user or re-subscribe), replace it
-	_, err := h.db.Exec(`
-		INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth)
-		VALUES (?, ?, ?, ?)
-		ON CONFLICT(endpoint) DO UPDATE SET user_id = ?, p256dh = ?, auth = ?, revoked_at = NULL
-	`, currentUserID, req.Endpoint, req.Keys.P256dh, req.Keys.Auth,
-		currentUserID, req.Keys.P256dh, req.Keys.Auth)
+	label := deviceLabel(req.Label)
+	userAgent := c.Request.UserAgent()
+	if len(userAgent) > maxUserAgent {
+		userAgent = userAgent[:maxUserAgent]
+	}
+
+	// Upsert — if endpoint already exists (maybe from a different user or re-subscribe), replace it.
+	// A re-subscribe without a label keeps the one given before.
+	subID, err := h.store.Subscriptions.Subscribe(store.NewSubscription{
+		UserID:    currentUserID,
+		Provider:  req.Provider,
+		Endpoint:  req.Endpoint,
+		P256dh:    req.Keys.P256dh,
+		Auth:      req.Keys.Auth,
+		UserAgent: userAgent,
+		Label:     label,
+	})
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to save subscription")})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "subscribed"})
+	c.JSON(http.StatusOK, gin.H{"status": "subscribed", "id": subID})
 }
 
 // UnsubscribePush removes a push subscription for the current user
@@ -1522,11 +1060,7 @@ func (h *MessageHandler) UnsubscribePush(c *gin.Context) {
 
 	currentUserID := userID.(int)
 
-	_, err := h.db.Exec(
-		"UPDATE push_subscriptions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND endpoint = ?",
-		currentUserID, req.Endpoint,
-	)
-	if err != nil {
+	if err := h.store.Subscriptions.Unsubscribe(currentUserID, req.Endpoint); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to remove subscription")})
 		return
 	}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/4xmen/payambar/internal/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// ConversationNotifications are the settings a user saved for one
+// conversation.
+type ConversationNotifications struct {
+	ConversationID int `json:"conversation_id"`
+	notify.Settings
+}
+
+// GetNotificationSettings returns the account-wide settings and every
+// conversation with its own.
+func (h *MessageHandler) GetNotificationSettings(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	account, _, err := notify.Get(h.store, userID, notify.Account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch notification settings")})
+		return
+	}
+
+	convIDs, err := h.store.Notifications.ConversationIDs(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch notification settings")})
+		return
+	}
+
+	conversations := []ConversationNotifications{}
+	for _, convID := range convIDs {
+		settings, _, err := notify.Get(h.store, userID, convID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch notification settings")})
+			return
+		}
+		conversations = append(conversations, ConversationNotifications{ConversationID: convID, Settings: settings})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"settings": account, "conversations": conversations})
+}
+
+// UpdateNotificationSettings replaces the account-wide settings.
+func (h *MessageHandler) UpdateNotificationSettings(c *gin.Context) {
+	var settings notify.Settings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
+	h.saveNotificationSettings(c, notify.Account, settings)
+}
+
+// GetConversationNotifications returns the settings that apply to a
+// conversation; "custom" is false while the account-wide ones are used.
+func (h *MessageHandler) GetConversationNotifications(c *gin.Context) {
+	convID, ok := h.notificationConversation(c)
+	if !ok {
+		return
+	}
+
+	userID := c.GetInt("user_id")
+	settings, custom, err := notify.Get(h.store, userID, convID)
+	if err == nil && !custom {
+		settings, _, err = notify.Get(h.store, userID, notify.Account)
+		settings.QuietStart, settings.QuietEnd, settings.Timezone = "", "", ""
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch notification settings")})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"conversation_id": convID, "custom": custom, "settings": settings})
+}
+
+// UpdateConversationNotifications saves settings for one conversation, which
+// then take precedence over the account-wide level. Quiet hours are
+// account-wide and rejected here.
+func (h *MessageHandler) UpdateConversationNotifications(c *gin.Context) {
+	convID, ok := h.notificationConversation(c)
+	if !ok {
+		return
+	}
+
+	var settings notify.Settings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
+	if settings.QuietStart != "" || settings.QuietEnd != "" || settings.Timezone != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("quiet hours are account-wide")})
+		return
+	}
+	h.saveNotificationSettings(c, convID, settings)
+}
+
+// ResetConversationNotifications drops a conversation's own settings.
+func (h *MessageHandler) ResetConversationNotifications(c *gin.Context) {
+	convID, ok := h.notificationConversation(c)
+	if !ok {
+		return
+	}
+
+	if err := notify.Reset(h.store, c.GetInt("user_id"), convID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to update notification settings")})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reset"})
+}
+
+func (h *MessageHandler) saveNotificationSettings(c *gin.Context, convID int, settings notify.Settings) {
+	err := settings.Validate()
+	if err == nil {
+		err = notify.Save(h.store, c.GetInt("user_id"), convID, settings)
+	}
+	switch {
+	case errors.Is(err, notify.ErrInvalidLevel):
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid notification level")})
+	case errors.Is(err, notify.ErrInvalidQuietHours):
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid quiet hours")})
+	case errors.Is(err, notify.ErrInvalidTimezone):
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid timezone")})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to update notification settings")})
+	default:
+		c.JSON(http.StatusOK, gin.H{"status": "updated", "settings": settings})
+	}
+}
+
+// notificationConversation reads the conversation id from the path and
+// checks that the current user takes part in it.
+func (h *MessageHandler) notificationConversation(c *gin.Context) (int, bool) {
+	convID, err := strconv.Atoi(c.Param("id"))
+	if err != nil || convID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid conversation id")})
+		return 0, false
+	}
+
+	member, err := h.store.Conversations.IsParticipant(convID, c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch conversation")})
+		return 0, false
+	}
+	if !member {
+		c.JSON(http.StatusNotFound, gin.H{"error": __("conversation not found")})
+		return 0, false
+	}
+	return convID, true
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/4xmen/payambar/internal/auth"
+	"github.com/gin-gonic/gin"
+)
+
+type PasskeyFinishRequest struct {
+	SessionID  string          `json:"session_id" binding:"required"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential" binding:"required"`
+}
+
+type PasskeyLoginBeginRequest struct {
+	Username string `json:"username"`
+}
+
+// PasskeyLoginFinishRequest carries the pre-auth token from Login when the
+// assertion completes a password login
+type PasskeyLoginFinishRequest struct {
+	SessionID    string          `json:"session_id" binding:"required"`
+	PreAuthToken string          `json:"preauth_token"`
+	Credential   json.RawMessage `json:"credential" binding:"required"`
+}
+
+// passkeyError maps passkey service errors onto HTTP responses.
+func passkeyError(c *gin.Context, err error, status int) {
+	if errors.Is(err, auth.ErrPasskeysDisabled) {
+		c.JSON(http.StatusNotFound, gin.H{"error": __(err.Error())})
+		return
+	}
+	if errors.Is(err, auth.ErrAccountSuspended) {
+		c.JSON(http.StatusForbidden, gin.H{"error": __(err.Error())})
+		return
+	}
+	var lockoutErr *auth.LockoutError
+	if errors.As(err, &lockoutErr) {
+		retryAfter := int(math.Ceil(lockoutErr.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": __(err.Error()), "retry_after": retryAfter})
+		return
+	}
+	c.JSON(status, gin.H{"error": __(err.Error())})
+}
+
+// BeginPasskeyRegistration returns creation options for a new passkey
+func (h *AuthHandler) BeginPasskeyRegistration(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	creation, sessionID, err := h.authSvc.BeginPasskeyRegistration(userID.(int))
+	if err != nil {
+		passkeyError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "publicKey": creation.Response})
+}
+
+// FinishPasskeyRegistration verifies and stores a new passkey
+func (h *AuthHandler) FinishPasskeyRegistration(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	var req PasskeyFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
+
+	passkey, err := h.authSvc.FinishPasskeyRegistration(userID.(int), req.SessionID, req.Name, req.Credential)
+	if err != nil {
+		passkeyError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusCreated, passkey)
+}
+
+// GetPasskeys lists the current user's passkeys
+func (h *AuthHandler) GetPasskeys(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	passkeys, err := h.authSvc.ListPasskeys(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch passkeys")})
+		return
+	}
+
+	required, err := h.authSvc.PasskeyRequired(userID.(int))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch passkeys")})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"passkeys": passkeys, "passkey_required": required})
+}
+
+// DeletePasskey removes one of the current user's passkeys
+func (h *AuthHandler) DeletePasskey(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	passkeyID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid passkey id")})
+		return
+	}
+
+	if err := h.authSvc.DeletePasskey(userID.(int), passkeyID); err != nil {
+		if err.Error() == "passkey not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": __(err.Error())})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to delete passkey")})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// SetPasskeySecondFactor enables or disables the passkey second factor
+func (h *AuthHandler) SetPasskeySecondFactor(c *gin.Context) {
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": __("unauthorized")})
+		return
+	}
+
+	var req struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
+
+	if err := h.authSvc.SetPasskeyRequired(userID.(int), *req.Enabled); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __(err.Error())})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"passkey_required": *req.Enabled})
+}
+
+// BeginPasskeyLogin returns assertion options for passwordless login
+func (h *AuthHandler) BeginPasskeyLogin(c *gin.Context) {
+	var req PasskeyLoginBeginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
+
+	assertion, sessionID, err := h.authSvc.BeginPasskeyLogin(req.Username)
+	if err != nil {
+		passkeyError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "publicKey": assertion.Response})
+}
+
+// FinishPasskeyLogin verifies an assertion and returns a token
+func (h *AuthHandler) FinishPasskeyLogin(c *gin.Context) {
+	var req PasskeyLoginFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid request")})
+		return
+	}
+
+	token, userID, username, err := h.authSvc.FinishPasskeyLogin(req.SessionID, req.Credential, req.PreAuthToken, c.ClientIP())
+	if err != nil {
+		passkeyError(c, err, http.StatusUnauthorized)
+		return
+	}
+
+	c.JSON(http.StatusOK, AuthResponse{
+		Token:    token,
+		UserID:   userID,
+		Username: username,
+	})
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/4xmen/payambar/internal/store"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxDeviceLabel caps a subscription's label, in characters
+	maxDeviceLabel = 64
+	// maxUserAgent caps the stored user agent, in bytes
+	maxUserAgent = 512
+)
+
+// PushSubscription is one of the user's devices subscribed to push
+// notifications. The endpoint and keys are never returned.
+type PushSubscription struct {
+	ID            int64      `json:"id"`
+	Provider      string     `json:"provider"`
+	Label         *string    `json:"label"`
+	UserAgent     *string    `json:"user_agent"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LastSuccessAt *time.Time `json:"last_success_at"`
+	LastFailureAt *time.Time `json:"last_failure_at"`
+	FailureCount  int        `json:"failure_count"`
+}
+
+// GetPushSubscriptions lists the current user's active push subscriptions
+func (h *MessageHandler) GetPushSubscriptions(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	active, err := h.store.Subscriptions.List(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to fetch subscriptions")})
+		return
+	}
+
+	subscriptions := make([]PushSubscription, 0, len(active))
+	for _, sub := range active {
+		subscriptions = append(subscriptions, PushSubscription(sub))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subscriptions})
+}
+
+// DeletePushSubscription revokes one of the current user's push
+// subscriptions and drops the notifications still queued for it
+func (h *MessageHandler) DeletePushSubscription(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	subID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || subID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid subscription id")})
+		return
+	}
+
+	err = h.store.Subscriptions.Revoke(subID, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": __("subscription not found")})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to remove subscription")})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// TestPushSubscription queues a test notification for one of the current
+// user's push subscriptions
+func (h *MessageHandler) TestPushSubscription(c *gin.Context) {
+	userID := c.GetInt("user_id")
+
+	subID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || subID <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": __("invalid subscription id")})
+		return
+	}
+
+	provider, err := h.store.Subscriptions.Provider(subID, userID)
+	if errors.Is(err, store.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": __("subscription not found")})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to send test notification")})
+		return
+	}
+
+	if h.pushNotifier == nil || !h.pushNotifier.HasProvider(provider) {
+		c.JSON(http.StatusNotFound, gin.H{"error": __("push notifications not configured")})
+		return
+	}
+
+	if err := h.pushNotifier.SendTestNotification(subID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": __("failed to send test notification")})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "queued"})
+}
+
+// isHTTPURL reports whether s is an absolute http(s) URL.
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// deviceLabel trims a client supplied device label; empty means none.
+func deviceLabel(label string) *string {
+	runes := []rune(strings.TrimSpace(label))
+	if len(runes) == 0 {
+		return nil
+	}
+	if len(runes) > maxDeviceLabel {
+		runes = runes[:maxDeviceLabel]
+	}
+	s := string(runes)
+	return &s
+}
@@ -8,28 +8,40 @@ type User struct {
 	DisplayName *string   `json:"display_name,omitempty"`
 	AvatarURL   *string   `json:"avatar_url,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
+	// PushPreview is only set on the user's own profile
+	PushPreview *bool `json:"push_preview,omitempty"`
 }
 
 type Message struct {
-	ID             int        `json:"id"`
-	SenderID       int        `json:"sender_id"`
-	ReceiverID     int        `json:"receiver_id"`
-	Content        string     `json:"content"`
-	Encrypted      bool       `json:"encrypted,omitempty"`
-	E2EEVersion    *int       `json:"e2ee_v,omitempty"`
-	Algorithm      *string    `json:"alg,omitempty"`
-	SenderDeviceID *string    `json:"sender_device_id,omitempty"`
-	KeyID          *string    `json:"key_id,omitempty"`
-	IV             *string    `json:"iv,omitempty"`
-	Ciphertext     *string    `json:"ciphertext,omitempty"`
-	AAD            *string    `json:"aad,omitempty"`
-	Status         string     `json:"status"` // sent, delivered, read
-	CreatedAt      time.Time  `json:"created_at"`
-	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
-	ReadAt         *time.Time `json:"read_at,omitempty"`
-	FileName       *string    `json:"file_name,omitempty"`
-	FileURL        *string    `json:"file_url,omitempty"`
-	FileType       *string    `json:"file_content_type,omitempty"`
+	ID             int          `json:"id"`
+	ClientMsgID    *string      `json:"client_message_id,omitempty"`
+	SenderID       int          `json:"sender_id"`
+	ReceiverID     int          `json:"receiver_id"`
+	Content        string       `json:"content"`
+	Encrypted      bool         `json:"encrypted,omitempty"`
+	E2EEVersion    *int         `json:"e2ee_v,omitempty"`
+	Algorithm      *string      `json:"alg,omitempty"`
+	SenderDeviceID *string      `json:"sender_device_id,omitempty"`
+	KeyID          *string      `json:"key_id,omitempty"`
+	IV             *string      `json:"iv,omitempty"`
+	Ciphertext     *string      `json:"ciphertext,omitempty"`
+	AAD            *string      `json:"aad,omitempty"`
+	Status         string       `json:"status"` // sent, delivered, read
+	CreatedAt      time.Time    `json:"created_at"`
+	DeliveredAt    *time.Time   `json:"delivered_at,omitempty"`
+	ReadAt         *time.Time   `json:"read_at,omitempty"`
+	FileName       *string      `json:"file_name,omitempty"`
+	FileURL        *string      `json:"file_url,omitempty"`
+	FileType       *string      `json:"file_content_type,omitempty"`
+	Call           *CallSummary `json:"call,omitempty"`
+}
+
+// CallSummary is a call history entry, seen from the receiver's side.
+type CallSummary struct {
+	ID       int    `json:"id"`
+	Kind     string `json:"kind"`               // audio, video
+	Outcome  string `json:"outcome"`            // completed, missed, declined, busy
+	Duration int    `json:"duration,omitempty"` // seconds, for completed calls
 }
 
 type File struct {
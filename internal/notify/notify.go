@@ -0,0 +1,240 @@
+// Package notify stores per-user and per-conversation notification settings
+// and decides whether a message warrants a push notification.
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	// Quiet hours need time zones even where the OS has no tzdata
+	_ "time/tzdata"
+
+	"github.com/4xmen/payambar/internal/conversation"
+	"github.com/4xmen/payambar/internal/store"
+)
+
+// Notification levels.
+const (
+	LevelAll      = "all"
+	LevelMentions = "mentions"
+	LevelNone     = "none"
+)
+
+// Account is the conversation id of a user's account-wide settings.
+const Account = 0
+
+var (
+	ErrInvalidLevel      = errors.New("invalid notification level")
+	ErrInvalidQuietHours = errors.New("invalid quiet hours")
+	ErrInvalidTimezone   = errors.New("invalid timezone")
+)
+
+// Settings controls push notifications for a user, either account-wide or
+// for one conversation. Quiet hours only apply account-wide.
+type Settings struct {
+	// Level is all, mentions (only messages naming @username) or none
+	Level string `json:"level"`
+	// Muted silences notifications until MutedUntil, or for good if unset
+	Muted      bool       `json:"muted"`
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	// QuietStart and QuietEnd are "HH:MM" in Timezone; the window may
+	// span midnight
+	QuietStart string `json:"quiet_start,omitempty"`
+	QuietEnd   string `json:"quiet_end,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+}
+
+// Validate normalizes s and checks its values.
+func (s *Settings) Validate() error {
+	if s.Level == "" {
+		s.Level = LevelAll
+	}
+	switch s.Level {
+	case LevelAll, LevelMentions, LevelNone:
+	default:
+		return ErrInvalidLevel
+	}
+	if !s.Muted {
+		s.MutedUntil = nil
+	}
+
+	if (s.QuietStart == "") != (s.QuietEnd == "") {
+		return ErrInvalidQuietHours
+	}
+	if s.QuietStart != "" {
+		if _, err := clockMinutes(s.QuietStart); err != nil {
+			return err
+		}
+		if _, err := clockMinutes(s.QuietEnd); err != nil {
+			return err
+		}
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			return ErrInvalidTimezone
+		}
+	}
+	return nil
+}
+
+// MutedAt reports whether the settings silence notifications at now.
+func (s Settings) MutedAt(now time.Time) bool {
+	if s.Level == LevelNone {
+		return true
+	}
+	return s.Muted && (s.MutedUntil == nil || now.Before(*s.MutedUntil))
+}
+
+// QuietAt reports whether now falls within the quiet hours.
+func (s Settings) QuietAt(now time.Time) bool {
+	if s.QuietStart == "" {
+		return false
+	}
+	start, err := clockMinutes(s.QuietStart)
+	if err != nil {
+		return false
+	}
+	end, err := clockMinutes(s.QuietEnd)
+	if err != nil {
+		return false
+	}
+
+	loc := time.UTC
+	if s.Timezone != "" {
+		if l, err := time.LoadLocation(s.Timezone); err == nil {
+			loc = l
+		}
+	}
+	local := now.In(loc)
+	minute := local.Hour()*60 + local.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// clockMinutes parses "HH:MM" into minutes after midnight.
+func clockMinutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, ErrInvalidQuietHours
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Get returns the settings of userID for conversationID (or Account). The
+// second result is false when none were saved and defaults are returned.
+func Get(s *store.Store, userID, conversationID int) (Settings, bool, error) {
+	saved, err := s.Notifications.Get(userID, conversationID)
+	if errors.Is(err, store.ErrNotFound) {
+		return Settings{Level: LevelAll}, false, nil
+	}
+	if err != nil {
+		return Settings{}, false, fmt.Errorf("failed to fetch notification settings: %w", err)
+	}
+	return Settings(*saved), true, nil
+}
+
+// Save stores settings of userID for conversationID (or Account).
+func Save(s *store.Store, userID, conversationID int, settings Settings) error {
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+	if settings.MutedUntil != nil {
+		mutedUntil := settings.MutedUntil.UTC()
+		settings.MutedUntil = &mutedUntil
+	}
+	if err := s.Notifications.Save(userID, conversationID, store.NotificationSettings(settings)); err != nil {
+		return fmt.Errorf("failed to save notification settings: %w", err)
+	}
+	return nil
+}
+
+// Reset removes the settings of userID for conversationID, so the account
+// settings apply again.
+func Reset(s *store.Store, userID, conversationID int) error {
+	if err := s.Notifications.Reset(userID, conversationID); err != nil {
+		return fmt.Errorf("failed to reset notification settings: %w", err)
+	}
+	return nil
+}
+
+// ShouldPush reports whether receiverID wants a push notification at now for
+// a message from senderID. content is the plaintext, if any, checked for
+// mentions; encrypted messages never count as mentions.
+func ShouldPush(s *store.Store, receiverID, senderID int, content string, now time.Time) (bool, error) {
+	level, err := levelAt(s, receiverID, senderID, now)
+	if err != nil || level == LevelNone {
+		return false, err
+	}
+
+	if level == LevelMentions {
+		receiver, err := s.Users.Get(receiverID)
+		if err != nil {
+			return false, fmt.Errorf("failed to fetch user: %w", err)
+		}
+		return mentions(content, receiver.Username), nil
+	}
+	return true, nil
+}
+
+// ShouldRing reports whether receiverID wants a push notification at now
+// about a call from callerID. Mutes and quiet hours apply; the mentions-only
+// level does not.
+func ShouldRing(s *store.Store, receiverID, callerID int, now time.Time) (bool, error) {
+	level, err := levelAt(s, receiverID, callerID, now)
+	return level != LevelNone, err
+}
+
+// levelAt returns the level that applies to pushes from senderID at now;
+// LevelNone while muted or in quiet hours.
+func levelAt(s *store.Store, receiverID, senderID int, now time.Time) (string, error) {
+	account, _, err := Get(s, receiverID, Account)
+	if err != nil {
+		return LevelNone, err
+	}
+	if account.MutedAt(now) || account.QuietAt(now) {
+		return LevelNone, nil
+	}
+
+	convID, err := conversation.FindDirect(s, receiverID, senderID)
+	if errors.Is(err, conversation.ErrNoConversation) {
+		return account.Level, nil
+	}
+	if err != nil {
+		return LevelNone, err
+	}
+	conv, saved, err := Get(s, receiverID, convID)
+	if err != nil {
+		return LevelNone, err
+	}
+	if !saved {
+		return account.Level, nil
+	}
+	if conv.MutedAt(now) {
+		return LevelNone, nil
+	}
+	return conv.Level, nil
+}
+
+// mentions reports whether content names @username as a whole word.
+func mentions(content, username string) bool {
+	content, tag := strings.ToLower(content), "@"+strings.ToLower(username)
+	for i := strings.Index(content, tag); i >= 0; {
+		end := i + len(tag)
+		if end == len(content) || !isUsernameChar(content[end]) {
+			return true
+		}
+		next := strings.Index(content[end:], tag)
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return false
+}
+
+func isUsernameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_'
+}
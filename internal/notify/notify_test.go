@@ -0,0 +1,235 @@
+package notify
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/4xmen/payambar/internal/conversation"
+	"github.com/4xmen/payambar/internal/db/dbtest"
+	"github.com/4xmen/payambar/internal/store"
+)
+
+func setupTestDB(t *testing.T) *store.Store {
+	t.Helper()
+	database := dbtest.New(t)
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := database.Exec("INSERT INTO users (username, password_hash) VALUES ($1, 'hash')", name); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	return store.New(database)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings Settings
+		want     error
+	}{
+		{"defaults", Settings{}, nil},
+		{"mentions", Settings{Level: LevelMentions}, nil},
+		{"unknown level", Settings{Level: "some"}, ErrInvalidLevel},
+		{"quiet hours", Settings{QuietStart: "22:00", QuietEnd: "07:30", Timezone: "Asia/Tehran"}, nil},
+		{"quiet start only", Settings{QuietStart: "22:00"}, ErrInvalidQuietHours},
+		{"bad clock", Settings{QuietStart: "25:00", QuietEnd: "07:00"}, ErrInvalidQuietHours},
+		{"bad timezone", Settings{Timezone: "Mars/Olympus"}, ErrInvalidTimezone},
+	}
+	for _, tt := range tests {
+		if err := tt.settings.Validate(); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Validate() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	s := Settings{MutedUntil: &time.Time{}}
+	s.Validate()
+	if s.Level != LevelAll || s.MutedUntil != nil {
+		t.Errorf("Validate() did not normalize: %+v", s)
+	}
+}
+
+func TestMutedAt(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	later := now.Add(time.Hour)
+
+	if (Settings{Level: LevelAll}).MutedAt(now) {
+		t.Error("unmuted settings are muted")
+	}
+	if !(Settings{Level: LevelAll, Muted: true}).MutedAt(now) {
+		t.Error("mute forever is not muted")
+	}
+	if !(Settings{Level: LevelAll, Muted: true, MutedUntil: &later}).MutedAt(now) {
+		t.Error("not muted before muted_until")
+	}
+	if (Settings{Level: LevelAll, Muted: true, MutedUntil: &later}).MutedAt(later) {
+		t.Error("still muted at muted_until")
+	}
+	if !(Settings{Level: LevelNone}).MutedAt(now) {
+		t.Error("level none is not muted")
+	}
+}
+
+func TestQuietAt(t *testing.T) {
+	overnight := Settings{QuietStart: "22:00", QuietEnd: "07:00", Timezone: "Asia/Tehran"}
+	daytime := Settings{QuietStart: "09:00", QuietEnd: "17:00"}
+
+	tests := []struct {
+		settings Settings
+		at       time.Time
+		want     bool
+	}{
+		// 19:00 UTC is 22:30 in Tehran (UTC+3:30)
+		{overnight, time.Date(2026, 3, 1, 19, 0, 0, 0, time.UTC), true},
+		{overnight, time.Date(2026, 3, 1, 3, 0, 0, 0, time.UTC), true},
+		{overnight, time.Date(2026, 3, 1, 3, 30, 0, 0, time.UTC), false},
+		{overnight, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), false},
+		{daytime, time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC), true},
+		{daytime, time.Date(2026, 3, 1, 17, 0, 0, 0, time.UTC), false},
+		{Settings{}, time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := tt.settings.QuietAt(tt.at); got != tt.want {
+			t.Errorf("%+v QuietAt(%v) = %v, want %v", tt.settings, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"@bob are you there?", true},
+		{"ping @Bob.", true},
+		{"hi @bobby", false},
+		{"@bobby and @bob", true},
+		{"bob", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := mentions(tt.content, "bob"); got != tt.want {
+			t.Errorf("mentions(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestSaveAndGet(t *testing.T) {
+	conn := setupTestDB(t)
+
+	if s, saved, err := Get(conn, 1, Account); err != nil || saved || s.Level != LevelAll {
+		t.Fatalf("Get() before saving = %+v, %v, %v", s, saved, err)
+	}
+
+	until := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	if err := Save(conn, 1, Account, Settings{Muted: true, MutedUntil: &until, QuietStart: "23:00", QuietEnd: "06:00", Timezone: "Europe/Berlin"}); err != nil {
+		t.Fatalf("Save() = %v", err)
+	}
+	s, saved, err := Get(conn, 1, Account)
+	if err != nil || !saved {
+		t.Fatalf("Get() = %v, %v", saved, err)
+	}
+	if !s.Muted || s.MutedUntil == nil || !s.MutedUntil.Equal(until) || s.QuietStart != "23:00" || s.Timezone != "Europe/Berlin" {
+		t.Errorf("Get() = %+v", s)
+	}
+
+	if err := Save(conn, 1, Account, Settings{Level: "loud"}); !errors.Is(err, ErrInvalidLevel) {
+		t.Errorf("Save() with an invalid level = %v", err)
+	}
+
+	if err := Reset(conn, 1, Account); err != nil {
+		t.Fatalf("Reset() = %v", err)
+	}
+	if _, saved, _ := Get(conn, 1, Account); saved {
+		t.Error("settings still saved after Reset()")
+	}
+}
+
+func TestShouldPush(t *testing.T) {
+	conn := setupTestDB(t)
+	alice, bob, carol := 1, 2, 3
+	convID, err := conversation.CreateDirect(conn, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirect: %v", err)
+	}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	shouldPush := func(senderID int, content string) bool {
+		t.Helper()
+		ok, err := ShouldPush(conn, bob, senderID, content, now)
+		if err != nil {
+			t.Fatalf("ShouldPush() = %v", err)
+		}
+		return ok
+	}
+
+	if !shouldPush(alice, "hi") {
+		t.Error("no push without settings")
+	}
+
+	// Muting the conversation with alice leaves carol alone
+	Save(conn, bob, convID, Settings{Muted: true})
+	if shouldPush(alice, "hi") || !shouldPush(carol, "hi") {
+		t.Error("conversation mute not applied to that conversation only")
+	}
+	past := now.Add(-time.Minute)
+	Save(conn, bob, convID, Settings{Muted: true, MutedUntil: &past})
+	if !shouldPush(alice, "hi") {
+		t.Error("expired mute still applied")
+	}
+
+	// Mentions only, account-wide, unless the conversation says otherwise
+	Save(conn, bob, Account, Settings{Level: LevelMentions})
+	if !shouldPush(alice, "hi") {
+		t.Error("conversation level did not override the account level")
+	}
+	Reset(conn, bob, convID)
+	if shouldPush(alice, "hi") || !shouldPush(alice, "hi @bob") {
+		t.Error("mentions-only level not applied")
+	}
+
+	// Quiet hours: 12:00 UTC is 15:30 in Tehran
+	Save(conn, bob, Account, Settings{QuietStart: "15:00", QuietEnd: "16:00", Timezone: "Asia/Tehran"})
+	if shouldPush(alice, "hi") || shouldPush(carol, "hi") {
+		t.Error("push during quiet hours")
+	}
+
+	Save(conn, bob, Account, Settings{Muted: true})
+	if shouldPush(carol, "@bob") {
+		t.Error("push while muted account-wide")
+	}
+}
+
+func TestShouldRing(t *testing.T) {
+	conn := setupTestDB(t)
+	alice, bob := 1, 2
+	convID, err := conversation.CreateDirect(conn, alice, bob)
+	if err != nil {
+		t.Fatalf("CreateDirect: %v", err)
+	}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	shouldRing := func() bool {
+		t.Helper()
+		ok, err := ShouldRing(conn, bob, alice, now)
+		if err != nil {
+			t.Fatalf("ShouldRing() = %v", err)
+		}
+		return ok
+	}
+
+	// Calls get through a mentions-only level, but not a mute
+	Save(conn, bob, Account, Settings{Level: LevelMentions})
+	if !shouldRing() {
+		t.Error("mentions-only level silenced a call")
+	}
+	Save(conn, bob, convID, Settings{Level: LevelNone})
+	if shouldRing() {
+		t.Error("call rang in a conversation set to none")
+	}
+	Reset(conn, bob, convID)
+	Save(conn, bob, Account, Settings{QuietStart: "11:00", QuietEnd: "13:00"})
+	if shouldRing() {
+		t.Error("call rang during quiet hours")
+	}
+}
@@ -0,0 +1,38 @@
+package push
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// ProviderFake is the name of FakeProvider.
+const ProviderFake = "fake"
+
+// FakeProvider records deliveries instead of sending them, for tests.
+type FakeProvider struct {
+	// Respond answers each delivery; nil answers 201 Created
+	Respond func(d Delivery) (Result, error)
+
+	mu         sync.Mutex
+	deliveries []Delivery
+}
+
+func (p *FakeProvider) Name() string { return ProviderFake }
+
+func (p *FakeProvider) Send(ctx context.Context, d Delivery) (Result, error) {
+	p.mu.Lock()
+	p.deliveries = append(p.deliveries, d)
+	p.mu.Unlock()
+	if p.Respond != nil {
+		return p.Respond(d)
+	}
+	return Result{Status: http.StatusCreated}, nil
+}
+
+// Deliveries returns what was sent so far.
+func (p *FakeProvider) Deliveries() []Delivery {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Delivery(nil), p.deliveries...)
+}
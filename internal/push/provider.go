@@ -0,0 +1,220 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// Provider names, stored with each subscription to pick how it is reached.
+const (
+	ProviderWebPush = "webpush"
+	ProviderFCM     = "fcm"
+	ProviderWebhook = "webhook"
+)
+
+// Provider delivers notifications through one kind of push service.
+type Provider interface {
+	// Name matches the provider column of the subscriptions it serves
+	Name() string
+	Send(ctx context.Context, d Delivery) (Result, error)
+}
+
+// Delivery is one queued notification for one subscription.
+type Delivery struct {
+	// Endpoint is the push service URL, device token or webhook URL
+	Endpoint string
+	// P256dh and Auth are the Web Push encryption keys
+	P256dh string
+	Auth   string
+	// Payload is the JSON notification (see payload)
+	Payload []byte
+	Topic   string
+	Urgency string
+	// TTL is how long the push service may hold it, in seconds
+	TTL int
+}
+
+// Result is the push service's answer. Status is an HTTP status code with
+// Web Push meaning: 2xx sent, 404/410 the subscription is gone, 429 and 5xx
+// retry later, anything else the notification was rejected.
+type Result struct {
+	Status     int
+	RetryAfter time.Duration
+}
+
+// defaultClient is used by providers without their own HTTP client.
+var defaultClient = &http.Client{Timeout: sendTimeout}
+
+// httpResult reads the outcome of a plain HTTP push request.
+func httpResult(resp *http.Response) Result {
+	return Result{
+		Status:     resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// WebPush sends encrypted Web Push messages signed with a VAPID key pair.
+type WebPush struct {
+	PublicKey  string
+	PrivateKey string
+	Client     *http.Client
+}
+
+// NewWebPush creates a Web Push provider for a VAPID key pair.
+func NewWebPush(publicKey, privateKey string) *WebPush {
+	return &WebPush{PublicKey: publicKey, PrivateKey: privateKey}
+}
+
+func (p *WebPush) Name() string { return ProviderWebPush }
+
+func (p *WebPush) Send(ctx context.Context, d Delivery) (Result, error) {
+	client := p.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := webpush.SendNotificationWithContext(ctx, d.Payload, &webpush.Subscription{
+		Endpoint: d.Endpoint,
+		Keys:     webpush.Keys{P256dh: d.P256dh, Auth: d.Auth},
+	}, &webpush.Options{
+		HTTPClient:      client,
+		VAPIDPublicKey:  p.PublicKey,
+		VAPIDPrivateKey: p.PrivateKey,
+		Subscriber:      "mailto:push@payambar.local",
+		Topic:           d.Topic,
+		TTL:             d.TTL,
+		Urgency:         webpush.Urgency(d.Urgency),
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	return httpResult(resp), nil
+}
+
+// FCM sends data messages in the FCM HTTP format to a device token. URL is
+// FCM itself or a gateway speaking the same format, e.g. one relaying to
+// APNs for iOS devices.
+type FCM struct {
+	URL string
+	// ServerKey is sent as "Authorization: key=<ServerKey>"
+	ServerKey string
+	Client    *http.Client
+}
+
+// NewFCM creates an FCM provider posting to url.
+func NewFCM(url, serverKey string) *FCM {
+	return &FCM{URL: url, ServerKey: serverKey}
+}
+
+func (p *FCM) Name() string { return ProviderFCM }
+
+func (p *FCM) Send(ctx context.Context, d Delivery) (Result, error) {
+	priority := "normal"
+	if d.Urgency == string(webpush.UrgencyHigh) {
+		priority = "high"
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"to":           d.Endpoint,
+		"priority":     priority,
+		"time_to_live": d.TTL,
+		"collapse_key": d.Topic,
+		"data":         json.RawMessage(d.Payload),
+	})
+	if err != nil {
+		return Result{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.ServerKey != "" {
+		req.Header.Set("Authorization", "key="+p.ServerKey)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	result := httpResult(resp)
+	if resp.StatusCode != http.StatusOK {
+		return result, nil
+	}
+
+	// FCM answers 200 and reports the outcome per token
+	var answer struct {
+		Results []struct {
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return Result{}, fmt.Errorf("fcm: unreadable response: %w", err)
+	}
+	if len(answer.Results) == 0 {
+		return result, nil
+	}
+	switch answer.Results[0].Error {
+	case "":
+	case "NotRegistered", "InvalidRegistration":
+		result.Status = http.StatusGone
+	case "Unavailable", "InternalServerError":
+		result.Status = http.StatusServiceUnavailable
+	case "DeviceMessageRateExceeded":
+		result.Status = http.StatusTooManyRequests
+	default:
+		result.Status = http.StatusBadRequest
+	}
+	return result, nil
+}
+
+// Webhook posts the plain JSON notification to the subscription's URL, as
+// UnifiedPush distributors and similar relays expect. The TTL, Urgency and
+// Topic headers follow Web Push.
+type Webhook struct {
+	Client *http.Client
+}
+
+// NewWebhook creates a webhook provider.
+func NewWebhook() *Webhook {
+	return &Webhook{}
+}
+
+func (p *Webhook) Name() string { return ProviderWebhook }
+
+func (p *Webhook) Send(ctx context.Context, d Delivery) (Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Endpoint, bytes.NewReader(d.Payload))
+	if err != nil {
+		return Result{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("TTL", strconv.Itoa(d.TTL))
+	if d.Urgency != "" {
+		req.Header.Set("Urgency", d.Urgency)
+	}
+	if d.Topic != "" {
+		req.Header.Set("Topic", d.Topic)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = defaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	return httpResult(resp), nil
+}
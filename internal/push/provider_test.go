@@ -0,0 +1,96 @@
+package push
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFCMSend(t *testing.T) {
+	var answer string
+	var got map[string]interface{}
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&got)
+		io.WriteString(w, answer)
+	}))
+	defer server.Close()
+	p := NewFCM(server.URL, "secret")
+
+	send := func() Result {
+		t.Helper()
+		res, err := p.Send(context.Background(), Delivery{
+			Endpoint: "device-token",
+			Payload:  []byte(`{"type":"call"}`),
+			Topic:    "call-7",
+			Urgency:  "high",
+			TTL:      45,
+		})
+		if err != nil {
+			t.Fatalf("Send() = %v", err)
+		}
+		return res
+	}
+
+	answer = `{"success":1,"failure":0,"results":[{"message_id":"0:1"}]}`
+	if res := send(); res.Status != http.StatusOK {
+		t.Errorf("sent status = %d", res.Status)
+	}
+	data, _ := got["data"].(map[string]interface{})
+	if auth != "key=secret" || got["to"] != "device-token" || got["priority"] != "high" ||
+		got["time_to_live"] != float64(45) || got["collapse_key"] != "call-7" || data["type"] != "call" {
+		t.Errorf("unexpected request %v with Authorization %q", got, auth)
+	}
+
+	tests := []struct {
+		error string
+		want  int
+	}{
+		{"NotRegistered", http.StatusGone},
+		{"InvalidRegistration", http.StatusGone},
+		{"Unavailable", http.StatusServiceUnavailable},
+		{"DeviceMessageRateExceeded", http.StatusTooManyRequests},
+		{"MessageTooBig", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		answer = `{"success":0,"failure":1,"results":[{"error":"` + tt.error + `"}]}`
+		if res := send(); res.Status != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.error, res.Status, tt.want)
+		}
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	var req *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = io.ReadAll(r.Body)
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	res, err := NewWebhook().Send(context.Background(), Delivery{
+		Endpoint: server.URL + "/UP?token=abc",
+		Payload:  []byte(`{"type":"message"}`),
+		Topic:    "conversation-3",
+		Urgency:  "normal",
+		TTL:      86400,
+	})
+	if err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+	if res.Status != http.StatusTooManyRequests || res.RetryAfter != 2*time.Minute {
+		t.Errorf("Send() = %+v", res)
+	}
+	if req.URL.RawQuery != "token=abc" || string(body) != `{"type":"message"}` ||
+		req.Header.Get("TTL") != "86400" || req.Header.Get("Topic") != "conversation-3" || req.Header.Get("Urgency") != "normal" {
+		t.Errorf("unexpected request %s %s with headers %v", req.URL, body, req.Header)
+	}
+}
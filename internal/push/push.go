@@ -1,121 +1,272 @@
 package push
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/4xmen/payambar/internal/conversation"
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/store"
+	"github.com/4xmen/payambar/pkg/i18n"
 	webpush "github.com/SherClockHolmes/webpush-go"
 )
 
-// Notifier sends Web Push notifications to subscribed users.
+// previewLength caps the message preview in a notification, in characters.
+const previewLength = 120
+
+// Notifier sends push notifications to subscribed users. Notifications are
+// queued in the database and sent by a pool of workers (see Start), each
+// through the provider its subscription was made with.
 type Notifier struct {
-	db              *sql.DB
-	vapidPublicKey  string
-	vapidPrivateKey string
-}
+	store     *store.Store
+	providers map[string]Provider
 
-// Subscription represents a stored Web Push subscription.
-type Subscription struct {
-	Endpoint  string `json:"endpoint"`
-	KeyP256dh string `json:"p256dh"`
-	KeyAuth   string `json:"auth"`
+	opts DeliveryOptions
+	wake chan struct{}
+	jobs chan *store.QueuedPush
+	stop chan struct{}
+	wg   sync.WaitGroup
 }
 
-// NewNotifier creates a push Notifier. Returns nil if VAPID keys are empty.
-func NewNotifier(db *sql.DB, vapidPublicKey, vapidPrivateKey string) *Notifier {
-	if vapidPublicKey == "" || vapidPrivateKey == "" {
+// NewNotifier creates a push Notifier delivering through providers. Returns
+// nil without providers.
+func NewNotifier(database *db.DB, providers ...Provider) *Notifier {
+	n := &Notifier{
+		store:     store.New(database),
+		providers: make(map[string]Provider),
+		opts:      DeliveryOptions{}.withDefaults(),
+		wake:      make(chan struct{}, 1),
+	}
+	for _, p := range providers {
+		n.providers[p.Name()] = p
+	}
+	if len(n.providers) == 0 {
 		return nil
 	}
-	return &Notifier{
-		db:              db,
-		vapidPublicKey:  vapidPublicKey,
-		vapidPrivateKey: vapidPrivateKey,
+	return n
+}
+
+// HasProvider reports whether subscriptions for the named provider can be
+// delivered.
+func (n *Notifier) HasProvider(name string) bool {
+	if n == nil {
+		return false
 	}
+	_, ok := n.providers[name]
+	return ok
 }
 
-// VAPIDPublicKey returns the public VAPID key for the frontend.
+// VAPIDPublicKey returns the public VAPID key for the frontend, or "" without
+// Web Push.
 func (n *Notifier) VAPIDPublicKey() string {
-	return n.vapidPublicKey
+	if n == nil {
+		return ""
+	}
+	if p, ok := n.providers[ProviderWebPush].(*WebPush); ok {
+		return p.PublicKey
+	}
+	return ""
 }
 
+// Message is a new chat message to notify its receiver about.
+type Message struct {
+	ID         int
+	SenderID   int
+	ReceiverID int
+	// Content is only previewed for plaintext messages
+	Content   string
+	Encrypted bool
+	FileName  string
+}
+
+// Notification types, so the service worker can render calls differently.
+const (
+	TypeMessage    = "message"
+	TypeCall       = "call"
+	TypeMissedCall = "missed_call"
+	TypeTest       = "test"
+)
+
 // payload is the JSON structure sent inside the push notification.
 type payload struct {
-	Title string `json:"title"`
-	Body  string `json:"body"`
-	URL   string `json:"url"`
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	Body           string `json:"body"`
+	URL            string `json:"url"`
+	Icon           string `json:"icon,omitempty"`
+	Tag            string `json:"tag"`
+	ConversationID int    `json:"conversation_id,omitempty"`
+	MessageID      int    `json:"message_id,omitempty"`
+	CallID         int    `json:"call_id,omitempty"`
+	CallKind       string `json:"call_kind,omitempty"`
+	SenderID       int    `json:"sender_id"`
+	SenderName     string `json:"sender_name"`
+
+	// topic collapses undelivered notifications of one conversation
+	topic string
 }
 
-// SendNewMessageNotification sends a push notification to all subscriptions of receiverID.
-func (n *Notifier) SendNewMessageNotification(receiverID int, senderUsername string) {
-	if n == nil {
-		return
+// senderPayload fills in who a notification is from and where opening it
+// leads: the conversation between sender and receiver, if there is one.
+func (n *Notifier) senderPayload(senderID, receiverID int) payload {
+	var senderName, icon string
+	if sender, err := n.store.Users.Get(senderID); err == nil {
+		senderName = sender.Name()
+		if sender.AvatarURL != nil {
+			icon = *sender.AvatarURL
+		}
 	}
-
-	rows, err := n.db.Query(
-		"SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE user_id = ? AND revoked_at IS NULL",
-		receiverID,
-	)
-	if err != nil {
-		log.Printf("push: failed to query subscriptions for user %d: %v", receiverID, err)
-		return
+	if senderName == "" {
+		senderName = i18n.Translate("someone")
 	}
-	defer rows.Close()
 
 	p := payload{
-		Title: "پیام جدید",
-		Body:  "پیام جدید از " + senderUsername,
-		URL:   "/",
+		Title:      senderName,
+		URL:        "/",
+		Icon:       icon,
+		Tag:        "user-" + strconv.Itoa(senderID),
+		SenderID:   senderID,
+		SenderName: senderName,
+		topic:      "user-" + strconv.Itoa(senderID),
 	}
-	data, _ := json.Marshal(p)
+	if convID, err := conversation.FindDirect(n.store, senderID, receiverID); err == nil {
+		p.ConversationID = convID
+		p.URL = "/?conversation=" + strconv.Itoa(convID)
+		p.Tag = "conversation-" + strconv.Itoa(convID)
+		p.topic = p.Tag
+	}
+	return p
+}
 
-	var subs []Subscription
-	for rows.Next() {
-		var sub Subscription
-		if err := rows.Scan(&sub.Endpoint, &sub.KeyP256dh, &sub.KeyAuth); err != nil {
-			continue
+// messagePayload builds the notification for msg. The body previews the
+// message only if the receiver opted in and the message is not end-to-end
+// encrypted.
+func (n *Notifier) messagePayload(msg Message) payload {
+	p := n.senderPayload(msg.SenderID, msg.ReceiverID)
+	p.Type = TypeMessage
+	p.Body = i18n.Translate("new message")
+	p.MessageID = msg.ID
+
+	receiver, err := n.store.Users.Get(msg.ReceiverID)
+	if err == nil && receiver.PushPreview && !msg.Encrypted {
+		if text := truncate(msg.Content, previewLength); text != "" {
+			p.Body = text
+		} else if msg.FileName != "" {
+			p.Body = i18n.Translate("file") + ": " + msg.FileName
 		}
-		subs = append(subs, sub)
 	}
-	rows.Close()
+	return p
+}
 
-	if len(subs) == 0 {
-		log.Printf("push: no active subscriptions for user %d", receiverID)
-		return
+// Call is a call to notify an invitee about.
+type Call struct {
+	ID         int
+	CallerID   int
+	ReceiverID int
+	// Kind is audio or video
+	Kind string
+	// RingTimeout is how long the call rings; the push expires with it
+	RingTimeout time.Duration
+	// MessageID is the call history message of a missed call
+	MessageID int
+}
+
+// callPayload builds the notification for an incoming or missed call. Both
+// share the call's tag and topic, so the missed call replaces the ringing
+// one, on the device and in the push service.
+func (n *Notifier) callPayload(call Call, missed bool) payload {
+	p := n.senderPayload(call.CallerID, call.ReceiverID)
+	p.Type = TypeCall
+	p.CallID = call.ID
+	p.CallKind = call.Kind
+	p.MessageID = call.MessageID
+	p.Tag = "call-" + strconv.Itoa(call.ID)
+	p.topic = p.Tag
+
+	video := call.Kind == "video"
+	switch {
+	case missed && video:
+		p.Type, p.Body = TypeMissedCall, i18n.Translate("missed video call")
+	case missed:
+		p.Type, p.Body = TypeMissedCall, i18n.Translate("missed voice call")
+	case video:
+		p.Body = i18n.Translate("incoming video call")
+	default:
+		p.Body = i18n.Translate("incoming voice call")
 	}
+	return p
+}
 
-	log.Printf("push: sending notification to %d subscription(s) for user %d", len(subs), receiverID)
-	for _, sub := range subs {
-		go n.sendToSubscription(sub, data)
+// truncate shortens s to at most n characters, marking the cut.
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
 	}
+	return string(runes[:n-1]) + "…"
 }
 
-func (n *Notifier) sendToSubscription(sub Subscription, data []byte) {
-	s := &webpush.Subscription{
-		Endpoint: sub.Endpoint,
-		Keys: webpush.Keys{
-			P256dh: sub.KeyP256dh,
-			Auth:   sub.KeyAuth,
-		},
+// SendNewMessageNotification queues a push notification about msg for all
+// subscriptions of its receiver.
+func (n *Notifier) SendNewMessageNotification(msg Message) {
+	if n == nil {
+		return
 	}
+	n.send(msg.ReceiverID, n.messagePayload(msg), webpush.UrgencyNormal, messageTTL)
+}
 
-	resp, err := webpush.SendNotification(data, s, &webpush.Options{
-		VAPIDPublicKey:  n.vapidPublicKey,
-		VAPIDPrivateKey: n.vapidPrivateKey,
-		Subscriber:      "mailto:push@payambar.local",
-		TTL:             86400,
-	})
-	if err != nil {
-		log.Printf("push: failed to send to %s: %v", sub.Endpoint, err)
+// SendCallNotification pushes an incoming call to the invitee's devices with
+// high urgency, expiring once the call stops ringing.
+func (n *Notifier) SendCallNotification(call Call) {
+	if n == nil {
 		return
 	}
-	defer resp.Body.Close()
+	ttl := int(call.RingTimeout / time.Second)
+	if ttl <= 0 {
+		ttl = callTTL
+	}
+	n.send(call.ReceiverID, n.callPayload(call, false), webpush.UrgencyHigh, ttl)
+}
 
-	log.Printf("push: sent to %s — status %d", sub.Endpoint, resp.StatusCode)
+// SendMissedCallNotification tells the invitee about a call nobody answered.
+func (n *Notifier) SendMissedCallNotification(call Call) {
+	if n == nil {
+		return
+	}
+	n.send(call.ReceiverID, n.callPayload(call, true), webpush.UrgencyNormal, messageTTL)
+}
 
-	// 410 Gone or 404 means the subscription is expired — clean it up
-	if resp.StatusCode == 410 || resp.StatusCode == 404 {
-		n.db.Exec("DELETE FROM push_subscriptions WHERE endpoint = ?", sub.Endpoint)
-		log.Printf("push: removed expired subscription %s (status %d)", sub.Endpoint, resp.StatusCode)
+// SendTestNotification queues a test notification for one subscription, so
+// its owner can check that the device receives pushes.
+func (n *Notifier) SendTestNotification(subscriptionID int64) error {
+	if n == nil {
+		return errors.New("push notifications not configured")
+	}
+	p := payload{
+		Type:  TypeTest,
+		Title: i18n.Translate("Payambar"),
+		Body:  i18n.Translate("notifications work on this device"),
+		URL:   "/",
+		Tag:   "test",
+		topic: "test",
+	}
+	data, _ := json.Marshal(p)
+	return n.enqueueFor([]int64{subscriptionID}, data, p.topic, string(webpush.UrgencyNormal), testTTL)
+}
+
+// send queues p for every subscription of userID.
+func (n *Notifier) send(userID int, p payload, urgency webpush.Urgency, ttl int) {
+	data, _ := json.Marshal(p)
+	queued, err := n.enqueue(userID, data, p.topic, string(urgency), ttl)
+	if err != nil {
+		log.Printf("push: failed to queue notification for user %d: %v", userID, err)
+		return
+	}
+	if queued == 0 {
+		log.Printf("push: no active subscriptions for user %d", userID)
 	}
 }
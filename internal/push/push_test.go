@@ -0,0 +1,101 @@
+package push
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/4xmen/payambar/internal/conversation"
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/db/dbtest"
+	"github.com/4xmen/payambar/internal/store"
+)
+
+func setupTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	database := dbtest.New(t)
+
+	database.Exec("INSERT INTO users (id, username, password_hash, display_name, avatar_url) VALUES (1, 'alice', 'hash', 'Alice A.', '/api/files/alice.png')")
+	database.Exec("INSERT INTO users (id, username, password_hash) VALUES (2, 'bob', 'hash')")
+	return database
+}
+
+func TestMessagePayload(t *testing.T) {
+	conn := setupTestDB(t)
+	convID, err := conversation.CreateDirect(store.New(conn), 1, 2)
+	if err != nil {
+		t.Fatalf("CreateDirect: %v", err)
+	}
+	n := NewNotifier(conn, NewWebPush("public", "private"))
+
+	p := n.messagePayload(Message{ID: 9, SenderID: 1, ReceiverID: 2, Content: "see you at noon"})
+	if p.Title != "Alice A." || p.SenderName != "Alice A." || p.Icon != "/api/files/alice.png" {
+		t.Errorf("unexpected sender details: %+v", p)
+	}
+	if p.ConversationID != convID || p.MessageID != 9 || p.SenderID != 1 {
+		t.Errorf("unexpected ids: %+v", p)
+	}
+	if want := "/?conversation=" + strconv.Itoa(convID); p.URL != want {
+		t.Errorf("URL = %q, want %q", p.URL, want)
+	}
+	if p.topic != "conversation-"+strconv.Itoa(convID) || p.Tag != p.topic {
+		t.Errorf("topic = %q, tag = %q", p.topic, p.Tag)
+	}
+	// Previews are opt-in
+	if p.Body != "پیام جدید" {
+		t.Errorf("Body = %q without opting in", p.Body)
+	}
+
+	conn.Exec("UPDATE users SET push_preview = 1 WHERE id = 2")
+	if p := n.messagePayload(Message{ID: 10, SenderID: 1, ReceiverID: 2, Content: "see you at noon"}); p.Body != "see you at noon" {
+		t.Errorf("Body = %q with previews on", p.Body)
+	}
+	if p := n.messagePayload(Message{ID: 11, SenderID: 1, ReceiverID: 2, Content: "[encrypted]", Encrypted: true}); p.Body != "پیام جدید" {
+		t.Errorf("encrypted message previewed: %q", p.Body)
+	}
+	if p := n.messagePayload(Message{ID: 12, SenderID: 1, ReceiverID: 2, FileName: "notes.pdf"}); p.Body != "فایل: notes.pdf" {
+		t.Errorf("Body = %q for a file", p.Body)
+	}
+	long := strings.Repeat("ب", 200)
+	if p := n.messagePayload(Message{ID: 13, SenderID: 1, ReceiverID: 2, Content: long}); len([]rune(p.Body)) != previewLength || !strings.HasSuffix(p.Body, "…") {
+		t.Errorf("long preview not truncated: %d characters", len([]rune(p.Body)))
+	}
+}
+
+func TestMessagePayloadWithoutConversation(t *testing.T) {
+	n := NewNotifier(setupTestDB(t), NewWebPush("public", "private"))
+
+	p := n.messagePayload(Message{ID: 9, SenderID: 2, ReceiverID: 1})
+	if p.Title != "bob" || p.Icon != "" {
+		t.Errorf("unexpected sender details: %+v", p)
+	}
+	if p.ConversationID != 0 || p.URL != "/" || p.topic != "user-2" {
+		t.Errorf("unexpected payload: %+v", p)
+	}
+}
+
+func TestCallPayload(t *testing.T) {
+	conn := setupTestDB(t)
+	convID, err := conversation.CreateDirect(store.New(conn), 1, 2)
+	if err != nil {
+		t.Fatalf("CreateDirect: %v", err)
+	}
+	n := NewNotifier(conn, NewWebPush("public", "private"))
+
+	ring := n.callPayload(Call{ID: 7, CallerID: 1, ReceiverID: 2, Kind: "video"}, false)
+	if ring.Type != TypeCall || ring.Body != "تماس تصویری ورودی" || ring.CallID != 7 || ring.CallKind != "video" {
+		t.Errorf("unexpected call payload: %+v", ring)
+	}
+	if ring.Title != "Alice A." || ring.ConversationID != convID || ring.Tag != "call-7" || ring.topic != "call-7" {
+		t.Errorf("unexpected call details: %+v", ring)
+	}
+
+	missed := n.callPayload(Call{ID: 7, CallerID: 1, ReceiverID: 2, Kind: "audio", MessageID: 30}, true)
+	if missed.Type != TypeMissedCall || missed.Body != "تماس صوتی از دست رفته" || missed.MessageID != 30 {
+		t.Errorf("unexpected missed call payload: %+v", missed)
+	}
+	// The missed call replaces the ringing notification
+	if missed.Tag != ring.Tag || missed.topic != ring.topic {
+		t.Errorf("missed call tag %q, ringing tag %q", missed.Tag, ring.Tag)
+	}
+}
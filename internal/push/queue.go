@@ -0,0 +1,372 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/4xmen/payambar/internal/store"
+)
+
+const (
+	// messageTTL is how long the push service keeps an undelivered message
+	// notification, in seconds
+	messageTTL = 86400
+	// callTTL is used when a call's ring timeout is unknown
+	callTTL = 60
+	// testTTL is for test notifications, which are only useful right away
+	testTTL = 300
+	// claimLease keeps other workers and instances off a claimed notification;
+	// it outlasts the send timeout
+	claimLease  = 2 * time.Minute
+	sendTimeout = 30 * time.Second
+)
+
+// DeliveryOptions tune the delivery workers. Zero values take defaults.
+type DeliveryOptions struct {
+	// Workers bounds concurrent sends
+	Workers int
+	// MaxAttempts per notification before it is dropped
+	MaxAttempts int
+	// MaxFailures in a row revoke a subscription
+	MaxFailures int
+	// Retries wait BaseBackoff, doubling up to MaxBackoff, unless the push
+	// service asks for longer with Retry-After
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// PollInterval rechecks the queue when nothing wakes the dispatcher
+	PollInterval time.Duration
+}
+
+func (o DeliveryOptions) withDefaults() DeliveryOptions {
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 6
+	}
+	if o.MaxFailures <= 0 {
+		o.MaxFailures = 5
+	}
+	if o.BaseBackoff <= 0 {
+		o.BaseBackoff = 10 * time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = 30 * time.Minute
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = 30 * time.Second
+	}
+	return o
+}
+
+// Stats are the delivery counters since the database was created, plus the
+// notifications still queued.
+type Stats struct {
+	Queued  int64 `json:"queued"`
+	Pending int64 `json:"pending"`
+	Sent    int64 `json:"sent"`
+	Retried int64 `json:"retried"`
+	Failed  int64 `json:"failed"`
+	Revoked int64 `json:"revoked"`
+}
+
+// ReadStats reads the delivery counters.
+func ReadStats(s *store.Store) (Stats, error) {
+	counters, pending, err := s.PushQueue.Counters()
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{
+		Queued:  counters["queued"],
+		Pending: pending,
+		Sent:    counters["sent"],
+		Retried: counters["retried"],
+		Failed:  counters["failed"],
+		Revoked: counters["revoked"],
+	}, nil
+}
+
+// SetDeliveryOptions replaces the delivery options; call it before Start.
+func (n *Notifier) SetDeliveryOptions(opts DeliveryOptions) {
+	n.opts = opts.withDefaults()
+}
+
+// Start runs the dispatcher and the delivery workers until Stop.
+func (n *Notifier) Start() {
+	n.jobs = make(chan *store.QueuedPush)
+	n.stop = make(chan struct{})
+	for i := 0; i < n.opts.Workers; i++ {
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			for job := range n.jobs {
+				n.deliver(job)
+			}
+		}()
+	}
+	n.wg.Add(1)
+	go n.dispatch()
+}
+
+// Stop waits for in-flight sends; queued notifications stay in the database.
+func (n *Notifier) Stop() {
+	close(n.stop)
+	n.wg.Wait()
+}
+
+// enqueue queues data for every active subscription of userID. A queued,
+// unsent notification with the same topic is replaced, keeping its retry
+// schedule.
+func (n *Notifier) enqueue(userID int, data []byte, topic, urgency string, ttl int) (int, error) {
+	subIDs, err := n.store.Subscriptions.Active(userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query subscriptions: %w", err)
+	}
+
+	return len(subIDs), n.enqueueFor(subIDs, data, topic, urgency, ttl)
+}
+
+// enqueueFor queues data for the given subscriptions.
+func (n *Notifier) enqueueFor(subIDs []int64, data []byte, topic, urgency string, ttl int) error {
+	now := dbTime(time.Now())
+	for _, subID := range subIDs {
+		added, err := n.store.PushQueue.Enqueue(subID, data, topic, urgency, ttl, now)
+		if err != nil {
+			return fmt.Errorf("failed to queue notification: %w", err)
+		}
+		if added {
+			n.count("queued")
+		}
+	}
+	if len(subIDs) > 0 {
+		n.wakeDispatcher()
+	}
+	return nil
+}
+
+func (n *Notifier) wakeDispatcher() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch hands due notifications to the workers, then sleeps until the
+// next one is due, something is queued, or PollInterval passes.
+func (n *Notifier) dispatch() {
+	defer n.wg.Done()
+	defer close(n.jobs)
+
+	for {
+		if !n.dispatchDue() {
+			return
+		}
+		timer := time.NewTimer(n.untilNextDue())
+		select {
+		case <-n.stop:
+			timer.Stop()
+			return
+		case <-n.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatchDue claims and hands out every due notification. It returns false
+// once Stop was called.
+func (n *Notifier) dispatchDue() bool {
+	batch := n.opts.Workers * 2
+	for {
+		now := dbTime(time.Now())
+		ids, err := n.store.PushQueue.Due(now, batch)
+		if err != nil {
+			log.Printf("push: failed to read the queue: %v", err)
+			return true
+		}
+
+		for _, id := range ids {
+			job, ok := n.claim(id, now)
+			if !ok {
+				continue
+			}
+			select {
+			case n.jobs <- job:
+			case <-n.stop:
+				n.store.PushQueue.Release(job.ID)
+				return false
+			}
+		}
+		if len(ids) < batch {
+			return true
+		}
+	}
+}
+
+// claim leases a queued notification. Notifications whose subscription was
+// revoked are dropped.
+func (n *Notifier) claim(id int64, now time.Time) (*store.QueuedPush, bool) {
+	job, err := n.store.PushQueue.Claim(id, now, dbTime(now.Add(claimLease)))
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("push: failed to claim notification %d: %v", id, err)
+		}
+		return nil, false
+	}
+	return job, true
+}
+
+// untilNextDue is how long the dispatcher may sleep.
+func (n *Notifier) untilNextDue() time.Duration {
+	wait := n.opts.PollInterval
+	// A notification is due at its next attempt, or when a claim on it lapses
+	if at, err := n.store.PushQueue.NextDue(); err == nil && at != nil {
+		if d := time.Until(*at); d < wait {
+			wait = d
+		}
+	}
+	if wait < 10*time.Millisecond {
+		wait = 10 * time.Millisecond
+	}
+	return wait
+}
+
+// deliver sends one notification through its subscription's provider and
+// records the outcome.
+func (n *Notifier) deliver(job *store.QueuedPush) {
+	provider, ok := n.providers[job.Provider]
+	if !ok {
+		// Left from a provider that is no longer configured
+		log.Printf("push: no %q provider for subscription %d", job.Provider, job.SubscriptionID)
+		n.store.PushQueue.Delete(job.ID)
+		n.count("failed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	result, err := provider.Send(ctx, Delivery{
+		Endpoint: job.Endpoint,
+		P256dh:   job.P256dh,
+		Auth:     job.Auth,
+		Payload:  job.Payload,
+		Topic:    job.Topic,
+		Urgency:  job.Urgency,
+		TTL:      job.TTL,
+	})
+	cancel()
+	status, retryAfter := result.Status, result.RetryAfter
+	if err != nil {
+		status = 0
+	}
+
+	switch {
+	case err == nil && status >= 200 && status < 300:
+		n.store.PushQueue.Delete(job.ID)
+		n.store.Subscriptions.RecordSuccess(job.SubscriptionID, dbTime(time.Now()))
+		n.count("sent")
+
+	case status == http.StatusNotFound || status == http.StatusGone:
+		log.Printf("push: subscription %d expired (status %d)", job.SubscriptionID, status)
+		n.revoke(job.SubscriptionID)
+
+	case err != nil || status == http.StatusTooManyRequests || status >= 500:
+		if err != nil {
+			log.Printf("push: failed to send to subscription %d: %v", job.SubscriptionID, err)
+		} else {
+			log.Printf("push: subscription %d got status %d, will retry", job.SubscriptionID, status)
+		}
+		if n.recordFailure(job.SubscriptionID) {
+			return
+		}
+		n.retry(job, retryAfter)
+
+	default:
+		// The push service rejected the request itself; resending won't help
+		log.Printf("push: subscription %d rejected the notification (status %d)", job.SubscriptionID, status)
+		n.store.PushQueue.Delete(job.ID)
+		n.count("failed")
+		n.recordFailure(job.SubscriptionID)
+	}
+}
+
+// retry schedules the next attempt, or drops the notification once it is
+// out of attempts or would outlive its TTL.
+func (n *Notifier) retry(job *store.QueuedPush, retryAfter time.Duration) {
+	attempts := job.Attempts + 1
+	wait := backoff(n.opts.BaseBackoff, n.opts.MaxBackoff, attempts)
+	if retryAfter > wait {
+		wait = retryAfter
+	}
+	next := time.Now().Add(wait)
+
+	if attempts >= n.opts.MaxAttempts || next.After(job.CreatedAt.Add(time.Duration(job.TTL)*time.Second)) {
+		n.store.PushQueue.Delete(job.ID)
+		n.count("failed")
+		return
+	}
+	n.store.PushQueue.Reschedule(job.ID, attempts, dbTime(next))
+	n.count("retried")
+	n.wakeDispatcher()
+}
+
+// recordFailure counts a failed send against the subscription and revokes
+// it after MaxFailures in a row. It reports whether it was revoked.
+func (n *Notifier) recordFailure(subscriptionID int64) bool {
+	failures, err := n.store.Subscriptions.RecordFailure(subscriptionID, dbTime(time.Now()))
+	if err != nil {
+		log.Printf("push: failed to record failure of subscription %d: %v", subscriptionID, err)
+		return false
+	}
+	if failures < n.opts.MaxFailures {
+		return false
+	}
+	log.Printf("push: revoking subscription %d after %d failures", subscriptionID, failures)
+	n.revoke(subscriptionID)
+	return true
+}
+
+// revoke stops sending to a subscription and drops what is queued for it.
+func (n *Notifier) revoke(subscriptionID int64) {
+	n.store.Subscriptions.Expire(subscriptionID, dbTime(time.Now()))
+	n.count("revoked")
+}
+
+func (n *Notifier) count(name string) {
+	n.store.PushQueue.Increment(name)
+}
+
+// backoff is the wait before the given retry attempt.
+func backoff(base, max time.Duration, attempt int) time.Duration {
+	wait := base
+	for i := 1; i < attempt && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date.
+func parseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// dbTime puts times in UTC so they compare correctly as stored text.
+func dbTime(t time.Time) time.Time {
+	return t.UTC()
+}
@@ -0,0 +1,408 @@
+package push
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/store"
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// fakePushService records requests and answers them with respond.
+type fakePushService struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	times    []time.Time
+}
+
+func newFakePushService(t *testing.T, respond func(w http.ResponseWriter, attempt int)) *fakePushService {
+	t.Helper()
+	f := &fakePushService{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r)
+		f.times = append(f.times, time.Now())
+		attempt := len(f.requests)
+		f.mu.Unlock()
+		respond(w, attempt)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// request returns the i-th request and when it arrived.
+func (f *fakePushService) request(i int) (*http.Request, time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[i], f.times[i]
+}
+
+func (f *fakePushService) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// startTestNotifier runs a notifier with fast retries against the test DB.
+func startTestNotifier(t *testing.T, conn *db.DB, opts DeliveryOptions) *Notifier {
+	t.Helper()
+	private, public, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("GenerateVAPIDKeys: %v", err)
+	}
+	n := NewNotifier(conn, NewWebPush(public, private))
+	if opts.BaseBackoff == 0 {
+		opts.BaseBackoff = 10 * time.Millisecond
+	}
+	opts.PollInterval = 50 * time.Millisecond
+	n.SetDeliveryOptions(opts)
+	n.Start()
+	t.Cleanup(n.Stop)
+	return n
+}
+
+// subscribe stores a subscription with real keys for userID at endpoint.
+func subscribe(t *testing.T, conn *db.DB, userID int, endpoint string) int64 {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	var id int64
+	err = conn.QueryRow(
+		"INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth) VALUES ($1, $2, $3, $4) RETURNING id",
+		userID, endpoint,
+		base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+		base64.RawURLEncoding.EncodeToString(auth),
+	).Scan(&id)
+	if err != nil {
+		t.Fatalf("insert subscription: %v", err)
+	}
+	return id
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func readStats(t *testing.T, conn *db.DB) Stats {
+	t.Helper()
+	stats, err := ReadStats(store.New(conn))
+	if err != nil {
+		t.Fatalf("ReadStats: %v", err)
+	}
+	return stats
+}
+
+func TestDeliverySendsQueuedNotification(t *testing.T) {
+	conn := setupTestDB(t)
+	service := newFakePushService(t, func(w http.ResponseWriter, _ int) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	subID := subscribe(t, conn, 2, service.URL+"/bob")
+	n := startTestNotifier(t, conn, DeliveryOptions{})
+
+	n.SendNewMessageNotification(Message{ID: 1, SenderID: 1, ReceiverID: 2, Content: "hi"})
+	waitFor(t, "the notification to be sent", func() bool { return readStats(t, conn).Sent == 1 })
+
+	req, _ := service.request(0)
+	if req.URL.Path != "/bob" || req.Header.Get("Topic") != "user-1" || req.Header.Get("TTL") != "86400" {
+		t.Errorf("unexpected request %s with headers %v", req.URL.Path, req.Header)
+	}
+	if stats := readStats(t, conn); stats.Queued != 1 || stats.Pending != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	var lastSuccess sql.NullTime
+	conn.QueryRow("SELECT last_success_at FROM push_subscriptions WHERE id = $1", subID).Scan(&lastSuccess)
+	if !lastSuccess.Valid {
+		t.Error("last_success_at not recorded")
+	}
+}
+
+func TestDeliveryHonorsRetryAfter(t *testing.T) {
+	conn := setupTestDB(t)
+	service := newFakePushService(t, func(w http.ResponseWriter, attempt int) {
+		if attempt == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	subscribe(t, conn, 2, service.URL)
+	n := startTestNotifier(t, conn, DeliveryOptions{})
+
+	n.SendNewMessageNotification(Message{ID: 1, SenderID: 1, ReceiverID: 2})
+	waitFor(t, "the retry to be sent", func() bool { return readStats(t, conn).Sent == 1 })
+
+	_, first := service.request(0)
+	_, retried := service.request(1)
+	if waited := retried.Sub(first); waited < time.Second {
+		t.Errorf("retried after %v despite Retry-After: 1", waited)
+	}
+	if stats := readStats(t, conn); stats.Retried != 1 || stats.Failed != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestDeliveryGivesUpAfterMaxAttempts(t *testing.T) {
+	conn := setupTestDB(t)
+	service := newFakePushService(t, func(w http.ResponseWriter, _ int) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	subscribe(t, conn, 2, service.URL)
+	n := startTestNotifier(t, conn, DeliveryOptions{MaxAttempts: 3, MaxFailures: 100})
+
+	n.SendNewMessageNotification(Message{ID: 1, SenderID: 1, ReceiverID: 2})
+	waitFor(t, "the notification to be dropped", func() bool { return readStats(t, conn).Failed == 1 })
+
+	// Backoff doubles: 10ms, then 20ms
+	_, t0 := service.request(0)
+	_, t1 := service.request(1)
+	_, t2 := service.request(2)
+	if gap1, gap2 := t1.Sub(t0), t2.Sub(t1); gap1 < 10*time.Millisecond || gap2 < 20*time.Millisecond {
+		t.Errorf("retries came after %v and %v", gap1, gap2)
+	}
+	if stats := readStats(t, conn); service.count() != 3 || stats.Retried != 2 || stats.Pending != 0 {
+		t.Errorf("%d requests, stats %+v", service.count(), stats)
+	}
+}
+
+func TestDeliveryRevokesFailingSubscription(t *testing.T) {
+	conn := setupTestDB(t)
+	service := newFakePushService(t, func(w http.ResponseWriter, _ int) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	subID := subscribe(t, conn, 2, service.URL)
+	n := startTestNotifier(t, conn, DeliveryOptions{MaxAttempts: 10, MaxFailures: 2})
+
+	n.SendNewMessageNotification(Message{ID: 1, SenderID: 1, ReceiverID: 2})
+	waitFor(t, "the subscription to be revoked", func() bool { return readStats(t, conn).Revoked == 1 })
+
+	var failures int
+	var revokedAt sql.NullTime
+	conn.QueryRow("SELECT failure_count, revoked_at FROM push_subscriptions WHERE id = $1", subID).Scan(&failures, &revokedAt)
+	if failures != 2 || !revokedAt.Valid {
+		t.Errorf("failure_count = %d, revoked = %v", failures, revokedAt.Valid)
+	}
+	if stats := readStats(t, conn); service.count() != 2 || stats.Pending != 0 {
+		t.Errorf("%d requests, stats %+v", service.count(), stats)
+	}
+
+	// Revoked subscriptions get nothing more
+	n.SendNewMessageNotification(Message{ID: 2, SenderID: 1, ReceiverID: 2})
+	time.Sleep(100 * time.Millisecond)
+	if service.count() != 2 {
+		t.Errorf("sent to a revoked subscription")
+	}
+}
+
+func TestDeliveryRevokesGoneSubscription(t *testing.T) {
+	conn := setupTestDB(t)
+	service := newFakePushService(t, func(w http.ResponseWriter, _ int) {
+		w.WriteHeader(http.StatusGone)
+	})
+	subscribe(t, conn, 2, service.URL)
+	n := startTestNotifier(t, conn, DeliveryOptions{})
+
+	n.SendNewMessageNotification(Message{ID: 1, SenderID: 1, ReceiverID: 2})
+	waitFor(t, "the subscription to be revoked", func() bool { return readStats(t, conn).Revoked == 1 })
+	if service.count() != 1 {
+		t.Errorf("%d requests to a gone subscription", service.count())
+	}
+}
+
+func TestDeliveryBoundsConcurrency(t *testing.T) {
+	conn := setupTestDB(t)
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	service := newFakePushService(t, func(w http.ResponseWriter, _ int) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	})
+	for i := 0; i < 6; i++ {
+		subscribe(t, conn, 2, service.URL+"/"+string(rune('a'+i)))
+	}
+	n := startTestNotifier(t, conn, DeliveryOptions{Workers: 2})
+
+	n.SendNewMessageNotification(Message{ID: 1, SenderID: 1, ReceiverID: 2})
+	waitFor(t, "all notifications to be sent", func() bool { return readStats(t, conn).Sent == 6 })
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight != 2 {
+		t.Errorf("%d concurrent sends with 2 workers", maxInFlight)
+	}
+}
+
+func TestEnqueueCollapsesTopic(t *testing.T) {
+	conn := setupTestDB(t)
+	subscribe(t, conn, 2, "https://push.example/bob")
+	n := NewNotifier(conn, NewWebPush("public", "private"))
+
+	n.SendNewMessageNotification(Message{ID: 1, SenderID: 1, ReceiverID: 2})
+	n.SendNewMessageNotification(Message{ID: 2, SenderID: 1, ReceiverID: 2})
+
+	var pending int
+	var payload string
+	conn.QueryRow("SELECT COUNT(*), MAX(payload) FROM push_queue").Scan(&pending, &payload)
+	if pending != 1 {
+		t.Fatalf("%d queued notifications for one topic", pending)
+	}
+	if want := `"message_id":2`; !strings.Contains(payload, want) {
+		t.Errorf("queued payload %s lacks %s", payload, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 10: 30 * time.Second} {
+		if got := backoff(time.Second, 30*time.Second, attempt); got != want {
+			t.Errorf("backoff(attempt %d) = %v, want %v", attempt, got, want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"-5":                            0,
+		"soon":                          0,
+		"Sun, 01 Mar 2026 12:00:30 GMT": 30 * time.Second,
+		"Sun, 01 Mar 2026 11:00:00 GMT": 0,
+	}
+	for header, want := range tests {
+		if got := parseRetryAfter(header, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestCallPushIsUrgent(t *testing.T) {
+	conn := setupTestDB(t)
+	service := newFakePushService(t, func(w http.ResponseWriter, _ int) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	subscribe(t, conn, 2, service.URL)
+	n := startTestNotifier(t, conn, DeliveryOptions{})
+
+	n.SendCallNotification(Call{ID: 7, CallerID: 1, ReceiverID: 2, Kind: "audio", RingTimeout: 45 * time.Second})
+	waitFor(t, "the call push to be sent", func() bool { return readStats(t, conn).Sent == 1 })
+
+	req, _ := service.request(0)
+	if req.Header.Get("Urgency") != "high" || req.Header.Get("TTL") != "45" || req.Header.Get("Topic") != "call-7" {
+		t.Errorf("unexpected headers %v", req.Header)
+	}
+}
+
+func TestMissedCallReplacesQueuedRing(t *testing.T) {
+	conn := setupTestDB(t)
+	subscribe(t, conn, 2, "https://push.example/bob")
+	n := NewNotifier(conn, NewWebPush("public", "private"))
+
+	n.SendCallNotification(Call{ID: 7, CallerID: 1, ReceiverID: 2, RingTimeout: 45 * time.Second})
+	n.SendMissedCallNotification(Call{ID: 7, CallerID: 1, ReceiverID: 2, MessageID: 30})
+
+	var pending, ttl int
+	var payload, urgency string
+	conn.QueryRow("SELECT COUNT(*), MAX(payload), MAX(urgency), MAX(ttl) FROM push_queue").Scan(&pending, &payload, &urgency, &ttl)
+	if pending != 1 || !strings.Contains(payload, `"type":"missed_call"`) {
+		t.Fatalf("%d queued notifications, payload %s", pending, payload)
+	}
+	if urgency != "normal" || ttl != messageTTL {
+		t.Errorf("missed call queued with urgency %q and TTL %d", urgency, ttl)
+	}
+}
+
+func TestTestNotificationTargetsOneDevice(t *testing.T) {
+	conn := setupTestDB(t)
+	service := newFakePushService(t, func(w http.ResponseWriter, _ int) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	phone := subscribe(t, conn, 2, service.URL+"/phone")
+	subscribe(t, conn, 2, service.URL+"/laptop")
+	n := startTestNotifier(t, conn, DeliveryOptions{})
+
+	if err := n.SendTestNotification(phone); err != nil {
+		t.Fatalf("SendTestNotification() = %v", err)
+	}
+	waitFor(t, "the test notification to be sent", func() bool { return readStats(t, conn).Sent == 1 })
+
+	req, _ := service.request(0)
+	if req.URL.Path != "/phone" || req.Header.Get("Topic") != "test" {
+		t.Errorf("unexpected request %s with headers %v", req.URL.Path, req.Header)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if service.count() != 1 {
+		t.Errorf("test notification sent %d times, want once", service.count())
+	}
+}
+
+func TestDeliveryUsesSubscriptionProvider(t *testing.T) {
+	conn := setupTestDB(t)
+	service := newFakePushService(t, func(w http.ResponseWriter, _ int) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	subscribe(t, conn, 2, service.URL+"/browser")
+	conn.Exec("INSERT INTO push_subscriptions (user_id, provider, endpoint, p256dh, auth) VALUES (2, 'fake', 'native-token', '', '')")
+	conn.Exec("INSERT INTO push_subscriptions (user_id, provider, endpoint, p256dh, auth) VALUES (2, 'fcm', 'fcm-token', '', '')")
+
+	private, public, err := webpush.GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("GenerateVAPIDKeys: %v", err)
+	}
+	fake := &FakeProvider{}
+	n := NewNotifier(conn, NewWebPush(public, private), fake)
+	n.SetDeliveryOptions(DeliveryOptions{PollInterval: 50 * time.Millisecond})
+	n.Start()
+	t.Cleanup(n.Stop)
+
+	n.SendNewMessageNotification(Message{ID: 1, SenderID: 1, ReceiverID: 2, Content: "hi"})
+	waitFor(t, "all notifications to be handled", func() bool { return readStats(t, conn).Pending == 0 })
+
+	if service.count() != 1 {
+		t.Errorf("web push sent %d times, want once", service.count())
+	}
+	deliveries := fake.Deliveries()
+	if len(deliveries) != 1 || deliveries[0].Endpoint != "native-token" || deliveries[0].Topic != "user-1" {
+		t.Fatalf("fake deliveries = %+v", deliveries)
+	}
+	var p payload
+	if err := json.Unmarshal(deliveries[0].Payload, &p); err != nil || p.Type != TypeMessage || p.MessageID != 1 {
+		t.Errorf("fake payload = %s", deliveries[0].Payload)
+	}
+	// Without an FCM provider its notification is dropped, not retried
+	if stats := readStats(t, conn); stats.Sent != 2 || stats.Failed != 1 || stats.Retried != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// BlockedUser is a user someone blocked.
+type BlockedUser struct {
+	ID          int
+	Username    string
+	DisplayName *string
+	AvatarURL   *string
+	BlockedAt   time.Time
+}
+
+// Blocks stores who blocked whom.
+type Blocks interface {
+	// Block does nothing if blockerID already blocked blockedID
+	Block(blockerID, blockedID int) error
+	Unblock(blockerID, blockedID int) error
+	IsBlocked(blockerID, blockedID int) (bool, error)
+	// List returns the users blockerID blocked, latest first
+	List(blockerID int) ([]BlockedUser, error)
+}
+
+type sqlBlocks struct{ db *db.DB }
+
+func (s sqlBlocks) Block(blockerID, blockedID int) error {
+	_, err := s.db.Exec(
+		"INSERT INTO user_blocks (blocker_id, blocked_id, created_at) VALUES ($1, $2, CURRENT_TIMESTAMP) ON CONFLICT DO NOTHING",
+		blockerID, blockedID,
+	)
+	return err
+}
+
+func (s sqlBlocks) Unblock(blockerID, blockedID int) error {
+	_, err := s.db.Exec("DELETE FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2", blockerID, blockedID)
+	return err
+}
+
+func (s sqlBlocks) IsBlocked(blockerID, blockedID int) (bool, error) {
+	var blocked bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM user_blocks WHERE blocker_id = $1 AND blocked_id = $2)",
+		blockerID, blockedID,
+	).Scan(&blocked)
+	return blocked, err
+}
+
+func (s sqlBlocks) List(blockerID int) ([]BlockedUser, error) {
+	rows, err := s.db.Query(`
+		SELECT u.id, u.username, u.display_name, u.avatar_url, b.created_at
+		FROM user_blocks b
+		INNER JOIN users u ON u.id = b.blocked_id
+		WHERE b.blocker_id = $1
+		ORDER BY b.created_at DESC
+	`, blockerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []BlockedUser{}
+	for rows.Next() {
+		var u BlockedUser
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.AvatarURL, &u.BlockedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// Call is a call session with its participants, caller first and invitees
+// in the order they were invited.
+type Call struct {
+	ID           int
+	CallerID     int
+	Kind         string
+	State        string
+	EndReason    string
+	AnsweredAt   *time.Time
+	Participants []CallParticipant
+}
+
+// CallParticipant is one member of a call. Outcome is set once the call
+// ended.
+type CallParticipant struct {
+	UserID  int
+	State   string
+	Hidden  bool
+	Outcome string
+}
+
+// Calls stores call sessions. Lookups of a call id return 0 when there is
+// none.
+type Calls interface {
+	// Get returns a call with its participants, or ErrNotFound
+	Get(id int) (*Call, error)
+	// LiveOf returns the unended call userID is rung in or takes part in,
+	// leaving out calls they are hidden from
+	LiveOf(userID int) (int, error)
+	// Shared returns the latest unended call both users are still rung in
+	// or take part in
+	Shared(userA, userB int) (int, error)
+	// JoinedIn returns the unended call userID has joined
+	JoinedIn(userID int) (int, error)
+	// Open lists the calls that have not ended
+	Open() ([]int, error)
+	// Create starts a ringing call with the caller joined as its first
+	// participant
+	Create(callerID int, kind string, at time.Time) (int, error)
+	Invite(callID, userID int, state string, hidden bool, seq int) error
+	// Join marks userID joined and a ringing call answered
+	Join(callID, userID int, at time.Time) error
+	SetState(callID, userID int, state string) error
+	Leave(callID, userID int, at time.Time) error
+	// ExpireInvites marks the invitees of an unended call who never
+	// answered as having missed it and reports whether there were any
+	ExpireInvites(callID int) (bool, error)
+	// End closes the call and settles every participant's outcome. It
+	// reports false when the call had already ended.
+	End(callID int, reason string, at time.Time) (bool, error)
+}
+
+// callID reads a call id, or 0 when there is no row.
+func callID(row *sql.Row) (int, error) {
+	var id int
+	err := row.Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+type sqlCalls struct{ db *db.DB }
+
+func (s sqlCalls) Get(id int) (*Call, error) {
+	c := &Call{ID: id}
+	var endReason sql.NullString
+	if err := s.db.QueryRow(
+		"SELECT caller_id, kind, state, end_reason, answered_at FROM calls WHERE id = $1",
+		id,
+	).Scan(&c.CallerID, &c.Kind, &c.State, &endReason, &c.AnsweredAt); err != nil {
+		return nil, notFound(err)
+	}
+	c.EndReason = endReason.String
+
+	rows, err := s.db.Query("SELECT user_id, state, hidden, outcome FROM call_participants WHERE call_id = $1 ORDER BY seq", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			p       CallParticipant
+			outcome sql.NullString
+		)
+		if err := rows.Scan(&p.UserID, &p.State, &p.Hidden, &outcome); err != nil {
+			return nil, err
+		}
+		p.Outcome = outcome.String
+		c.Participants = append(c.Participants, p)
+	}
+	return c, rows.Err()
+}
+
+func (s sqlCalls) LiveOf(userID int) (int, error) {
+	return callID(s.db.QueryRow(`
+		SELECT p.call_id
+		FROM call_participants p
+		JOIN calls c ON c.id = p.call_id
+		WHERE p.user_id = $1 AND p.state IN ('invited', 'joined') AND p.hidden = 0 AND c.state != 'ended'
+		LIMIT 1
+	`, userID))
+}
+
+func (s sqlCalls) Shared(userA, userB int) (int, error) {
+	return callID(s.db.QueryRow(`
+		SELECT c.id
+		FROM calls c
+		JOIN call_participants a ON a.call_id = c.id AND a.user_id = $1 AND a.state IN ('invited', 'joined')
+		JOIN call_participants b ON b.call_id = c.id AND b.user_id = $2 AND b.state IN ('invited', 'joined')
+		WHERE c.state != 'ended'
+		ORDER BY c.id DESC
+		LIMIT 1
+	`, userA, userB))
+}
+
+func (s sqlCalls) JoinedIn(userID int) (int, error) {
+	return callID(s.db.QueryRow(`
+		SELECT p.call_id
+		FROM call_participants p
+		JOIN calls c ON c.id = p.call_id
+		WHERE p.user_id = $1 AND p.state = 'joined' AND c.state != 'ended'
+		LIMIT 1
+	`, userID))
+}
+
+func (s sqlCalls) Open() ([]int, error) {
+	return scanIDs(s.db.Query("SELECT id FROM calls WHERE state != 'ended'"))
+}
+
+func (s sqlCalls) Create(callerID int, kind string, at time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	if err := tx.QueryRow(
+		"INSERT INTO calls (caller_id, kind, state, created_at) VALUES ($1, $2, 'ringing', $3) RETURNING id",
+		callerID, kind, at,
+	).Scan(&id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(
+		"INSERT INTO call_participants (call_id, user_id, state, joined_at, seq) VALUES ($1, $2, 'joined', $3, 0)",
+		id, callerID, at,
+	); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s sqlCalls) Invite(callID, userID int, state string, hidden bool, seq int) error {
+	_, err := s.db.Exec(`
+		INSERT INTO call_participants (call_id, user_id, state, hidden, seq) VALUES ($1, $2, $3, $4, $5)
+	`, callID, userID, state, flag(hidden), seq)
+	return err
+}
+
+func (s sqlCalls) Join(callID, userID int, at time.Time) error {
+	if _, err := s.db.Exec(`
+		UPDATE call_participants SET state = 'joined', joined_at = COALESCE(joined_at, $1), left_at = NULL
+		WHERE call_id = $2 AND user_id = $3
+	`, at, callID, userID); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("UPDATE calls SET state = 'active', answered_at = $1 WHERE id = $2 AND state = 'ringing'", at, callID)
+	return err
+}
+
+func (s sqlCalls) SetState(callID, userID int, state string) error {
+	_, err := s.db.Exec("UPDATE call_participants SET state = $1 WHERE call_id = $2 AND user_id = $3", state, callID, userID)
+	return err
+}
+
+func (s sqlCalls) Leave(callID, userID int, at time.Time) error {
+	_, err := s.db.Exec(`
+		UPDATE call_participants SET state = 'left', left_at = $1 WHERE call_id = $2 AND user_id = $3
+	`, at, callID, userID)
+	return err
+}
+
+func (s sqlCalls) ExpireInvites(callID int) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE call_participants SET state = 'missed'
+		WHERE call_id = $1 AND state = 'invited'
+			AND EXISTS (SELECT 1 FROM calls WHERE id = $1 AND state != 'ended')
+	`, callID)
+	if err != nil {
+		return false, err
+	}
+	return affected(result) == nil, nil
+}
+
+func (s sqlCalls) End(callID int, reason string, at time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE calls SET state = 'ended', end_reason = $1, ended_at = $2 WHERE id = $3 AND state != 'ended'
+	`, reason, at, callID)
+	if err != nil {
+		return false, err
+	}
+	if affected(result) != nil {
+		return false, nil
+	}
+	if _, err := tx.Exec(`
+		UPDATE call_participants SET
+			state = CASE state WHEN 'invited' THEN 'missed' WHEN 'joined' THEN 'left' ELSE state END,
+			left_at = CASE state WHEN 'joined' THEN $1 ELSE left_at END,
+			outcome = CASE
+				WHEN joined_at IS NOT NULL THEN 'completed'
+				WHEN state IN ('declined', 'busy') THEN state
+				ELSE 'missed'
+			END
+		WHERE call_id = $2
+	`, at, callID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
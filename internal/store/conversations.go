@@ -0,0 +1,257 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// ErrNotDirect is returned by Conversations.Delete for a conversation that
+// does not have exactly two participants.
+var ErrNotDirect = errors.New("invalid participants")
+
+// ConversationSummary is a direct conversation as listed for one of its
+// participants, described by the other one.
+type ConversationSummary struct {
+	ID          int
+	UserID      int
+	Username    string
+	DisplayName *string
+	AvatarURL   *string
+	// BlockedMe is set when the other participant blocked the viewer
+	BlockedMe     bool
+	LastMessageAt time.Time
+	UnreadCount   int
+}
+
+// Conversations stores direct conversations and who takes part in them.
+type Conversations interface {
+	// FindDirect returns the two-person conversation between userA and
+	// userB, or ErrNotFound
+	FindDirect(userA, userB int) (int, error)
+	// CreateDirect returns the conversation between userA and userB,
+	// creating it unless a concurrent call did so first
+	CreateDirect(userA, userB int) (int, error)
+	IsParticipant(conversationID, userID int) (bool, error)
+	// List returns userID's direct conversations, leaving out those with
+	// users userID blocked
+	List(userID int) ([]ConversationSummary, error)
+	// Delete removes a conversation with its messages and settings and
+	// returns the paths of the files that were attached. It returns
+	// ErrForbidden when userID takes no part in it.
+	Delete(conversationID, userID int) ([]string, error)
+}
+
+type sqlConversations struct{ db *db.DB }
+
+func (s sqlConversations) FindDirect(userA, userB int) (int, error) {
+	var id int
+	err := s.db.QueryRow(`
+		SELECT cp1.conversation_id
+		FROM conversation_participants cp1
+		INNER JOIN conversation_participants cp2
+			ON cp2.conversation_id = cp1.conversation_id AND cp2.user_id = $1
+		WHERE cp1.user_id = $2
+			AND (
+				SELECT COUNT(*)
+				FROM conversation_participants cp
+				WHERE cp.conversation_id = cp1.conversation_id
+			) = 2
+		LIMIT 1
+	`, userB, userA).Scan(&id)
+	return id, notFound(err)
+}
+
+func (s sqlConversations) CreateDirect(userA, userB int) (int, error) {
+	low, high := userA, userB
+	if low > high {
+		low, high = high, low
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRow(`
+		INSERT INTO conversations (direct_low, direct_high) VALUES ($1, $2)
+		ON CONFLICT (direct_low, direct_high) DO NOTHING
+		RETURNING id
+	`, low, high).Scan(&id)
+	if err == sql.ErrNoRows {
+		err = tx.QueryRow("SELECT id FROM conversations WHERE direct_low = $1 AND direct_high = $2", low, high).Scan(&id)
+		return id, err
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO conversation_participants (conversation_id, user_id) VALUES ($1, $2), ($1, $3)",
+		id, userA, userB,
+	); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (s sqlConversations) IsParticipant(conversationID, userID int) (bool, error) {
+	var member bool
+	err := s.db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM conversation_participants WHERE conversation_id = $1 AND user_id = $2)",
+		conversationID, userID,
+	).Scan(&member)
+	return member, err
+}
+
+func (s sqlConversations) List(userID int) ([]ConversationSummary, error) {
+	rows, err := s.db.Query(`
+		SELECT c.id, u.id, u.username, u.display_name, u.avatar_url,
+			EXISTS(SELECT 1 FROM user_blocks b WHERE b.blocker_id = u.id AND b.blocked_id = $1)
+		FROM conversations c
+		INNER JOIN conversation_participants me
+			ON me.conversation_id = c.id AND me.user_id = $1
+		INNER JOIN conversation_participants other
+			ON other.conversation_id = c.id AND other.user_id != $1
+		INNER JOIN users u ON u.id = other.user_id
+		WHERE (
+			SELECT COUNT(*)
+			FROM conversation_participants cp
+			WHERE cp.conversation_id = c.id
+		) = 2
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE b.blocker_id = $1 AND b.blocked_id = other.user_id
+			)
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	var conversations []ConversationSummary
+	for rows.Next() {
+		var c ConversationSummary
+		if err := rows.Scan(&c.ID, &c.UserID, &c.Username, &c.DisplayName, &c.AvatarURL, &c.BlockedMe); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		conversations = append(conversations, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range conversations {
+		c := &conversations[i]
+		var lastMessageAt sql.NullTime
+		if err := s.db.QueryRow(`
+			SELECT created_at FROM messages
+			WHERE ((sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1))
+				AND NOT (receiver_id = $1 AND hidden = 1)
+			ORDER BY created_at DESC LIMIT 1
+		`, userID, c.UserID).Scan(&lastMessageAt); err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		if lastMessageAt.Valid {
+			c.LastMessageAt = lastMessageAt.Time
+		}
+		if err := s.db.QueryRow(`
+			SELECT COUNT(*) FROM messages
+			WHERE receiver_id = $1 AND sender_id = $2 AND read_at IS NULL AND hidden = 0
+		`, userID, c.UserID).Scan(&c.UnreadCount); err != nil {
+			return nil, err
+		}
+	}
+	return conversations, nil
+}
+
+// Delete locks the participants so a concurrent delete of the same
+// conversation waits for this one.
+func (s sqlConversations) Delete(conversationID, userID int) ([]string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT user_id FROM conversation_participants WHERE conversation_id = $1"+s.db.ForUpdate(), conversationID)
+	if err != nil {
+		return nil, err
+	}
+	var participants []int
+	member := false
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		participants = append(participants, id)
+		if id == userID {
+			member = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(participants) == 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM conversations WHERE id = $1)", conversationID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrNotFound
+		}
+		return nil, ErrNotDirect
+	}
+	if !member {
+		return nil, ErrForbidden
+	}
+	if len(participants) != 2 {
+		return nil, ErrNotDirect
+	}
+	a, b := participants[0], participants[1]
+
+	paths := []string{}
+	fileRows, err := tx.Query(`
+		SELECT f.file_path FROM files f
+		INNER JOIN messages m ON f.message_id = m.id
+		WHERE (m.sender_id = $1 AND m.receiver_id = $2) OR (m.sender_id = $2 AND m.receiver_id = $1)
+	`, a, b)
+	if err != nil {
+		return nil, err
+	}
+	for fileRows.Next() {
+		var path string
+		if err := fileRows.Scan(&path); err == nil && path != "" {
+			paths = append(paths, path)
+		}
+	}
+	fileRows.Close()
+
+	const between = "(sender_id = $1 AND receiver_id = $2) OR (sender_id = $2 AND receiver_id = $1)"
+	for _, stmt := range []string{
+		"DELETE FROM files WHERE message_id IN (SELECT id FROM messages WHERE " + between + ")",
+		"DELETE FROM messages WHERE " + between,
+	} {
+		if _, err := tx.Exec(stmt, a, b); err != nil {
+			return nil, err
+		}
+	}
+	for _, stmt := range []string{
+		"DELETE FROM conversation_participants WHERE conversation_id = $1",
+		"DELETE FROM notification_settings WHERE conversation_id = $1",
+		"DELETE FROM conversations WHERE id = $1",
+	} {
+		if _, err := tx.Exec(stmt, conversationID); err != nil {
+			return nil, err
+		}
+	}
+	return paths, tx.Commit()
+}
@@ -0,0 +1,96 @@
+package store
+
+import "github.com/4xmen/payambar/internal/db"
+
+// DeviceKey is a device's public key. The wrapped private key and its KDF
+// parameters are only returned to the key's owner.
+type DeviceKey struct {
+	DeviceID        string
+	Algorithm       string
+	PublicKey       string
+	KeyID           string
+	EncPrivateKey   *string
+	EncPrivateKeyIV *string
+	KDFSalt         *string
+	KDFIterations   *int
+	KDFAlg          *string
+	KeyWrapVersion  *int
+}
+
+// DeviceKeys stores the public keys of users' devices.
+type DeviceKeys interface {
+	// Upsert stores or rotates a key, keeping wrapped key fields it was
+	// stored with before when k leaves them nil
+	Upsert(userID int, k DeviceKey) error
+	// ListPublic returns userID's active keys without the wrapped private keys
+	ListPublic(userID int) ([]DeviceKey, error)
+	// ListOwn returns userID's active keys in full, latest first
+	ListOwn(userID int) ([]DeviceKey, error)
+}
+
+type sqlDeviceKeys struct{ db *db.DB }
+
+func (s sqlDeviceKeys) Upsert(userID int, k DeviceKey) error {
+	_, err := s.db.Exec(`
+		INSERT INTO user_device_keys (
+			user_id, device_id, algorithm, public_key, key_id,
+			enc_private_key, enc_private_key_iv, kdf_salt, kdf_iterations, kdf_alg, key_wrap_version, updated_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, CURRENT_TIMESTAMP)
+		ON CONFLICT(user_id, device_id, key_id)
+		DO UPDATE SET
+			algorithm = excluded.algorithm,
+			public_key = excluded.public_key,
+			enc_private_key = COALESCE(excluded.enc_private_key, user_device_keys.enc_private_key),
+			enc_private_key_iv = COALESCE(excluded.enc_private_key_iv, user_device_keys.enc_private_key_iv),
+			kdf_salt = COALESCE(excluded.kdf_salt, user_device_keys.kdf_salt),
+			kdf_iterations = COALESCE(excluded.kdf_iterations, user_device_keys.kdf_iterations),
+			kdf_alg = COALESCE(excluded.kdf_alg, user_device_keys.kdf_alg),
+			key_wrap_version = COALESCE(excluded.key_wrap_version, user_device_keys.key_wrap_version),
+			updated_at = CURRENT_TIMESTAMP,
+			revoked_at = NULL
+	`, userID, k.DeviceID, k.Algorithm, k.PublicKey, k.KeyID,
+		k.EncPrivateKey, k.EncPrivateKeyIV, k.KDFSalt, k.KDFIterations, k.KDFAlg, k.KeyWrapVersion)
+	return err
+}
+
+func (s sqlDeviceKeys) ListPublic(userID int) ([]DeviceKey, error) {
+	return s.list(`
+		SELECT device_id, algorithm, public_key, key_id
+		FROM user_device_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID, false)
+}
+
+func (s sqlDeviceKeys) ListOwn(userID int) ([]DeviceKey, error) {
+	return s.list(`
+		SELECT device_id, algorithm, public_key, key_id,
+		       enc_private_key, enc_private_key_iv, kdf_salt, kdf_iterations, kdf_alg, key_wrap_version
+		FROM user_device_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY COALESCE(updated_at, created_at) DESC
+	`, userID, true)
+}
+
+func (s sqlDeviceKeys) list(query string, userID int, full bool) ([]DeviceKey, error) {
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]DeviceKey, 0)
+	for rows.Next() {
+		var k DeviceKey
+		dest := []interface{}{&k.DeviceID, &k.Algorithm, &k.PublicKey, &k.KeyID}
+		if full {
+			dest = append(dest, &k.EncPrivateKey, &k.EncPrivateKeyIV, &k.KDFSalt, &k.KDFIterations, &k.KDFAlg, &k.KeyWrapVersion)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,74 @@
+package store
+
+import (
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// Invite is a registration invite code. CreatedBy is nil for invites
+// created by the operator.
+type Invite struct {
+	ID        int        `json:"id"`
+	Code      string     `json:"code"`
+	CreatedBy *int       `json:"created_by"`
+	MaxUses   int        `json:"max_uses"`
+	UseCount  int        `json:"use_count"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Invites stores registration invites. They are redeemed by Users.Create.
+type Invites interface {
+	// Create stores inv and sets its ID
+	Create(inv *Invite) error
+	// ListBy returns the invites createdBy minted, newest first
+	ListBy(createdBy int) ([]Invite, error)
+	// Revoke returns ErrNotFound unless createdBy has the invite and it is
+	// not revoked yet
+	Revoke(id, createdBy int, at time.Time) error
+}
+
+type sqlInvites struct{ db *db.DB }
+
+func (s sqlInvites) Create(inv *Invite) error {
+	return s.db.QueryRow(
+		"INSERT INTO invites (code, created_by, max_uses, expires_at, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		inv.Code, inv.CreatedBy, inv.MaxUses, inv.ExpiresAt, inv.CreatedAt,
+	).Scan(&inv.ID)
+}
+
+func (s sqlInvites) ListBy(createdBy int) ([]Invite, error) {
+	rows, err := s.db.Query(`
+		SELECT id, code, created_by, max_uses, use_count, expires_at, revoked_at, created_at
+		FROM invites
+		WHERE created_by = $1
+		ORDER BY created_at DESC, id DESC
+	`, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []Invite{}
+	for rows.Next() {
+		var inv Invite
+		if err := rows.Scan(&inv.ID, &inv.Code, &inv.CreatedBy, &inv.MaxUses, &inv.UseCount, &inv.ExpiresAt, &inv.RevokedAt, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+func (s sqlInvites) Revoke(id, createdBy int, at time.Time) error {
+	result, err := s.db.Exec(
+		"UPDATE invites SET revoked_at = $1 WHERE id = $2 AND created_by = $3 AND revoked_at IS NULL",
+		at, id, createdBy,
+	)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// Lockouts stores failed login counters per username and the failed login
+// audit trail.
+type Lockouts interface {
+	// LockedUntil returns when the username's lockout ends, or nil
+	LockedUntil(username string) (*time.Time, error)
+	// RecordFailure counts a failed login at now, starting over when the
+	// last one is more than resetAfter ago, and locks the username for
+	// lockFor(failures) when that is positive
+	RecordFailure(username string, now time.Time, resetAfter time.Duration, lockFor func(failures int) time.Duration) error
+	Clear(username string) error
+	// Prune drops counters that have reset and are no longer locked, and
+	// audit records older than retention
+	Prune(now time.Time, resetAfter, retention time.Duration) error
+	// Audit records a failed login
+	Audit(username, clientIP, reason string, now time.Time) error
+}
+
+type sqlLockouts struct{ db *db.DB }
+
+func (s sqlLockouts) LockedUntil(username string) (*time.Time, error) {
+	var until *time.Time
+	err := s.db.QueryRow("SELECT locked_until FROM login_lockouts WHERE username = $1", username).Scan(&until)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return until, err
+}
+
+func (s sqlLockouts) RecordFailure(username string, now time.Time, resetAfter time.Duration, lockFor func(int) time.Duration) error {
+	// Counting is a single statement so concurrent failures each see their
+	// own count
+	var failures int
+	if err := s.db.QueryRow(`
+		INSERT INTO login_lockouts (username, failed_count, last_failed_at) VALUES ($1, 1, $2)
+		ON CONFLICT (username) DO UPDATE SET
+			failed_count = CASE WHEN login_lockouts.last_failed_at < $3 THEN 1 ELSE login_lockouts.failed_count + 1 END,
+			locked_until = CASE WHEN login_lockouts.last_failed_at < $3 THEN NULL ELSE login_lockouts.locked_until END,
+			last_failed_at = $2
+		RETURNING failed_count
+	`, username, now, now.Add(-resetAfter)).Scan(&failures); err != nil {
+		return err
+	}
+	delay := lockFor(failures)
+	if delay <= 0 {
+		return nil
+	}
+	// A later failure has already counted past this one and sets its own,
+	// longer lockout
+	_, err := s.db.Exec(
+		"UPDATE login_lockouts SET locked_until = $1 WHERE username = $2 AND failed_count = $3",
+		now.Add(delay), username, failures,
+	)
+	return err
+}
+
+func (s sqlLockouts) Clear(username string) error {
+	_, err := s.db.Exec("DELETE FROM login_lockouts WHERE username = $1", username)
+	return err
+}
+
+func (s sqlLockouts) Prune(now time.Time, resetAfter, retention time.Duration) error {
+	if _, err := s.db.Exec(
+		"DELETE FROM login_lockouts WHERE last_failed_at < $1 AND (locked_until IS NULL OR locked_until < $2)",
+		now.Add(-resetAfter), now,
+	); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE created_at < $1", now.Add(-retention))
+	return err
+}
+
+func (s sqlLockouts) Audit(username, clientIP, reason string, now time.Time) error {
+	_, err := s.db.Exec(
+		"INSERT INTO login_failures (username, client_ip, reason, created_at) VALUES ($1, $2, $3, $4)",
+		username, clientIP, reason, now,
+	)
+	return err
+}
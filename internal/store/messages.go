@@ -0,0 +1,217 @@
+package store
+
+import (
+	"database/sql"
+	"path/filepath"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/models"
+)
+
+// NewMessage is a message to store. Nil fields are stored as NULL.
+type NewMessage struct {
+	SenderID       int
+	ReceiverID     int
+	Content        string
+	Encrypted      bool
+	E2EEVersion    *int
+	Algorithm      *string
+	SenderDeviceID *string
+	KeyID          *string
+	IV             *string
+	Ciphertext     *string
+	AAD            *string
+	// Hidden messages are never shown to the receiver
+	Hidden      bool
+	ClientMsgID *string
+	// CallID links a call history entry to its call
+	CallID *int
+	// CreatedAt defaults to the database's current time
+	CreatedAt *time.Time
+}
+
+// Messages stores messages and their attachments.
+type Messages interface {
+	// Create returns ErrDuplicate when the sender already stored a message
+	// under the same client message id
+	Create(m NewMessage) (int, error)
+	// FindByClientID returns the sender's message stored under clientMsgID,
+	// or ErrNotFound
+	FindByClientID(senderID int, clientMsgID string) (*models.Message, error)
+	// History pages back through the messages between userID and otherID,
+	// leaving out those hidden from userID, and returns them oldest first
+	History(userID, otherID, limit, offset int) ([]*models.Message, error)
+	// MarkDelivered and MarkRead update a message to receiverID that is not
+	// hidden from them and return its sender, or ErrNotFound. A read message
+	// stays read.
+	MarkDelivered(id, receiverID int) (int, error)
+	MarkRead(id, receiverID int) (int, error)
+	// Delete removes one of senderID's messages and returns the path of its
+	// attachment, if any. It returns ErrForbidden for someone else's message.
+	Delete(id, senderID int) (string, error)
+	AttachFile(f *models.File) error
+}
+
+type sqlMessages struct{ db *db.DB }
+
+func (s sqlMessages) Create(m NewMessage) (int, error) {
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO messages (sender_id, receiver_id, content, encrypted, e2ee_v, alg, sender_device_id, key_id, iv, ciphertext, aad,
+			status, hidden, client_message_id, call_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, 'sent', $12, $13, $14, COALESCE($15, CURRENT_TIMESTAMP))
+		RETURNING id
+	`, m.SenderID, m.ReceiverID, m.Content, flag(m.Encrypted), m.E2EEVersion, m.Algorithm, m.SenderDeviceID, m.KeyID, m.IV, m.Ciphertext, m.AAD,
+		flag(m.Hidden), m.ClientMsgID, m.CallID, m.CreatedAt).Scan(&id)
+	if err != nil {
+		return 0, duplicate(err)
+	}
+	return id, nil
+}
+
+func (s sqlMessages) FindByClientID(senderID int, clientMsgID string) (*models.Message, error) {
+	return scanClientMessage(s.db.QueryRow(`
+		SELECT id, client_message_id, receiver_id, content, encrypted, e2ee_v, alg, sender_device_id, key_id, iv, ciphertext, aad,
+			status, created_at, delivered_at, read_at
+		FROM messages
+		WHERE sender_id = $1 AND client_message_id = $2
+	`, senderID, clientMsgID), senderID)
+}
+
+func (s sqlMessages) History(userID, otherID, limit, offset int) ([]*models.Message, error) {
+	rows, err := s.db.Query(`
+		SELECT m.id, m.client_message_id, m.sender_id, m.receiver_id, m.content, m.encrypted, m.e2ee_v, m.alg, m.sender_device_id, m.key_id, m.iv, m.ciphertext, m.aad,
+		       m.status, m.created_at, m.delivered_at, m.read_at, f.file_name, f.file_path, f.content_type,
+		       m.call_id, cl.kind, cp.outcome, cl.answered_at, cl.ended_at
+		FROM messages m
+		LEFT JOIN files f ON f.message_id = m.id
+		LEFT JOIN calls cl ON cl.id = m.call_id
+		LEFT JOIN call_participants cp ON cp.call_id = m.call_id AND cp.user_id = m.receiver_id
+		WHERE ((m.sender_id = $1 AND m.receiver_id = $2) OR (m.sender_id = $2 AND m.receiver_id = $1))
+			AND NOT (m.receiver_id = $1 AND m.hidden = 1)
+		ORDER BY m.created_at DESC
+		LIMIT $3 OFFSET $4
+	`, userID, otherID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanHistory(rows)
+}
+
+func (s sqlMessages) MarkDelivered(id, receiverID int) (int, error) {
+	var senderID int
+	err := s.db.QueryRow(`
+		UPDATE messages
+		SET status = CASE status WHEN 'read' THEN status ELSE 'delivered' END,
+			delivered_at = COALESCE(delivered_at, CURRENT_TIMESTAMP)
+		WHERE id = $1 AND receiver_id = $2 AND hidden = 0
+		RETURNING sender_id
+	`, id, receiverID).Scan(&senderID)
+	return senderID, notFound(err)
+}
+
+func (s sqlMessages) MarkRead(id, receiverID int) (int, error) {
+	var senderID int
+	err := s.db.QueryRow(`
+		UPDATE messages SET status = 'read', read_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND receiver_id = $2 AND hidden = 0
+		RETURNING sender_id
+	`, id, receiverID).Scan(&senderID)
+	return senderID, notFound(err)
+}
+
+func (s sqlMessages) Delete(id, senderID int) (string, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var sender int
+	if err := tx.QueryRow("SELECT sender_id FROM messages WHERE id = $1"+s.db.ForUpdate(), id).Scan(&sender); err != nil {
+		return "", notFound(err)
+	}
+	if sender != senderID {
+		return "", ErrForbidden
+	}
+
+	var path sql.NullString
+	if err := tx.QueryRow("SELECT file_path FROM files WHERE message_id = $1", id).Scan(&path); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM files WHERE message_id = $1", id); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec("DELETE FROM messages WHERE id = $1", id); err != nil {
+		return "", err
+	}
+	return path.String, tx.Commit()
+}
+
+func (s sqlMessages) AttachFile(f *models.File) error {
+	_, err := s.db.Exec(`
+		INSERT INTO files (message_id, file_name, file_path, file_size, content_type, created_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP)
+	`, f.MessageID, f.FileName, f.FilePath, f.FileSize, f.ContentType)
+	return err
+}
+
+// scanHistory reads the rows of a History query, newest first, and returns
+// them oldest first.
+func scanHistory(rows *sql.Rows) ([]*models.Message, error) {
+	defer rows.Close()
+
+	var messages []*models.Message
+	for rows.Next() {
+		msg := &models.Message{}
+		var (
+			fileName, filePath, fileType sql.NullString
+			callID                       sql.NullInt64
+			callKind, callOutcome        sql.NullString
+			callAnsweredAt, callEndedAt  sql.NullTime
+		)
+		if err := rows.Scan(&msg.ID, &msg.ClientMsgID, &msg.SenderID, &msg.ReceiverID, &msg.Content, &msg.Encrypted,
+			&msg.E2EEVersion, &msg.Algorithm, &msg.SenderDeviceID, &msg.KeyID, &msg.IV, &msg.Ciphertext, &msg.AAD,
+			&msg.Status, &msg.CreatedAt, &msg.DeliveredAt, &msg.ReadAt, &fileName, &filePath, &fileType,
+			&callID, &callKind, &callOutcome, &callAnsweredAt, &callEndedAt); err != nil {
+			return nil, err
+		}
+		if fileName.Valid {
+			msg.FileName = &fileName.String
+			fileURL := "/api/files/" + filepath.Base(filePath.String)
+			msg.FileURL = &fileURL
+			if fileType.Valid {
+				msg.FileType = &fileType.String
+			}
+		}
+		// Call history entries carry the call's outcome for the receiver
+		if callID.Valid {
+			msg.Call = &models.CallSummary{ID: int(callID.Int64), Kind: callKind.String, Outcome: callOutcome.String}
+			if callOutcome.String == "completed" && callAnsweredAt.Valid && callEndedAt.Valid {
+				msg.Call.Duration = int(callEndedAt.Time.Sub(callAnsweredAt.Time).Seconds())
+			}
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := len(messages)/2 - 1; i >= 0; i-- {
+		opp := len(messages) - 1 - i
+		messages[i], messages[opp] = messages[opp], messages[i]
+	}
+	return messages, nil
+}
+
+func scanClientMessage(row scanner, senderID int) (*models.Message, error) {
+	msg := &models.Message{SenderID: senderID}
+	err := row.Scan(&msg.ID, &msg.ClientMsgID, &msg.ReceiverID, &msg.Content, &msg.Encrypted, &msg.E2EEVersion,
+		&msg.Algorithm, &msg.SenderDeviceID, &msg.KeyID, &msg.IV, &msg.Ciphertext, &msg.AAD,
+		&msg.Status, &msg.CreatedAt, &msg.DeliveredAt, &msg.ReadAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,95 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// NotificationSettings are stored notification settings. Conversation id 0
+// holds a user's account-wide settings.
+type NotificationSettings struct {
+	Level      string
+	Muted      bool
+	MutedUntil *time.Time
+	QuietStart string
+	QuietEnd   string
+	Timezone   string
+}
+
+// Notifications stores notification settings.
+type Notifications interface {
+	// Get returns ErrNotFound when none were saved
+	Get(userID, conversationID int) (*NotificationSettings, error)
+	Save(userID, conversationID int, s NotificationSettings) error
+	Reset(userID, conversationID int) error
+	// ConversationIDs lists the conversations userID saved settings for
+	ConversationIDs(userID int) ([]int, error)
+}
+
+type sqlNotifications struct{ db *db.DB }
+
+func (s sqlNotifications) Get(userID, conversationID int) (*NotificationSettings, error) {
+	return scanNotificationSettings(s.db.QueryRow(`
+		SELECT level, muted, muted_until, quiet_start, quiet_end, timezone
+		FROM notification_settings
+		WHERE user_id = $1 AND conversation_id = $2
+	`, userID, conversationID))
+}
+
+func (s sqlNotifications) Save(userID, conversationID int, n NotificationSettings) error {
+	_, err := s.db.Exec(`
+		INSERT INTO notification_settings (user_id, conversation_id, level, muted, muted_until, quiet_start, quiet_end, timezone, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP)
+		ON CONFLICT (user_id, conversation_id) DO UPDATE SET
+			level = excluded.level,
+			muted = excluded.muted,
+			muted_until = excluded.muted_until,
+			quiet_start = excluded.quiet_start,
+			quiet_end = excluded.quiet_end,
+			timezone = excluded.timezone,
+			updated_at = CURRENT_TIMESTAMP
+	`, userID, conversationID, n.Level, flag(n.Muted), n.MutedUntil, n.QuietStart, n.QuietEnd, n.Timezone)
+	return err
+}
+
+func (s sqlNotifications) Reset(userID, conversationID int) error {
+	_, err := s.db.Exec("DELETE FROM notification_settings WHERE user_id = $1 AND conversation_id = $2", userID, conversationID)
+	return err
+}
+
+func (s sqlNotifications) ConversationIDs(userID int) ([]int, error) {
+	return scanIDs(s.db.Query(`
+		SELECT conversation_id FROM notification_settings
+		WHERE user_id = $1 AND conversation_id != 0
+		ORDER BY conversation_id
+	`, userID))
+}
+
+func scanNotificationSettings(row scanner) (*NotificationSettings, error) {
+	s := &NotificationSettings{}
+	var quietStart, quietEnd, timezone sql.NullString
+	if err := row.Scan(&s.Level, &s.Muted, &s.MutedUntil, &quietStart, &quietEnd, &timezone); err != nil {
+		return nil, notFound(err)
+	}
+	s.QuietStart, s.QuietEnd, s.Timezone = quietStart.String, quietEnd.String, timezone.String
+	return s, nil
+}
+
+func scanIDs(rows *sql.Rows, err error) ([]int, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// Passkey is a registered WebAuthn credential as shown to its owner.
+type Passkey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// Credential is the stored part of a WebAuthn credential. CredentialID is
+// base64url encoded and Transports is comma separated.
+type Credential struct {
+	CredentialID    string
+	PublicKey       []byte
+	AttestationType string
+	AAGUID          []byte
+	SignCount       uint32
+	BackupEligible  bool
+	BackupState     bool
+	Transports      string
+}
+
+// Ceremony is the stored challenge state of a begun WebAuthn ceremony.
+// UserID is zero for a discoverable login.
+type Ceremony struct {
+	UserID    int
+	Data      string
+	ExpiresAt time.Time
+}
+
+// Passkeys stores WebAuthn credentials and ceremonies.
+type Passkeys interface {
+	// Add returns ErrDuplicate when the credential is already registered
+	Add(userID int, name string, c Credential) (int, error)
+	List(userID int) ([]Passkey, error)
+	Credentials(userID int) ([]Credential, error)
+	Count(userID int) (int, error)
+	// Touch records a successful assertion
+	Touch(userID int, credentialID string, signCount uint32, backupState bool) error
+	// Delete returns ErrNotFound for someone else's passkey. Removing the
+	// last passkey also turns off the passkey second factor.
+	Delete(userID, id int) error
+	// SaveSession stores a ceremony and drops expired ones; a userID of zero
+	// stores no owner
+	SaveSession(id string, userID int, ceremony, data string, expiresAt time.Time) error
+	// ConsumeSession deletes a ceremony and returns it, or ErrNotFound when it
+	// does not exist or was consumed first. Expiry is left to the caller.
+	ConsumeSession(id, ceremony string) (*Ceremony, error)
+}
+
+type sqlPasskeys struct{ db *db.DB }
+
+func (s sqlPasskeys) Add(userID int, name string, c Credential) (int, error) {
+	var id int
+	err := s.db.QueryRow(`
+		INSERT INTO webauthn_credentials (
+			user_id, credential_id, name, public_key, attestation_type, aaguid,
+			sign_count, backup_eligible, backup_state, transports
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`, userID, c.CredentialID, name, c.PublicKey, c.AttestationType, c.AAGUID,
+		int64(c.SignCount), flag(c.BackupEligible), flag(c.BackupState), c.Transports).Scan(&id)
+	if err != nil {
+		return 0, duplicate(err)
+	}
+	return id, nil
+}
+
+func (s sqlPasskeys) List(userID int) ([]Passkey, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := make([]Passkey, 0)
+	for rows.Next() {
+		var p Passkey
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+func (s sqlPasskeys) Credentials(userID int) ([]Credential, error) {
+	rows, err := s.db.Query(`
+		SELECT credential_id, public_key, attestation_type, aaguid, sign_count, backup_eligible, backup_state, transports
+		FROM webauthn_credentials
+		WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []Credential
+	for rows.Next() {
+		var c Credential
+		if err := rows.Scan(&c.CredentialID, &c.PublicKey, &c.AttestationType, &c.AAGUID, &c.SignCount,
+			&c.BackupEligible, &c.BackupState, &c.Transports); err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, c)
+	}
+	return credentials, rows.Err()
+}
+
+func (s sqlPasskeys) Count(userID int) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = $1", userID).Scan(&count)
+	return count, err
+}
+
+func (s sqlPasskeys) Touch(userID int, credentialID string, signCount uint32, backupState bool) error {
+	_, err := s.db.Exec(`
+		UPDATE webauthn_credentials
+		SET sign_count = $1, backup_state = $2, last_used_at = CURRENT_TIMESTAMP
+		WHERE credential_id = $3 AND user_id = $4
+	`, int64(signCount), flag(backupState), credentialID, userID)
+	return err
+}
+
+func (s sqlPasskeys) Delete(userID, id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2", id, userID)
+	if err != nil {
+		return err
+	}
+	if err := affected(result); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE users SET passkey_required = 0
+		WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = $1)
+	`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s sqlPasskeys) SaveSession(id string, userID int, ceremony, data string, expiresAt time.Time) error {
+	s.db.Exec("DELETE FROM webauthn_sessions WHERE expires_at < $1", time.Now().UTC())
+	_, err := s.db.Exec(`
+		INSERT INTO webauthn_sessions (id, user_id, ceremony, session_data, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, id, ownerArg(userID), ceremony, data, expiresAt)
+	return err
+}
+
+func (s sqlPasskeys) ConsumeSession(id, ceremony string) (*Ceremony, error) {
+	var (
+		c      Ceremony
+		userID sql.NullInt64
+	)
+	err := s.db.QueryRow(`
+		DELETE FROM webauthn_sessions WHERE id = $1 AND ceremony = $2
+		RETURNING user_id, session_data, expires_at
+	`, id, ceremony).Scan(&userID, &c.Data, &c.ExpiresAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	c.UserID = int(userID.Int64)
+	return &c, nil
+}
+
+// ownerArg is the user_id of a stored ceremony, NULL for zero.
+func ownerArg(userID int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(userID), Valid: userID > 0}
+}
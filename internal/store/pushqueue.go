@@ -0,0 +1,187 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// QueuedPush is a queued notification with the subscription it goes to.
+type QueuedPush struct {
+	ID             int64
+	SubscriptionID int64
+	Provider       string
+	Endpoint       string
+	P256dh         string
+	Auth           string
+	Payload        []byte
+	Topic          string
+	Urgency        string
+	TTL            int
+	Attempts       int
+	CreatedAt      time.Time
+}
+
+// PushQueue stores notifications waiting to be sent and the delivery
+// counters.
+type PushQueue interface {
+	// Enqueue queues payload for a subscription at now. A queued notification
+	// with the same non-empty topic that no worker holds is replaced instead,
+	// keeping its retry schedule; Enqueue reports whether a new one was added.
+	Enqueue(subscriptionID int64, payload []byte, topic, urgency string, ttl int, now time.Time) (bool, error)
+	// Due lists up to limit notifications due at now that no worker holds
+	Due(now time.Time, limit int) ([]int64, error)
+	// Claim holds a due notification until until and returns it, or
+	// ErrNotFound when another worker got it first. Notifications whose
+	// subscription was revoked are dropped.
+	Claim(id int64, now, until time.Time) (*QueuedPush, error)
+	Release(id int64) error
+	Reschedule(id int64, attempts int, next time.Time) error
+	Delete(id int64) error
+	// NextDue returns when the next notification is due, at its next attempt
+	// or when a claim on it lapses, or nil for an empty queue
+	NextDue() (*time.Time, error)
+	// Increment adds one to a delivery counter
+	Increment(counter string) error
+	// Counters returns the delivery counters and the number of queued
+	// notifications
+	Counters() (map[string]int64, int64, error)
+}
+
+type sqlPushQueue struct{ db *db.DB }
+
+func (s sqlPushQueue) Enqueue(subscriptionID int64, payload []byte, topic, urgency string, ttl int, now time.Time) (bool, error) {
+	result, err := s.db.Exec(`
+		UPDATE push_queue SET payload = $1, urgency = $2, ttl = $3, attempts = 0, created_at = $4
+		WHERE subscription_id = $5 AND topic = $6 AND topic != ''
+			AND (locked_until IS NULL OR locked_until <= $4)
+	`, payload, urgency, ttl, now, subscriptionID, topic)
+	if err != nil {
+		return false, err
+	}
+	if replaced, _ := result.RowsAffected(); replaced > 0 {
+		return false, nil
+	}
+	if _, err := s.db.Exec(`
+		INSERT INTO push_queue (subscription_id, payload, topic, urgency, ttl, next_attempt_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $6)
+	`, subscriptionID, payload, topic, urgency, ttl, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s sqlPushQueue) Due(now time.Time, limit int) ([]int64, error) {
+	return scanInt64s(s.db.Query(`
+		SELECT id FROM push_queue
+		WHERE next_attempt_at <= $1 AND (locked_until IS NULL OR locked_until <= $1)
+		ORDER BY next_attempt_at, id
+		LIMIT $2
+	`, now, limit))
+}
+
+func (s sqlPushQueue) Claim(id int64, now, until time.Time) (*QueuedPush, error) {
+	result, err := s.db.Exec(`
+		UPDATE push_queue SET locked_until = $1
+		WHERE id = $2 AND (locked_until IS NULL OR locked_until <= $3)
+	`, until, id, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := affected(result); err != nil {
+		return nil, err
+	}
+
+	p := &QueuedPush{ID: id}
+	var revokedAt sql.NullTime
+	err = s.db.QueryRow(`
+		SELECT q.subscription_id, s.provider, s.endpoint, s.p256dh, s.auth, s.revoked_at,
+			q.payload, q.topic, q.urgency, q.ttl, q.attempts, q.created_at
+		FROM push_queue q
+		JOIN push_subscriptions s ON s.id = q.subscription_id
+		WHERE q.id = $1
+	`, id).Scan(&p.SubscriptionID, &p.Provider, &p.Endpoint, &p.P256dh, &p.Auth, &revokedAt,
+		&p.Payload, &p.Topic, &p.Urgency, &p.TTL, &p.Attempts, &p.CreatedAt)
+	if err != nil || revokedAt.Valid {
+		s.db.Exec("DELETE FROM push_queue WHERE id = $1", id)
+		return nil, ErrNotFound
+	}
+	return p, nil
+}
+
+func (s sqlPushQueue) Release(id int64) error {
+	_, err := s.db.Exec("UPDATE push_queue SET locked_until = NULL WHERE id = $1", id)
+	return err
+}
+
+func (s sqlPushQueue) Reschedule(id int64, attempts int, next time.Time) error {
+	_, err := s.db.Exec(
+		"UPDATE push_queue SET attempts = $1, next_attempt_at = $2, locked_until = NULL WHERE id = $3",
+		attempts, next, id,
+	)
+	return err
+}
+
+func (s sqlPushQueue) Delete(id int64) error {
+	_, err := s.db.Exec("DELETE FROM push_queue WHERE id = $1", id)
+	return err
+}
+
+func (s sqlPushQueue) NextDue() (*time.Time, error) {
+	// The earlier of the next attempt and the next lapsing claim
+	var next *time.Time
+	for _, query := range []string{`
+		SELECT next_attempt_at FROM push_queue
+		WHERE locked_until IS NULL OR locked_until <= next_attempt_at
+		ORDER BY next_attempt_at LIMIT 1
+	`, `
+		SELECT locked_until FROM push_queue
+		WHERE locked_until > next_attempt_at
+		ORDER BY locked_until LIMIT 1
+	`} {
+		var at time.Time
+		err := s.db.QueryRow(query).Scan(&at)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if next == nil || at.Before(*next) {
+			next = &at
+		}
+	}
+	return next, nil
+}
+
+func (s sqlPushQueue) Increment(counter string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO push_counters (name, value) VALUES ($1, 1)
+		ON CONFLICT (name) DO UPDATE SET value = push_counters.value + 1
+	`, counter)
+	return err
+}
+
+func (s sqlPushQueue) Counters() (map[string]int64, int64, error) {
+	var pending int64
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM push_queue").Scan(&pending); err != nil {
+		return nil, 0, err
+	}
+	rows, err := s.db.Query("SELECT name, value FROM push_counters")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	counters := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, 0, err
+		}
+		counters[name] = value
+	}
+	return counters, pending, rows.Err()
+}
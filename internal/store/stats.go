@@ -0,0 +1,64 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// InstanceStats are the counts shown by the status command.
+type InstanceStats struct {
+	Users           int64
+	Conversations   int64
+	Messages        int64
+	UnreadMessages  int64
+	Files           int64
+	UploadedBytes   int64
+	MessagesLast24h int64
+	// LatestMessageAt is nil when there are no messages
+	LatestMessageAt *time.Time
+	FailedLogins24h int64
+	LockedUsernames int64
+}
+
+// Stats reads instance-wide counts.
+type Stats interface {
+	// Read compares recent activity with the clock of the database
+	Read() (*InstanceStats, error)
+}
+
+type sqlStats struct{ db *db.DB }
+
+func (s sqlStats) Read() (*InstanceStats, error) {
+	stats := &InstanceStats{}
+	counts := []struct {
+		value *int64
+		query string
+	}{
+		{&stats.Users, "SELECT COUNT(*) FROM users"},
+		{&stats.Conversations, "SELECT COUNT(*) FROM conversations"},
+		{&stats.Messages, "SELECT COUNT(*) FROM messages"},
+		{&stats.UnreadMessages, "SELECT COUNT(*) FROM messages WHERE read_at IS NULL"},
+		{&stats.Files, "SELECT COUNT(*) FROM files"},
+		{&stats.UploadedBytes, "SELECT COALESCE(SUM(file_size), 0) FROM files"},
+		{&stats.MessagesLast24h, "SELECT COUNT(*) FROM messages WHERE " + s.db.Later("created_at", 24*time.Hour)},
+		{&stats.FailedLogins24h, "SELECT COUNT(*) FROM login_failures WHERE " + s.db.Later("created_at", 24*time.Hour)},
+		{&stats.LockedUsernames, "SELECT COUNT(*) FROM login_lockouts WHERE " + s.db.Later("locked_until", 0)},
+	}
+	for _, c := range counts {
+		if err := s.db.QueryRow(c.query).Scan(c.value); err != nil {
+			return nil, err
+		}
+	}
+
+	var latest time.Time
+	err := s.db.QueryRow("SELECT created_at FROM messages ORDER BY created_at DESC LIMIT 1").Scan(&latest)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		stats.LatestMessageAt = &latest
+	}
+	return stats, nil
+}
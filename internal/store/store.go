@@ -0,0 +1,105 @@
+// Package store is the application's data access. Each domain has a
+// repository interface and one implementation whose queries run on both
+// SQLite and PostgreSQL.
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+var (
+	// ErrNotFound is returned when the row to read or change does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrDuplicate is returned when a unique key is already taken.
+	ErrDuplicate = errors.New("already exists")
+	// ErrForbidden is returned when the row belongs to someone else.
+	ErrForbidden = errors.New("forbidden")
+)
+
+// Store holds the repositories of one database.
+type Store struct {
+	Users         Users
+	Invites       Invites
+	Lockouts      Lockouts
+	Tickets       Tickets
+	Passkeys      Passkeys
+	Conversations Conversations
+	Blocks        Blocks
+	Messages      Messages
+	DeviceKeys    DeviceKeys
+	Notifications Notifications
+	Subscriptions Subscriptions
+	PushQueue     PushQueue
+	Calls         Calls
+	Stats         Stats
+}
+
+// New returns the repositories for database. Queries are written once with
+// $N placeholders; database adapts them to its dialect.
+func New(database *db.DB) *Store {
+	return &Store{
+		Users:         sqlUsers{database},
+		Invites:       sqlInvites{database},
+		Lockouts:      sqlLockouts{database},
+		Tickets:       sqlTickets{database},
+		Passkeys:      sqlPasskeys{database},
+		Conversations: sqlConversations{database},
+		Blocks:        sqlBlocks{database},
+		Messages:      sqlMessages{database},
+		DeviceKeys:    sqlDeviceKeys{database},
+		Notifications: sqlNotifications{database},
+		Subscriptions: sqlSubscriptions{database},
+		PushQueue:     sqlPushQueue{database},
+		Calls:         sqlCalls{database},
+		Stats:         sqlStats{database},
+	}
+}
+
+// scanner is a *sql.Row or *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// notFound turns sql.ErrNoRows into ErrNotFound.
+func notFound(err error) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
+
+// duplicate turns a unique constraint failure into ErrDuplicate.
+func duplicate(err error) error {
+	if db.IsUniqueViolation(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+// affected returns ErrNotFound unless result changed a row.
+func affected(result sql.Result) error {
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func timePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// flag is the 0 or 1 stored in INTEGER flag columns. PostgreSQL does not
+// cast a bool argument to BIGINT, so flags are passed through here.
+func flag(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/4xmen/payambar/internal/db/dbtest"
+)
+
+func setupTestStore(t *testing.T) *Store {
+	t.Helper()
+	s := New(dbtest.New(t))
+	for _, name := range []string{"alice", "bob"} {
+		if _, err := s.Users.Create(NewUser{Username: name, PasswordHash: "hash"}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	return s
+}
+
+func TestUsersCreateDuplicate(t *testing.T) {
+	s := setupTestStore(t)
+
+	if _, err := s.Users.Create(NewUser{Username: "alice", PasswordHash: "hash"}); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("duplicate username: err = %v, want ErrDuplicate", err)
+	}
+	if _, err := s.Users.Create(NewUser{Username: "carol", PasswordHash: "hash", InviteCode: "nope"}); !errors.Is(err, ErrInvalidInvite) {
+		t.Fatalf("unknown invite: err = %v, want ErrInvalidInvite", err)
+	}
+	if _, err := s.Users.Get(99); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing user: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMessagesMarkKeepsRead(t *testing.T) {
+	s := setupTestStore(t)
+
+	id, err := s.Messages.Create(NewMessage{SenderID: 1, ReceiverID: 2, Content: "hi"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.Messages.MarkDelivered(id, 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("sender marking: err = %v, want ErrNotFound", err)
+	}
+	if sender, err := s.Messages.MarkRead(id, 2); err != nil || sender != 1 {
+		t.Fatalf("MarkRead = %d, %v", sender, err)
+	}
+	if _, err := s.Messages.MarkDelivered(id, 2); err != nil {
+		t.Fatalf("MarkDelivered: %v", err)
+	}
+
+	history, err := s.Messages.History(2, 1, 10, 0)
+	if err != nil || len(history) != 1 {
+		t.Fatalf("History = %v, %v", history, err)
+	}
+	if history[0].Status != "read" {
+		t.Fatalf("status = %q, want read", history[0].Status)
+	}
+}
+
+func TestMessagesHiddenFromReceiver(t *testing.T) {
+	s := setupTestStore(t)
+
+	id, err := s.Messages.Create(NewMessage{SenderID: 1, ReceiverID: 2, Content: "hidden", Hidden: true})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.Messages.MarkRead(id, 2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("marking hidden message: err = %v, want ErrNotFound", err)
+	}
+	if history, _ := s.Messages.History(2, 1, 10, 0); len(history) != 0 {
+		t.Fatalf("receiver sees %d hidden messages", len(history))
+	}
+	if history, _ := s.Messages.History(1, 2, 10, 0); len(history) != 1 {
+		t.Fatalf("sender sees %d messages, want 1", len(history))
+	}
+}
+
+func TestMessagesDeleteOwnOnly(t *testing.T) {
+	s := setupTestStore(t)
+
+	id, err := s.Messages.Create(NewMessage{SenderID: 1, ReceiverID: 2, Content: "hi"})
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := s.Messages.Delete(id, 2); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("deleting someone else's message: err = %v, want ErrForbidden", err)
+	}
+	if _, err := s.Messages.Delete(id, 1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Messages.Delete(id, 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting again: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestUsersDeleteWithForeignKeys(t *testing.T) {
+	s := setupTestStore(t)
+
+	convID, err := s.Conversations.CreateDirect(1, 2)
+	if err != nil {
+		t.Fatalf("CreateDirect: %v", err)
+	}
+	if _, err := s.Messages.Create(NewMessage{SenderID: 1, ReceiverID: 2, Content: "hi"}); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := s.Blocks.Block(2, 1); err != nil {
+		t.Fatalf("Block: %v", err)
+	}
+
+	if _, err := s.Users.Delete(1); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Conversations.FindDirect(1, 2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("conversation %d survived: err = %v", convID, err)
+	}
+	if _, err := s.Users.Delete(1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting again: err = %v, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,183 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// NewSubscription is a device subscribing to push notifications. An empty
+// UserAgent is stored as NULL; a nil Label keeps the one given before.
+type NewSubscription struct {
+	UserID    int
+	Provider  string
+	Endpoint  string
+	P256dh    string
+	Auth      string
+	UserAgent string
+	Label     *string
+}
+
+// Subscription is an active push subscription as shown to its owner.
+type Subscription struct {
+	ID            int64
+	Provider      string
+	Label         *string
+	UserAgent     *string
+	CreatedAt     time.Time
+	LastSuccessAt *time.Time
+	LastFailureAt *time.Time
+	FailureCount  int
+}
+
+// Subscriptions stores push subscriptions and their health.
+type Subscriptions interface {
+	// Subscribe stores a subscription, taking over and reactivating one with
+	// the same endpoint, and returns its id
+	Subscribe(s NewSubscription) (int64, error)
+	Unsubscribe(userID int, endpoint string) error
+	List(userID int) ([]Subscription, error)
+	// Revoke deactivates one of userID's active subscriptions and drops
+	// what is queued for it, or returns ErrNotFound
+	Revoke(id int64, userID int) error
+	// Provider returns the provider of one of userID's active
+	// subscriptions, or ErrNotFound
+	Provider(id int64, userID int) (string, error)
+	// Active lists the ids of userID's active subscriptions
+	Active(userID int) ([]int64, error)
+	RecordSuccess(id int64, at time.Time) error
+	// RecordFailure counts a failed send and returns the failures in a row
+	RecordFailure(id int64, at time.Time) (int, error)
+	// Expire deactivates a subscription the push service gave up on and
+	// drops what is queued for it
+	Expire(id int64, at time.Time) error
+}
+
+type sqlSubscriptions struct{ db *db.DB }
+
+func (s sqlSubscriptions) Subscribe(n NewSubscription) (int64, error) {
+	var id int64
+	err := s.db.QueryRow(`
+		INSERT INTO push_subscriptions (user_id, provider, endpoint, p256dh, auth, user_agent, device_label)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7)
+		ON CONFLICT (endpoint) DO UPDATE SET
+			user_id = excluded.user_id,
+			provider = excluded.provider,
+			p256dh = excluded.p256dh,
+			auth = excluded.auth,
+			user_agent = excluded.user_agent,
+			device_label = COALESCE(excluded.device_label, push_subscriptions.device_label),
+			revoked_at = NULL,
+			failure_count = 0
+		RETURNING id
+	`, n.UserID, n.Provider, n.Endpoint, n.P256dh, n.Auth, n.UserAgent, n.Label).Scan(&id)
+	return id, err
+}
+
+func (s sqlSubscriptions) Unsubscribe(userID int, endpoint string) error {
+	_, err := s.db.Exec(
+		"UPDATE push_subscriptions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND endpoint = $2",
+		userID, endpoint,
+	)
+	return err
+}
+
+func (s sqlSubscriptions) List(userID int) ([]Subscription, error) {
+	rows, err := s.db.Query(`
+		SELECT id, provider, device_label, user_agent, created_at, last_success_at, last_failure_at, failure_count
+		FROM push_subscriptions
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []Subscription{}
+	for rows.Next() {
+		var s Subscription
+		if err := rows.Scan(&s.ID, &s.Provider, &s.Label, &s.UserAgent, &s.CreatedAt, &s.LastSuccessAt, &s.LastFailureAt, &s.FailureCount); err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	return subscriptions, rows.Err()
+}
+
+func (s sqlSubscriptions) Revoke(id int64, userID int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE push_subscriptions SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		id, userID,
+	)
+	if err != nil {
+		return err
+	}
+	if err := affected(result); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM push_queue WHERE subscription_id = $1", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s sqlSubscriptions) Provider(id int64, userID int) (string, error) {
+	var provider string
+	err := s.db.QueryRow(
+		"SELECT provider FROM push_subscriptions WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		id, userID,
+	).Scan(&provider)
+	return provider, notFound(err)
+}
+
+func (s sqlSubscriptions) Active(userID int) ([]int64, error) {
+	return scanInt64s(s.db.Query("SELECT id FROM push_subscriptions WHERE user_id = $1 AND revoked_at IS NULL", userID))
+}
+
+func (s sqlSubscriptions) RecordSuccess(id int64, at time.Time) error {
+	_, err := s.db.Exec("UPDATE push_subscriptions SET failure_count = 0, last_success_at = $1 WHERE id = $2", at, id)
+	return err
+}
+
+func (s sqlSubscriptions) RecordFailure(id int64, at time.Time) (int, error) {
+	var failures int
+	err := s.db.QueryRow(`
+		UPDATE push_subscriptions SET failure_count = failure_count + 1, last_failure_at = $1
+		WHERE id = $2
+		RETURNING failure_count
+	`, at, id).Scan(&failures)
+	return failures, err
+}
+
+func (s sqlSubscriptions) Expire(id int64, at time.Time) error {
+	if _, err := s.db.Exec("UPDATE push_subscriptions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL", at, id); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("DELETE FROM push_queue WHERE subscription_id = $1", id)
+	return err
+}
+
+func scanInt64s(rows *sql.Rows, err error) ([]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// Ticket is a redeemed single-use WebSocket ticket.
+type Ticket struct {
+	UserID       int
+	Username     string
+	TokenVersion int
+	ExpiresAt    time.Time
+}
+
+// Tickets stores single-use WebSocket tickets.
+type Tickets interface {
+	// Create stores a ticket and drops expired ones
+	Create(id string, userID, tokenVersion int, expiresAt time.Time) error
+	// Redeem deletes a ticket and returns it, or ErrNotFound when it does not
+	// exist or someone else redeemed it first. Expiry is left to the caller.
+	Redeem(id string) (*Ticket, error)
+}
+
+type sqlTickets struct{ db *db.DB }
+
+func (s sqlTickets) Create(id string, userID, tokenVersion int, expiresAt time.Time) error {
+	s.db.Exec("DELETE FROM ws_tickets WHERE expires_at < $1", time.Now().UTC())
+	_, err := s.db.Exec(
+		"INSERT INTO ws_tickets (id, user_id, token_version, expires_at) VALUES ($1, $2, $3, $4)",
+		id, userID, tokenVersion, expiresAt,
+	)
+	return err
+}
+
+func (s sqlTickets) Redeem(id string) (*Ticket, error) {
+	// Whoever deletes the row first owns the ticket
+	t := &Ticket{}
+	err := s.db.QueryRow(
+		"DELETE FROM ws_tickets WHERE id = $1 RETURNING user_id, token_version, expires_at",
+		id,
+	).Scan(&t.UserID, &t.TokenVersion, &t.ExpiresAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if err := s.db.QueryRow("SELECT username FROM users WHERE id = $1", t.UserID).Scan(&t.Username); err != nil {
+		return nil, notFound(err)
+	}
+	return t, nil
+}
@@ -0,0 +1,309 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+)
+
+// ErrInvalidInvite is returned by Users.Create when the invite code is
+// unknown, revoked, expired or used up.
+var ErrInvalidInvite = errors.New("invalid or expired invite code")
+
+// User is an account.
+type User struct {
+	ID              int
+	Username        string
+	PasswordHash    string
+	DisplayName     *string
+	AvatarURL       *string
+	Role            string
+	PasskeyRequired bool
+	PushPreview     bool
+	TokenVersion    int
+	SuspendedAt     *time.Time
+	CreatedAt       time.Time
+}
+
+// Name is the display name, or the username without one.
+func (u *User) Name() string {
+	if u.DisplayName != nil && *u.DisplayName != "" {
+		return *u.DisplayName
+	}
+	return u.Username
+}
+
+// NewUser is an account to create. A non-empty InviteCode has one use
+// consumed together with the insert.
+type NewUser struct {
+	Username     string
+	PasswordHash string
+	InviteCode   string
+}
+
+// DeletedUser is what is left on disk of a deleted account.
+type DeletedUser struct {
+	AvatarURL *string
+	FilePaths []string
+}
+
+// Users stores accounts.
+type Users interface {
+	// Create returns ErrDuplicate for a taken username and ErrInvalidInvite
+	// for an unusable invite code
+	Create(u NewUser) (int, error)
+	Get(id int) (*User, error)
+	GetByUsername(username string) (*User, error)
+	Exists(id int) (bool, error)
+	// Directory lists up to limit users other than viewerID whose username or
+	// display name contains query, leaving out anyone on either side of a
+	// block with viewerID
+	Directory(viewerID int, query string, limit int) ([]User, error)
+	// Search pages through every account whose username or display name
+	// contains term literally; it also returns the number of matches
+	Search(term string, limit, offset int) ([]User, int, error)
+	SetRole(id int, role string) error
+	// Suspend keeps an earlier suspension time and revokes all sessions
+	Suspend(id int, at time.Time) error
+	Unsuspend(id int) error
+	RevokeSessions(id int) error
+	// UpdateProfile leaves the push preview setting alone when pushPreview
+	// is nil
+	UpdateProfile(id int, displayName string, pushPreview *bool) error
+	SetAvatar(id int, avatarURL string) error
+	SetPasskeyRequired(id int, required bool) error
+	// Delete removes an account with everything that refers to it
+	Delete(id int) (*DeletedUser, error)
+}
+
+const userColumns = `id, username, password_hash, display_name, avatar_url, role,
+	passkey_required, push_preview, token_version, suspended_at, created_at`
+
+func scanUser(row scanner) (*User, error) {
+	u := &User{}
+	err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.DisplayName, &u.AvatarURL, &u.Role,
+		&u.PasskeyRequired, &u.PushPreview, &u.TokenVersion, &u.SuspendedAt, &u.CreatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return u, nil
+}
+
+// escapeLike quotes LIKE wildcards so a search term matches literally
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(term)
+}
+
+type sqlUsers struct{ db *db.DB }
+
+func (s sqlUsers) Create(u NewUser) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var inviteID sql.NullInt64
+	if u.InviteCode != "" {
+		// Checking and counting the use in one statement makes concurrent
+		// redemptions of the last use queue up
+		err := tx.QueryRow(`
+			UPDATE invites SET use_count = use_count + 1
+			WHERE code = $1 AND revoked_at IS NULL AND expires_at > $2 AND use_count < max_uses
+			RETURNING id
+		`, u.InviteCode, time.Now().UTC()).Scan(&inviteID)
+		if err == sql.ErrNoRows {
+			return 0, ErrInvalidInvite
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO users (username, password_hash, invite_id) VALUES ($1, $2, $3) RETURNING id",
+		u.Username, u.PasswordHash, inviteID,
+	).Scan(&id)
+	if err != nil {
+		return 0, duplicate(err)
+	}
+	return id, tx.Commit()
+}
+
+func (s sqlUsers) Get(id int) (*User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", id))
+}
+
+func (s sqlUsers) GetByUsername(username string) (*User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = $1", username))
+}
+
+func (s sqlUsers) Exists(id int) (bool, error) {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists)
+	return exists, err
+}
+
+func (s sqlUsers) Directory(viewerID int, query string, limit int) ([]User, error) {
+	pattern := "%" + query + "%"
+	return s.list(`
+		SELECT id, username, display_name, avatar_url, role, suspended_at, created_at FROM users
+		WHERE id != $1
+			AND (LOWER(username) LIKE LOWER($2) OR LOWER(display_name) LIKE LOWER($2))
+			AND NOT EXISTS (
+				SELECT 1 FROM user_blocks b
+				WHERE (b.blocker_id = $1 AND b.blocked_id = users.id) OR (b.blocker_id = users.id AND b.blocked_id = $1)
+			)
+		ORDER BY username
+		LIMIT $3
+	`, viewerID, pattern, limit)
+}
+
+func (s sqlUsers) Search(term string, limit, offset int) ([]User, int, error) {
+	pattern := "%" + escapeLike(term) + "%"
+	const match = `LOWER(username) LIKE LOWER($1) ESCAPE '\' OR LOWER(COALESCE(display_name, '')) LIKE LOWER($1) ESCAPE '\'`
+
+	var total int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE "+match, pattern).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	users, err := s.list(`
+		SELECT id, username, display_name, avatar_url, role, suspended_at, created_at FROM users
+		WHERE `+match+`
+		ORDER BY username
+		LIMIT $2 OFFSET $3
+	`, pattern, limit, offset)
+	return users, total, err
+}
+
+func (s sqlUsers) SetRole(id int, role string) error {
+	return s.update("UPDATE users SET role = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", role, id)
+}
+
+func (s sqlUsers) Suspend(id int, at time.Time) error {
+	return s.update(`
+		UPDATE users
+		SET suspended_at = COALESCE(suspended_at, $1), token_version = token_version + 1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`, at.UTC(), id)
+}
+
+func (s sqlUsers) Unsuspend(id int) error {
+	return s.update("UPDATE users SET suspended_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = $1", id)
+}
+
+func (s sqlUsers) RevokeSessions(id int) error {
+	return s.update("UPDATE users SET token_version = token_version + 1 WHERE id = $1", id)
+}
+
+func (s sqlUsers) UpdateProfile(id int, displayName string, pushPreview *bool) error {
+	var preview sql.NullInt64
+	if pushPreview != nil {
+		preview = sql.NullInt64{Int64: flag(*pushPreview), Valid: true}
+	}
+	return s.update(`
+		UPDATE users SET display_name = $1, push_preview = COALESCE($2, push_preview), updated_at = CURRENT_TIMESTAMP
+		WHERE id = $3
+	`, displayName, preview, id)
+}
+
+func (s sqlUsers) SetAvatar(id int, avatarURL string) error {
+	return s.update("UPDATE users SET avatar_url = $1, updated_at = CURRENT_TIMESTAMP WHERE id = $2", avatarURL, id)
+}
+
+func (s sqlUsers) SetPasskeyRequired(id int, required bool) error {
+	return s.update("UPDATE users SET passkey_required = $1 WHERE id = $2", flag(required), id)
+}
+
+func (s sqlUsers) update(query string, args ...interface{}) error {
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	return affected(result)
+}
+
+// list reads the rows of a query selecting id, username, display_name,
+// avatar_url, role, suspended_at and created_at.
+func (s sqlUsers) list(query string, args ...interface{}) ([]User, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.AvatarURL, &u.Role, &u.SuspendedAt, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// Delete collects the avatar and the user's attachments, removes everything
+// that refers to the user and drops conversations nobody takes part in
+// anymore.
+func (s sqlUsers) Delete(id int) (*DeletedUser, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deleted := &DeletedUser{FilePaths: []string{}}
+	if err := tx.QueryRow("SELECT avatar_url FROM users WHERE id = $1"+s.db.ForUpdate(), id).Scan(&deleted.AvatarURL); err != nil {
+		return nil, notFound(err)
+	}
+
+	rows, err := tx.Query(`
+		SELECT f.file_path FROM files f
+		INNER JOIN messages m ON f.message_id = m.id
+		WHERE m.sender_id = $1 OR m.receiver_id = $1
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err == nil && path != "" {
+			deleted.FilePaths = append(deleted.FilePaths, path)
+		}
+	}
+	rows.Close()
+
+	for _, stmt := range []string{
+		"DELETE FROM files WHERE message_id IN (SELECT id FROM messages WHERE sender_id = $1 OR receiver_id = $1)",
+		"DELETE FROM messages WHERE sender_id = $1 OR receiver_id = $1",
+		"DELETE FROM call_participants WHERE user_id = $1 OR call_id IN (SELECT id FROM calls WHERE caller_id = $1)",
+		"DELETE FROM calls WHERE caller_id = $1",
+		"DELETE FROM conversation_participants WHERE user_id = $1",
+		"DELETE FROM user_blocks WHERE blocker_id = $1 OR blocked_id = $1",
+		"DELETE FROM notification_settings WHERE user_id = $1",
+		"DELETE FROM push_queue WHERE subscription_id IN (SELECT id FROM push_subscriptions WHERE user_id = $1)",
+		"DELETE FROM push_subscriptions WHERE user_id = $1",
+		"DELETE FROM webauthn_credentials WHERE user_id = $1",
+		"DELETE FROM webauthn_sessions WHERE user_id = $1",
+		"DELETE FROM user_device_keys WHERE user_id = $1",
+		"DELETE FROM ws_tickets WHERE user_id = $1",
+		"UPDATE invites SET created_by = NULL WHERE created_by = $1",
+		"DELETE FROM users WHERE id = $1",
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(`
+		DELETE FROM conversations
+		WHERE NOT EXISTS (SELECT 1 FROM conversation_participants cp WHERE cp.conversation_id = conversations.id)
+	`); err != nil {
+		return nil, err
+	}
+	return deleted, tx.Commit()
+}
@@ -0,0 +1,31 @@
+package turn
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewCredentials(t *testing.T) {
+	now := time.Unix(1700000000, 500)
+	creds := NewCredentials("north", 42, time.Hour, now)
+
+	if creds.Username != "1700003600:42" {
+		t.Errorf("Username = %q", creds.Username)
+	}
+	// echo -n "1700003600:42" | openssl dgst -sha1 -hmac north -binary | base64
+	if creds.Password != "WO3ZFttCQxBYtA2Ohz7jjGcQStA=" {
+		t.Errorf("Password = %q", creds.Password)
+	}
+	if !creds.ExpiresAt.Equal(time.Unix(1700003600, 0)) {
+		t.Errorf("ExpiresAt = %v", creds.ExpiresAt)
+	}
+
+	// Another secret or user yields another password
+	if NewCredentials("south", 42, time.Hour, now).Password == creds.Password {
+		t.Error("password does not depend on the secret")
+	}
+	if other := NewCredentials("north", 7, time.Hour, now); !strings.HasSuffix(other.Username, ":7") || other.Password == creds.Password {
+		t.Errorf("unexpected credentials for another user: %+v", other)
+	}
+}
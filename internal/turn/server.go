@@ -0,0 +1,189 @@
+package turn
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	pionturn "github.com/pion/turn/v4"
+	"golang.org/x/time/rate"
+)
+
+// relayMTU is the largest packet the server relays; rate limits always admit
+// at least one packet of this size.
+const relayMTU = 1600
+
+// ServerConfig configures the embedded STUN/TURN server.
+type ServerConfig struct {
+	// ListenAddr is the host:port served on both UDP and TCP
+	ListenAddr string
+	// RelayIP is the public address handed out for relayed traffic
+	RelayIP net.IP
+	Realm   string
+	// Secret checks the credentials issued by NewCredentials
+	Secret string
+	// Relays are allocated from MinPort..MaxPort (inclusive)
+	MinPort uint16
+	MaxPort uint16
+	// MaxBPS caps each allocation and BPSCapacity the whole server, in
+	// bytes per second; 0 is unlimited. Traffic over the cap is dropped.
+	MaxBPS      int
+	BPSCapacity int
+}
+
+// Server is an embedded STUN/TURN server.
+type Server struct {
+	server *pionturn.Server
+	udp    net.PacketConn
+	tcp    net.Listener
+}
+
+// NewServer starts a STUN/TURN server that accepts the time-limited
+// credentials issued with cfg.Secret.
+func NewServer(cfg ServerConfig) (*Server, error) {
+	if cfg.Secret == "" {
+		return nil, errors.New("turn: a shared secret is required")
+	}
+	if cfg.RelayIP == nil {
+		return nil, errors.New("turn: a relay IP is required")
+	}
+	if cfg.MinPort == 0 || cfg.MaxPort < cfg.MinPort {
+		return nil, fmt.Errorf("turn: invalid relay port range %d-%d", cfg.MinPort, cfg.MaxPort)
+	}
+
+	udp, err := net.ListenPacket("udp", cfg.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("turn: listen udp: %w", err)
+	}
+	// TCP shares the UDP port, which also resolves port 0
+	host, _, _ := net.SplitHostPort(cfg.ListenAddr)
+	port := udp.LocalAddr().(*net.UDPAddr).Port
+	tcp, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		udp.Close()
+		return nil, fmt.Errorf("turn: listen tcp: %w", err)
+	}
+
+	relay := &limitedRelay{
+		RelayAddressGenerator: &pionturn.RelayAddressGeneratorPortRange{
+			RelayAddress: cfg.RelayIP,
+			Address:      "0.0.0.0",
+			MinPort:      cfg.MinPort,
+			MaxPort:      cfg.MaxPort,
+		},
+		maxBPS: cfg.MaxBPS,
+	}
+	if cfg.BPSCapacity > 0 {
+		relay.capacity = newLimiter(cfg.BPSCapacity)
+	}
+
+	server, err := pionturn.NewServer(pionturn.ServerConfig{
+		Realm:             cfg.Realm,
+		AuthHandler:       authHandler(cfg.Secret),
+		PacketConnConfigs: []pionturn.PacketConnConfig{{PacketConn: udp, RelayAddressGenerator: relay}},
+		ListenerConfigs:   []pionturn.ListenerConfig{{Listener: tcp, RelayAddressGenerator: relay}},
+	})
+	if err != nil {
+		udp.Close()
+		tcp.Close()
+		return nil, fmt.Errorf("turn: %w", err)
+	}
+
+	return &Server{server: server, udp: udp, tcp: tcp}, nil
+}
+
+// Addr returns the UDP address the server listens on; TCP uses the same port.
+func (s *Server) Addr() net.Addr {
+	return s.udp.LocalAddr()
+}
+
+// Close stops the server and drops all allocations.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// authHandler accepts usernames issued by NewCredentials until they expire.
+func authHandler(secret string) pionturn.AuthHandler {
+	return func(username, realm string, _ net.Addr) ([]byte, bool) {
+		expiry, _, _ := strings.Cut(username, ":")
+		expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil || time.Now().Unix() > expiresAt {
+			return nil, false
+		}
+		return pionturn.GenerateAuthKey(username, realm, password(secret, username)), true
+	}
+}
+
+// limitedRelay rate-limits the relay sockets of the wrapped generator.
+type limitedRelay struct {
+	pionturn.RelayAddressGenerator
+	maxBPS   int
+	capacity *rate.Limiter
+}
+
+func (g *limitedRelay) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGenerator.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	limited := &limitedPacketConn{PacketConn: conn}
+	if g.maxBPS > 0 {
+		limited.limiters = append(limited.limiters, newLimiter(g.maxBPS))
+	}
+	if g.capacity != nil {
+		limited.limiters = append(limited.limiters, g.capacity)
+	}
+	if len(limited.limiters) == 0 {
+		return conn, addr, nil
+	}
+	return limited, addr, nil
+}
+
+// newLimiter allows bps bytes per second with bursts of one second.
+func newLimiter(bps int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bps), max(bps, relayMTU))
+}
+
+// limitedPacketConn drops relayed packets in either direction once any of
+// its limiters runs out.
+type limitedPacketConn struct {
+	net.PacketConn
+	limiters []*rate.Limiter
+}
+
+func (c *limitedPacketConn) allow(n int) bool {
+	now := time.Now()
+	reservations := make([]*rate.Reservation, 0, len(c.limiters))
+	for _, limiter := range c.limiters {
+		r := limiter.ReserveN(now, n)
+		if !r.OK() || r.DelayFrom(now) > 0 {
+			r.CancelAt(now)
+			for _, taken := range reservations {
+				taken.CancelAt(now)
+			}
+			return false
+		}
+		reservations = append(reservations, r)
+	}
+	return true
+}
+
+func (c *limitedPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.allow(n) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *limitedPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.allow(len(p)) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
@@ -0,0 +1,187 @@
+package turn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	pionturn "github.com/pion/turn/v4"
+)
+
+const testSecret = "north"
+
+func startTestServer(t *testing.T, cfg ServerConfig) *Server {
+	t.Helper()
+	cfg.ListenAddr = "127.0.0.1:0"
+	cfg.RelayIP = net.ParseIP("127.0.0.1")
+	cfg.Realm = "payambar.test"
+	cfg.Secret = testSecret
+	cfg.MinPort, cfg.MaxPort = 50000, 50999
+	server, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+// newTestClient connects a TURN client to server over conn.
+func newTestClient(t *testing.T, server *Server, conn net.PacketConn, creds Credentials) *pionturn.Client {
+	t.Helper()
+	client, err := pionturn.NewClient(&pionturn.ClientConfig{
+		STUNServerAddr: server.Addr().String(),
+		TURNServerAddr: server.Addr().String(),
+		Username:       creds.Username,
+		Password:       creds.Password,
+		Conn:           conn,
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := client.Listen(); err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func validCredentials() Credentials {
+	return NewCredentials(testSecret, 42, time.Hour, time.Now())
+}
+
+// assertRelays sends a packet each way between relay and a loopback peer.
+// The client's TCP framing needs payloads longer than a few bytes.
+func assertRelays(t *testing.T, relay net.PacketConn) {
+	t.Helper()
+	const ping, pong = "ping from client", "pong from peer.."
+	peer := listenUDP(t)
+	buf := make([]byte, 1500)
+
+	if _, err := relay.WriteTo([]byte(ping), peer.LocalAddr()); err != nil {
+		t.Fatalf("relay write: %v", err)
+	}
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := peer.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != ping {
+		t.Fatalf("peer read %q, %v", buf[:n], err)
+	}
+	if from.String() != relay.LocalAddr().String() {
+		t.Errorf("peer got packet from %v, want the relay %v", from, relay.LocalAddr())
+	}
+
+	if _, err := peer.WriteTo([]byte(pong), from); err != nil {
+		t.Fatalf("peer write: %v", err)
+	}
+	relay.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err = relay.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != pong {
+		t.Fatalf("relay read %q, %v", buf[:n], err)
+	}
+}
+
+func TestServerRelaysUDP(t *testing.T) {
+	server := startTestServer(t, ServerConfig{})
+	client := newTestClient(t, server, listenUDP(t), validCredentials())
+
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	defer relay.Close()
+	assertRelays(t, relay)
+}
+
+func TestServerRelaysTCP(t *testing.T) {
+	server := startTestServer(t, ServerConfig{})
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	client := newTestClient(t, server, pionturn.NewSTUNConn(conn), validCredentials())
+
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	defer relay.Close()
+	assertRelays(t, relay)
+}
+
+func TestServerAnswersSTUN(t *testing.T) {
+	server := startTestServer(t, ServerConfig{})
+	conn := listenUDP(t)
+	client := newTestClient(t, server, conn, Credentials{})
+
+	mapped, err := client.SendBindingRequest()
+	if err != nil {
+		t.Fatalf("SendBindingRequest: %v", err)
+	}
+	if mapped.String() != conn.LocalAddr().String() {
+		t.Errorf("mapped address = %v, want %v", mapped, conn.LocalAddr())
+	}
+}
+
+func TestServerRejectsInvalidCredentials(t *testing.T) {
+	server := startTestServer(t, ServerConfig{})
+
+	for name, creds := range map[string]Credentials{
+		"expired":      NewCredentials(testSecret, 42, time.Hour, time.Now().Add(-2*time.Hour)),
+		"other secret": NewCredentials("south", 42, time.Hour, time.Now()),
+		"static":       {Username: "alice", Password: "secret"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t, server, listenUDP(t), creds)
+			if relay, err := client.Allocate(); err == nil {
+				relay.Close()
+				t.Fatal("allocation succeeded")
+			}
+		})
+	}
+}
+
+func TestServerBandwidthLimit(t *testing.T) {
+	server := startTestServer(t, ServerConfig{MaxBPS: 4000})
+	client := newTestClient(t, server, listenUDP(t), validCredentials())
+	relay, err := client.Allocate()
+	if err != nil {
+		t.Fatalf("Allocate: %v", err)
+	}
+	defer relay.Close()
+
+	peer := listenUDP(t)
+	packet := make([]byte, 1000)
+	for i := 0; i < 20; i++ {
+		relay.WriteTo(packet, peer.LocalAddr())
+	}
+
+	received := 0
+	buf := make([]byte, 1500)
+	for {
+		peer.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, _, err := peer.ReadFrom(buf); err != nil {
+			break
+		}
+		received++
+	}
+	// One second of burst is 4 packets; a few more may trickle in
+	if received == 0 || received > 8 {
+		t.Errorf("peer received %d of 20 packets with a 4000 B/s cap", received)
+	}
+}
+
+func TestNewServerRequiresSecret(t *testing.T) {
+	_, err := NewServer(ServerConfig{ListenAddr: "127.0.0.1:0", RelayIP: net.ParseIP("127.0.0.1"), MinPort: 50000, MaxPort: 50999})
+	if err == nil {
+		t.Fatal("expected an error without a secret")
+	}
+}
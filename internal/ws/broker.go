@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"log"
+	"sync"
+)
+
+// Envelope kinds exchanged between nodes.
+const (
+	envelopeEvent      = "event"
+	envelopePresence   = "presence"
+	envelopeSnapshot   = "snapshot"
+	envelopeDisconnect = "disconnect"
+	envelopeLeave      = "leave"
+)
+
+// Envelope is the unit of hub traffic shared between Payambar nodes.
+type Envelope struct {
+	Node       string        `json:"node"`
+	Kind       string        `json:"kind"`
+	Event      *MessageEvent `json:"event,omitempty"`
+	SenderOnly bool          `json:"sender_only,omitempty"`
+	UserID     int           `json:"user_id,omitempty"`
+	Online     bool          `json:"online,omitempty"`
+	Users      []int         `json:"users,omitempty"`
+}
+
+// Broker fans hub traffic out to every node, including the publisher.
+type Broker interface {
+	Publish(env *Envelope) error
+	// Subscribe calls handler, in publish order, for every envelope.
+	Subscribe(handler func(*Envelope)) error
+	Close() error
+}
+
+// LocalBroker is an in-process Broker. Several hubs sharing one LocalBroker
+// behave like separate nodes, which is how multi-node setups are tested.
+type LocalBroker struct {
+	mu     sync.RWMutex
+	subs   []chan *Envelope
+	closed bool
+}
+
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+func (b *LocalBroker) Publish(env *Envelope) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return nil
+	}
+	for _, sub := range b.subs {
+		select {
+		case sub <- env:
+		default:
+			log.Printf("Local broker subscriber is full, dropping %s envelope", env.Kind)
+		}
+	}
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(handler func(*Envelope)) error {
+	sub := make(chan *Envelope, 1024)
+	b.mu.Lock()
+	b.subs = append(b.subs, sub)
+	b.mu.Unlock()
+
+	go func() {
+		for env := range sub {
+			handler(env)
+		}
+	}()
+	return nil
+}
+
+func (b *LocalBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		for _, sub := range b.subs {
+			close(sub)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// waitFor polls cond until it holds or a second passes.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// waitEvent reads the client's frames until one of the given type arrives.
+func waitEvent(t *testing.T, client *Client, eventType string) *MessageEvent {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case frame, ok := <-client.send:
+			if !ok {
+				t.Fatalf("Connection closed waiting for %s", eventType)
+			}
+			if msg, ok := frame.(*MessageEvent); ok && msg.Type == eventType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s", eventType)
+		}
+	}
+}
+
+// testCluster checks that two hubs joined by brokers act as one.
+func testCluster(t *testing.T, brokerA, brokerB Broker) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	nodeA, nodeB := NewHub(db), NewHub(db)
+	if err := nodeA.SetBroker(brokerA); err != nil {
+		t.Fatalf("SetBroker failed: %v", err)
+	}
+	if err := nodeB.SetBroker(brokerB); err != nil {
+		t.Fatalf("SetBroker failed: %v", err)
+	}
+	go nodeA.Run()
+	go nodeB.Run()
+
+	sender := &Client{userID: 1, hub: nodeA, send: make(chan interface{}, 256)}
+	receiver := &Client{userID: 2, hub: nodeB, send: make(chan interface{}, 256)}
+	nodeA.register <- sender
+	nodeB.register <- receiver
+
+	waitFor(t, "presence on node A", func() bool { return nodeA.IsUserOnline(2) })
+	waitFor(t, "presence on node B", func() bool { return nodeB.IsUserOnline(1) })
+
+	nodeA.BroadcastMessage(1, 1, 2, "across nodes", "sent", "", "", "")
+
+	if msg := waitEvent(t, receiver, "message"); msg.Content != "across nodes" || msg.Seq == 0 {
+		t.Fatalf("Receiver got %+v", msg)
+	}
+	waitEvent(t, sender, "message")
+	if status := waitEvent(t, sender, "status_update"); status.Status != "delivered" {
+		t.Fatalf("Expected delivered status, got %+v", status)
+	}
+
+	// Read receipts travel back the same way
+	nodeB.broadcast <- &MessageEvent{Type: "status_update", MessageID: 1, Status: "read", SenderID: 1, ReceiverID: 2}
+	if status := waitEvent(t, sender, "status_update"); status.Status != "read" {
+		t.Fatalf("Expected read status, got %+v", status)
+	}
+
+	// Revoking a session on one node closes the connection on the other
+	nodeA.DisconnectUser(2)
+	waitFor(t, "remote disconnect", func() bool { return !nodeA.IsUserOnline(2) })
+	for range receiver.send {
+	}
+
+	// A node shutting down takes its users' presence with it
+	nodeA.Close()
+	waitFor(t, "node A to leave", func() bool { return !nodeB.IsUserOnline(1) })
+}
+
+func TestLocalBrokerCluster(t *testing.T) {
+	broker := NewLocalBroker()
+	testCluster(t, broker, broker)
+}
+
+func TestRedisBrokerCluster(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	brokerA, err := NewRedisBroker("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisBroker failed: %v", err)
+	}
+	brokerB, err := NewRedisBroker("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisBroker failed: %v", err)
+	}
+	defer brokerB.Close()
+
+	testCluster(t, brokerA, brokerB)
+}
+
+func TestStaleNodeForgotten(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.handleEnvelope(&Envelope{Node: "other", Kind: envelopeSnapshot, Users: []int{5}})
+	if !hub.IsUserOnline(5) {
+		t.Fatal("Expected user 5 online via snapshot")
+	}
+
+	hub.remote["other"].seen = time.Now().Add(-presenceTTL - time.Second)
+	if hub.IsUserOnline(5) {
+		t.Fatal("Presence from a silent node should expire")
+	}
+	hub.refreshPresence()
+	if _, ok := hub.remote["other"]; ok {
+		t.Fatal("Silent node should be forgotten")
+	}
+}
+
+// clusterHubs starts two hubs joined by a LocalBroker, as main does even on
+// a single node.
+func clusterHubs(t *testing.T) (*Hub, *Hub) {
+	t.Helper()
+	db := setupTestDB(t)
+	t.Cleanup(func() { db.Close() })
+
+	broker := NewLocalBroker()
+	nodeA, nodeB := NewHub(db), NewHub(db)
+	if err := nodeA.SetBroker(broker); err != nil {
+		t.Fatalf("SetBroker failed: %v", err)
+	}
+	if err := nodeB.SetBroker(broker); err != nil {
+		t.Fatalf("SetBroker failed: %v", err)
+	}
+	go nodeA.Run()
+	go nodeB.Run()
+	t.Cleanup(func() {
+		nodeA.Close()
+		nodeB.Close()
+	})
+	return nodeA, nodeB
+}
+
+func hasOutbox(hub *Hub, userID int) bool {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+	_, ok := hub.outboxes[userID]
+	return ok
+}
+
+func TestClusterQueuesForOfflineUsers(t *testing.T) {
+	nodeA, nodeB := clusterHubs(t)
+
+	// A user connected nowhere is queued for on every node
+	nodeA.BroadcastMessage(1, 1, 2, "before connecting", "sent", "", "", "")
+	waitFor(t, "both nodes to queue", func() bool { return hasOutbox(nodeA, 2) && hasOutbox(nodeB, 2) })
+
+	// Connecting to node A replays there; node B lets its copy go
+	first := &Client{userID: 2, hub: nodeA, send: make(chan interface{}, 256)}
+	nodeA.register <- first
+	if msg := waitEvent(t, first, "message"); msg.Content != "before connecting" {
+		t.Fatalf("Replayed %+v", msg)
+	}
+	waitFor(t, "node B to evict", func() bool { return !hasOutbox(nodeB, 2) })
+
+	// While connected to node A, only node A queues
+	nodeB.BroadcastMessage(2, 1, 2, "while connected", "sent", "", "", "")
+	waitEvent(t, first, "message")
+	if hasOutbox(nodeB, 2) {
+		t.Fatal("Node B should not queue for a user connected elsewhere")
+	}
+
+	// Moving to node B hands the session over; node A lets its outbox go
+	nodeA.unregister <- first
+	second := &Client{userID: 2, hub: nodeB, send: make(chan interface{}, 256)}
+	nodeB.register <- second
+	waitFor(t, "presence on node A", func() bool { return nodeA.IsUserOnline(2) })
+	waitFor(t, "node A to evict", func() bool { return !hasOutbox(nodeA, 2) })
+
+	nodeA.BroadcastMessage(3, 1, 2, "after moving", "sent", "", "", "")
+	if msg := waitEvent(t, second, "message"); msg.Content != "after moving" || msg.Seq != 1 {
+		t.Fatalf("Expected the first seq of node B's epoch, got %+v", msg)
+	}
+	if hasOutbox(nodeA, 2) {
+		t.Fatal("Node A should not queue for a user connected elsewhere")
+	}
+}
+
+func TestClusterReplaysAfterIdleEviction(t *testing.T) {
+	nodeA, nodeB := clusterHubs(t)
+
+	first := &Client{userID: 2, hub: nodeA, send: make(chan interface{}, 256)}
+	nodeA.register <- first
+	waitFor(t, "presence on node B", func() bool { return nodeB.IsUserOnline(2) })
+	epoch := nodeA.outboxEpoch(2)
+	nodeA.unregister <- first
+	waitFor(t, "node B to see the user leave", func() bool { return !nodeB.IsUserOnline(2) })
+
+	// The idle timer evicts the empty outbox of the disconnected user
+	nodeA.pruneOutboxes()
+	if hasOutbox(nodeA, 2) {
+		t.Fatal("An empty outbox of a disconnected user should be evicted")
+	}
+
+	nodeB.BroadcastMessage(1, 1, 2, "while offline", "sent", "", "", "")
+	waitFor(t, "node A to queue", func() bool { return hasOutbox(nodeA, 2) })
+
+	// Reconnecting with the old epoch replays the new epoch from the start
+	second := &Client{userID: 2, hub: nodeA, send: make(chan interface{}, 256), epoch: epoch, lastSeq: 5}
+	nodeA.register <- second
+	if msg := waitEvent(t, second, "message"); msg.Content != "while offline" || msg.Seq != 1 {
+		t.Fatalf("Replayed %+v", msg)
+	}
+}
@@ -0,0 +1,803 @@
+package ws
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/4xmen/payambar/internal/models"
+	"github.com/4xmen/payambar/internal/notify"
+	"github.com/4xmen/payambar/internal/push"
+	"github.com/4xmen/payambar/internal/store"
+)
+
+// maxCallParticipants bounds a group call, caller included. Media is
+// peer-to-peer, so every pair of participants holds its own connection.
+const maxCallParticipants = 8
+
+const (
+	// defaultRingTimeout is how long invitees are rung before the call
+	// counts as missed for them
+	defaultRingTimeout = 45 * time.Second
+	// defaultRejoinGrace is how long a participant who lost their connection
+	// stays in the call before being dropped from it
+	defaultRejoinGrace = 30 * time.Second
+)
+
+// Call kinds
+const (
+	CallAudio = "audio"
+	CallVideo = "video"
+)
+
+// Call session states
+const (
+	CallRinging = "ringing"
+	CallActive  = "active"
+	CallEnded   = "ended"
+)
+
+// Participant states; invited and joined are live, the rest are final.
+const (
+	participantInvited  = "invited"
+	participantJoined   = "joined"
+	participantLeft     = "left"
+	participantDeclined = "declined"
+	participantBusy     = "busy"
+	participantMissed   = "missed"
+)
+
+// Call outcomes recorded for each invitee, and the reasons a call ended.
+const (
+	OutcomeCompleted = "completed"
+	OutcomeMissed    = "missed"
+	OutcomeDeclined  = "declined"
+	OutcomeBusy      = "busy"
+	OutcomeCancelled = "cancelled"
+)
+
+// CallSession is a call as sent in call_ring and call_state frames.
+type CallSession struct {
+	ID           int               `json:"id"`
+	CallerID     int               `json:"caller_id"`
+	Kind         string            `json:"kind"`
+	State        string            `json:"state"`
+	EndReason    string            `json:"end_reason,omitempty"`
+	AnsweredAt   *time.Time        `json:"answered_at,omitempty"`
+	Participants []CallParticipant `json:"participants"`
+}
+
+// CallParticipant is one member of a call, the caller included.
+type CallParticipant struct {
+	UserID int    `json:"user_id"`
+	State  string `json:"state"`
+
+	// hidden invitees blocked the caller; they are never rung
+	hidden bool
+}
+
+func (s *CallSession) participant(userID int) *CallParticipant {
+	for i := range s.Participants {
+		if s.Participants[i].UserID == userID {
+			return &s.Participants[i]
+		}
+	}
+	return nil
+}
+
+func (p *CallParticipant) live() bool {
+	return p.State == participantInvited || p.State == participantJoined
+}
+
+// loadCall reads a call and its participants, or returns nil if there is no
+// such call.
+func (h *Hub) loadCall(callID int) (*CallSession, error) {
+	call, err := h.store.Calls.Get(callID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Failed to load call: %v", err)
+		return nil, err
+	}
+	s := &CallSession{
+		ID:         call.ID,
+		CallerID:   call.CallerID,
+		Kind:       call.Kind,
+		State:      call.State,
+		EndReason:  call.EndReason,
+		AnsweredAt: call.AnsweredAt,
+	}
+	for _, p := range call.Participants {
+		s.Participants = append(s.Participants, CallParticipant{UserID: p.UserID, State: p.State, hidden: p.Hidden})
+	}
+	return s, nil
+}
+
+// liveCallOf returns the call the user is ringing in or taking part in, or 0.
+func (h *Hub) liveCallOf(userID int) (int, error) {
+	return h.store.Calls.LiveOf(userID)
+}
+
+// sharedCall returns the latest live call both users are still ringing in
+// or taking part in, or 0. It lets clients that predate call ids keep
+// addressing calls by receiver.
+func (h *Hub) sharedCall(userA, userB int) (int, error) {
+	return h.store.Calls.Shared(userA, userB)
+}
+
+// startCall creates a ringing call from callerID to receiverIDs. Invitees
+// already in a call are marked busy; if all of them are, the call ends at
+// once.
+func (h *Hub) startCall(callerID int, receiverIDs []int, kind string) (*CallSession, error) {
+	if kind == "" {
+		kind = CallAudio
+	}
+
+	h.callMu.Lock()
+	defer h.callMu.Unlock()
+
+	if callID, err := h.liveCallOf(callerID); err != nil {
+		return nil, err
+	} else if callID != 0 {
+		return nil, newEventError(CodeBusy, "already in a call")
+	}
+
+	hidden := make([]bool, len(receiverIDs))
+	for i, receiverID := range receiverIDs {
+		grant, err := h.access.Authorize(callerID, receiverID)
+		if err != nil {
+			if err = accessError(err); !isEventError(err) {
+				log.Printf("Failed to authorize call: %v", err)
+			}
+			return nil, err
+		}
+		hidden[i] = grant.Hidden
+	}
+
+	callID, err := h.store.Calls.Create(callerID, kind, time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to create call: %v", err)
+		return nil, err
+	}
+
+	ringing := 0
+	for i, receiverID := range receiverIDs {
+		state := participantInvited
+		if !hidden[i] {
+			busyIn, err := h.liveCallOf(receiverID)
+			if err != nil {
+				return nil, err
+			}
+			if busyIn != 0 {
+				state = participantBusy
+			} else {
+				ringing++
+			}
+		}
+		// seq keeps the caller first and invitees in the order they were given
+		if err := h.store.Calls.Invite(callID, receiverID, state, hidden[i], i+1); err != nil {
+			log.Printf("Failed to add call participant: %v", err)
+			return nil, err
+		}
+	}
+
+	session, err := h.loadCall(callID)
+	if err != nil {
+		return nil, err
+	}
+	// Hidden invitees are never rung, but to the caller they look unanswered
+	if ringing == 0 && !anyHidden(hidden) {
+		return h.endCallLocked(session, OutcomeBusy)
+	}
+	time.AfterFunc(h.ringTimeout, func() { h.expireInvites(callID) })
+	h.pushRing(session)
+	return session, nil
+}
+
+// pushRing sends a call push to each rung invitee who is offline. Settings
+// are checked in the push goroutine, outside h.callMu.
+func (h *Hub) pushRing(session *CallSession) {
+	if h.pushNotifier == nil {
+		return
+	}
+	for _, p := range session.Participants {
+		if p.hidden || p.State != participantInvited || h.IsUserOnline(p.UserID) {
+			continue
+		}
+		go func(call push.Call) {
+			wanted, err := notify.ShouldRing(h.store, call.ReceiverID, call.CallerID, time.Now())
+			if err != nil {
+				log.Printf("push: failed to check notification settings of user %d: %v", call.ReceiverID, err)
+			}
+			if !wanted {
+				return
+			}
+			h.pushNotifier.SendCallNotification(call)
+		}(push.Call{
+			ID:          session.ID,
+			CallerID:    session.CallerID,
+			ReceiverID:  p.UserID,
+			Kind:        session.Kind,
+			RingTimeout: h.ringTimeout,
+		})
+	}
+}
+
+// pushMissedCall sends a missed-call push for a call history message to an
+// offline invitee. It runs in its own goroutine, off the hub loop.
+func (h *Hub) pushMissedCall(msg *MessageEvent) {
+	if msg.Call.Outcome != OutcomeMissed {
+		return
+	}
+	wanted, err := notify.ShouldRing(h.store, msg.ReceiverID, msg.SenderID, time.Now())
+	if err != nil {
+		log.Printf("push: failed to check notification settings of user %d: %v", msg.ReceiverID, err)
+	}
+	if !wanted {
+		return
+	}
+	h.pushNotifier.SendMissedCallNotification(push.Call{
+		ID:         msg.Call.ID,
+		CallerID:   msg.SenderID,
+		ReceiverID: msg.ReceiverID,
+		Kind:       msg.Call.Kind,
+		MessageID:  msg.MessageID,
+	})
+}
+
+func anyHidden(hidden []bool) bool {
+	for _, h := range hidden {
+		if h {
+			return true
+		}
+	}
+	return false
+}
+
+// joinCall answers a ringing call, or rejoins one the user dropped out of.
+func (h *Hub) joinCall(callID, userID int) (*CallSession, error) {
+	h.callMu.Lock()
+	defer h.callMu.Unlock()
+
+	session, err := h.loadCall(callID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || session.State == CallEnded {
+		return nil, newEventError(CodeNotFound, "call not found")
+	}
+	p := session.participant(userID)
+	if p == nil || p.hidden || (p.State != participantInvited && p.State != participantLeft) {
+		return nil, newEventError(CodeNotFound, "call not found")
+	}
+	if other, err := h.liveCallOf(userID); err != nil {
+		return nil, err
+	} else if other != 0 && other != callID {
+		return nil, newEventError(CodeBusy, "already in a call")
+	}
+
+	if err := h.store.Calls.Join(callID, userID, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+
+	session, err = h.loadCall(callID)
+	if err != nil {
+		return nil, err
+	}
+	h.notifyCall(session)
+	return session, nil
+}
+
+// declineCall turns down an invitation. The call ends once nobody is left
+// to answer it.
+func (h *Hub) declineCall(callID, userID int, busy bool) error {
+	h.callMu.Lock()
+	defer h.callMu.Unlock()
+
+	session, err := h.loadCall(callID)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.State == CallEnded {
+		return newEventError(CodeNotFound, "call not found")
+	}
+	p := session.participant(userID)
+	if p == nil || p.State != participantInvited {
+		return newEventError(CodeNotFound, "call not found")
+	}
+	p.State = participantDeclined
+	if busy {
+		p.State = participantBusy
+	}
+	if err := h.store.Calls.SetState(callID, userID, p.State); err != nil {
+		return err
+	}
+	return h.settleLocked(session, false)
+}
+
+// leaveCall hangs up. A caller hanging up an unanswered call cancels it; an
+// invitee hanging up declines.
+func (h *Hub) leaveCall(callID, userID int) error {
+	h.callMu.Lock()
+	defer h.callMu.Unlock()
+
+	session, err := h.loadCall(callID)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.State == CallEnded {
+		return newEventError(CodeNotFound, "call not found")
+	}
+	p := session.participant(userID)
+	if p == nil || !p.live() {
+		return newEventError(CodeNotFound, "call not found")
+	}
+
+	if p.State == participantInvited {
+		p.State = participantDeclined
+		if err := h.store.Calls.SetState(callID, userID, participantDeclined); err != nil {
+			return err
+		}
+		return h.settleLocked(session, false)
+	}
+
+	p.State = participantLeft
+	if err := h.store.Calls.Leave(callID, userID, time.Now().UTC()); err != nil {
+		return err
+	}
+	return h.settleLocked(session, session.State == CallRinging && userID == session.CallerID)
+}
+
+// expireInvites marks invitees who never answered as having missed the call.
+func (h *Hub) expireInvites(callID int) {
+	h.callMu.Lock()
+	defer h.callMu.Unlock()
+
+	expired, err := h.store.Calls.ExpireInvites(callID)
+	if err != nil {
+		log.Printf("Failed to expire call invites: %v", err)
+		return
+	}
+	if !expired {
+		return
+	}
+	session, err := h.loadCall(callID)
+	if err != nil || session == nil {
+		return
+	}
+	if err := h.settleLocked(session, false); err != nil {
+		log.Printf("Failed to expire call: %v", err)
+	}
+}
+
+// settleLocked ends the call if it can no longer go on and otherwise tells
+// the participants about its new state. h.callMu must be held.
+func (h *Hub) settleLocked(session *CallSession, cancelled bool) error {
+	joined, invited := 0, 0
+	for _, p := range session.Participants {
+		switch p.State {
+		case participantJoined:
+			joined++
+		case participantInvited:
+			invited++
+		}
+	}
+
+	switch {
+	case cancelled:
+		_, err := h.endCallLocked(session, OutcomeCancelled)
+		return err
+	case session.State == CallRinging && invited == 0:
+		_, err := h.endCallLocked(session, callEndReason(session))
+		return err
+	case session.State == CallActive && joined <= 1 && invited == 0,
+		session.State == CallActive && joined == 0:
+		_, err := h.endCallLocked(session, OutcomeCompleted)
+		return err
+	}
+	h.notifyCall(session)
+	return nil
+}
+
+// callEndReason explains why an unanswered call ended.
+func callEndReason(session *CallSession) string {
+	reason := OutcomeBusy
+	for _, p := range session.Participants {
+		switch p.State {
+		case participantInvited, participantMissed:
+			return OutcomeMissed
+		case participantDeclined:
+			reason = OutcomeDeclined
+		}
+	}
+	return reason
+}
+
+// endCallLocked closes the call, settles every participant's outcome and
+// adds a history entry to each invitee's conversation with the caller.
+// h.callMu must be held.
+func (h *Hub) endCallLocked(session *CallSession, reason string) (*CallSession, error) {
+	now := time.Now().UTC()
+	closed, err := h.store.Calls.End(session.ID, reason, now)
+	if err != nil {
+		log.Printf("Failed to end call: %v", err)
+		return nil, err
+	}
+	if !closed {
+		// Another node ended it first
+		return h.loadCall(session.ID)
+	}
+
+	ended, err := h.loadCall(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	h.notifyCall(ended)
+	h.recordCallHistory(ended, now)
+	return ended, nil
+}
+
+// recordCallHistory saves and delivers one call message per invitee.
+func (h *Hub) recordCallHistory(session *CallSession, endedAt time.Time) {
+	duration := 0
+	if session.AnsweredAt != nil {
+		duration = int(endedAt.Sub(*session.AnsweredAt).Seconds())
+	}
+
+	call, err := h.store.Calls.Get(session.ID)
+	if err != nil {
+		log.Printf("Failed to load call outcomes: %v", err)
+		return
+	}
+
+	callID := session.ID
+	for _, p := range call.Participants {
+		if p.UserID == session.CallerID {
+			continue
+		}
+		msgID, err := h.store.Messages.Create(store.NewMessage{
+			SenderID:   session.CallerID,
+			ReceiverID: p.UserID,
+			Hidden:     p.Hidden,
+			CallID:     &callID,
+			CreatedAt:  &endedAt,
+		})
+		if err != nil {
+			log.Printf("Failed to save call history: %v", err)
+			continue
+		}
+
+		summary := &models.CallSummary{ID: session.ID, Kind: session.Kind, Outcome: p.Outcome}
+		if p.Outcome == OutcomeCompleted {
+			summary.Duration = duration
+		}
+		h.broadcast <- &MessageEvent{
+			Type:       "message",
+			MessageID:  msgID,
+			SenderID:   session.CallerID,
+			ReceiverID: p.UserID,
+			Status:     "sent",
+			CreatedAt:  endedAt,
+			Call:       summary,
+			senderOnly: p.Hidden,
+		}
+	}
+}
+
+// notifyCall sends the call's state to everyone taking part in it. Hidden
+// invitees and those who were busy are left out.
+func (h *Hub) notifyCall(session *CallSession) {
+	for _, p := range session.Participants {
+		if p.hidden || p.State == participantBusy {
+			continue
+		}
+		h.broadcast <- &MessageEvent{
+			Type:       FrameCallState,
+			ReceiverID: p.UserID,
+			CallID:     session.ID,
+			Session:    session,
+		}
+	}
+}
+
+// ringCall sends call_ring to every invitee who is rung.
+func (h *Hub) ringCall(session *CallSession) {
+	for _, p := range session.Participants {
+		if p.hidden || p.State != participantInvited {
+			continue
+		}
+		h.broadcast <- &MessageEvent{
+			Type:       FrameCallRing,
+			SenderID:   session.CallerID,
+			ReceiverID: p.UserID,
+			CallID:     session.ID,
+			Session:    session,
+		}
+	}
+}
+
+// relaySignal forwards a signaling event between two members of a call.
+// Events to hidden invitees are dropped.
+func (h *Hub) relaySignal(eventType string, callID, senderID, receiverID int, payload map[string]interface{}) error {
+	session, err := h.loadCall(callID)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.State == CallEnded {
+		return newEventError(CodeNotFound, "call not found")
+	}
+	sender, receiver := session.participant(senderID), session.participant(receiverID)
+	if sender == nil || receiver == nil || !sender.live() || !receiver.live() || senderID == receiverID {
+		return newEventError(CodeNotFound, "call not found")
+	}
+	if receiver.hidden {
+		return nil
+	}
+
+	h.broadcast <- &MessageEvent{
+		Type:       eventType,
+		SenderID:   senderID,
+		ReceiverID: receiverID,
+		CallID:     callID,
+		Payload:    payload,
+	}
+	return nil
+}
+
+// leaveCallsLater drops a user who lost their connection from their call,
+// unless they are back within the rejoin grace period.
+func (h *Hub) leaveCallsLater(userID int) {
+	time.AfterFunc(h.rejoinGrace, func() {
+		if h.IsUserOnline(userID) {
+			return
+		}
+		callID, err := h.store.Calls.JoinedIn(userID)
+		if err != nil || callID == 0 {
+			return
+		}
+		if err := h.leaveCall(callID, userID); err != nil && !isEventError(err) {
+			log.Printf("Failed to drop user %d from call %d: %v", userID, callID, err)
+		}
+	})
+}
+
+// EndOpenCalls ends calls left open by a previous run. Only call it when
+// this is the sole node, after Run has started.
+func (h *Hub) EndOpenCalls() {
+	ids, err := h.store.Calls.Open()
+	if err != nil {
+		log.Printf("Failed to list open calls: %v", err)
+		return
+	}
+
+	h.callMu.Lock()
+	defer h.callMu.Unlock()
+	for _, id := range ids {
+		session, err := h.loadCall(id)
+		if err != nil || session == nil {
+			continue
+		}
+		reason := OutcomeCompleted
+		if session.AnsweredAt == nil {
+			reason = callEndReason(session)
+		}
+		h.endCallLocked(session, reason)
+	}
+}
+
+func (c *Client) handleCallInvite(event *Event) (int, error) {
+	var p CallInvitePayload
+	if err := event.Decode(&p); err != nil {
+		return 0, err
+	}
+	if err := p.validate(); err != nil {
+		return 0, err
+	}
+
+	session, err := c.hub.startCall(c.userID, p.ReceiverIDs, p.Kind)
+	if err != nil {
+		return 0, err
+	}
+	if session.State != CallEnded {
+		c.hub.ringCall(session)
+		c.hub.notifyCall(session)
+	}
+	return 0, nil
+}
+
+func (c *Client) handleCallJoin(event *Event) (int, error) {
+	var p CallPayload
+	if err := event.Decode(&p); err != nil {
+		return 0, err
+	}
+	if err := p.validate(); err != nil {
+		return 0, err
+	}
+	if _, err := c.hub.joinCall(p.CallID, c.userID); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// handleCallOffer starts a one-to-one call when the offer names no call;
+// otherwise it relays the offer inside the call, as group members do to
+// connect to each newcomer.
+func (c *Client) handleCallOffer(event *Event) (int, error) {
+	p, err := decodeSignaling(event)
+	if err != nil {
+		return 0, err
+	}
+	if p.ReceiverID <= 0 {
+		return 0, newEventError(CodeInvalidPayload, "receiver_id required")
+	}
+
+	if p.CallID == 0 {
+		if p.CallID, err = c.hub.sharedCall(c.userID, p.ReceiverID); err != nil {
+			return 0, err
+		}
+	}
+	if p.CallID == 0 {
+		session, err := c.hub.startCall(c.userID, []int{p.ReceiverID}, p.Kind)
+		if err != nil {
+			return 0, err
+		}
+		if receiver := session.participant(p.ReceiverID); receiver.State == participantBusy {
+			// What a busy client would answer itself
+			c.hub.broadcast <- &MessageEvent{
+				Type:       EventCallReject,
+				SenderID:   p.ReceiverID,
+				ReceiverID: c.userID,
+				CallID:     session.ID,
+				Payload:    map[string]interface{}{"reason": OutcomeBusy},
+			}
+			return 0, nil
+		}
+		c.hub.notifyCall(session)
+		p.CallID = session.ID
+	}
+
+	if err := c.hub.relaySignal(event.Type, p.CallID, c.userID, p.ReceiverID, p.Payload); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// handleCallAnswer relays an answer; answering an invitation joins the call.
+func (c *Client) handleCallAnswer(event *Event) (int, error) {
+	p, err := c.resolveCall(event)
+	if err != nil {
+		return 0, err
+	}
+	if p.ReceiverID <= 0 {
+		return 0, newEventError(CodeInvalidPayload, "receiver_id required")
+	}
+
+	session, err := c.hub.loadCall(p.CallID)
+	if err != nil {
+		return 0, err
+	}
+	if session != nil {
+		if me := session.participant(c.userID); me != nil && me.State == participantInvited {
+			if _, err := c.hub.joinCall(p.CallID, c.userID); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if err := c.hub.relaySignal(event.Type, p.CallID, c.userID, p.ReceiverID, p.Payload); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// handleSignalingEvent relays ICE candidates between call members.
+func (c *Client) handleSignalingEvent(event *Event) (int, error) {
+	p, err := c.resolveCall(event)
+	if err != nil {
+		return 0, err
+	}
+	if p.ReceiverID <= 0 {
+		return 0, newEventError(CodeInvalidPayload, "receiver_id required")
+	}
+	if err := c.hub.relaySignal(event.Type, p.CallID, c.userID, p.ReceiverID, p.Payload); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// handleCallReject declines an invitation; a "busy" reason records the
+// invitee as busy.
+func (c *Client) handleCallReject(event *Event) (int, error) {
+	p, err := c.resolveCall(event)
+	if err != nil {
+		return 0, err
+	}
+
+	busy := p.Payload["reason"] == OutcomeBusy
+	if err := c.hub.declineCall(p.CallID, c.userID, busy); err != nil {
+		return 0, err
+	}
+	return 0, c.hub.relayToCaller(event.Type, p.CallID, c.userID, p.Payload)
+}
+
+// handleCallHangup leaves the call and passes the hangup on to the members
+// still in it.
+func (c *Client) handleCallHangup(event *Event) (int, error) {
+	p, err := c.resolveCall(event)
+	if err != nil {
+		return 0, err
+	}
+	session, err := c.hub.loadCall(p.CallID)
+	if err != nil {
+		return 0, err
+	}
+	if session == nil || session.State == CallEnded {
+		return 0, newEventError(CodeNotFound, "call not found")
+	}
+	if me := session.participant(c.userID); me == nil || !me.live() {
+		return 0, newEventError(CodeNotFound, "call not found")
+	}
+	for _, other := range session.Participants {
+		if other.UserID == c.userID || other.hidden || !other.live() {
+			continue
+		}
+		c.hub.broadcast <- &MessageEvent{
+			Type:       event.Type,
+			SenderID:   c.userID,
+			ReceiverID: other.UserID,
+			CallID:     p.CallID,
+			Payload:    p.Payload,
+		}
+	}
+	if err := c.hub.leaveCall(p.CallID, c.userID); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// relayToCaller tells the caller who turned their call down, as one-to-one
+// clients expect a call_reject from the receiver.
+func (h *Hub) relayToCaller(eventType string, callID, senderID int, payload map[string]interface{}) error {
+	session, err := h.loadCall(callID)
+	if err != nil || session == nil {
+		return err
+	}
+	h.broadcast <- &MessageEvent{
+		Type:       eventType,
+		SenderID:   senderID,
+		ReceiverID: session.CallerID,
+		CallID:     callID,
+		Payload:    payload,
+	}
+	return nil
+}
+
+func decodeSignaling(event *Event) (*SignalingPayload, error) {
+	var p SignalingPayload
+	if err := event.Decode(&p); err != nil {
+		return nil, err
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// resolveCall decodes a signaling event and fills in its call id from the
+// call shared with the receiver when the client sent none.
+func (c *Client) resolveCall(event *Event) (*SignalingPayload, error) {
+	p, err := decodeSignaling(event)
+	if err != nil {
+		return nil, err
+	}
+	if p.CallID == 0 {
+		if p.CallID, err = c.hub.sharedCall(c.userID, p.ReceiverID); err != nil {
+			return nil, err
+		}
+		if p.CallID == 0 {
+			return nil, newEventError(CodeNotFound, "call not found")
+		}
+	}
+	return p, nil
+}
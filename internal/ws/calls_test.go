@@ -0,0 +1,357 @@
+package ws
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/push"
+)
+
+// callTestHub runs a hub with users 1..n connected.
+func callTestHub(t *testing.T, n int) (*Hub, *db.DB, []*Client) {
+	t.Helper()
+	db := setupTestDB(t)
+	for id := 3; id <= n; id++ {
+		db.Exec("INSERT INTO users (id, username, password_hash) VALUES ($1, $2, 'hash')", id, fmt.Sprintf("user%d", id))
+	}
+
+	hub := NewHub(db)
+	go hub.Run()
+
+	clients := make([]*Client, n+1)
+	for id := 1; id <= n; id++ {
+		clients[id] = &Client{userID: id, hub: hub, send: make(chan interface{}, 256)}
+		hub.register <- clients[id]
+	}
+	time.Sleep(10 * time.Millisecond)
+	return hub, db, clients
+}
+
+// nextEvent reads the client's events until one of frameType arrives.
+func nextEvent(t *testing.T, client *Client, frameType string) *MessageEvent {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case frame := <-client.send:
+			if msg, ok := frame.(*MessageEvent); ok && msg.Type == frameType {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("User %d did not receive %s", client.userID, frameType)
+			return nil
+		}
+	}
+}
+
+// nextCallState reads call_state frames until the call reaches state.
+func nextCallState(t *testing.T, client *Client, state string) *CallSession {
+	t.Helper()
+	for {
+		if msg := nextEvent(t, client, FrameCallState); msg.Session.State == state {
+			return msg.Session
+		}
+	}
+}
+
+func TestOneToOneCall(t *testing.T) {
+	_, db, clients := callTestHub(t, 2)
+	caller, callee := clients[1], clients[2]
+
+	if _, err := caller.handleCallOffer(testEvent(t, map[string]interface{}{
+		"type": EventCallOffer, "receiver_id": 2, "kind": CallVideo, "payload": map[string]interface{}{"offer": "sdp"},
+	})); err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	offer := nextEvent(t, callee, EventCallOffer)
+	if offer.CallID == 0 || offer.Payload["offer"] != "sdp" {
+		t.Fatalf("Unexpected offer: %+v", offer)
+	}
+
+	// Clients without call ids still reach the call through the receiver
+	if _, err := callee.handleCallAnswer(testEvent(t, map[string]interface{}{
+		"type": EventCallAnswer, "receiver_id": 1, "payload": map[string]interface{}{"answer": "sdp"},
+	})); err != nil {
+		t.Fatalf("Answer failed: %v", err)
+	}
+	nextCallState(t, caller, CallActive)
+	if answer := nextEvent(t, caller, EventCallAnswer); answer.CallID != offer.CallID {
+		t.Fatalf("Answer not tied to the call: %+v", answer)
+	}
+
+	callee.handleSignalingEvent(testEvent(t, map[string]interface{}{
+		"type": EventIceCandidate, "call_id": offer.CallID, "receiver_id": 1, "payload": map[string]interface{}{"candidate": "c"},
+	}))
+	nextEvent(t, caller, EventIceCandidate)
+
+	if _, err := caller.handleCallHangup(testEvent(t, map[string]interface{}{"type": EventCallHangup, "receiver_id": 2})); err != nil {
+		t.Fatalf("Hangup failed: %v", err)
+	}
+	nextEvent(t, callee, EventCallHangup)
+	if ended := nextCallState(t, callee, CallEnded); ended.EndReason != OutcomeCompleted {
+		t.Errorf("Expected completed call, got %+v", ended)
+	}
+
+	entry := nextEvent(t, callee, "message")
+	if entry.Call == nil || entry.Call.ID != offer.CallID || entry.Call.Kind != CallVideo || entry.Call.Outcome != OutcomeCompleted {
+		t.Errorf("Unexpected history entry: %+v", entry)
+	}
+	var callID int
+	db.QueryRow("SELECT call_id FROM messages WHERE sender_id = 1 AND receiver_id = 2").Scan(&callID)
+	if callID != offer.CallID {
+		t.Errorf("Expected call history message, got call_id=%d", callID)
+	}
+
+	// The call is over; further signaling has nowhere to go
+	_, err := callee.handleSignalingEvent(testEvent(t, map[string]interface{}{
+		"type": EventIceCandidate, "call_id": offer.CallID, "receiver_id": 1,
+	}))
+	if eventErr, ok := err.(*EventError); !ok || eventErr.Code != CodeNotFound {
+		t.Errorf("Expected %s after the call ended, got %v", CodeNotFound, err)
+	}
+}
+
+func TestCallBusy(t *testing.T) {
+	_, db, clients := callTestHub(t, 3)
+
+	clients[1].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 2}))
+	nextEvent(t, clients[2], EventCallOffer)
+
+	// User 2 is being rung, so user 3 gets the busy signal
+	if _, err := clients[3].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 2})); err != nil {
+		t.Fatalf("Offer failed: %v", err)
+	}
+	reject := nextEvent(t, clients[3], EventCallReject)
+	if reject.SenderID != 2 || reject.Payload["reason"] != OutcomeBusy {
+		t.Errorf("Expected busy reject from user 2, got %+v", reject)
+	}
+
+	var reason, outcome string
+	db.QueryRow("SELECT end_reason FROM calls WHERE caller_id = 3").Scan(&reason)
+	db.QueryRow("SELECT p.outcome FROM call_participants p JOIN calls c ON c.id = p.call_id WHERE c.caller_id = 3 AND p.user_id = 2").Scan(&outcome)
+	if reason != OutcomeBusy || outcome != OutcomeBusy {
+		t.Errorf("Expected busy call, got reason=%q outcome=%q", reason, outcome)
+	}
+
+	// A caller cannot start a second call
+	_, err := clients[1].handleCallInvite(testEvent(t, map[string]interface{}{"type": EventCallInvite, "receiver_ids": []int{3}}))
+	if eventErr, ok := err.(*EventError); !ok || eventErr.Code != CodeBusy {
+		t.Errorf("Expected %s, got %v", CodeBusy, err)
+	}
+}
+
+func TestUnansweredCallIsMissed(t *testing.T) {
+	hub, db, clients := callTestHub(t, 2)
+	hub.ringTimeout = 50 * time.Millisecond
+
+	clients[1].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 2}))
+
+	if ended := nextCallState(t, clients[1], CallEnded); ended.EndReason != OutcomeMissed {
+		t.Errorf("Expected missed call, got %+v", ended)
+	}
+	entry := nextEvent(t, clients[2], "message")
+	if entry.Call == nil || entry.Call.Outcome != OutcomeMissed || entry.SenderID != 1 {
+		t.Errorf("Expected missed call entry, got %+v", entry)
+	}
+	if count := countMessages(db); count != 1 {
+		t.Errorf("Expected 1 history message, got %d", count)
+	}
+}
+
+// fakePushNotifier records the call pushes the hub asks for.
+type fakePushNotifier struct {
+	calls  chan push.Call
+	missed chan push.Call
+}
+
+func newFakePushNotifier() *fakePushNotifier {
+	return &fakePushNotifier{calls: make(chan push.Call, 8), missed: make(chan push.Call, 8)}
+}
+
+func (f *fakePushNotifier) SendNewMessageNotification(push.Message) {}
+
+func (f *fakePushNotifier) SendCallNotification(call push.Call) {
+	f.calls <- call
+}
+
+func (f *fakePushNotifier) SendMissedCallNotification(call push.Call) {
+	f.missed <- call
+}
+
+func receivePush(t *testing.T, pushes chan push.Call, what string) push.Call {
+	t.Helper()
+	select {
+	case call := <-pushes:
+		return call
+	case <-time.After(2 * time.Second):
+		t.Fatalf("No %s push", what)
+		return push.Call{}
+	}
+}
+
+func TestOfflineCalleeGetsCallPushes(t *testing.T) {
+	hub, _, clients := callTestHub(t, 2)
+	hub.ringTimeout = 50 * time.Millisecond
+	notifier := newFakePushNotifier()
+	hub.SetPushNotifier(notifier)
+	hub.unregister <- clients[2]
+	time.Sleep(10 * time.Millisecond)
+
+	clients[1].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 2, "kind": CallVideo}))
+
+	ring := receivePush(t, notifier.calls, "incoming call")
+	if ring.CallerID != 1 || ring.ReceiverID != 2 || ring.Kind != CallVideo || ring.RingTimeout != hub.ringTimeout || ring.ID == 0 {
+		t.Errorf("Unexpected call push: %+v", ring)
+	}
+	missed := receivePush(t, notifier.missed, "missed call")
+	if missed.ID != ring.ID || missed.ReceiverID != 2 || missed.MessageID == 0 {
+		t.Errorf("Unexpected missed call push: %+v", missed)
+	}
+}
+
+func TestOnlineCalleeGetsNoCallPush(t *testing.T) {
+	hub, _, clients := callTestHub(t, 2)
+	notifier := newFakePushNotifier()
+	hub.SetPushNotifier(notifier)
+
+	clients[1].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 2}))
+	nextEvent(t, clients[2], EventCallOffer)
+	clients[2].handleCallReject(testEvent(t, map[string]interface{}{"type": EventCallReject, "receiver_id": 1}))
+	nextEvent(t, clients[2], "message")
+
+	select {
+	case call := <-notifier.calls:
+		t.Errorf("Pushed a call to an online callee: %+v", call)
+	case call := <-notifier.missed:
+		t.Errorf("Pushed a declined call as missed: %+v", call)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRejectedCall(t *testing.T) {
+	_, _, clients := callTestHub(t, 2)
+
+	clients[1].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 2}))
+	nextEvent(t, clients[2], EventCallOffer)
+	if _, err := clients[2].handleCallReject(testEvent(t, map[string]interface{}{"type": EventCallReject, "receiver_id": 1})); err != nil {
+		t.Fatalf("Reject failed: %v", err)
+	}
+
+	if ended := nextCallState(t, clients[1], CallEnded); ended.EndReason != OutcomeDeclined {
+		t.Errorf("Expected declined call, got %+v", ended)
+	}
+	nextEvent(t, clients[1], EventCallReject)
+	if entry := nextEvent(t, clients[2], "message"); entry.Call == nil || entry.Call.Outcome != OutcomeDeclined {
+		t.Errorf("Expected declined entry, got %+v", entry)
+	}
+}
+
+func TestGroupCall(t *testing.T) {
+	_, db, clients := callTestHub(t, 4)
+
+	if _, err := clients[1].handleCallInvite(testEvent(t, map[string]interface{}{
+		"type": EventCallInvite, "receiver_ids": []int{2, 3}, "kind": CallAudio,
+	})); err != nil {
+		t.Fatalf("Invite failed: %v", err)
+	}
+	ring := nextEvent(t, clients[2], FrameCallRing)
+	nextEvent(t, clients[3], FrameCallRing)
+	callID := ring.CallID
+	if ring.SenderID != 1 || len(ring.Session.Participants) != 3 {
+		t.Fatalf("Unexpected ring: %+v", ring)
+	}
+
+	for _, id := range []int{2, 3} {
+		if _, err := clients[id].handleCallJoin(testEvent(t, map[string]interface{}{"type": EventCallJoin, "call_id": callID})); err != nil {
+			t.Fatalf("Join failed: %v", err)
+		}
+	}
+	state := nextCallState(t, clients[1], CallActive)
+	for state.participant(3).State != participantJoined {
+		state = nextCallState(t, clients[1], CallActive)
+	}
+
+	// Members connect to each other directly; outsiders are refused
+	clients[2].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "call_id": callID, "receiver_id": 3}))
+	if offer := nextEvent(t, clients[3], EventCallOffer); offer.SenderID != 2 || offer.CallID != callID {
+		t.Errorf("Unexpected offer: %+v", offer)
+	}
+	_, err := clients[2].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "call_id": callID, "receiver_id": 4}))
+	if eventErr, ok := err.(*EventError); !ok || eventErr.Code != CodeNotFound {
+		t.Errorf("Expected %s for an outsider, got %v", CodeNotFound, err)
+	}
+
+	// The call goes on until one member is left
+	clients[1].handleCallHangup(testEvent(t, map[string]interface{}{"type": EventCallHangup, "call_id": callID}))
+	nextEvent(t, clients[2], EventCallHangup)
+	if state := nextCallState(t, clients[2], CallActive); state.participant(1).State != participantLeft {
+		t.Errorf("Expected caller to have left, got %+v", state)
+	}
+	clients[3].handleCallHangup(testEvent(t, map[string]interface{}{"type": EventCallHangup, "call_id": callID}))
+	nextCallState(t, clients[2], CallEnded)
+
+	var entries int
+	db.QueryRow("SELECT COUNT(*) FROM messages WHERE call_id = $1 AND sender_id = 1", callID).Scan(&entries)
+	if entries != 2 {
+		t.Errorf("Expected a history entry per invitee, got %d", entries)
+	}
+}
+
+func TestRecallAfterDecliningGroupCall(t *testing.T) {
+	_, _, clients := callTestHub(t, 4)
+
+	clients[1].handleCallInvite(testEvent(t, map[string]interface{}{"type": EventCallInvite, "receiver_ids": []int{2, 3, 4}}))
+	callID := nextEvent(t, clients[2], FrameCallRing).CallID
+	for _, id := range []int{3, 4} {
+		clients[id].handleCallJoin(testEvent(t, map[string]interface{}{"type": EventCallJoin, "call_id": callID}))
+	}
+	clients[2].handleCallReject(testEvent(t, map[string]interface{}{"type": EventCallReject, "call_id": callID}))
+	clients[3].handleCallHangup(testEvent(t, map[string]interface{}{"type": EventCallHangup, "call_id": callID}))
+	state := nextCallState(t, clients[1], CallActive)
+	for state.participant(2).State != participantDeclined || state.participant(3).State != participantLeft {
+		state = nextCallState(t, clients[1], CallActive)
+	}
+
+	// Neither is in the group call any more, so this is a new call
+	if _, err := clients[2].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 3})); err != nil {
+		t.Fatalf("Offer after declining failed: %v", err)
+	}
+	if offer := nextEvent(t, clients[3], EventCallOffer); offer.SenderID != 2 || offer.CallID == callID {
+		t.Errorf("Expected an offer in a new call, got %+v", offer)
+	}
+}
+
+func TestDroppedParticipantLeavesCall(t *testing.T) {
+	hub, _, clients := callTestHub(t, 2)
+	hub.rejoinGrace = 50 * time.Millisecond
+
+	clients[1].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 2}))
+	clients[2].handleCallAnswer(testEvent(t, map[string]interface{}{"type": EventCallAnswer, "receiver_id": 1}))
+	nextCallState(t, clients[1], CallActive)
+
+	hub.unregister <- clients[2]
+	if ended := nextCallState(t, clients[1], CallEnded); ended.EndReason != OutcomeCompleted {
+		t.Errorf("Expected the call to end, got %+v", ended)
+	}
+}
+
+func TestBlockedCalleeIsNotRung(t *testing.T) {
+	hub, db, clients := callTestHub(t, 2)
+	hub.ringTimeout = 50 * time.Millisecond
+	db.Exec("INSERT INTO user_blocks (blocker_id, blocked_id) VALUES (2, 1)")
+
+	clients[1].handleCallOffer(testEvent(t, map[string]interface{}{"type": EventCallOffer, "receiver_id": 2}))
+	nextCallState(t, clients[1], CallEnded)
+	time.Sleep(20 * time.Millisecond)
+
+	for len(clients[2].send) > 0 {
+		t.Errorf("Blocker received %+v", <-clients[2].send)
+	}
+	var hidden int
+	db.QueryRow("SELECT hidden FROM messages WHERE call_id IS NOT NULL").Scan(&hidden)
+	if hidden != 1 {
+		t.Errorf("Expected the missed call entry to be hidden, got hidden=%d", hidden)
+	}
+}
@@ -0,0 +1,173 @@
+package ws
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// presenceInterval is how often a node republishes its connected users
+	presenceInterval = 10 * time.Second
+	// presenceTTL forgets a node that stopped publishing, e.g. after a crash
+	presenceTTL = 3 * presenceInterval
+)
+
+// remoteNode is the presence last published by another node.
+type remoteNode struct {
+	users map[int]struct{}
+	seen  time.Time
+}
+
+// SetBroker joins the hub to other nodes sharing broker. Call before Run.
+func (h *Hub) SetBroker(broker Broker) error {
+	h.broker = broker
+	h.outgoing = make(chan *Envelope, 1024)
+	h.published = make(chan struct{})
+
+	// Publishing happens on its own goroutine so a slow broker never stalls
+	// Run; a single goroutine keeps envelopes in order. It stops after the
+	// leave envelope Close queues.
+	go func() {
+		defer close(h.published)
+		for env := range h.outgoing {
+			if err := broker.Publish(env); err != nil {
+				log.Printf("Failed to publish %s envelope: %v", env.Kind, err)
+			}
+			if env.Kind == envelopeLeave {
+				return
+			}
+		}
+	}()
+
+	if err := broker.Subscribe(func(env *Envelope) {
+		if env.Node != h.nodeID {
+			h.inbound <- env
+		}
+	}); err != nil {
+		return err
+	}
+
+	// Announce ourselves; the other nodes answer with their snapshots
+	h.mu.RLock()
+	h.publishSnapshotLocked()
+	h.mu.RUnlock()
+	return nil
+}
+
+// Close tells the other nodes this node's users are gone. The leave envelope
+// follows everything already queued, so no later presence undoes it, and the
+// broker is closed once it has been published.
+func (h *Hub) Close() error {
+	if h.broker == nil {
+		return nil
+	}
+	var err error
+	h.closeOnce.Do(func() {
+		h.outgoing <- &Envelope{Node: h.nodeID, Kind: envelopeLeave}
+		<-h.published
+		err = h.broker.Close()
+	})
+	return err
+}
+
+// publish hands env to the broker without blocking the caller, which may
+// hold h.mu.
+func (h *Hub) publish(env *Envelope) {
+	if h.broker == nil {
+		return
+	}
+	env.Node = h.nodeID
+	select {
+	case h.outgoing <- env:
+	default:
+		log.Printf("Broker queue is full, dropping %s envelope", env.Kind)
+	}
+}
+
+// publishSnapshotLocked publishes every locally connected user. h.mu must
+// be held.
+func (h *Hub) publishSnapshotLocked() {
+	users := make([]int, 0, len(h.clients))
+	for userID := range h.clients {
+		users = append(users, userID)
+	}
+	h.publish(&Envelope{Kind: envelopeSnapshot, Users: users})
+}
+
+// handleEnvelope applies traffic from another node. Runs on the Run goroutine.
+func (h *Hub) handleEnvelope(env *Envelope) {
+	switch env.Kind {
+	case envelopeEvent:
+		if env.Event == nil {
+			return
+		}
+		// Copy: the same envelope may be shared by other in-process hubs
+		event := *env.Event
+		event.senderOnly = env.SenderOnly
+		h.deliverLocal(&event)
+
+	case envelopePresence, envelopeSnapshot:
+		h.mu.Lock()
+		node, known := h.remote[env.Node]
+		if !known {
+			node = &remoteNode{users: make(map[int]struct{})}
+			h.remote[env.Node] = node
+			// A node we have not heard from yet needs our users too
+			h.publishSnapshotLocked()
+		}
+		node.seen = time.Now()
+		if env.Kind == envelopeSnapshot {
+			node.users = make(map[int]struct{}, len(env.Users))
+			for _, userID := range env.Users {
+				node.users[userID] = struct{}{}
+			}
+		} else if env.Online {
+			node.users[env.UserID] = struct{}{}
+		} else {
+			delete(node.users, env.UserID)
+		}
+		// Users who connected to that node are replayed from its outbox;
+		// ours would only repeat what they already got there
+		for userID := range node.users {
+			if _, ok := h.clients[userID]; !ok {
+				delete(h.outboxes, userID)
+			}
+		}
+		h.mu.Unlock()
+
+	case envelopeDisconnect:
+		h.disconnectLocal(env.UserID)
+
+	case envelopeLeave:
+		h.mu.Lock()
+		delete(h.remote, env.Node)
+		h.mu.Unlock()
+	}
+}
+
+// refreshPresence republishes local users and forgets silent nodes.
+func (h *Hub) refreshPresence() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.publishSnapshotLocked()
+	for id, node := range h.remote {
+		if time.Since(node.seen) > presenceTTL {
+			log.Printf("Node %s stopped publishing presence", id)
+			delete(h.remote, id)
+		}
+	}
+}
+
+// onlineElsewhereLocked reports whether another live node has the user
+// connected. h.mu must be held.
+func (h *Hub) onlineElsewhereLocked(userID int) bool {
+	for _, node := range h.remote {
+		if time.Since(node.seen) > presenceTTL {
+			continue
+		}
+		if _, ok := node.users[userID]; ok {
+			return true
+		}
+	}
+	return false
+}
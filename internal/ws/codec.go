@@ -0,0 +1,63 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Subprotocols a client may request in Sec-WebSocket-Protocol. Without one,
+// frames are JSON text.
+const (
+	SubprotocolJSON    = "payambar.v1.json"
+	SubprotocolMsgpack = "payambar.v1.msgpack"
+)
+
+// codec encodes frames for one subprotocol. Both codecs use the json struct
+// tags, so field names are identical on the wire.
+type codec interface {
+	messageType() int
+	marshal(v interface{}) ([]byte, error)
+	unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) messageType() int { return websocket.TextMessage }
+
+func (jsonCodec) marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec carries the same frames as MessagePack binary messages, which
+// keeps ciphertext-heavy traffic small.
+type msgpackCodec struct{}
+
+func (msgpackCodec) messageType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// codecFor returns the codec of a negotiated subprotocol.
+func codecFor(subprotocol string) codec {
+	if subprotocol == SubprotocolMsgpack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
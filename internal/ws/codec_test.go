@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// roundTrip encodes frame with c and decodes it into a new value of its type,
+// then renders that as JSON so both codecs can be compared.
+func roundTrip(t *testing.T, c codec, frame interface{}) string {
+	t.Helper()
+	data, err := c.marshal(frame)
+	if err != nil {
+		t.Fatalf("%T: marshal failed: %v", c, err)
+	}
+	decoded := reflect.New(reflect.TypeOf(frame).Elem()).Interface()
+	if err := c.unmarshal(data, decoded); err != nil {
+		t.Fatalf("%T: unmarshal failed: %v", c, err)
+	}
+	// Timestamps compare as instants; msgpack decodes them in the local zone
+	if event, ok := decoded.(*MessageEvent); ok {
+		event.CreatedAt = event.CreatedAt.UTC()
+		for _, at := range []*time.Time{event.DeliveredAt, event.ReadAt} {
+			if at != nil {
+				*at = at.UTC()
+			}
+		}
+	}
+	rendered, _ := json.Marshal(decoded)
+	return string(rendered)
+}
+
+func TestCodecConformance(t *testing.T) {
+	created := time.Date(2026, 1, 25, 10, 30, 0, 0, time.UTC)
+	frames := []interface{}{
+		&MessageEvent{
+			Type:           "message",
+			MessageID:      123,
+			ClientMsgID:    "client-1",
+			SenderID:       1,
+			ReceiverID:     2,
+			Encrypted:      true,
+			E2EEVersion:    1,
+			Algorithm:      "ECDH-P256/AES-GCM",
+			SenderDeviceID: "device",
+			KeyID:          "key",
+			IV:             "aXY=",
+			Ciphertext:     "Y2lwaGVydGV4dA==",
+			Status:         "sent",
+			CreatedAt:      created,
+			DeliveredAt:    &created,
+			Seq:            1 << 40,
+		},
+		&MessageEvent{Type: "call_offer", SenderID: 1, ReceiverID: 2, Payload: map[string]interface{}{"sdp": "v=0", "port": 3478.0}},
+		&AckFrame{Type: FrameAck, V: ProtocolVersion, RequestID: "r", MessageID: 7, ClientMsgID: "c"},
+		&ErrorFrame{Type: FrameError, V: ProtocolVersion, RequestID: "r", Code: CodeNotFound, Error: "message not found"},
+		&HelloFrame{Type: FrameHello, V: ProtocolVersion, Epoch: "9f2c4a1b7d3e8f60"},
+	}
+
+	for _, frame := range frames {
+		fromJSON := roundTrip(t, jsonCodec{}, frame)
+		fromMsgpack := roundTrip(t, msgpackCodec{}, frame)
+		if fromJSON != fromMsgpack {
+			t.Errorf("%T differs between encodings:\njson:    %s\nmsgpack: %s", frame, fromJSON, fromMsgpack)
+		}
+	}
+}
+
+func TestCodecClientEventConformance(t *testing.T) {
+	fields := map[string]interface{}{
+		"type":              EventMessage,
+		"v":                 ProtocolVersion,
+		"request_id":        "r",
+		"client_message_id": "c",
+		"receiver_id":       2,
+		"content":           "hello",
+	}
+
+	var payloads []MessagePayload
+	var events []Event
+	for _, c := range []codec{jsonCodec{}, msgpackCodec{}} {
+		data, err := c.marshal(fields)
+		if err != nil {
+			t.Fatalf("%T: marshal failed: %v", c, err)
+		}
+		event, err := decodeEvent(c, data)
+		if err != nil {
+			t.Fatalf("%T: decode failed: %v", c, err)
+		}
+		var p MessagePayload
+		if err := event.Decode(&p); err != nil {
+			t.Fatalf("%T: payload decode failed: %v", c, err)
+		}
+		event.raw, event.codec = nil, nil
+		events = append(events, *event)
+		payloads = append(payloads, p)
+	}
+
+	if !reflect.DeepEqual(events[0], events[1]) || payloads[0] != payloads[1] {
+		t.Fatalf("Encodings decode differently: %+v %+v / %+v %+v", events[0], payloads[0], events[1], payloads[1])
+	}
+}
+
+func TestMsgpackSubprotocol(t *testing.T) {
+	conn := dialTestHub(t, SubprotocolMsgpack)
+	if conn.Subprotocol() != SubprotocolMsgpack {
+		t.Fatalf("Negotiated %q, want %q", conn.Subprotocol(), SubprotocolMsgpack)
+	}
+
+	readBinary := func(v interface{}) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("Got message type %d, want binary", messageType)
+		}
+		if err := (msgpackCodec{}).unmarshal(data, v); err != nil {
+			t.Fatalf("Failed to decode frame: %v", err)
+		}
+	}
+
+	var hello HelloFrame
+	readBinary(&hello)
+	if hello.Type != FrameHello || hello.Epoch == "" {
+		t.Fatalf("Unexpected hello: %+v", hello)
+	}
+
+	data, _ := (msgpackCodec{}).marshal(map[string]interface{}{
+		"type":        EventMessage,
+		"request_id":  "r",
+		"receiver_id": 2,
+		"content":     "packed",
+	})
+	conn.WriteMessage(websocket.BinaryMessage, data)
+
+	var echo MessageEvent
+	readBinary(&echo)
+	if echo.Type != "message" || echo.Content != "packed" || echo.Seq == 0 {
+		t.Fatalf("Unexpected echo: %+v", echo)
+	}
+	var ack AckFrame
+	readBinary(&ack)
+	if ack.Type != FrameAck || ack.RequestID != "r" || ack.MessageID != echo.MessageID {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+}
+
+func TestDefaultSubprotocolIsJSON(t *testing.T) {
+	conn := dialTestHub(t)
+	if conn.Subprotocol() != "" {
+		t.Fatalf("Negotiated %q without asking", conn.Subprotocol())
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if messageType, _, err := conn.ReadMessage(); err != nil || messageType != websocket.TextMessage {
+		t.Fatalf("Expected a JSON text frame, got type %d, err %v", messageType, err)
+	}
+}
@@ -0,0 +1,185 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+const (
+	// maxPendingEvents bounds each user's unacknowledged events; the oldest
+	// are dropped first and have to be refetched over REST
+	maxPendingEvents = 500
+	// pendingEventTTL drops events nobody acknowledged in time
+	pendingEventTTL = 24 * time.Hour
+	// outboxPruneInterval is how often expired events are dropped and the
+	// outboxes of disconnected users with nothing pending are evicted
+	outboxPruneInterval = time.Minute
+)
+
+// HelloFrame opens every connection. Sequence numbers are only comparable
+// within one epoch; a new epoch means the client must reset its last seq.
+type HelloFrame struct {
+	Type  string `json:"type"`
+	V     int    `json:"v"`
+	Epoch string `json:"epoch"`
+}
+
+// outbox holds a user's sequenced events until the client acknowledges them.
+type outbox struct {
+	userID  int
+	epoch   string
+	nextSeq uint64
+	pending []pendingEvent
+}
+
+type pendingEvent struct {
+	event    *MessageEvent
+	queuedAt time.Time
+}
+
+func newOutbox(userID int) *outbox {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return &outbox{userID: userID, epoch: hex.EncodeToString(raw)}
+}
+
+// push assigns the next sequence number to a copy of msg and queues it.
+func (b *outbox) push(msg *MessageEvent) *MessageEvent {
+	event := *msg
+	b.nextSeq++
+	event.Seq = b.nextSeq
+
+	now := time.Now()
+	b.pending = append(b.pending, pendingEvent{event: &event, queuedAt: now})
+	b.prune(now)
+
+	return &event
+}
+
+// prune drops events past pendingEventTTL and the oldest beyond
+// maxPendingEvents.
+func (b *outbox) prune(now time.Time) {
+	drop := 0
+	for drop < len(b.pending) && (len(b.pending)-drop > maxPendingEvents || now.Sub(b.pending[drop].queuedAt) > pendingEventTTL) {
+		drop++
+	}
+	if drop > 0 {
+		log.Printf("Dropped %d unacknowledged events for user %d", drop, b.userID)
+		b.pending = append([]pendingEvent(nil), b.pending[drop:]...)
+	}
+}
+
+// ack drops every event up to and including seq.
+func (b *outbox) ack(seq uint64) {
+	i := 0
+	for i < len(b.pending) && b.pending[i].event.Seq <= seq {
+		i++
+	}
+	b.pending = b.pending[i:]
+}
+
+// outboxLocked returns userID's outbox, creating it. h.mu must be held.
+func (h *Hub) outboxLocked(userID int) *outbox {
+	box, ok := h.outboxes[userID]
+	if !ok {
+		box = newOutbox(userID)
+		h.outboxes[userID] = box
+	}
+	return box
+}
+
+// outboxEpoch returns the epoch of userID's outbox for the hello frame.
+func (h *Hub) outboxEpoch(userID int) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.outboxLocked(userID).epoch
+}
+
+// ownedOutboxLocked returns the outbox userID's events are queued in on this
+// node, or nil if the user is connected to another node, which queues them
+// in its own epoch. Users connected nowhere get an outbox on every node, so
+// whichever node they reconnect to can replay what they missed. h.mu must be
+// held for writing.
+func (h *Hub) ownedOutboxLocked(userID int) *outbox {
+	if _, ok := h.clients[userID]; !ok && h.onlineElsewhereLocked(userID) {
+		delete(h.outboxes, userID)
+		return nil
+	}
+	return h.outboxLocked(userID)
+}
+
+// deliverLocked queues msg for userID unless the user is connected to
+// another node and sends it if the user is connected here. It reports whether the event
+// reached a live connection. h.mu must be held for writing.
+func (h *Hub) deliverLocked(userID int, msg *MessageEvent) bool {
+	box := h.ownedOutboxLocked(userID)
+	if box == nil {
+		return false
+	}
+	event := box.push(msg)
+	client, ok := h.clients[userID]
+	if !ok {
+		return false
+	}
+	return h.sendLocked(client, event)
+}
+
+// pruneOutboxes drops expired events and evicts the outboxes of users who
+// are not connected here and have nothing left pending or moved to another
+// node. An outbox is created again with a new epoch when an event arrives
+// for them, so nothing sent while they are away is lost.
+func (h *Hub) pruneOutboxes() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for userID, box := range h.outboxes {
+		box.prune(now)
+		if _, ok := h.clients[userID]; ok {
+			continue
+		}
+		if len(box.pending) == 0 || h.onlineElsewhereLocked(userID) {
+			delete(h.outboxes, userID)
+		}
+	}
+}
+
+// sendLocked writes a frame to the client's buffer. A client that cannot keep
+// up is disconnected instead of losing the frame; its unacknowledged events
+// are replayed when it reconnects. h.mu must be held for writing.
+func (h *Hub) sendLocked(client *Client, frame interface{}) bool {
+	select {
+	case client.send <- frame:
+		return true
+	default:
+		log.Printf("Disconnecting slow consumer: user %d", client.userID)
+		h.removeLocked(client)
+		return false
+	}
+}
+
+// replayLocked sends the client every queued event newer than the last
+// sequence number it reported. The outbox is created if needed, since this
+// node now owns the user's session. h.mu must be held for writing.
+func (h *Hub) replayLocked(client *Client) {
+	box := h.outboxLocked(client.userID)
+	if client.epoch == box.epoch {
+		box.ack(client.lastSeq)
+	}
+	for _, pending := range box.pending {
+		if !h.sendLocked(client, pending.event) {
+			return
+		}
+	}
+}
+
+// ackEvents drops the user's events up to seq.
+func (h *Hub) ackEvents(userID int, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if box, ok := h.outboxes[userID]; ok {
+		box.ack(seq)
+	}
+}
@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxSequenceAndAck(t *testing.T) {
+	box := newOutbox(1)
+	for i := 0; i < 3; i++ {
+		if event := box.push(&MessageEvent{Type: "message", MessageID: i}); event.Seq != uint64(i+1) {
+			t.Fatalf("push %d got seq %d", i, event.Seq)
+		}
+	}
+
+	box.ack(2)
+	if len(box.pending) != 1 || box.pending[0].event.Seq != 3 {
+		t.Fatalf("pending after ack = %+v", box.pending)
+	}
+}
+
+func TestOutboxBounded(t *testing.T) {
+	box := newOutbox(1)
+	for i := 0; i < maxPendingEvents+10; i++ {
+		box.push(&MessageEvent{Type: "message"})
+	}
+	if len(box.pending) != maxPendingEvents {
+		t.Fatalf("pending = %d, want %d", len(box.pending), maxPendingEvents)
+	}
+	if box.pending[0].event.Seq != 11 {
+		t.Fatalf("oldest seq = %d, want 11", box.pending[0].event.Seq)
+	}
+}
+
+// drainMessages returns the seqs of message events waiting in send.
+func drainMessages(client *Client) []uint64 {
+	var seqs []uint64
+	for {
+		select {
+		case frame, ok := <-client.send:
+			if !ok {
+				return seqs
+			}
+			if msg, ok := frame.(*MessageEvent); ok && msg.Type == "message" {
+				seqs = append(seqs, msg.Seq)
+			}
+		default:
+			return seqs
+		}
+	}
+}
+
+func TestOfflineEventsReplayedOnConnect(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	go hub.Run()
+
+	for i := 1; i <= 2; i++ {
+		hub.BroadcastMessage(i, 1, 2, "while offline", "sent", "", "", "")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	epoch := hub.outboxEpoch(2)
+	first := &Client{userID: 2, hub: hub, send: make(chan interface{}, 256)}
+	hub.register <- first
+	time.Sleep(20 * time.Millisecond)
+
+	if seqs := drainMessages(first); len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Fatalf("replayed seqs = %v, want [1 2]", seqs)
+	}
+
+	// Reconnecting after seeing seq 1 only replays seq 2
+	hub.unregister <- first
+	second := &Client{userID: 2, hub: hub, send: make(chan interface{}, 256), epoch: epoch, lastSeq: 1}
+	hub.register <- second
+	time.Sleep(20 * time.Millisecond)
+
+	if seqs := drainMessages(second); len(seqs) != 1 || seqs[0] != 2 {
+		t.Fatalf("replayed seqs = %v, want [2]", seqs)
+	}
+
+	// After an ack nothing is replayed; a stale epoch does not ack anything
+	second.handleEvent([]byte(`{"type":"ack","seq":2}`))
+	hub.unregister <- second
+	third := &Client{userID: 2, hub: hub, send: make(chan interface{}, 256), epoch: "stale", lastSeq: 99}
+	hub.register <- third
+	time.Sleep(20 * time.Millisecond)
+
+	if frames := len(third.send); frames != 0 {
+		t.Fatalf("got %d frames after ack, want none", frames)
+	}
+}
+
+func TestSlowConsumerDisconnected(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	go hub.Run()
+
+	slow := &Client{userID: 2, hub: hub, send: make(chan interface{}, 1)}
+	hub.register <- slow
+	time.Sleep(10 * time.Millisecond)
+
+	hub.BroadcastMessage(1, 1, 2, "fits", "sent", "", "", "")
+	hub.BroadcastMessage(2, 1, 2, "overflows", "sent", "", "", "")
+	time.Sleep(20 * time.Millisecond)
+
+	if hub.IsUserOnline(2) {
+		t.Fatal("slow consumer was not disconnected")
+	}
+	<-slow.send
+	if _, ok := <-slow.send; ok {
+		t.Fatal("slow consumer's send channel should be closed")
+	}
+
+	// Nothing was lost: both events come back on reconnect
+	again := &Client{userID: 2, hub: hub, send: make(chan interface{}, 256)}
+	hub.register <- again
+	time.Sleep(20 * time.Millisecond)
+
+	if seqs := drainMessages(again); len(seqs) != 2 {
+		t.Fatalf("replayed seqs = %v, want 2 events", seqs)
+	}
+}
+
+func TestIdleOutboxesEvicted(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.clients[1] = &Client{userID: 1, hub: hub, send: make(chan interface{}, 256)}
+	hub.mu.Lock()
+	hub.outboxLocked(1)
+	hub.outboxLocked(2)
+	hub.deliverLocked(3, &MessageEvent{Type: "message"})
+	hub.deliverLocked(4, &MessageEvent{Type: "message"})
+	hub.outboxes[4].pending[0].queuedAt = time.Now().Add(-pendingEventTTL - time.Second)
+	hub.mu.Unlock()
+
+	hub.pruneOutboxes()
+
+	if _, ok := hub.outboxes[1]; !ok {
+		t.Fatal("a connected user's outbox should be kept")
+	}
+	if _, ok := hub.outboxes[2]; ok {
+		t.Fatal("an empty outbox of a disconnected user should be evicted")
+	}
+	if box, ok := hub.outboxes[3]; !ok || len(box.pending) != 1 {
+		t.Fatal("an outbox with pending events should be kept")
+	}
+	if _, ok := hub.outboxes[4]; ok {
+		t.Fatal("an outbox whose events all expired should be evicted")
+	}
+}
@@ -0,0 +1,293 @@
+package ws
+
+import (
+	"errors"
+
+	"github.com/4xmen/payambar/internal/conversation"
+)
+
+// ProtocolVersion is the version of the WebSocket event schema documented in
+// DEVELOPMENT.md. Clients may send it as "v"; newer versions are rejected.
+const ProtocolVersion = 1
+
+// maxClientMessageIDLength bounds the client-chosen idempotency key
+const maxClientMessageIDLength = 64
+
+// maxEventSize is the default bound on a single client frame
+const maxEventSize = 64 << 10
+
+// Client → server event types
+const (
+	EventMessage       = "message"
+	EventMarkDelivered = "mark_delivered"
+	EventMarkRead      = "mark_read"
+	EventCallOffer     = "call_offer"
+	EventCallAnswer    = "call_answer"
+	EventIceCandidate  = "ice_candidate"
+	EventCallReject    = "call_reject"
+	EventCallHangup    = "call_hangup"
+	EventCallInvite    = "call_invite"
+	EventCallJoin      = "call_join"
+	EventAck           = "ack"
+)
+
+// Server → client frame types
+const (
+	FrameMessage        = "message"
+	FrameStatusUpdate   = "status_update"
+	FrameAck            = "ack"
+	FrameError          = "error"
+	FrameSessionRevoked = "session_revoked"
+	FrameHello          = "hello"
+	FrameCallRing       = "call_ring"
+	FrameCallState      = "call_state"
+)
+
+// Error codes carried by error frames
+const (
+	CodeInvalidJSON        = "invalid_json"
+	CodeUnsupportedVersion = "unsupported_version"
+	CodeUnknownEvent       = "unknown_event"
+	CodeInvalidPayload     = "invalid_payload"
+	CodeSelf               = "self"
+	CodeUnknownReceiver    = "unknown_receiver"
+	CodeNoConversation     = "no_conversation"
+	CodeBlocked            = "blocked"
+	CodeNotFound           = "not_found"
+	CodeBusy               = "busy"
+	CodeInternal           = "internal"
+)
+
+// Event is a decoded client frame. The fields every event shares are decoded
+// up front; handlers read their own fields with Decode.
+type Event struct {
+	Type        string `json:"type"`
+	V           int    `json:"v"`
+	RequestID   string `json:"request_id"`
+	ClientMsgID string `json:"client_message_id"`
+
+	raw   []byte
+	codec codec
+}
+
+// Decode reads the event's type-specific fields into v.
+func (e *Event) Decode(v interface{}) error {
+	if err := e.codec.unmarshal(e.raw, v); err != nil {
+		return newEventError(CodeInvalidPayload, "invalid event payload")
+	}
+	return nil
+}
+
+// decodeEvent parses a client frame. On a payload error the returned event
+// still carries whatever common fields could be read, for the error frame.
+func decodeEvent(codec codec, data []byte) (*Event, error) {
+	event := &Event{raw: data, codec: codec}
+	if err := codec.unmarshal(data, event); err != nil {
+		// A well-formed object with mistyped fields is a payload error
+		var object map[string]interface{}
+		if codec.unmarshal(data, &object) == nil && object != nil {
+			return event, newEventError(CodeInvalidPayload, "invalid event payload")
+		}
+		return nil, newEventError(CodeInvalidJSON, "invalid event")
+	}
+	if event.V > ProtocolVersion {
+		return event, newEventError(CodeUnsupportedVersion, "unsupported protocol version")
+	}
+	return event, nil
+}
+
+// MessagePayload is the body of a "message" event.
+type MessagePayload struct {
+	ReceiverID     int    `json:"receiver_id"`
+	ClientMsgID    string `json:"client_message_id"`
+	Content        string `json:"content"`
+	Encrypted      bool   `json:"encrypted"`
+	E2EEVersion    int    `json:"e2ee_v"`
+	Algorithm      string `json:"alg"`
+	SenderDeviceID string `json:"sender_device_id"`
+	KeyID          string `json:"key_id"`
+	IV             string `json:"iv"`
+	Ciphertext     string `json:"ciphertext"`
+	AAD            string `json:"aad"`
+}
+
+func (p *MessagePayload) validate() error {
+	if p.ReceiverID <= 0 {
+		return newEventError(CodeInvalidPayload, "receiver_id required")
+	}
+	if p.Encrypted {
+		if p.E2EEVersion <= 0 || p.Algorithm == "" || p.SenderDeviceID == "" || p.KeyID == "" || p.IV == "" || p.Ciphertext == "" {
+			return newEventError(CodeInvalidPayload, "invalid encrypted payload")
+		}
+		// Ciphertext replaces the content; never store both
+		p.Content = ""
+	} else if p.Content == "" {
+		return newEventError(CodeInvalidPayload, "content required")
+	} else {
+		// Plaintext messages carry no encryption metadata
+		*p = MessagePayload{ReceiverID: p.ReceiverID, ClientMsgID: p.ClientMsgID, Content: p.Content}
+	}
+	if len(p.ClientMsgID) > maxClientMessageIDLength {
+		return newEventError(CodeInvalidPayload, "client_message_id too long")
+	}
+	return nil
+}
+
+// StatusPayload is the body of "mark_delivered" and "mark_read" events.
+type StatusPayload struct {
+	MessageID int `json:"message_id"`
+}
+
+func (p *StatusPayload) validate() error {
+	if p.MessageID <= 0 {
+		return newEventError(CodeInvalidPayload, "message_id required")
+	}
+	return nil
+}
+
+// SignalingPayload is the body of call signaling events; Payload is relayed
+// to the receiver untouched. Without call_id, call_offer starts a one-to-one
+// call and the other events apply to the call shared with the receiver.
+type SignalingPayload struct {
+	CallID     int                    `json:"call_id"`
+	ReceiverID int                    `json:"receiver_id"`
+	Kind       string                 `json:"kind"`
+	Payload    map[string]interface{} `json:"payload"`
+}
+
+func (p *SignalingPayload) validate() error {
+	if p.ReceiverID <= 0 && p.CallID <= 0 {
+		return newEventError(CodeInvalidPayload, "receiver_id required")
+	}
+	if p.CallID < 0 {
+		return newEventError(CodeInvalidPayload, "invalid call_id")
+	}
+	return validateCallKind(p.Kind)
+}
+
+// CallInvitePayload is the body of a "call_invite" event, which rings
+// several users at once.
+type CallInvitePayload struct {
+	ReceiverIDs []int  `json:"receiver_ids"`
+	Kind        string `json:"kind"`
+}
+
+func (p *CallInvitePayload) validate() error {
+	if len(p.ReceiverIDs) == 0 {
+		return newEventError(CodeInvalidPayload, "receiver_ids required")
+	}
+	if len(p.ReceiverIDs) >= maxCallParticipants {
+		return newEventError(CodeInvalidPayload, "too many call participants")
+	}
+	seen := make(map[int]bool, len(p.ReceiverIDs))
+	for _, id := range p.ReceiverIDs {
+		if id <= 0 || seen[id] {
+			return newEventError(CodeInvalidPayload, "invalid receiver_ids")
+		}
+		seen[id] = true
+	}
+	return validateCallKind(p.Kind)
+}
+
+// CallPayload is the body of a "call_join" event.
+type CallPayload struct {
+	CallID int `json:"call_id"`
+}
+
+func (p *CallPayload) validate() error {
+	if p.CallID <= 0 {
+		return newEventError(CodeInvalidPayload, "call_id required")
+	}
+	return nil
+}
+
+func validateCallKind(kind string) error {
+	if kind != "" && kind != CallAudio && kind != CallVideo {
+		return newEventError(CodeInvalidPayload, "invalid call kind")
+	}
+	return nil
+}
+
+// AckPayload is the body of an "ack" event.
+type AckPayload struct {
+	Seq *uint64 `json:"seq"`
+}
+
+func (p *AckPayload) validate() error {
+	if p.Seq == nil {
+		return newEventError(CodeInvalidPayload, "seq required")
+	}
+	return nil
+}
+
+// AckFrame confirms a client event that carried a request_id.
+type AckFrame struct {
+	Type        string `json:"type"`
+	V           int    `json:"v"`
+	RequestID   string `json:"request_id"`
+	MessageID   int    `json:"message_id,omitempty"`
+	ClientMsgID string `json:"client_message_id,omitempty"`
+}
+
+// ErrorFrame reports a rejected client event. It is sent whether or not the
+// event carried a request_id; Error is translated for display.
+type ErrorFrame struct {
+	Type        string `json:"type"`
+	V           int    `json:"v"`
+	RequestID   string `json:"request_id,omitempty"`
+	ClientMsgID string `json:"client_message_id,omitempty"`
+	Code        string `json:"code"`
+	Error       string `json:"error"`
+}
+
+// EventError is returned by event handlers to reject a client event.
+type EventError struct {
+	Code    string
+	Message string
+}
+
+func (e *EventError) Error() string {
+	return e.Message
+}
+
+func newEventError(code, message string) *EventError {
+	return &EventError{Code: code, Message: message}
+}
+
+func isEventError(err error) bool {
+	var eventErr *EventError
+	return errors.As(err, &eventErr)
+}
+
+// errorFrame builds the frame for err. Errors other than EventError are
+// reported as internal without leaking their text.
+func errorFrame(requestID, clientMsgID string, err error) *ErrorFrame {
+	var eventErr *EventError
+	if !errors.As(err, &eventErr) {
+		eventErr = newEventError(CodeInternal, "failed to process event")
+	}
+	return &ErrorFrame{
+		Type:        FrameError,
+		V:           ProtocolVersion,
+		RequestID:   requestID,
+		ClientMsgID: clientMsgID,
+		Code:        eventErr.Code,
+		Error:       __(eventErr.Message),
+	}
+}
+
+// accessError maps conversation authorization failures to event errors.
+func accessError(err error) error {
+	switch {
+	case errors.Is(err, conversation.ErrSelf):
+		return newEventError(CodeSelf, err.Error())
+	case errors.Is(err, conversation.ErrUnknownReceiver):
+		return newEventError(CodeUnknownReceiver, err.Error())
+	case errors.Is(err, conversation.ErrNoConversation):
+		return newEventError(CodeNoConversation, err.Error())
+	case errors.Is(err, conversation.ErrBlocked):
+		return newEventError(CodeBlocked, err.Error())
+	default:
+		return err
+	}
+}
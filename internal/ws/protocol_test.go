@@ -0,0 +1,263 @@
+package ws
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// serveTestHub runs hub and serves its WebSocket endpoint for user 1,
+// returning the ws:// URL.
+func serveTestHub(t *testing.T, hub *Hub) string {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	go hub.Run()
+
+	router := gin.New()
+	router.GET("/ws", func(c *gin.Context) {
+		c.Set("user_id", 1)
+		hub.HandleWebSocket(c)
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+}
+
+// dialTestHub connects user 1 to a hub served over a real WebSocket,
+// requesting the given subprotocols.
+func dialTestHub(t *testing.T, subprotocols ...string) *websocket.Conn {
+	t.Helper()
+	db := setupTestDB(t)
+	t.Cleanup(func() { db.Close() })
+
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial(serveTestHub(t, NewHub(db)), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	time.Sleep(50 * time.Millisecond)
+	return conn
+}
+
+// testEvent encodes fields as a client frame and decodes it as readPump would.
+func testEvent(t *testing.T, fields map[string]interface{}) *Event {
+	t.Helper()
+	data, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("Failed to encode event: %v", err)
+	}
+	event, err := decodeEvent(jsonCodec{}, data)
+	if err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	return event
+}
+
+// readFrame reads frames until one of the given type arrives.
+func readFrame(t *testing.T, conn *websocket.Conn, frameType string, v interface{}) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed waiting for %s frame: %v", frameType, err)
+		}
+		var head struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(data, &head)
+		if head.Type == frameType {
+			if err := json.Unmarshal(data, v); err != nil {
+				t.Fatalf("Failed to decode %s frame: %v", frameType, err)
+			}
+			return
+		}
+	}
+}
+
+func TestAckFrame(t *testing.T) {
+	conn := dialTestHub(t)
+
+	var hello HelloFrame
+	readFrame(t, conn, FrameHello, &hello)
+	if hello.Epoch == "" || hello.V != ProtocolVersion {
+		t.Fatalf("Unexpected hello: %+v", hello)
+	}
+
+	conn.WriteJSON(map[string]interface{}{
+		"type":              EventMessage,
+		"v":                 ProtocolVersion,
+		"request_id":        "req-1",
+		"client_message_id": "client-1",
+		"receiver_id":       2,
+		"content":           "hello",
+	})
+
+	var ack AckFrame
+	readFrame(t, conn, FrameAck, &ack)
+	if ack.RequestID != "req-1" || ack.ClientMsgID != "client-1" || ack.MessageID == 0 || ack.V != ProtocolVersion {
+		t.Fatalf("Unexpected ack: %+v", ack)
+	}
+
+	// Acks confirm status updates too
+	conn.WriteJSON(map[string]interface{}{"type": EventMarkRead, "request_id": "req-2", "message_id": ack.MessageID})
+	var errFrame ErrorFrame
+	readFrame(t, conn, FrameError, &errFrame)
+	if errFrame.RequestID != "req-2" || errFrame.Code != CodeNotFound {
+		t.Fatalf("Expected not_found for marking own message read, got %+v", errFrame)
+	}
+}
+
+func TestErrorFrames(t *testing.T) {
+	conn := dialTestHub(t)
+
+	tests := []struct {
+		name  string
+		event string
+		code  string
+	}{
+		{"invalid json", `{"type":`, CodeInvalidJSON},
+		{"newer version", `{"type":"message","v":99,"request_id":"r","receiver_id":2,"content":"x"}`, CodeUnsupportedVersion},
+		{"unknown type", `{"type":"shout","request_id":"r"}`, CodeUnknownEvent},
+		{"missing receiver", `{"type":"message","request_id":"r","content":"x"}`, CodeInvalidPayload},
+		{"unknown receiver", `{"type":"message","request_id":"r","receiver_id":99,"content":"x"}`, CodeUnknownReceiver},
+		{"self", `{"type":"message","request_id":"r","receiver_id":1,"content":"x"}`, CodeSelf},
+		{"missing message id", `{"type":"mark_delivered","request_id":"r"}`, CodeInvalidPayload},
+		{"string receiver", `{"type":"message","request_id":"r","receiver_id":"2","content":"x"}`, CodeInvalidPayload},
+		{"fractional message id", `{"type":"mark_read","request_id":"r","message_id":1.5}`, CodeInvalidPayload},
+		{"mistyped common field", `{"type":"message","request_id":"r","client_message_id":7}`, CodeInvalidPayload},
+		{"negative seq", `{"type":"ack","request_id":"r","seq":-1}`, CodeInvalidPayload},
+		{"empty invite", `{"type":"call_invite","request_id":"r","receiver_ids":[]}`, CodeInvalidPayload},
+		{"duplicate invitee", `{"type":"call_invite","request_id":"r","receiver_ids":[2,2]}`, CodeInvalidPayload},
+		{"unknown call kind", `{"type":"call_offer","request_id":"r","receiver_id":2,"kind":"hologram"}`, CodeInvalidPayload},
+		{"missing call id", `{"type":"call_join","request_id":"r"}`, CodeInvalidPayload},
+		{"unknown call", `{"type":"call_join","request_id":"r","call_id":5}`, CodeNotFound},
+		{"no shared call", `{"type":"ice_candidate","request_id":"r","receiver_id":2}`, CodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn.WriteMessage(websocket.TextMessage, []byte(tt.event))
+
+			var frame ErrorFrame
+			readFrame(t, conn, FrameError, &frame)
+			if frame.Code != tt.code {
+				t.Errorf("Expected code %s, got %+v", tt.code, frame)
+			}
+			if frame.Error == "" || frame.V != ProtocolVersion {
+				t.Errorf("Error frame missing text or version: %+v", frame)
+			}
+			if tt.code != CodeInvalidJSON && frame.RequestID != "r" {
+				t.Errorf("Expected request_id to be echoed, got %+v", frame)
+			}
+		})
+	}
+}
+
+func TestCustomEventHandler(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.HandleEvent("typing", func(c *Client, event *Event) (int, error) {
+		var p struct {
+			ReceiverID int `json:"receiver_id"`
+		}
+		if err := event.Decode(&p); err != nil {
+			return 0, err
+		}
+		return p.ReceiverID, nil
+	})
+	go hub.Run()
+
+	client := &Client{userID: 1, hub: hub, send: make(chan interface{}, 256)}
+	hub.register <- client
+	time.Sleep(10 * time.Millisecond)
+
+	client.handleEvent([]byte(`{"type":"typing","request_id":"t","receiver_id":2}`))
+	select {
+	case frame := <-client.send:
+		if ack, ok := frame.(*AckFrame); !ok || ack.RequestID != "t" || ack.MessageID != 2 {
+			t.Fatalf("Unexpected frame %+v", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No ack for custom event")
+	}
+}
+
+func TestOversizedEventClosesConnection(t *testing.T) {
+	conn := dialTestHub(t)
+
+	big := `{"type":"message","receiver_id":2,"content":"` + strings.Repeat("x", maxEventSize) + `"}`
+	conn.WriteMessage(websocket.TextMessage, []byte(big))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Fatalf("Expected close %d, got %v", websocket.CloseMessageTooBig, err)
+			}
+			return
+		}
+	}
+}
+
+func FuzzDecodeEvent(f *testing.F) {
+	f.Add([]byte(`{"type":"message","v":1,"request_id":"r","client_message_id":"c","receiver_id":2,"content":"hi"}`))
+	f.Add([]byte(`{"type":"message","receiver_id":2,"encrypted":true,"e2ee_v":1,"alg":"a","sender_device_id":"d","key_id":"k","iv":"i","ciphertext":"c"}`))
+	f.Add([]byte(`{"type":"mark_read","message_id":9}`))
+	f.Add([]byte(`{"type":"call_offer","receiver_id":2,"payload":{"sdp":"x"}}`))
+	f.Add([]byte(`{"type":"call_invite","receiver_ids":[2,3],"kind":"video"}`))
+	f.Add([]byte(`{"type":"ack","seq":18446744073709551615}`))
+	f.Add([]byte(`{"type":`))
+	f.Add([]byte(`[1,2]`))
+	f.Add([]byte(`null`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, codec := range []codec{jsonCodec{}, msgpackCodec{}} {
+			fuzzDecode(t, codec, data)
+		}
+	})
+}
+
+// fuzzDecode checks the decoder invariants for one codec.
+func fuzzDecode(t *testing.T, codec codec, data []byte) {
+	event, err := decodeEvent(codec, data)
+	if err != nil {
+		eventErr, ok := err.(*EventError)
+		if !ok {
+			t.Fatalf("decodeEvent returned %T, want *EventError", err)
+		}
+		if eventErr.Code == CodeInvalidJSON && event != nil {
+			t.Fatal("invalid frame must not yield an event")
+		}
+		return
+	}
+	if event.V > ProtocolVersion {
+		t.Fatalf("accepted version %d", event.V)
+	}
+
+	payloads := []interface{ validate() error }{&MessagePayload{}, &StatusPayload{}, &SignalingPayload{}, &CallInvitePayload{}, &CallPayload{}, &AckPayload{}}
+	for _, p := range payloads {
+		if event.Decode(p) == nil {
+			p.validate()
+		}
+	}
+
+	var msg MessagePayload
+	if event.Decode(&msg) == nil && msg.validate() == nil {
+		if msg.ReceiverID <= 0 || len(msg.ClientMsgID) > maxClientMessageIDLength {
+			t.Fatalf("accepted invalid message %+v", msg)
+		}
+		if msg.Encrypted == (msg.Content != "") {
+			t.Fatalf("message must have exactly one of content and ciphertext: %+v", msg)
+		}
+	}
+}
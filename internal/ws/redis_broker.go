@@ -0,0 +1,75 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisChannel is the pub/sub channel all nodes share.
+const redisChannel = "payambar:hub"
+
+// RedisBroker relays hub traffic through Redis pub/sub. Any server speaking
+// the Redis protocol (Redis, Valkey, KeyDB, ...) works.
+type RedisBroker struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+}
+
+// NewRedisBroker connects to a redis:// or rediss:// URL.
+func NewRedisBroker(url string) (*RedisBroker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid broker URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to broker: %w", err)
+	}
+	return &RedisBroker{client: client}, nil
+}
+
+func (b *RedisBroker) Publish(env *Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(context.Background(), redisChannel, data).Err()
+}
+
+func (b *RedisBroker) Subscribe(handler func(*Envelope)) error {
+	ctx := context.Background()
+	b.pubsub = b.client.Subscribe(ctx, redisChannel)
+	// Wait for the subscription so nothing published afterwards is missed
+	if _, err := b.pubsub.Receive(ctx); err != nil {
+		b.pubsub.Close()
+		return fmt.Errorf("failed to subscribe to broker: %w", err)
+	}
+
+	go func() {
+		for msg := range b.pubsub.Channel() {
+			var env Envelope
+			if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+				log.Printf("Ignoring malformed broker envelope: %v", err)
+				continue
+			}
+			handler(&env)
+		}
+	}()
+	return nil
+}
+
+func (b *RedisBroker) Close() error {
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	return b.client.Close()
+}
@@ -0,0 +1,131 @@
+package ws
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisBroker(t *testing.T, server *miniredis.Miniredis) *RedisBroker {
+	t.Helper()
+	broker, err := NewRedisBroker("redis://" + server.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisBroker failed: %v", err)
+	}
+	return broker
+}
+
+func TestRedisBrokerPublishSubscribe(t *testing.T) {
+	server := miniredis.RunT(t)
+	publisher, subscriber := newTestRedisBroker(t, server), newTestRedisBroker(t, server)
+	defer publisher.Close()
+
+	received := make(chan *Envelope, 16)
+	if err := subscriber.Subscribe(func(env *Envelope) { received <- env }); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// Malformed payloads are skipped; envelopes arrive in publish order
+	server.Publish(redisChannel, "not json")
+	for i := 1; i <= 3; i++ {
+		if err := publisher.Publish(&Envelope{Node: "a", Kind: envelopePresence, UserID: i, Online: true}); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+	for i := 1; i <= 3; i++ {
+		select {
+		case env := <-received:
+			if env.Node != "a" || env.Kind != envelopePresence || env.UserID != i || !env.Online {
+				t.Fatalf("Envelope %d = %+v", i, env)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for envelope %d", i)
+		}
+	}
+
+	// Nothing is delivered after Close
+	if err := subscriber.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	publisher.Publish(&Envelope{Node: "a", Kind: envelopeLeave})
+	select {
+	case env := <-received:
+		t.Fatalf("Got %+v after Close", env)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// redisHubs starts two hubs joined through miniredis.
+func redisHubs(t *testing.T) (*Hub, *Hub) {
+	t.Helper()
+	db := setupTestDB(t)
+	t.Cleanup(func() { db.Close() })
+
+	server := miniredis.RunT(t)
+	nodeA, nodeB := NewHub(db), NewHub(db)
+	if err := nodeA.SetBroker(newTestRedisBroker(t, server)); err != nil {
+		t.Fatalf("SetBroker failed: %v", err)
+	}
+	if err := nodeB.SetBroker(newTestRedisBroker(t, server)); err != nil {
+		t.Fatalf("SetBroker failed: %v", err)
+	}
+	go nodeA.Run()
+	go nodeB.Run()
+	t.Cleanup(func() { nodeB.Close() })
+	return nodeA, nodeB
+}
+
+func TestRedisPresenceSnapshotExpires(t *testing.T) {
+	nodeA, nodeB := redisHubs(t)
+
+	nodeA.register <- &Client{userID: 2, hub: nodeA, send: make(chan interface{}, 256)}
+	waitFor(t, "presence on node B", func() bool { return nodeB.IsUserOnline(2) })
+
+	// Node A dies without saying goodbye; its snapshot ages out on node B
+	nodeA.broker.Close()
+	nodeB.mu.Lock()
+	for _, node := range nodeB.remote {
+		node.seen = time.Now().Add(-presenceTTL - time.Second)
+	}
+	nodeB.mu.Unlock()
+	if nodeB.IsUserOnline(2) {
+		t.Fatal("Presence from a silent node should expire")
+	}
+	nodeB.refreshPresence()
+	nodeB.mu.RLock()
+	remaining := len(nodeB.remote)
+	nodeB.mu.RUnlock()
+	if remaining != 0 {
+		t.Fatalf("Node B still tracks %d silent nodes", remaining)
+	}
+}
+
+func TestRedisCloseLeavesAfterQueuedEnvelopes(t *testing.T) {
+	nodeA, nodeB := redisHubs(t)
+
+	waitFor(t, "node B to know node A", func() bool {
+		nodeB.mu.RLock()
+		defer nodeB.mu.RUnlock()
+		return len(nodeB.remote) == 1
+	})
+
+	// Presence queued right before Close must not outlive the leave
+	nodeA.register <- &Client{userID: 2, hub: nodeA, send: make(chan interface{}, 256)}
+	if err := nodeA.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := nodeA.Close(); err != nil {
+		t.Fatalf("Second Close failed: %v", err)
+	}
+
+	waitFor(t, "node B to forget node A", func() bool {
+		nodeB.mu.RLock()
+		defer nodeB.mu.RUnlock()
+		return len(nodeB.remote) == 0
+	})
+	time.Sleep(50 * time.Millisecond)
+	if nodeB.IsUserOnline(2) {
+		t.Fatal("User of a closed node should be offline")
+	}
+}
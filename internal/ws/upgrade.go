@@ -0,0 +1,73 @@
+package ws
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// UpgradeOptions tunes how connections are accepted. Zero values keep the
+// defaults.
+type UpgradeOptions struct {
+	// AllowedOrigins may open a connection from a browser, besides the
+	// server's own origin; "*" allows any origin
+	AllowedOrigins []string
+	// Compression offers permessage-deflate to clients that support it
+	Compression     bool
+	ReadBufferSize  int
+	WriteBufferSize int
+	// MaxMessageSize bounds a client frame; larger frames close the connection
+	MaxMessageSize int64
+}
+
+func newUpgrader(opts UpgradeOptions) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:    opts.ReadBufferSize,
+		WriteBufferSize:   opts.WriteBufferSize,
+		EnableCompression: opts.Compression,
+		Subprotocols:      []string{SubprotocolJSON, SubprotocolMsgpack},
+		CheckOrigin:       originChecker(opts.AllowedOrigins),
+	}
+}
+
+// SetUpgradeOptions replaces the defaults (same-origin only, no compression,
+// 1 KiB buffers, 64 KiB frames). Call before serving connections.
+func (h *Hub) SetUpgradeOptions(opts UpgradeOptions) {
+	if opts.ReadBufferSize <= 0 {
+		opts.ReadBufferSize = 1024
+	}
+	if opts.WriteBufferSize <= 0 {
+		opts.WriteBufferSize = 1024
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = maxEventSize
+	}
+	h.upgrader = newUpgrader(opts)
+	h.maxMessageSize = opts.MaxMessageSize
+}
+
+// originChecker accepts requests without an Origin header (native clients),
+// from the server's own host, and from the allowed origins.
+func originChecker(allowed []string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return true
+		}
+		for _, candidate := range allowed {
+			if candidate == "*" || strings.EqualFold(strings.TrimSuffix(candidate, "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
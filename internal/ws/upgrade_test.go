@@ -0,0 +1,136 @@
+package ws
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialFrom opens a connection to wsURL as a browser on origin would.
+func dialFrom(wsURL, origin string, compression bool) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+	dialer := websocket.Dialer{EnableCompression: compression}
+	return dialer.Dial(wsURL, header)
+}
+
+func TestUpgradeOriginCheck(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.SetUpgradeOptions(UpgradeOptions{AllowedOrigins: []string{"https://chat.example.com/"}})
+	wsURL := serveTestHub(t, hub)
+	u, _ := url.Parse(wsURL)
+
+	tests := []struct {
+		name    string
+		origin  string
+		allowed bool
+	}{
+		{"no origin", "", true},
+		{"same origin", "http://" + u.Host, true},
+		{"allowed origin", "https://chat.example.com", true},
+		{"allowed origin case", "https://CHAT.example.com", true},
+		{"cross origin", "https://evil.example.com", false},
+		{"allowed host wrong scheme", "http://chat.example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, resp, err := dialFrom(wsURL, tt.origin, false)
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("Expected upgrade to succeed: %v", err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil {
+				conn.Close()
+				t.Fatal("Cross-origin upgrade was accepted")
+			}
+			if resp == nil || resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("Expected 403, got %v", resp)
+			}
+		})
+	}
+}
+
+func TestUpgradeAnyOrigin(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.SetUpgradeOptions(UpgradeOptions{AllowedOrigins: []string{"*"}})
+	conn, _, err := dialFrom(serveTestHub(t, hub), "https://evil.example.com", false)
+	if err != nil {
+		t.Fatalf("Expected * to allow any origin: %v", err)
+	}
+	conn.Close()
+}
+
+func TestUpgradeDefaultsToSameOrigin(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	if _, _, err := dialFrom(serveTestHub(t, NewHub(db)), "https://evil.example.com", false); err == nil {
+		t.Fatal("Default hub accepted a cross-origin upgrade")
+	}
+}
+
+func TestUpgradeCompression(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		db := setupTestDB(t)
+		defer db.Close()
+
+		hub := NewHub(db)
+		hub.SetUpgradeOptions(UpgradeOptions{Compression: enabled})
+		conn, resp, err := dialFrom(serveTestHub(t, hub), "", true)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+
+		negotiated := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+		if negotiated != enabled {
+			t.Fatalf("Compression enabled=%v but negotiated=%v", enabled, negotiated)
+		}
+
+		var hello HelloFrame
+		readFrame(t, conn, FrameHello, &hello)
+		if hello.Epoch == "" {
+			t.Fatalf("Unexpected hello over compressed connection: %+v", hello)
+		}
+	}
+}
+
+func TestUpgradeMaxMessageSize(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	hub.SetUpgradeOptions(UpgradeOptions{MaxMessageSize: 128})
+	conn, _, err := dialFrom(serveTestHub(t, hub), "", false)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"message","receiver_id":2,"content":"`+strings.Repeat("x", 200)+`"}`))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Fatalf("Expected close %d, got %v", websocket.CloseMessageTooBig, err)
+			}
+			return
+		}
+	}
+}
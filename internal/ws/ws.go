@@ -1,13 +1,21 @@
 package ws
 
 import (
-	"database/sql"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"log"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/4xmen/payambar/internal/conversation"
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/models"
+	"github.com/4xmen/payambar/internal/notify"
+	"github.com/4xmen/payambar/internal/push"
+	"github.com/4xmen/payambar/internal/store"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
@@ -17,14 +25,38 @@ type Hub struct {
 	broadcast    chan interface{}
 	register     chan *Client
 	unregister   chan *Client
-	db           *sql.DB
+	outboxes     map[int]*outbox
+	store        *store.Store
+	access       *conversation.Authorizer
 	mu           sync.RWMutex
 	pushNotifier PushNotifier
+	handlers     map[string]EventHandler
+
+	upgrader       websocket.Upgrader
+	maxMessageSize int64
+
+	// nodeID tells this process's envelopes apart from other nodes'
+	nodeID   string
+	broker   Broker
+	outgoing chan *Envelope
+	// published is closed once the publishing goroutine has sent the leave
+	// envelope and stopped
+	published chan struct{}
+	closeOnce sync.Once
+	inbound   chan *Envelope
+	remote    map[string]*remoteNode
+
+	// callMu serializes call state changes made by this node
+	callMu      sync.Mutex
+	ringTimeout time.Duration
+	rejoinGrace time.Duration
 }
 
 // PushNotifier sends push notifications to offline users.
 type PushNotifier interface {
-	SendNewMessageNotification(receiverID int, senderUsername string)
+	SendNewMessageNotification(msg push.Message)
+	SendCallNotification(call push.Call)
+	SendMissedCallNotification(call push.Call)
 }
 
 type Client struct {
@@ -32,6 +64,11 @@ type Client struct {
 	conn   *websocket.Conn
 	hub    *Hub
 	send   chan interface{}
+	// codec is the negotiated wire encoding; nil means JSON
+	codec codec
+	// epoch and lastSeq are what the client saw before reconnecting
+	epoch   string
+	lastSeq uint64
 }
 
 type MessageEvent struct {
@@ -57,25 +94,76 @@ type MessageEvent struct {
 	FileURL        string                 `json:"file_url,omitempty"`
 	FileType       string                 `json:"file_content_type,omitempty"`
 	Payload        map[string]interface{} `json:"payload,omitempty"`
+	// CallID ties signaling, call_ring and call_state frames to a call
+	CallID int `json:"call_id,omitempty"`
+	// Call summarizes the call behind a call history message
+	Call *models.CallSummary `json:"call,omitempty"`
+	// Session is the call's state in call_ring and call_state frames
+	Session *CallSession `json:"session,omitempty"`
+	// Seq orders reliable events per user; clients acknowledge it
+	Seq uint64 `json:"seq,omitempty"`
+
+	// senderOnly delivers a message to its sender alone: messages to a user
+	// who blocked the sender (as if the receiver were offline) and retried
+	// sends that were already saved
+	senderOnly bool
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// In production, validate origin
-		return true
-	},
-}
-
-func NewHub(db *sql.DB) *Hub {
-	return &Hub{
+func NewHub(database *db.DB) *Hub {
+	access, _ := conversation.NewAuthorizer(database, conversation.PolicyAutoCreate)
+	node := make([]byte, 8)
+	rand.Read(node)
+	h := &Hub{
 		clients:    make(map[int]*Client),
+		outboxes:   make(map[int]*outbox),
 		broadcast:  make(chan interface{}, 256),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
-		db:         db,
+		store:      store.New(database),
+		access:     access,
+		nodeID:     hex.EncodeToString(node),
+		inbound:    make(chan *Envelope, 256),
+		remote:     make(map[string]*remoteNode),
+		handlers:   make(map[string]EventHandler),
+
+		ringTimeout: defaultRingTimeout,
+		rejoinGrace: defaultRejoinGrace,
 	}
+	h.SetUpgradeOptions(UpgradeOptions{})
+
+	h.HandleEvent(EventMessage, (*Client).handleMessageEvent)
+	h.HandleEvent(EventMarkDelivered, (*Client).handleMarkDelivered)
+	h.HandleEvent(EventMarkRead, (*Client).handleMarkRead)
+	h.HandleEvent(EventCallOffer, (*Client).handleCallOffer)
+	h.HandleEvent(EventCallAnswer, (*Client).handleCallAnswer)
+	h.HandleEvent(EventIceCandidate, (*Client).handleSignalingEvent)
+	h.HandleEvent(EventCallReject, (*Client).handleCallReject)
+	h.HandleEvent(EventCallHangup, (*Client).handleCallHangup)
+	h.HandleEvent(EventCallInvite, (*Client).handleCallInvite)
+	h.HandleEvent(EventCallJoin, (*Client).handleCallJoin)
+	h.HandleEvent(EventAck, (*Client).handleAck)
+	return h
+}
+
+// EventHandler handles one type of client event. The message id it returns,
+// if any, is echoed in the ack frame; an EventError becomes an error frame.
+type EventHandler func(c *Client, event *Event) (int, error)
+
+// HandleEvent registers handler for client events of eventType, replacing any
+// earlier handler. Register handlers before Run.
+func (h *Hub) HandleEvent(eventType string, handler EventHandler) {
+	h.handlers[eventType] = handler
+}
+
+// SetAuthorizer replaces the default auto-create conversation authorizer.
+func (h *Hub) SetAuthorizer(access *conversation.Authorizer) {
+	h.access = access
+}
+
+// reply is an ack or error frame for the connection that sent an event.
+type reply struct {
+	client *Client
+	frame  interface{}
 }
 
 // SetPushNotifier sets the push notifier on the hub.
@@ -83,12 +171,49 @@ func (h *Hub) SetPushNotifier(pn PushNotifier) {
 	h.pushNotifier = pn
 }
 
-// IsUserOnline checks if a user is currently connected
+// IsUserOnline checks if a user is currently connected to any node
 func (h *Hub) IsUserOnline(userID int) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	_, ok := h.clients[userID]
-	return ok
+	if _, ok := h.clients[userID]; ok {
+		return true
+	}
+	return h.onlineElsewhereLocked(userID)
+}
+
+// DisconnectUser notifies and closes the user's live connection on every node.
+func (h *Hub) DisconnectUser(userID int) {
+	h.publish(&Envelope{Kind: envelopeDisconnect, UserID: userID})
+	h.disconnectLocal(userID)
+}
+
+// disconnectLocal closes the user's connection to this node, if any.
+func (h *Hub) disconnectLocal(userID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	client, ok := h.clients[userID]
+	if !ok {
+		return
+	}
+	select {
+	case client.send <- map[string]interface{}{"type": FrameSessionRevoked}:
+	default:
+	}
+	h.removeLocked(client)
+}
+
+// removeLocked drops client if it is still the user's registered connection
+// and tells the other nodes. h.mu must be held for writing.
+func (h *Hub) removeLocked(client *Client) bool {
+	if current, ok := h.clients[client.userID]; !ok || current != client {
+		return false
+	}
+	delete(h.clients, client.userID)
+	close(client.send)
+	h.publish(&Envelope{Kind: envelopePresence, UserID: client.userID})
+	h.leaveCallsLater(client.userID)
+	return true
 }
 
 // BroadcastMessage allows handlers to broadcast a message event to connected clients
@@ -104,107 +229,150 @@ func (h *Hub) BroadcastMessage(messageID, senderID, receiverID int, content, sta
 		FileName:   fileName,
 		FileURL:    fileURL,
 		FileType:   fileType,
+		senderOnly: h.isBlocked(receiverID, senderID),
 	}
 	h.broadcast <- msg
 }
 
+// isBlocked reports whether blockerID has blocked blockedID
+func (h *Hub) isBlocked(blockerID, blockedID int) bool {
+	blocked, err := conversation.IsBlocked(h.store, blockerID, blockedID)
+	if err != nil {
+		log.Printf("%v", err)
+	}
+	return blocked
+}
+
 func (h *Hub) Run() {
+	var presence <-chan time.Time
+	if h.broker != nil {
+		ticker := time.NewTicker(presenceInterval)
+		defer ticker.Stop()
+		presence = ticker.C
+	}
+	prune := time.NewTicker(outboxPruneInterval)
+	defer prune.Stop()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
 			h.clients[client.userID] = client
+			h.publish(&Envelope{Kind: envelopePresence, UserID: client.userID, Online: true})
+			h.replayLocked(client)
+			total := len(h.clients)
 			h.mu.Unlock()
-			log.Printf("User %d connected (total: %d)", client.userID, len(h.clients))
+			log.Printf("User %d connected (total: %d)", client.userID, total)
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.userID]; ok {
-				delete(h.clients, client.userID)
-				close(client.send)
-			}
+			// Only drop the entry if it still belongs to this connection; a
+			// newer connection or DisconnectUser may have replaced it
+			h.removeLocked(client)
+			total := len(h.clients)
 			h.mu.Unlock()
-			log.Printf("User %d disconnected (total: %d)", client.userID, len(h.clients))
+			log.Printf("User %d disconnected (total: %d)", client.userID, total)
 
 		case message := <-h.broadcast:
 			h.broadcast_message(message)
+
+		case env := <-h.inbound:
+			h.handleEnvelope(env)
+
+		case <-presence:
+			h.refreshPresence()
+
+		case <-prune.C:
+			h.pruneOutboxes()
 		}
 	}
 }
 
 func (h *Hub) broadcast_message(message interface{}) {
 	switch msg := message.(type) {
+	case *reply:
+		// Only deliver while the connection is registered, so send is open
+		h.mu.Lock()
+		if current, ok := h.clients[msg.client.userID]; ok && current == msg.client {
+			h.sendLocked(current, msg.frame)
+		}
+		h.mu.Unlock()
 	case *MessageEvent:
-		if msg.Type == "message" {
-			// Check if receiver is connected
-			h.mu.RLock()
-			receiverOnline := false
-			if client, ok := h.clients[msg.ReceiverID]; ok {
-				receiverOnline = true
-				select {
-				case client.send <- msg:
-				default:
-					log.Printf("Message channel full for user %d", msg.ReceiverID)
-				}
-			}
-			// Also send to sender so they get the canonical message id
-			if sender, ok := h.clients[msg.SenderID]; ok {
-				select {
-				case sender.send <- msg:
-				default:
-				}
-			}
-			h.mu.RUnlock()
-
-			// Only send delivery confirmation if receiver is online
-			if receiverOnline {
-				if sender, ok := h.clients[msg.SenderID]; ok {
-					select {
-					case sender.send <- &MessageEvent{
-						Type:       "status_update",
-						MessageID:  msg.MessageID,
-						Status:     "delivered",
-						SenderID:   msg.SenderID,
-						ReceiverID: msg.ReceiverID,
-					}:
-					default:
-					}
-				}
-			} else if h.pushNotifier != nil {
-				// Receiver is offline — send push notification
-				var senderUsername string
-				h.db.QueryRow("SELECT username FROM users WHERE id = ?", msg.SenderID).Scan(&senderUsername)
-				if senderUsername == "" {
-					senderUsername = "someone"
-				}
-				go h.pushNotifier.SendNewMessageNotification(msg.ReceiverID, senderUsername)
-			}
-		} else if msg.Type == "status_update" {
-			// Broadcast status updates to both sender and receiver when available
-			h.mu.RLock()
-			if client, ok := h.clients[msg.SenderID]; ok {
-				select {
-				case client.send <- msg:
-				default:
-				}
-			}
-			if client, ok := h.clients[msg.ReceiverID]; ok {
-				select {
-				case client.send <- msg:
-				default:
-				}
-			}
-			h.mu.RUnlock()
-		} else {
-			// WebRTC signaling - forward only to receiver
-			h.mu.RLock()
-			if client, ok := h.clients[msg.ReceiverID]; ok {
-				select {
-				case client.send <- msg:
-				default:
-				}
+		h.publish(&Envelope{Kind: envelopeEvent, Event: msg, SenderOnly: msg.senderOnly})
+		h.deliverLocal(msg)
+		if msg.Type != "message" || msg.senderOnly {
+			return
+		}
+
+		// The node that accepted the message confirms delivery once, based
+		// on presence across all nodes
+		if h.IsUserOnline(msg.ReceiverID) {
+			status := &MessageEvent{
+				Type:       "status_update",
+				MessageID:  msg.MessageID,
+				Status:     "delivered",
+				SenderID:   msg.SenderID,
+				ReceiverID: msg.ReceiverID,
 			}
-			h.mu.RUnlock()
+			h.publish(&Envelope{Kind: envelopeEvent, Event: status})
+			h.deliverLocal(status)
+		} else if h.pushNotifier != nil && msg.Call != nil {
+			go h.pushMissedCall(msg)
+		} else if h.pushNotifier != nil {
+			// Receiver is offline — send push notification unless muted. The
+			// settings lookup runs off the hub goroutine so it never stalls
+			// delivery.
+			go h.pushMessage(msg)
+		}
+	}
+}
+
+// pushMessage sends a new message push to an offline receiver unless their
+// notification settings silence it.
+func (h *Hub) pushMessage(msg *MessageEvent) {
+	var plaintext string
+	if !msg.Encrypted {
+		plaintext = msg.Content
+	}
+	wanted, err := notify.ShouldPush(h.store, msg.ReceiverID, msg.SenderID, plaintext, time.Now())
+	if err != nil {
+		log.Printf("push: failed to check notification settings of user %d: %v", msg.ReceiverID, err)
+	}
+	if !wanted {
+		return
+	}
+	h.pushNotifier.SendNewMessageNotification(push.Message{
+		ID:         msg.MessageID,
+		SenderID:   msg.SenderID,
+		ReceiverID: msg.ReceiverID,
+		Content:    msg.Content,
+		Encrypted:  msg.Encrypted,
+		FileName:   msg.FileName,
+	})
+}
+
+// deliverLocal hands an event to the users connected to this node and
+// queues it for the disconnected users whose sessions this node owns.
+func (h *Hub) deliverLocal(msg *MessageEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch msg.Type {
+	case "message":
+		if !msg.senderOnly {
+			h.deliverLocked(msg.ReceiverID, msg)
+		}
+		// Also send to sender so they get the canonical message id
+		h.deliverLocked(msg.SenderID, msg)
+	case "status_update":
+		// Broadcast status updates to both sender and receiver
+		h.deliverLocked(msg.SenderID, msg)
+		h.deliverLocked(msg.ReceiverID, msg)
+	default:
+		// WebRTC signaling - forward only to receiver, never queued since
+		// a stale call event is useless after reconnecting
+		if client, ok := h.clients[msg.ReceiverID]; ok {
+			h.sendLocked(client, msg)
 		}
 	}
 }
@@ -216,7 +384,7 @@ func (h *Hub) HandleWebSocket(c *gin.Context) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("Upgrade error: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": __("websocket upgrade failed")})
@@ -228,20 +396,39 @@ func (h *Hub) HandleWebSocket(c *gin.Context) {
 		conn:   conn,
 		hub:    h,
 		send:   make(chan interface{}, 256),
+		epoch:  c.Query("epoch"),
+		codec:  codecFor(conn.Subprotocol()),
 	}
+	client.lastSeq, _ = strconv.ParseUint(c.Query("last_seq"), 10, 64)
 
+	// Not registered yet, so nothing else writes to send
+	client.send <- &HelloFrame{Type: FrameHello, V: ProtocolVersion, Epoch: h.outboxEpoch(client.userID)}
 	h.register <- client
 
 	go client.readPump()
 	go client.writePump()
 }
 
+// wire returns the connection's codec.
+func (c *Client) wire() codec {
+	if c.codec == nil {
+		return jsonCodec{}
+	}
+	return c.codec
+}
+
+// UserID returns the authenticated user behind the connection.
+func (c *Client) UserID() int {
+	return c.userID
+}
+
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
 
+	c.conn.SetReadLimit(c.hub.maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -257,193 +444,247 @@ func (c *Client) readPump() {
 			break
 		}
 
-		var event map[string]interface{}
-		if err := json.Unmarshal(data, &event); err != nil {
-			continue
-		}
-
-		eventType, ok := event["type"].(string)
-		if !ok {
-			continue
-		}
+		c.handleEvent(data)
+	}
+}
 
-		switch eventType {
-		case "message":
-			c.handleMessageEvent(event)
-		case "mark_delivered":
-			c.handleMarkDelivered(event)
-		case "mark_read":
-			c.handleMarkRead(event)
-		case "call_offer", "call_answer", "ice_candidate", "call_reject", "call_hangup":
-			c.handleSignalingEvent(event)
+// handleEvent decodes and dispatches one client event. Failures are answered
+// with an error frame; successes with an ack when the event has a request_id.
+func (c *Client) handleEvent(data []byte) {
+	event, err := decodeEvent(c.wire(), data)
+	var messageID int
+	if err == nil {
+		if handler, ok := c.hub.handlers[event.Type]; ok {
+			messageID, err = handler(c, event)
+		} else {
+			err = newEventError(CodeUnknownEvent, "unknown event type")
 		}
 	}
-}
+	if event == nil {
+		event = &Event{}
+	}
 
-func (c *Client) handleMessageEvent(event map[string]interface{}) {
-	receiverID, ok := event["receiver_id"].(float64)
-	if !ok {
+	if err != nil {
+		c.reply(errorFrame(event.RequestID, event.ClientMsgID, err))
 		return
 	}
+	// Acks are never acknowledged themselves
+	if event.RequestID != "" && event.Type != EventAck {
+		c.reply(&AckFrame{
+			Type:        FrameAck,
+			V:           ProtocolVersion,
+			RequestID:   event.RequestID,
+			MessageID:   messageID,
+			ClientMsgID: event.ClientMsgID,
+		})
+	}
+}
 
-	clientMsgID, _ := event["client_message_id"].(string)
-	encrypted, _ := event["encrypted"].(bool)
+// reply sends a frame to this connection through the hub, so it never races
+// with the hub closing the send channel.
+func (c *Client) reply(frame interface{}) {
+	c.hub.broadcast <- &reply{client: c, frame: frame}
+}
 
-	var (
-		content        string
-		e2eeVersion    int
-		algorithm      string
-		senderDeviceID string
-		keyID          string
-		iv             string
-		ciphertext     string
-		aad            string
-	)
+func (c *Client) handleMessageEvent(event *Event) (int, error) {
+	var p MessagePayload
+	if err := event.Decode(&p); err != nil {
+		return 0, err
+	}
+	if err := p.validate(); err != nil {
+		return 0, err
+	}
 
-	if encrypted {
-		e2eeVersionRaw, ok := event["e2ee_v"].(float64)
-		if !ok {
-			return
+	// A retry of a message that was already saved gets the original back
+	if p.ClientMsgID != "" {
+		existing, err := c.hub.findClientMessage(c.userID, p.ClientMsgID)
+		if err != nil {
+			return 0, err
 		}
-		e2eeVersion = int(e2eeVersionRaw)
-		algorithm, _ = event["alg"].(string)
-		senderDeviceID, _ = event["sender_device_id"].(string)
-		keyID, _ = event["key_id"].(string)
-		iv, _ = event["iv"].(string)
-		ciphertext, _ = event["ciphertext"].(string)
-		aad, _ = event["aad"].(string)
-		if e2eeVersion <= 0 || algorithm == "" || senderDeviceID == "" || keyID == "" || iv == "" || ciphertext == "" {
-			return
+		if existing != nil {
+			c.hub.broadcast <- existing
+			return existing.MessageID, nil
 		}
-		content = ""
-	} else {
-		content, ok = event["content"].(string)
-		if !ok || content == "" {
-			return
+	}
+
+	grant, err := c.hub.access.Authorize(c.userID, p.ReceiverID)
+	if err != nil {
+		if err = accessError(err); !isEventError(err) {
+			log.Printf("Failed to authorize message: %v", err)
 		}
+		return 0, err
 	}
 
-	// Save message to database
-	result, err := c.hub.db.Exec(`
-		INSERT INTO messages (sender_id, receiver_id, content, encrypted, e2ee_v, alg, sender_device_id, key_id, iv, ciphertext, aad, status, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'sent', CURRENT_TIMESTAMP)
-	`, c.userID, int(receiverID), content, encrypted, e2eeVersion, algorithm, senderDeviceID, keyID, iv, ciphertext, aad)
+	m := store.NewMessage{
+		SenderID:       c.userID,
+		ReceiverID:     p.ReceiverID,
+		Content:        p.Content,
+		Encrypted:      p.Encrypted,
+		E2EEVersion:    &p.E2EEVersion,
+		Algorithm:      &p.Algorithm,
+		SenderDeviceID: &p.SenderDeviceID,
+		KeyID:          &p.KeyID,
+		IV:             &p.IV,
+		Ciphertext:     &p.Ciphertext,
+		AAD:            &p.AAD,
+		Hidden:         grant.Hidden,
+	}
+	if p.ClientMsgID != "" {
+		m.ClientMsgID = &p.ClientMsgID
+	}
 
+	// Save message to database
+	msgID, err := c.hub.store.Messages.Create(m)
 	if err != nil {
+		// A concurrent retry saved it first
+		if p.ClientMsgID != "" && errors.Is(err, store.ErrDuplicate) {
+			if existing, findErr := c.hub.findClientMessage(c.userID, p.ClientMsgID); findErr == nil && existing != nil {
+				c.hub.broadcast <- existing
+				return existing.MessageID, nil
+			}
+		}
 		log.Printf("Failed to save message: %v", err)
-		return
+		return 0, err
 	}
 
-	msgID, _ := result.LastInsertId()
-
 	// Broadcast to hub
 	msg := &MessageEvent{
 		Type:           "message",
-		MessageID:      int(msgID),
+		MessageID:      msgID,
 		SenderID:       c.userID,
-		ReceiverID:     int(receiverID),
-		ClientMsgID:    clientMsgID,
-		Content:        content,
-		Encrypted:      encrypted,
-		E2EEVersion:    e2eeVersion,
-		Algorithm:      algorithm,
-		SenderDeviceID: senderDeviceID,
-		KeyID:          keyID,
-		IV:             iv,
-		Ciphertext:     ciphertext,
-		AAD:            aad,
+		ReceiverID:     p.ReceiverID,
+		ClientMsgID:    p.ClientMsgID,
+		Content:        p.Content,
+		Encrypted:      p.Encrypted,
+		E2EEVersion:    p.E2EEVersion,
+		Algorithm:      p.Algorithm,
+		SenderDeviceID: p.SenderDeviceID,
+		KeyID:          p.KeyID,
+		IV:             p.IV,
+		Ciphertext:     p.Ciphertext,
+		AAD:            p.AAD,
 		Status:         "sent",
 		CreatedAt:      time.Now(),
+		senderOnly:     grant.Hidden,
 	}
 
 	c.hub.broadcast <- msg
+	return msgID, nil
 }
 
-func (c *Client) handleSignalingEvent(event map[string]interface{}) {
-	receiverID, ok := event["receiver_id"].(float64)
-	if !ok {
-		return
+// handleAck drops the events the client has processed.
+func (c *Client) handleAck(event *Event) (int, error) {
+	var p AckPayload
+	if err := event.Decode(&p); err != nil {
+		return 0, err
 	}
+	if err := p.validate(); err != nil {
+		return 0, err
+	}
+	c.hub.ackEvents(c.userID, *p.Seq)
+	return 0, nil
+}
 
-	eventType, _ := event["type"].(string)
-	payload, _ := event["payload"].(map[string]interface{})
-
-	msg := &MessageEvent{
-		Type:       eventType,
-		SenderID:   c.userID,
-		ReceiverID: int(receiverID),
-		Payload:    payload,
+// findClientMessage returns the sender's message saved under clientMsgID as a
+// sender-only event, or nil if there is none.
+func (h *Hub) findClientMessage(senderID int, clientMsgID string) (*MessageEvent, error) {
+	msg := &MessageEvent{Type: "message", SenderID: senderID, ClientMsgID: clientMsgID, senderOnly: true}
+	stored, err := h.store.Messages.FindByClientID(senderID, clientMsgID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Printf("Failed to look up client message: %v", err)
+		return nil, err
 	}
 
-	c.hub.broadcast <- msg
+	msg.MessageID = stored.ID
+	msg.ReceiverID = stored.ReceiverID
+	msg.Content = stored.Content
+	msg.Encrypted = stored.Encrypted
+	msg.E2EEVersion = deref(stored.E2EEVersion)
+	msg.Algorithm = deref(stored.Algorithm)
+	msg.SenderDeviceID = deref(stored.SenderDeviceID)
+	msg.KeyID = deref(stored.KeyID)
+	msg.IV = deref(stored.IV)
+	msg.Ciphertext = deref(stored.Ciphertext)
+	msg.AAD = deref(stored.AAD)
+	msg.Status = stored.Status
+	msg.CreatedAt = stored.CreatedAt
+	msg.DeliveredAt = stored.DeliveredAt
+	msg.ReadAt = stored.ReadAt
+	return msg, nil
 }
 
-func (c *Client) handleMarkDelivered(event map[string]interface{}) {
-	messageID, ok := event["message_id"].(float64)
-	if !ok {
-		return
+// deref returns the value behind p, or the zero value for nil.
+func deref[T any](p *T) T {
+	var zero T
+	if p == nil {
+		return zero
 	}
+	return *p
+}
 
-	// Update database
-	_, err := c.hub.db.Exec(`
-		UPDATE messages 
-		SET status = 'delivered', delivered_at = CURRENT_TIMESTAMP
-		WHERE id = ? AND receiver_id = ?
-	`, int(messageID), c.userID)
+func (c *Client) handleMarkDelivered(event *Event) (int, error) {
+	var p StatusPayload
+	if err := event.Decode(&p); err != nil {
+		return 0, err
+	}
+	if err := p.validate(); err != nil {
+		return 0, err
+	}
 
+	senderID, err := c.hub.store.Messages.MarkDelivered(p.MessageID, c.userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, newEventError(CodeNotFound, "message not found")
+	}
 	if err != nil {
 		log.Printf("Failed to mark delivered: %v", err)
-		return
+		return 0, err
 	}
 
-	// Get sender ID
-	var senderID int
-	c.hub.db.QueryRow("SELECT sender_id FROM messages WHERE id = ?", int(messageID)).Scan(&senderID)
-
 	// Broadcast status update
 	msg := &MessageEvent{
 		Type:       "status_update",
-		MessageID:  int(messageID),
+		MessageID:  p.MessageID,
 		Status:     "delivered",
 		SenderID:   senderID,
 		ReceiverID: c.userID,
 	}
 
 	c.hub.broadcast <- msg
+	return p.MessageID, nil
 }
 
-func (c *Client) handleMarkRead(event map[string]interface{}) {
-	messageID, ok := event["message_id"].(float64)
-	if !ok {
-		return
+func (c *Client) handleMarkRead(event *Event) (int, error) {
+	var p StatusPayload
+	if err := event.Decode(&p); err != nil {
+		return 0, err
+	}
+	if err := p.validate(); err != nil {
+		return 0, err
 	}
 
-	// Update database
-	_, err := c.hub.db.Exec(`
-		UPDATE messages 
-		SET status = 'read', read_at = CURRENT_TIMESTAMP
-		WHERE id = ? AND receiver_id = ?
-	`, int(messageID), c.userID)
-
+	senderID, err := c.hub.store.Messages.MarkRead(p.MessageID, c.userID)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, newEventError(CodeNotFound, "message not found")
+	}
 	if err != nil {
 		log.Printf("Failed to mark read: %v", err)
-		return
+		return 0, err
 	}
 
-	// Get sender ID
-	var senderID int
-	c.hub.db.QueryRow("SELECT sender_id FROM messages WHERE id = ?", int(messageID)).Scan(&senderID)
-
 	// Broadcast status update
 	msg := &MessageEvent{
 		Type:       "status_update",
-		MessageID:  int(messageID),
+		MessageID:  p.MessageID,
 		Status:     "read",
 		SenderID:   senderID,
 		ReceiverID: c.userID,
 	}
 
 	c.hub.broadcast <- msg
+	return p.MessageID, nil
 }
 
 func (c *Client) writePump() {
@@ -462,15 +703,12 @@ func (c *Client) writePump() {
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			data, err := c.wire().marshal(message)
 			if err != nil {
-				return
+				log.Printf("Failed to encode frame: %v", err)
+				continue
 			}
-
-			data, _ := json.Marshal(message)
-			w.Write(data)
-
-			if err := w.Close(); err != nil {
+			if err := c.conn.WriteMessage(c.wire().messageType(), data); err != nil {
 				return
 			}
 
@@ -1,60 +1,26 @@
 package ws
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/4xmen/payambar/internal/db"
+	"github.com/4xmen/payambar/internal/db/dbtest"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	_ "github.com/mattn/go-sqlite3"
 )
 
-func setupTestDB(t *testing.T) *sql.DB {
-	db, err := sql.Open("sqlite3", ":memory:")
-	if err != nil {
-		t.Fatalf("Failed to open test db: %v", err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			username TEXT UNIQUE NOT NULL,
-			password_hash TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		);
-
-		CREATE TABLE IF NOT EXISTS messages (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			sender_id INTEGER NOT NULL,
-			receiver_id INTEGER NOT NULL,
-			content TEXT NOT NULL,
-			encrypted INTEGER NOT NULL DEFAULT 0,
-			e2ee_v INTEGER,
-			alg TEXT,
-			sender_device_id TEXT,
-			key_id TEXT,
-			iv TEXT,
-			ciphertext TEXT,
-			aad TEXT,
-			status TEXT DEFAULT 'sent',
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			delivered_at TIMESTAMP,
-			read_at TIMESTAMP
-		);
-	`)
-	if err != nil {
-		t.Fatalf("Failed to create tables: %v", err)
-	}
+func setupTestDB(t *testing.T) *db.DB {
+	database := dbtest.New(t)
 
 	// Create test users
-	db.Exec("INSERT INTO users (id, username, password_hash) VALUES (1, 'user1', 'hash1')")
-	db.Exec("INSERT INTO users (id, username, password_hash) VALUES (2, 'user2', 'hash2')")
+	database.Exec("INSERT INTO users (id, username, password_hash) VALUES (1, 'user1', 'hash1')")
+	database.Exec("INSERT INTO users (id, username, password_hash) VALUES (2, 'user2', 'hash2')")
 
-	return db
+	return database
 }
 
 func TestHubCreation(t *testing.T) {
@@ -120,6 +86,49 @@ func TestHubRun(t *testing.T) {
 	hub.mu.RUnlock()
 }
 
+func TestDisconnectUser(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	go hub.Run()
+
+	time.Sleep(10 * time.Millisecond)
+
+	stale := &Client{userID: 1, hub: hub, send: make(chan interface{}, 256)}
+	current := &Client{userID: 1, hub: hub, send: make(chan interface{}, 256)}
+	hub.register <- stale
+	hub.register <- current
+
+	// A stale connection unregistering must not evict the newer one
+	hub.unregister <- stale
+	time.Sleep(10 * time.Millisecond)
+	if !hub.IsUserOnline(1) {
+		t.Fatal("newer connection was evicted by a stale unregister")
+	}
+
+	hub.DisconnectUser(1)
+	if hub.IsUserOnline(1) {
+		t.Fatal("user still online after DisconnectUser")
+	}
+
+	event, ok := <-current.send
+	if !ok {
+		t.Fatal("expected session_revoked before the channel closed")
+	}
+	if event.(map[string]interface{})["type"] != "session_revoked" {
+		t.Fatalf("unexpected event: %#v", event)
+	}
+	if _, ok := <-current.send; ok {
+		t.Fatal("send channel should be closed")
+	}
+
+	// The connection's own unregister afterwards is a no-op
+	hub.unregister <- current
+	hub.DisconnectUser(2)
+	time.Sleep(10 * time.Millisecond)
+}
+
 func TestMessageEvent(t *testing.T) {
 	db := setupTestDB(t)
 	defer db.Close()
@@ -316,7 +325,7 @@ func TestMessageSaveToDatabase(t *testing.T) {
 		"content":     "Test message",
 	}
 
-	client.handleMessageEvent(event)
+	client.handleMessageEvent(testEvent(t, event))
 
 	// Check if message was saved to database
 	var count int
@@ -363,7 +372,7 @@ func TestHandleEncryptedMessageEvent(t *testing.T) {
 		"aad":              "aad-b64",
 	}
 
-	client.handleMessageEvent(event)
+	client.handleMessageEvent(testEvent(t, event))
 
 	var encrypted int
 	var ciphertext, iv, alg string
@@ -410,11 +419,11 @@ func TestMarkDelivered(t *testing.T) {
 		"message_id": float64(msgID),
 	}
 
-	client.handleMarkDelivered(event)
+	client.handleMarkDelivered(testEvent(t, event))
 
 	// Check status in database
 	var status string
-	err = db.QueryRow("SELECT status FROM messages WHERE id = ?", msgID).Scan(&status)
+	err = db.QueryRow("SELECT status FROM messages WHERE id = $1", msgID).Scan(&status)
 	if err != nil {
 		t.Fatalf("Failed to query status: %v", err)
 	}
@@ -455,11 +464,11 @@ func TestMarkRead(t *testing.T) {
 		"message_id": float64(msgID),
 	}
 
-	client.handleMarkRead(event)
+	client.handleMarkRead(testEvent(t, event))
 
 	// Check status in database
 	var status string
-	err = db.QueryRow("SELECT status FROM messages WHERE id = ?", msgID).Scan(&status)
+	err = db.QueryRow("SELECT status FROM messages WHERE id = $1", msgID).Scan(&status)
 	if err != nil {
 		t.Fatalf("Failed to query status: %v", err)
 	}
@@ -503,17 +512,20 @@ func TestInvalidMessageEvent(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			initialCount := countMessages(db)
-			client.handleMessageEvent(tt.event)
+			_, err := client.handleMessageEvent(testEvent(t, tt.event))
 			afterCount := countMessages(db)
 
 			if afterCount != initialCount {
 				t.Errorf("Message was saved despite invalid data")
 			}
+			if eventErr, ok := err.(*EventError); !ok || eventErr.Code != CodeInvalidPayload {
+				t.Errorf("Expected %s error, got %v", CodeInvalidPayload, err)
+			}
 		})
 	}
 }
 
-func countMessages(db *sql.DB) int {
+func countMessages(db *db.DB) int {
 	var count int
 	db.QueryRow("SELECT COUNT(*) FROM messages").Scan(&count)
 	return count
@@ -584,33 +596,215 @@ func TestSignalingForwarding(t *testing.T) {
 		},
 	}
 
-	client1.handleSignalingEvent(offerEvent)
+	client1.handleCallOffer(testEvent(t, offerEvent))
 
 	// Wait for delivery
 	time.Sleep(50 * time.Millisecond)
 
-	// Check if client2 received the offer
-	select {
-	case received := <-client2.send:
-		receivedMsg, ok := received.(*MessageEvent)
-		if !ok {
-			t.Fatal("Received wrong type")
+	// Client2 is told about the ringing call, then gets the offer
+	var offer *MessageEvent
+	for len(client2.send) > 0 {
+		if msg := (<-client2.send).(*MessageEvent); msg.Type == "call_offer" {
+			offer = msg
 		}
-		if receivedMsg.Type != "call_offer" {
-			t.Errorf("Expected type 'call_offer', got '%s'", receivedMsg.Type)
+	}
+	if offer == nil {
+		t.Fatal("Client2 did not receive the call_offer")
+	}
+	if offer.Payload["offer"] != "test-sdp-offer" {
+		t.Errorf("Expected offer 'test-sdp-offer', got '%v'", offer.Payload["offer"])
+	}
+	if offer.CallID == 0 || offer.SenderID != 1 {
+		t.Errorf("Expected the offer to carry the call, got %+v", offer)
+	}
+
+	// Check that client1 did NOT receive the offer (signaling should be one-way)
+	for len(client1.send) > 0 {
+		if msg := (<-client1.send).(*MessageEvent); msg.Type != FrameCallState {
+			t.Errorf("Sender received their own signaling message: %+v", msg)
 		}
-		if receivedMsg.Payload["offer"] != "test-sdp-offer" {
-			t.Errorf("Expected offer 'test-sdp-offer', got '%v'", receivedMsg.Payload["offer"])
+	}
+}
+
+func TestBlockedSenderMessagesHidden(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	// User 2 blocked user 1
+	db.Exec("INSERT INTO user_blocks (blocker_id, blocked_id) VALUES (2, 1)")
+
+	hub := NewHub(db)
+	go hub.Run()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client1 := &Client{userID: 1, hub: hub, send: make(chan interface{}, 256)}
+	client2 := &Client{userID: 2, hub: hub, send: make(chan interface{}, 256)}
+	hub.register <- client1
+	hub.register <- client2
+
+	time.Sleep(10 * time.Millisecond)
+
+	client1.handleMessageEvent(testEvent(t, map[string]interface{}{
+		"type":        "message",
+		"receiver_id": float64(2),
+		"content":     "hello?",
+	}))
+	client1.handleCallOffer(testEvent(t, map[string]interface{}{
+		"type":        "call_offer",
+		"receiver_id": float64(2),
+	}))
+	// The blocker cannot message the blocked user either
+	if _, err := client2.handleMessageEvent(testEvent(t, map[string]interface{}{
+		"type":        "message",
+		"receiver_id": float64(1),
+		"content":     "go away",
+	})); err == nil || err.(*EventError).Code != CodeBlocked {
+		t.Errorf("Expected %s error, got %v", CodeBlocked, err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	var hidden int
+	db.QueryRow("SELECT hidden FROM messages WHERE sender_id = 1").Scan(&hidden)
+	if hidden != 1 {
+		t.Errorf("Expected message to be stored hidden, got hidden=%d", hidden)
+	}
+	if count := countMessages(db); count != 1 {
+		t.Errorf("Expected 1 message in database, got %d", count)
+	}
+
+	// The sender only gets its own echo, without a delivered status
+	select {
+	case received := <-client1.send:
+		if msg := received.(*MessageEvent); msg.Type != "message" || msg.Content != "hello?" {
+			t.Errorf("Unexpected echo: %+v", msg)
 		}
 	default:
-		t.Error("Client2 did not receive the call_offer")
+		t.Fatal("Sender did not receive the echo")
+	}
+	// The call rings on for the caller alone
+	for len(client1.send) > 0 {
+		if msg := (<-client1.send).(*MessageEvent); msg.Type != FrameCallState || msg.Session.State != CallRinging {
+			t.Errorf("Sender received unexpected event: %+v", msg)
+		}
 	}
 
-	// Check that client1 did NOT receive the offer (signaling should be one-way)
 	select {
-	case <-client1.send:
-		t.Error("Sender received their own signaling message")
+	case received := <-client2.send:
+		t.Errorf("Blocker received unexpected event: %+v", received)
 	default:
-		// Correct
+	}
+}
+
+func TestMessageAuthorization(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	go hub.Run()
+
+	time.Sleep(10 * time.Millisecond)
+
+	client := &Client{userID: 1, hub: hub, send: make(chan interface{}, 256)}
+	hub.register <- client
+
+	time.Sleep(10 * time.Millisecond)
+
+	_, err := client.handleMessageEvent(testEvent(t, map[string]interface{}{
+		"type":        "message",
+		"receiver_id": float64(99),
+		"content":     "anyone there?",
+	}))
+	if eventErr, ok := err.(*EventError); !ok || eventErr.Code != CodeUnknownReceiver {
+		t.Errorf("Expected %s error, got %v", CodeUnknownReceiver, err)
+	}
+	if count := countMessages(db); count != 0 {
+		t.Errorf("Expected no message for unknown receiver, got %d", count)
+	}
+
+	// The first message to a known user opens the conversation
+	client.handleMessageEvent(testEvent(t, map[string]interface{}{
+		"type":        "message",
+		"receiver_id": float64(2),
+		"content":     "hi",
+	}))
+	var participants int
+	db.QueryRow("SELECT COUNT(*) FROM conversation_participants").Scan(&participants)
+	if participants != 2 {
+		t.Errorf("Expected auto-created conversation, got %d participants", participants)
+	}
+}
+
+func TestMessageRetryIsIdempotent(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	hub := NewHub(db)
+	go hub.Run()
+
+	time.Sleep(10 * time.Millisecond)
+
+	sender := &Client{userID: 1, hub: hub, send: make(chan interface{}, 256)}
+	receiver := &Client{userID: 2, hub: hub, send: make(chan interface{}, 256)}
+	hub.register <- sender
+	hub.register <- receiver
+
+	time.Sleep(10 * time.Millisecond)
+
+	event := map[string]interface{}{
+		"type":              "message",
+		"receiver_id":       float64(2),
+		"content":           "only once",
+		"client_message_id": "client-42",
+	}
+	firstID, err := sender.handleMessageEvent(testEvent(t, event))
+	if err != nil {
+		t.Fatalf("first send: %v", err)
+	}
+	retryID, err := sender.handleMessageEvent(testEvent(t, event))
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if firstID != retryID {
+		t.Errorf("Retry returned message %d, want %d", retryID, firstID)
+	}
+	if count := countMessages(db); count != 1 {
+		t.Errorf("Expected 1 message after retry, got %d", count)
+	}
+
+	// Another sender may reuse the same client id
+	other := &Client{userID: 2, hub: hub, send: make(chan interface{}, 256)}
+	if _, err := other.handleMessageEvent(testEvent(t, map[string]interface{}{
+		"type":              "message",
+		"receiver_id":       float64(1),
+		"content":           "mine",
+		"client_message_id": "client-42",
+	})); err != nil {
+		t.Fatalf("other sender: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	// The receiver saw the first message once, plus the echo of its own
+	receivedMessages := 0
+	for len(receiver.send) > 0 {
+		if msg, ok := (<-receiver.send).(*MessageEvent); ok && msg.Type == "message" && msg.SenderID == 1 {
+			receivedMessages++
+		}
+	}
+	if receivedMessages != 1 {
+		t.Errorf("Receiver got %d copies of the message, want 1", receivedMessages)
+	}
+
+	// The retry echo carries the canonical id back to the sender
+	var echoes []int
+	for len(sender.send) > 0 {
+		if msg, ok := (<-sender.send).(*MessageEvent); ok && msg.Type == "message" && msg.SenderID == 1 && msg.ClientMsgID == "client-42" {
+			echoes = append(echoes, msg.MessageID)
+		}
+	}
+	if len(echoes) != 2 || echoes[1] != firstID {
+		t.Errorf("Sender echoes = %v, want two echoes of %d", echoes, firstID)
 	}
 }
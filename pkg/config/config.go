@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
@@ -20,8 +21,59 @@ type Config struct {
 	TurnServer      string
 	TurnUsername    string
 	TurnPassword    string
+
+	// TurnSecret is coturn's static-auth-secret; when set, clients get
+	// per-user credentials valid for TurnCredentialTTL instead of the static
+	// username and password
+	TurnSecret        string
+	TurnCredentialTTL time.Duration
+
+	// TurnEmbedded serves STUN/TURN from this process on TurnListen (UDP and
+	// TCP), relaying via TurnExternalIP with TurnSecret credentials
+	TurnEmbedded     bool
+	TurnListen       string
+	TurnExternalIP   string
+	TurnRealm        string
+	TurnRelayPortMin int
+	TurnRelayPortMax int
+	// Relay bandwidth caps in bytes per second, per allocation and in total
+	TurnMaxBPS      int
+	TurnBPSCapacity int
+
 	VAPIDPublicKey  string
 	VAPIDPrivateKey string
+	// Push delivery workers, attempts per notification and failures in a
+	// row before a subscription is revoked
+	PushWorkers     int
+	PushMaxAttempts int
+	PushMaxFailures int
+	// Native push providers: an FCM-compatible endpoint and its server key,
+	// and webhook (UnifiedPush) subscriptions
+	PushFCMURL      string
+	PushFCMKey      string
+	PushWebhook     bool
+	WebAuthnRPID    string
+	WebAuthnRPName  string
+	WebAuthnOrigins string
+	// open, invite or closed
+	RegistrationMode string
+	// Per-username login lockout
+	LoginLockoutThreshold int
+	LoginLockoutBase      time.Duration
+	LoginLockoutMax       time.Duration
+	// auto or existing: whether the first message opens a conversation
+	ConversationPolicy string
+	// BrokerURL links WebSocket hubs across nodes; empty keeps them in-process
+	BrokerURL string
+	// DatabaseURL is a PostgreSQL URL; empty keeps SQLite at DatabasePath
+	DatabaseURL string
+
+	WSCompression     bool
+	WSReadBufferSize  int
+	WSWriteBufferSize int
+	WSMaxMessageSize  int64
+	// WSAllowQueryToken accepts the JWT as /ws?token= (legacy clients)
+	WSAllowQueryToken bool
 }
 
 func Load() *Config {
@@ -39,8 +91,46 @@ func Load() *Config {
 		TurnServer:      getEnv(fileEnv, "TURN_SERVER", ""),
 		TurnUsername:    getEnv(fileEnv, "TURN_USERNAME", ""),
 		TurnPassword:    getEnv(fileEnv, "TURN_PASSWORD", ""),
+
+		TurnSecret:        getEnv(fileEnv, "TURN_SECRET", ""),
+		TurnCredentialTTL: parseDuration(getEnv(fileEnv, "TURN_CREDENTIAL_TTL", "24h"), 24*time.Hour),
+
+		TurnEmbedded:     getEnv(fileEnv, "TURN_EMBEDDED", "false") == "true",
+		TurnListen:       getEnv(fileEnv, "TURN_LISTEN", "0.0.0.0:3478"),
+		TurnExternalIP:   getEnv(fileEnv, "TURN_EXTERNAL_IP", ""),
+		TurnRealm:        getEnv(fileEnv, "TURN_REALM", "payambar"),
+		TurnRelayPortMin: parseInt(getEnv(fileEnv, "TURN_RELAY_PORT_MIN", "49152"), 49152),
+		TurnRelayPortMax: parseInt(getEnv(fileEnv, "TURN_RELAY_PORT_MAX", "49252"), 49252),
+		TurnMaxBPS:       parseInt(getEnv(fileEnv, "TURN_MAX_BPS", "0"), 0),
+		TurnBPSCapacity:  parseInt(getEnv(fileEnv, "TURN_BPS_CAPACITY", "0"), 0),
+
 		VAPIDPublicKey:  getEnv(fileEnv, "VAPID_PUBLIC_KEY", ""),
 		VAPIDPrivateKey: getEnv(fileEnv, "VAPID_PRIVATE_KEY", ""),
+		PushWorkers:     parseInt(getEnv(fileEnv, "PUSH_WORKERS", "4"), 4),
+		PushMaxAttempts: parseInt(getEnv(fileEnv, "PUSH_MAX_ATTEMPTS", "6"), 6),
+		PushMaxFailures: parseInt(getEnv(fileEnv, "PUSH_MAX_FAILURES", "5"), 5),
+		PushFCMURL:      getEnv(fileEnv, "PUSH_FCM_URL", ""),
+		PushFCMKey:      getEnv(fileEnv, "PUSH_FCM_KEY", ""),
+		PushWebhook:     getEnv(fileEnv, "PUSH_WEBHOOK", "false") == "true",
+		WebAuthnRPID:    getEnv(fileEnv, "WEBAUTHN_RP_ID", ""),
+		WebAuthnRPName:  getEnv(fileEnv, "WEBAUTHN_RP_NAME", "Payambar"),
+		WebAuthnOrigins: getEnv(fileEnv, "WEBAUTHN_ORIGINS", ""),
+
+		RegistrationMode: getEnv(fileEnv, "REGISTRATION_MODE", "open"),
+
+		LoginLockoutThreshold: parseInt(getEnv(fileEnv, "LOGIN_LOCKOUT_THRESHOLD", "5"), 5),
+		LoginLockoutBase:      parseDuration(getEnv(fileEnv, "LOGIN_LOCKOUT_BASE", "1m"), time.Minute),
+		LoginLockoutMax:       parseDuration(getEnv(fileEnv, "LOGIN_LOCKOUT_MAX", "1h"), time.Hour),
+
+		ConversationPolicy: getEnv(fileEnv, "CONVERSATION_POLICY", "auto"),
+		BrokerURL:          getEnv(fileEnv, "BROKER_URL", ""),
+		DatabaseURL:        getEnv(fileEnv, "DATABASE_URL", ""),
+
+		WSCompression:     getEnv(fileEnv, "WS_COMPRESSION", "false") == "true",
+		WSReadBufferSize:  parseInt(getEnv(fileEnv, "WS_READ_BUFFER_SIZE", "1024"), 1024),
+		WSWriteBufferSize: parseInt(getEnv(fileEnv, "WS_WRITE_BUFFER_SIZE", "1024"), 1024),
+		WSMaxMessageSize:  parseSize(getEnv(fileEnv, "WS_MAX_MESSAGE_SIZE", "65536"), 65536),
+		WSAllowQueryToken: getEnv(fileEnv, "WS_ALLOW_QUERY_TOKEN", "false") == "true",
 	}
 }
 
@@ -62,6 +152,32 @@ func parseInt64(s string) int64 {
 	return val
 }
 
+// parseSize reads a positive byte count, falling back to defaultValue so a
+// typo never widens a limit beyond its default
+func parseSize(s string, defaultValue int64) int64 {
+	val, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || val <= 0 {
+		return defaultValue
+	}
+	return val
+}
+
+func parseInt(s string, defaultValue int) int {
+	val, err := strconv.Atoi(s)
+	if err != nil {
+		return defaultValue
+	}
+	return val
+}
+
+func parseDuration(s string, defaultValue time.Duration) time.Duration {
+	val, err := time.ParseDuration(s)
+	if err != nil || val <= 0 {
+		return defaultValue
+	}
+	return val
+}
+
 func loadFileEnv() map[string]string {
 	candidates := envFileCandidates()
 	for _, candidate := range candidates {
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func writeEnvFile(t *testing.T, dir string, body string) string {
@@ -108,7 +109,7 @@ JWT_SECRET=file-secret
 
 func TestLoadFallsBackToDefaultsWhenNoEnvFile(t *testing.T) {
 	for _, key := range []string{
-		"PAYAMBAR_ENV_FILE", "PORT", "ENVIRONMENT", "DATABASE_PATH", "JWT_SECRET", "CORS_ORIGINS", "MAX_UPLOAD_SIZE",
+		"PAYAMBAR_ENV_FILE", "PORT", "ENVIRONMENT", "DATABASE_PATH", "DATABASE_URL", "JWT_SECRET", "CORS_ORIGINS", "MAX_UPLOAD_SIZE",
 		"FILE_STORAGE_PATH", "STUN_SERVERS", "TURN_SERVER", "TURN_USERNAME", "TURN_PASSWORD",
 	} {
 		_ = os.Unsetenv(key)
@@ -122,7 +123,126 @@ func TestLoadFallsBackToDefaultsWhenNoEnvFile(t *testing.T) {
 	if cfg.DatabasePath != "./data/payambar.db" {
 		t.Fatalf("DatabasePath = %q, want default", cfg.DatabasePath)
 	}
+	if cfg.DatabaseURL != "" {
+		t.Fatalf("DatabaseURL = %q, want SQLite by default", cfg.DatabaseURL)
+	}
 	if cfg.FileStoragePath != "./data/uploads" {
 		t.Fatalf("FileStoragePath = %q, want default", cfg.FileStoragePath)
 	}
 }
+
+func TestLoadWebSocketSettings(t *testing.T) {
+	t.Setenv("PAYAMBAR_ENV_FILE", writeEnvFile(t, t.TempDir(), `
+WS_COMPRESSION=true
+WS_READ_BUFFER_SIZE=4096
+WS_MAX_MESSAGE_SIZE=1048576
+`))
+	for _, key := range []string{"WS_COMPRESSION", "WS_READ_BUFFER_SIZE", "WS_WRITE_BUFFER_SIZE", "WS_MAX_MESSAGE_SIZE"} {
+		_ = os.Unsetenv(key)
+	}
+
+	cfg := Load()
+
+	if !cfg.WSCompression {
+		t.Fatal("WSCompression = false, want true")
+	}
+	if cfg.WSReadBufferSize != 4096 || cfg.WSWriteBufferSize != 1024 {
+		t.Fatalf("buffer sizes = %d/%d, want 4096/1024", cfg.WSReadBufferSize, cfg.WSWriteBufferSize)
+	}
+	if cfg.WSMaxMessageSize != 1048576 {
+		t.Fatalf("WSMaxMessageSize = %d", cfg.WSMaxMessageSize)
+	}
+}
+
+func TestLoadWebSocketMaxMessageSizeInvalid(t *testing.T) {
+	t.Setenv("PAYAMBAR_ENV_FILE", writeEnvFile(t, t.TempDir(), `
+WS_MAX_MESSAGE_SIZE=64k
+`))
+	_ = os.Unsetenv("WS_MAX_MESSAGE_SIZE")
+
+	cfg := Load()
+
+	if cfg.WSMaxMessageSize != 65536 {
+		t.Fatalf("WSMaxMessageSize = %d, want the 64 KiB default for an invalid value", cfg.WSMaxMessageSize)
+	}
+}
+
+func TestLoadTURNSecret(t *testing.T) {
+	t.Setenv("PAYAMBAR_ENV_FILE", writeEnvFile(t, t.TempDir(), `
+TURN_SECRET=north
+TURN_CREDENTIAL_TTL=soon
+`))
+	for _, key := range []string{"TURN_SECRET", "TURN_CREDENTIAL_TTL"} {
+		_ = os.Unsetenv(key)
+	}
+
+	cfg := Load()
+
+	if cfg.TurnSecret != "north" {
+		t.Fatalf("TurnSecret = %q", cfg.TurnSecret)
+	}
+	if cfg.TurnCredentialTTL != 24*time.Hour {
+		t.Fatalf("TurnCredentialTTL = %v, want the 24h default for an invalid value", cfg.TurnCredentialTTL)
+	}
+}
+
+func TestLoadEmbeddedTURN(t *testing.T) {
+	t.Setenv("PAYAMBAR_ENV_FILE", writeEnvFile(t, t.TempDir(), `
+TURN_EMBEDDED=true
+TURN_EXTERNAL_IP=203.0.113.7
+TURN_RELAY_PORT_MIN=40000
+TURN_MAX_BPS=125000
+`))
+	for _, key := range []string{"TURN_EMBEDDED", "TURN_LISTEN", "TURN_EXTERNAL_IP", "TURN_REALM", "TURN_RELAY_PORT_MIN", "TURN_RELAY_PORT_MAX", "TURN_MAX_BPS", "TURN_BPS_CAPACITY"} {
+		_ = os.Unsetenv(key)
+	}
+
+	cfg := Load()
+
+	if !cfg.TurnEmbedded || cfg.TurnExternalIP != "203.0.113.7" {
+		t.Fatalf("TurnEmbedded = %v, TurnExternalIP = %q", cfg.TurnEmbedded, cfg.TurnExternalIP)
+	}
+	if cfg.TurnListen != "0.0.0.0:3478" || cfg.TurnRealm != "payambar" {
+		t.Fatalf("TurnListen = %q, TurnRealm = %q", cfg.TurnListen, cfg.TurnRealm)
+	}
+	if cfg.TurnRelayPortMin != 40000 || cfg.TurnRelayPortMax != 49252 {
+		t.Fatalf("relay ports = %d-%d", cfg.TurnRelayPortMin, cfg.TurnRelayPortMax)
+	}
+	if cfg.TurnMaxBPS != 125000 || cfg.TurnBPSCapacity != 0 {
+		t.Fatalf("TurnMaxBPS = %d, TurnBPSCapacity = %d", cfg.TurnMaxBPS, cfg.TurnBPSCapacity)
+	}
+}
+
+func TestLoadPushDelivery(t *testing.T) {
+	t.Setenv("PAYAMBAR_ENV_FILE", writeEnvFile(t, t.TempDir(), `
+PUSH_WORKERS=8
+PUSH_MAX_FAILURES=oops
+PUSH_FCM_URL=https://fcm.example.com/send
+PUSH_WEBHOOK=true
+`))
+	for _, key := range []string{"PUSH_WORKERS", "PUSH_MAX_ATTEMPTS", "PUSH_MAX_FAILURES", "PUSH_FCM_URL", "PUSH_FCM_KEY", "PUSH_WEBHOOK"} {
+		_ = os.Unsetenv(key)
+	}
+
+	cfg := Load()
+
+	if cfg.PushWorkers != 8 || cfg.PushMaxAttempts != 6 || cfg.PushMaxFailures != 5 {
+		t.Fatalf("push delivery = %d workers, %d attempts, %d failures", cfg.PushWorkers, cfg.PushMaxAttempts, cfg.PushMaxFailures)
+	}
+	if cfg.PushFCMURL != "https://fcm.example.com/send" || cfg.PushFCMKey != "" || !cfg.PushWebhook {
+		t.Fatalf("push providers = %q, %q, %v", cfg.PushFCMURL, cfg.PushFCMKey, cfg.PushWebhook)
+	}
+}
+
+func TestLoadDatabaseURL(t *testing.T) {
+	t.Setenv("PAYAMBAR_ENV_FILE", writeEnvFile(t, t.TempDir(), `
+DATABASE_URL=postgres://payambar:secret@db:5432/payambar?sslmode=disable
+`))
+	_ = os.Unsetenv("DATABASE_URL")
+
+	cfg := Load()
+
+	if cfg.DatabaseURL != "postgres://payambar:secret@db:5432/payambar?sslmode=disable" {
+		t.Fatalf("DatabaseURL = %q", cfg.DatabaseURL)
+	}
+}
@@ -8,6 +8,9 @@ var translations = map[string]string{
 	"failed to get user":                           "خطا در دریافت کاربر",
 	"missing authorization token":                  "توکن احراز هویت ارسال نشده است",
 	"invalid token":                                "توکن نامعتبر است",
+	"invalid or expired ticket":                    "بلیت نامعتبر یا منقضی شده است",
+	"missing websocket ticket":                     "بلیت اتصال ارسال نشده است",
+	"failed to create ticket":                      "ایجاد بلیت اتصال ناموفق بود",
 	"failed to validate user":                      "خطا در اعتبارسنجی کاربر",
 	"user not found":                               "کاربر یافت نشد",
 	"unauthorized":                                 "دسترسی غیرمجاز",
@@ -66,17 +69,111 @@ var translations = map[string]string{
 	"password must be at least 6 characters":                      "رمز عبور باید حداقل ۶ کاراکتر باشد",
 	"username already exists":                                     "این نام کاربری قبلا ثبت شده است",
 	"invalid username or password":                                "نام کاربری یا رمز عبور اشتباه است",
+	"passkeys not configured":                                     "ورود با کلید عبور پیکربندی نشده است",
+	"passkey verification required":                               "تایید با کلید عبور الزامی است",
+	"password required for this account":                          "ورود به این حساب به رمز عبور نیز نیاز دارد",
+	"passkey required but passkeys are not configured":            "این حساب به کلید عبور نیاز دارد اما ورود با کلید عبور پیکربندی نشده است",
+	"invalid or expired pre-auth token":                           "توکن پیش‌احراز نامعتبر یا منقضی شده است",
+	"registration is closed":                                      "ثبت‌نام در این سرور بسته است",
+	"invite code required":                                        "برای ثبت‌نام کد دعوت لازم است",
+	"invalid or expired invite code":                              "کد دعوت نامعتبر یا منقضی شده است",
+	"max uses must be between 1 and 100":                          "تعداد استفاده باید بین ۱ تا ۱۰۰ باشد",
+	"invite expiry cannot exceed 30 days":                         "مدت اعتبار دعوت نمی‌تواند بیش از ۳۰ روز باشد",
+	"invite not found":                                            "دعوت یافت نشد",
+	"only admins can create multi-use invites":                    "فقط مدیر می‌تواند دعوت چندبار مصرف بسازد",
+	"invalid invite id":                                           "شناسه دعوت نامعتبر است",
+	"failed to fetch invites":                                     "خطا در دریافت دعوت ها",
+	"failed to revoke invite":                                     "خطا در لغو دعوت",
+	"admin access required":                                       "دسترسی مدیر لازم است",
+	"account suspended":                                           "حساب کاربری شما تعلیق شده است",
+	"session revoked":                                             "نشست شما لغو شده است، دوباره وارد شوید",
+	"invalid user id":                                             "شناسه کاربر نامعتبر است",
+	"cannot modify your own account":                              "امکان تغییر حساب خودتان وجود ندارد",
+	"invalid role":                                                "نقش نامعتبر است",
+	"stats unavailable":                                           "آمار در دسترس نیست",
+	"failed to update user":                                       "خطا در به روزرسانی کاربر",
+	"too many failed login attempts, try again later":             "تلاش‌های ناموفق ورود بیش از حد مجاز است، بعداً دوباره تلاش کنید",
+	"passkey verification failed":                                 "تایید کلید عبور ناموفق بود",
+	"invalid passkey session":                                     "نشست کلید عبور نامعتبر است",
+	"passkey session expired":                                     "نشست کلید عبور منقضی شده است",
+	"invalid passkey response":                                    "پاسخ کلید عبور نامعتبر است",
+	"passkey already registered":                                  "این کلید عبور قبلا ثبت شده است",
+	"no passkeys registered":                                      "کلید عبوری ثبت نشده است",
+	"passkey not found":                                           "کلید عبور یافت نشد",
+	"invalid passkey id":                                          "شناسه کلید عبور نامعتبر است",
+	"failed to fetch passkeys":                                    "خطا در دریافت کلیدهای عبور",
+	"failed to delete passkey":                                    "خطا در حذف کلید عبور",
+	"cannot block yourself":                                       "نمی توانید خودتان را مسدود کنید",
+	"failed to block user":                                        "خطا در مسدود کردن کاربر",
+	"failed to unblock user":                                      "خطا در رفع مسدودی کاربر",
+	"failed to fetch blocked users":                               "خطا در دریافت کاربران مسدود شده",
+	"you have blocked this user":                                  "شما این کاربر را مسدود کرده اید",
+	"cannot message yourself":                                     "نمی توانید به خودتان پیام دهید",
+	"receiver not found":                                          "گیرنده یافت نشد",
+	"invalid event":                                               "رویداد نامعتبر است",
+	"invalid event payload":                                       "محتوای رویداد نامعتبر است",
+	"seq required":                                                "شماره ترتیب الزامی است",
+	"already in a call":                                           "در حال تماس دیگری هستید",
+	"call not found":                                              "تماس یافت نشد",
+	"receiver_ids required":                                       "شناسه گیرندگان الزامی است",
+	"too many call participants":                                  "تعداد شرکت‌کنندگان تماس بیش از حد مجاز است",
+	"invalid receiver_ids":                                        "شناسه گیرندگان نامعتبر است",
+	"call_id required":                                            "شناسه تماس الزامی است",
+	"invalid call_id":                                             "شناسه تماس نامعتبر است",
+	"invalid call kind":                                           "نوع تماس نامعتبر است",
+	"unsupported protocol version":                                "نسخه پروتکل پشتیبانی نمی شود",
+	"unknown event type":                                          "نوع رویداد ناشناخته است",
+	"receiver_id required":                                        "شناسه گیرنده الزامی است",
+	"content required":                                            "متن پیام الزامی است",
+	"invalid encrypted payload":                                   "داده رمزنگاری شده نامعتبر است",
+	"message_id required":                                         "شناسه پیام الزامی است",
+	"client_message_id too long":                                  "شناسه پیام کلاینت بیش از حد طولانی است",
+	"failed to process event":                                     "خطا در پردازش رویداد",
+	"new message":                                                 "پیام جدید",
+	"someone":                                                     "یک کاربر",
+	"file":                                                        "فایل",
+	"incoming voice call":                                         "تماس صوتی ورودی",
+	"incoming video call":                                         "تماس تصویری ورودی",
+	"missed voice call":                                           "تماس صوتی از دست رفته",
+	"missed video call":                                           "تماس تصویری از دست رفته",
+	"Payambar":                                                    "پیام‌بر",
+	"notifications work on this device":                           "اعلان‌ها روی این دستگاه کار می کنند",
+	"invalid subscription id":                                     "شناسه اشتراک نامعتبر است",
+	"subscription not found":                                      "اشتراک یافت نشد",
+	"failed to fetch subscriptions":                               "خطا در دریافت اشتراک ها",
+	"failed to send test notification":                            "خطا در ارسال اعلان آزمایشی",
+	"unsupported push provider":                                   "ارائه دهنده اعلان پشتیبانی نمی شود",
+	"failed to fetch notification settings":                       "خطا در دریافت تنظیمات اعلان",
+	"failed to update notification settings":                      "خطا در به روزرسانی تنظیمات اعلان",
+	"invalid notification level":                                  "سطح اعلان نامعتبر است",
+	"invalid quiet hours":                                         "ساعات سکوت نامعتبر است",
+	"invalid timezone":                                            "منطقه زمانی نامعتبر است",
+	"quiet hours are account-wide":                                "ساعات سکوت فقط برای کل حساب قابل تنظیم است",
 }
 
 var prefixTranslations = map[string]string{
-	"failed to hash password:":   "خطا در پردازش رمز عبور",
-	"failed to register user:":   "خطا در ثبت نام کاربر",
-	"failed to get user id:":     "خطا در دریافت شناسه کاربر",
-	"failed to query user:":      "خطا در دریافت اطلاعات کاربر",
-	"failed to generate token:":  "خطا در تولید توکن",
-	"failed to sign token:":      "خطا در امضای توکن",
-	"failed to parse token:":     "توکن نامعتبر است",
-	"unexpected signing method:": "روش امضای توکن نامعتبر است",
+	"failed to hash password:":         "خطا در پردازش رمز عبور",
+	"failed to register user:":         "خطا در ثبت نام کاربر",
+	"failed to get user id:":           "خطا در دریافت شناسه کاربر",
+	"failed to query user:":            "خطا در دریافت اطلاعات کاربر",
+	"failed to generate token:":        "خطا در تولید توکن",
+	"failed to sign token:":            "خطا در امضای توکن",
+	"failed to parse token:":           "توکن نامعتبر است",
+	"unexpected signing method:":       "روش امضای توکن نامعتبر است",
+	"failed to begin registration:":    "خطا در شروع ثبت کلید عبور",
+	"failed to begin login:":           "خطا در شروع ورود با کلید عبور",
+	"failed to save passkey:":          "خطا در ذخیره کلید عبور",
+	"failed to store passkey session:": "خطا در ذخیره نشست کلید عبور",
+	"failed to load passkey session:":  "خطا در بارگذاری نشست کلید عبور",
+	"failed to fetch passkeys:":        "خطا در دریافت کلیدهای عبور",
+	"failed to update passkey:":        "خطا در به روزرسانی کلید عبور",
+	"failed to update user:":           "خطا در به روزرسانی کاربر",
+	"failed to record login failure:":  "خطا در ثبت تلاش ناموفق ورود",
+	"failed to create invite:":         "خطا در ایجاد دعوت",
+	"failed to generate invite code:":  "خطا در تولید کد دعوت",
+	"failed to check invite:":          "خطا در بررسی کد دعوت",
+	"failed to fetch invites:":         "خطا در دریافت دعوت ها",
+	"failed to query lockout:":         "خطا در بررسی وضعیت قفل حساب",
 }
 
 func Translate(message string) string {